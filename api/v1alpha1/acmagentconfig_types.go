@@ -0,0 +1,108 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ACMAgentConfigName is the name of the singleton ACMAgentConfig read by the agent. ACMAgentConfigs with other names are ignored.
+const ACMAgentConfigName string = "default"
+
+// Condition types reported in ACMAgentConfigStatus.
+const (
+	// The configuration has been applied by the agent.
+	ConditionApplied string = "Applied"
+)
+
+// ACMAgentConfigSpec defines defaults applied by the agent at runtime. Unset fields fall back to the agent's environment configuration.
+type ACMAgentConfigSpec struct {
+	// AWS regions into which certificates are imported, unless a Secret carries the 'v2.acm-certificate-agent.validitron.io/regions' annotation. Defaults to the region in which the agent is running.
+	// +optional
+	Regions []string `json:"regions,omitempty"`
+
+	// ARN of an IAM role to assume when communicating with AWS, unless an object carries the 'v2.acm-certificate-agent.validitron.io/assume-role-arn' annotation.
+	// +optional
+	// +kubebuilder:validation:Pattern=`^arn:[^:]+:iam::[0-9]{12}:role/.+$`
+	RoleArn string `json:"roleArn,omitempty"`
+
+	// Tags applied to ACM certificates, replacing those configured using the ACM_TAGS environment variable. Values may reference the variables {namespace}, {name}, {clusterName}, {agent}, {correlationId}, {createdAt} and {modifiedAt}.
+	// +optional
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// Namespaces whose Secrets are synchronized with ACM. If empty, Secrets in all namespaces are synchronized.
+	// +optional
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// Namespaces whose Secrets are never synchronized with ACM.
+	// +optional
+	ExcludedNamespaces []string `json:"excludedNamespaces,omitempty"`
+
+	// Ceiling for the exponential backoff applied when reconciliation fails or must be retried (e.g. '10m'), replacing MAX_REQUEUE_DELAY.
+	// +optional
+	MaxRequeueDelay *metav1.Duration `json:"maxRequeueDelay,omitempty"`
+
+	// If true, the agent reports (but does not make) changes to ACM: certificates are neither imported nor deleted.
+	// +optional
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// Delete policy applied to objects without the 'v2.acm-certificate-agent.validitron.io/delete-policy' annotation. Certificate deletion must also be enabled.
+	// +optional
+	// +kubebuilder:validation:Enum=Delete;Retain
+	DeletePolicy string `json:"deletePolicy,omitempty"`
+
+	// ARN of an SNS topic to which certificate lifecycle notifications (import, import failure and expiry without renewal) are published, replacing NOTIFICATION_TOPIC_ARN.
+	// +optional
+	// +kubebuilder:validation:Pattern=`^arn:[^:]+:sns:[^:]+:[0-9]{12}:.+$`
+	NotificationTopicArn string `json:"notificationTopicArn,omitempty"`
+
+	// Name or ARN of an EventBridge event bus to which certificate lifecycle notifications are published, replacing NOTIFICATION_EVENT_BUS.
+	// +optional
+	NotificationEventBus string `json:"notificationEventBus,omitempty"`
+}
+
+// ACMAgentConfigStatus defines the observed state of the agent configuration.
+type ACMAgentConfigStatus struct {
+	// The most recent generation observed by the agent.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Conditions describing whether the configuration has been applied.
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// ACMAgentConfig holds runtime configuration for the agent, which is applied without restarting it. Only the ACMAgentConfig named 'default' is read.
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:scope=Cluster,shortName=acmconfig
+// +kubebuilder:printcolumn:name="Dry Run",type=boolean,JSONPath=`.spec.dryRun`
+// +kubebuilder:printcolumn:name="Applied",type=string,JSONPath=`.status.conditions[?(@.type=="Applied")].status`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+type ACMAgentConfig struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ACMAgentConfigSpec   `json:"spec,omitempty"`
+	Status ACMAgentConfigStatus `json:"status,omitempty"`
+}
+
+// ACMAgentConfigList contains a list of ACMAgentConfig.
+// +kubebuilder:object:root=true
+type ACMAgentConfigList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ACMAgentConfig `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ACMAgentConfig{}, &ACMAgentConfigList{})
+}
@@ -0,0 +1,85 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Condition types reported in ACMCertificateExportStatus.
+const (
+	// The ACM certificate has been exported into the Secret.
+	ConditionExported string = "Exported"
+)
+
+// ACMCertificateExportSpec defines the ACM certificate that should be exported into a TLS Secret.
+type ACMCertificateExportSpec struct {
+	// ARN of the (exportable) ACM certificate.
+	// +kubebuilder:validation:Pattern=`^arn:[^:]+:acm:[^:]+:[0-9]{12}:certificate/.+$`
+	CertificateArn string `json:"certificateArn"`
+
+	// Name of the 'kubernetes.io/tls' Secret, in the same namespace, into which the certificate, chain and private key are written. The Secret is created (and owned) by the ACMCertificateExport.
+	// +kubebuilder:validation:MinLength=1
+	SecretName string `json:"secretName"`
+
+	// ARN of an IAM role to assume when communicating with ACM, allowing export from another AWS account.
+	// +optional
+	// +kubebuilder:validation:Pattern=`^arn:[^:]+:iam::[0-9]{12}:role/.+$`
+	RoleArn string `json:"roleArn,omitempty"`
+}
+
+// ACMCertificateExportStatus defines the observed state of the exported certificate.
+type ACMCertificateExportStatus struct {
+	// Serial number of the most recently exported certificate.
+	// +optional
+	SerialNumber string `json:"serialNumber,omitempty"`
+
+	// Expiry date of the most recently exported certificate.
+	// +optional
+	ExpiryDate *metav1.Time `json:"expiryDate,omitempty"`
+
+	// The most recent generation observed by the agent.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Conditions describing the state of the export.
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// ACMCertificateExport maintains a TLS Secret holding a copy of an exportable ACM certificate, refreshing it when ACM renews the certificate.
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:shortName=acmexport
+// +kubebuilder:printcolumn:name="Secret",type=string,JSONPath=`.spec.secretName`
+// +kubebuilder:printcolumn:name="Exported",type=string,JSONPath=`.status.conditions[?(@.type=="Exported")].status`
+// +kubebuilder:printcolumn:name="Expires",type=string,JSONPath=`.status.expiryDate`
+// +kubebuilder:printcolumn:name="ARN",type=string,JSONPath=`.spec.certificateArn`,priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+type ACMCertificateExport struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ACMCertificateExportSpec   `json:"spec,omitempty"`
+	Status ACMCertificateExportStatus `json:"status,omitempty"`
+}
+
+// ACMCertificateExportList contains a list of ACMCertificateExport.
+// +kubebuilder:object:root=true
+type ACMCertificateExportList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ACMCertificateExport `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ACMCertificateExport{}, &ACMCertificateExportList{})
+}
@@ -0,0 +1,158 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Condition types reported in ACMCertificateRequestStatus.
+const (
+	// The requested certificate has been issued (by ACM or AWS Private CA.)
+	ConditionIssued string = "Issued"
+	// The DNS validation records for the certificate have been published to Route53.
+	ConditionValidationRecordsPublished string = "ValidationRecordsPublished"
+	// ACM has validated all of the certificate's domain names.
+	ConditionValidated string = "Validated"
+)
+
+// ACMCertificateRequestSpec defines the ACM public certificate that should be requested.
+type ACMCertificateRequestSpec struct {
+	// Primary domain name of the certificate.
+	// +kubebuilder:validation:MinLength=1
+	DomainName string `json:"domainName"`
+
+	// Additional domain names to include in the certificate.
+	// +optional
+	SubjectAlternativeNames []string `json:"subjectAlternativeNames,omitempty"`
+
+	// AWS region in which the certificate should be requested. Defaults to the region in which the agent is running.
+	// +optional
+	// +kubebuilder:validation:Pattern=`^[a-z]{2}(-[a-z]+)+-[0-9]+$`
+	Region string `json:"region,omitempty"`
+
+	// ARN of an IAM role to assume when communicating with ACM and Route53, allowing certificates to be requested in another AWS account.
+	// +optional
+	// +kubebuilder:validation:Pattern=`^arn:[^:]+:iam::[0-9]{12}:role/.+$`
+	RoleArn string `json:"roleArn,omitempty"`
+
+	// ID of the Route53 hosted zone into which DNS validation records should be published. Additional hosted zones may be listed (comma-separated) in the 'v2.acm-certificate-agent.validitron.io/hosted-zone-id' annotation.
+	// If no hosted zone is specified, validation records are reported in status but must be created manually.
+	// +optional
+	HostedZoneID string `json:"hostedZoneId,omitempty"`
+
+	// Additional tags to apply to the ACM certificate.
+	// +optional
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// Whether the ACM certificate is deleted when the ACMCertificateRequest is deleted (only honoured if certificate deletion is enabled for the agent.)
+	// +optional
+	// +kubebuilder:default=Retain
+	// +kubebuilder:validation:Enum=Delete;Retain
+	DeletePolicy string `json:"deletePolicy,omitempty"`
+}
+
+// DNSValidationRecord is a DNS record that must exist for ACM to validate ownership of a domain.
+type DNSValidationRecord struct {
+	// Domain name being validated.
+	DomainName string `json:"domainName"`
+
+	// Name of the DNS record.
+	Name string `json:"name"`
+
+	// Type of the DNS record (CNAME.)
+	Type string `json:"type"`
+
+	// Value of the DNS record.
+	Value string `json:"value"`
+
+	// ID of the Route53 hosted zone to which the record was published (if any.)
+	// +optional
+	HostedZoneID string `json:"hostedZoneId,omitempty"`
+
+	// Validation status of the domain name as reported by ACM (e.g. PENDING_VALIDATION, SUCCESS.)
+	// +optional
+	ValidationStatus string `json:"validationStatus,omitempty"`
+}
+
+// ACMCertificateRequestStatus defines the observed state of the requested ACM certificate.
+type ACMCertificateRequestStatus struct {
+	// ARN of the ACM certificate.
+	// +optional
+	CertificateArn string `json:"certificateArn,omitempty"`
+
+	// Status of the certificate as reported by ACM (e.g. PENDING_VALIDATION, ISSUED.)
+	// +optional
+	CertificateStatus string `json:"certificateStatus,omitempty"`
+
+	// DNS records required to validate the certificate.
+	// +optional
+	ValidationRecords []DNSValidationRecord `json:"validationRecords,omitempty"`
+
+	// Expiry date of the issued certificate.
+	// +optional
+	ExpiryDate *metav1.Time `json:"expiryDate,omitempty"`
+
+	// The most recent generation observed by the agent.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Conditions describing the state of the ACM certificate.
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// ACMCertificateRequest declares a DNS-validated public certificate that is issued (and renewed) by ACM.
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:shortName=acmreq
+// +kubebuilder:printcolumn:name="Domain",type=string,JSONPath=`.spec.domainName`
+// +kubebuilder:printcolumn:name="Status",type=string,JSONPath=`.status.certificateStatus`
+// +kubebuilder:printcolumn:name="Expires",type=string,JSONPath=`.status.expiryDate`
+// +kubebuilder:printcolumn:name="ARN",type=string,JSONPath=`.status.certificateArn`,priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+type ACMCertificateRequest struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ACMCertificateRequestSpec   `json:"spec,omitempty"`
+	Status ACMCertificateRequestStatus `json:"status,omitempty"`
+}
+
+// DomainNames returns the primary domain name followed by any (unique) subject alternative names.
+func (r *ACMCertificateRequest) DomainNames() []string {
+	output := []string{r.Spec.DomainName}
+	for _, domainName := range r.Spec.SubjectAlternativeNames {
+		duplicate := false
+		for _, existing := range output {
+			if existing == domainName {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			output = append(output, domainName)
+		}
+	}
+	return output
+}
+
+// ACMCertificateRequestList contains a list of ACMCertificateRequest.
+// +kubebuilder:object:root=true
+type ACMCertificateRequestList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ACMCertificateRequest `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ACMCertificateRequest{}, &ACMCertificateRequestList{})
+}
@@ -0,0 +1,99 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Condition types reported in ACMCertificateSyncStatus.
+const (
+	// The certificate has been imported into (or found in) ACM.
+	ConditionImported string = "Imported"
+	// Any tags requested in the spec have been applied to the ACM certificate.
+	ConditionTagsApplied string = "TagsApplied"
+	// The ACM certificate is in use by at least one other AWS resource.
+	ConditionInUse string = "InUse"
+)
+
+// ACMCertificateSyncSpec defines the ACM import target for a TLS Secret.
+type ACMCertificateSyncSpec struct {
+	// Name of the 'kubernetes.io/tls' Secret, in the same namespace, whose certificate should be imported into ACM. Secrets of other types may be used if they carry the 'v2.acm-certificate-agent.validitron.io/certificate-secret', 'v2.acm-certificate-agent.validitron.io/cert-key' or 'v2.acm-certificate-agent.validitron.io/pkcs12-key' annotation.
+	// +kubebuilder:validation:MinLength=1
+	SecretName string `json:"secretName"`
+
+	// AWS region into which the certificate should be imported. Defaults to the region in which the agent is running.
+	// +optional
+	// +kubebuilder:validation:Pattern=`^[a-z]{2}(-[a-z]+)+-[0-9]+$`
+	Region string `json:"region,omitempty"`
+
+	// ARN of an IAM role to assume when communicating with ACM, allowing import into another AWS account.
+	// +optional
+	// +kubebuilder:validation:Pattern=`^arn:[^:]+:iam::[0-9]{12}:role/.+$`
+	RoleArn string `json:"roleArn,omitempty"`
+
+	// Additional tags to apply to the ACM certificate.
+	// +optional
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// ACMCertificateSyncStatus defines the observed state of the ACM certificate.
+type ACMCertificateSyncStatus struct {
+	// ARN of the ACM certificate.
+	// +optional
+	CertificateArn string `json:"certificateArn,omitempty"`
+
+	// Serial number of the imported certificate.
+	// +optional
+	SerialNumber string `json:"serialNumber,omitempty"`
+
+	// Expiry date of the imported certificate.
+	// +optional
+	ExpiryDate *metav1.Time `json:"expiryDate,omitempty"`
+
+	// The most recent generation observed by the agent.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Conditions describing the state of the ACM certificate.
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// ACMCertificateSync declaratively links a TLS Secret to an ACM import target.
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:shortName=acmsync
+// +kubebuilder:printcolumn:name="Secret",type=string,JSONPath=`.spec.secretName`
+// +kubebuilder:printcolumn:name="Region",type=string,JSONPath=`.spec.region`
+// +kubebuilder:printcolumn:name="Imported",type=string,JSONPath=`.status.conditions[?(@.type=="Imported")].status`
+// +kubebuilder:printcolumn:name="Expires",type=string,JSONPath=`.status.expiryDate`
+// +kubebuilder:printcolumn:name="ARN",type=string,JSONPath=`.status.certificateArn`,priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+type ACMCertificateSync struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ACMCertificateSyncSpec   `json:"spec,omitempty"`
+	Status ACMCertificateSyncStatus `json:"status,omitempty"`
+}
+
+// ACMCertificateSyncList contains a list of ACMCertificateSync.
+// +kubebuilder:object:root=true
+type ACMCertificateSyncList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ACMCertificateSync `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ACMCertificateSync{}, &ACMCertificateSyncList{})
+}
@@ -0,0 +1,90 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ACMSecretStateStatus summarises the synchronization of a Secret with ACM, as recorded in the Secret's annotations.
+type ACMSecretStateStatus struct {
+	// Outcome of the most recent synchronization (e.g. 'Synced', 'Pending' or 'Failed'.)
+	// +optional
+	State string `json:"state,omitempty"`
+
+	// Details of the outcome of the most recent synchronization, if it was unsuccessful (or incomplete.)
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// First domain name of the Secret's certificate.
+	// +optional
+	DomainName string `json:"domainName,omitempty"`
+
+	// Domain names of the Secret's certificate.
+	// +optional
+	DomainNames []string `json:"domainNames,omitempty"`
+
+	// ARN of the ACM certificate holding the Secret's certificate (in the agent's own region where possible.)
+	// +optional
+	CertificateArn string `json:"certificateArn,omitempty"`
+
+	// Final component of CertificateArn (the ACM certificate ID.)
+	// +optional
+	CertificateID string `json:"certificateId,omitempty"`
+
+	// ACM regions into which the Secret's certificate has been imported.
+	// +optional
+	Regions []string `json:"regions,omitempty"`
+
+	// Serial number of the Secret's certificate.
+	// +optional
+	SerialNumber string `json:"serialNumber,omitempty"`
+
+	// Expiry date of the Secret's certificate.
+	// +optional
+	ExpiryDate *metav1.Time `json:"expiryDate,omitempty"`
+
+	// Time at which the Secret's certificate was most recently imported into ACM.
+	// +optional
+	LastImportTime *metav1.Time `json:"lastImportTime,omitempty"`
+
+	// Time at which the Secret was most recently found to be synchronized with its current certificate.
+	// +optional
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+}
+
+// ACMSecretState reports the synchronization of a Secret with ACM, so that managed Secrets can be reviewed using kubectl (e.g. 'kubectl get acmstate -A'.) Each is created by the agent, with the name of its Secret, and is owned by the Secret (so is deleted with it.) It has no spec.
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=acmstate
+// +kubebuilder:printcolumn:name="State",type=string,JSONPath=`.status.state`
+// +kubebuilder:printcolumn:name="Domain",type=string,JSONPath=`.status.domainName`
+// +kubebuilder:printcolumn:name="Certificate",type=string,JSONPath=`.status.certificateId`
+// +kubebuilder:printcolumn:name="Expires",type=string,JSONPath=`.status.expiryDate`
+// +kubebuilder:printcolumn:name="Last Sync",type=date,JSONPath=`.status.lastSyncTime`
+// +kubebuilder:printcolumn:name="ARN",type=string,JSONPath=`.status.certificateArn`,priority=1
+// +kubebuilder:printcolumn:name="Message",type=string,JSONPath=`.status.message`,priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+type ACMSecretState struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Status ACMSecretStateStatus `json:"status,omitempty"`
+}
+
+// ACMSecretStateList contains a list of ACMSecretState.
+// +kubebuilder:object:root=true
+type ACMSecretStateList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ACMSecretState `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ACMSecretState{}, &ACMSecretStateList{})
+}
@@ -0,0 +1,129 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Key algorithms supported for private certificates.
+const (
+	KeyAlgorithmRSA2048      string = "RSA_2048"
+	KeyAlgorithmECPrime256v1 string = "EC_prime256v1"
+	KeyAlgorithmECSecp384r1  string = "EC_secp384r1"
+)
+
+// PrivateCertificateSpec defines the certificate that should be issued by an AWS Private CA.
+type PrivateCertificateSpec struct {
+	// ARN of the AWS Private CA (ACM PCA) certificate authority that should issue the certificate.
+	// +kubebuilder:validation:Pattern=`^arn:[^:]+:acm-pca:[^:]+:[0-9]{12}:certificate-authority/.+$`
+	CertificateAuthorityArn string `json:"certificateAuthorityArn"`
+
+	// Name of the 'kubernetes.io/tls' Secret, in the same namespace, into which the certificate, chain and private key are written. The Secret is created (and owned) by the PrivateCertificate.
+	// +kubebuilder:validation:MinLength=1
+	SecretName string `json:"secretName"`
+
+	// Subject common name of the certificate. Defaults to the first DNS name.
+	// +optional
+	CommonName string `json:"commonName,omitempty"`
+
+	// DNS names to include in the certificate.
+	// +kubebuilder:validation:MinItems=1
+	DNSNames []string `json:"dnsNames"`
+
+	// Algorithm of the private key generated for the certificate.
+	// +optional
+	// +kubebuilder:default=EC_prime256v1
+	// +kubebuilder:validation:Enum=RSA_2048;EC_prime256v1;EC_secp384r1
+	KeyAlgorithm string `json:"keyAlgorithm,omitempty"`
+
+	// Validity period of the certificate, in days.
+	// +optional
+	// +kubebuilder:default=90
+	// +kubebuilder:validation:Minimum=1
+	ValidityDays int64 `json:"validityDays,omitempty"`
+
+	// Number of days before expiry at which the certificate is renewed.
+	// +optional
+	// +kubebuilder:default=30
+	// +kubebuilder:validation:Minimum=0
+	RenewBeforeDays int64 `json:"renewBeforeDays,omitempty"`
+
+	// AWS region of the certificate authority. Defaults to the region in the certificate authority ARN.
+	// +optional
+	// +kubebuilder:validation:Pattern=`^[a-z]{2}(-[a-z]+)+-[0-9]+$`
+	Region string `json:"region,omitempty"`
+
+	// ARN of an IAM role to assume when communicating with AWS Private CA, allowing use of a certificate authority in another AWS account.
+	// +optional
+	// +kubebuilder:validation:Pattern=`^arn:[^:]+:iam::[0-9]{12}:role/.+$`
+	RoleArn string `json:"roleArn,omitempty"`
+}
+
+// PrivateCertificateStatus defines the observed state of the issued certificate.
+type PrivateCertificateStatus struct {
+	// ARN of the most recently issued certificate.
+	// +optional
+	CertificateArn string `json:"certificateArn,omitempty"`
+
+	// ARN of the certificate authority that issued the most recent certificate.
+	// +optional
+	CertificateAuthorityArn string `json:"certificateAuthorityArn,omitempty"`
+
+	// Serial number of the most recently issued certificate.
+	// +optional
+	SerialNumber string `json:"serialNumber,omitempty"`
+
+	// Expiry date of the most recently issued certificate.
+	// +optional
+	ExpiryDate *metav1.Time `json:"expiryDate,omitempty"`
+
+	// Time at which the certificate will be renewed.
+	// +optional
+	RenewalTime *metav1.Time `json:"renewalTime,omitempty"`
+
+	// The most recent generation observed by the agent.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Conditions describing the state of the certificate.
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// PrivateCertificate declares a certificate that is issued by an AWS Private CA, written into a TLS Secret, and renewed before it expires.
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:shortName=pcert
+// +kubebuilder:printcolumn:name="Secret",type=string,JSONPath=`.spec.secretName`
+// +kubebuilder:printcolumn:name="Issued",type=string,JSONPath=`.status.conditions[?(@.type=="Issued")].status`
+// +kubebuilder:printcolumn:name="Expires",type=string,JSONPath=`.status.expiryDate`
+// +kubebuilder:printcolumn:name="CA",type=string,JSONPath=`.spec.certificateAuthorityArn`,priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+type PrivateCertificate struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   PrivateCertificateSpec   `json:"spec,omitempty"`
+	Status PrivateCertificateStatus `json:"status,omitempty"`
+}
+
+// PrivateCertificateList contains a list of PrivateCertificate.
+// +kubebuilder:object:root=true
+type PrivateCertificateList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []PrivateCertificate `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&PrivateCertificate{}, &PrivateCertificateList{})
+}
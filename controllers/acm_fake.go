@@ -0,0 +1,393 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+	"github.com/aws/aws-sdk-go-v2/service/acm/types"
+	"github.com/google/uuid"
+)
+
+// FakeACMService is an in-memory ACMService, for use in tests (e.g. with envtest) in place of the ACM API.
+// Imported certificates are parsed to populate the details returned by DescribeCertificate. Requested certificates remain pending validation until SetCertificateStatus is called. Certificates cannot be exported.
+type FakeACMService struct {
+	Region    string
+	AccountId string
+
+	mutex        sync.Mutex
+	certificates map[string]*fakeACMCertificate // Keyed by certificate ARN.
+}
+
+type fakeACMCertificate struct {
+	detail           types.CertificateDetail
+	certificatePEM   string
+	certificateChain string
+	tags             map[string]string
+	idempotencyToken string
+}
+
+var _ ACMService = (*FakeACMService)(nil)
+
+// NewFakeACMService returns an empty FakeACMService for the specified region and AWS account.
+func NewFakeACMService(region string, accountId string) *FakeACMService {
+	return &FakeACMService{
+		Region:       region,
+		AccountId:    accountId,
+		certificates: map[string]*fakeACMCertificate{},
+	}
+}
+
+// Factory returns an ACMServiceFactory which always returns this FakeACMService, regardless of region.
+func (f *FakeACMService) Factory() ACMServiceFactory {
+	return func(_ aws.Config, _ string) ACMService {
+		return f
+	}
+}
+
+// CertificateArns returns the ARNs of all certificates held, in sorted order.
+func (f *FakeACMService) CertificateArns() []string {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	output := []string{}
+	for certificateArn := range f.certificates {
+		output = append(output, certificateArn)
+	}
+	sort.Strings(output)
+
+	return output
+}
+
+// SetCertificateStatus changes the status of a certificate (e.g. to simulate the validation of a requested certificate.)
+func (f *FakeACMService) SetCertificateStatus(certificateArn string, status types.CertificateStatus) error {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	certificate, ok := f.certificates[certificateArn]
+	if !ok {
+		return f.notFound(certificateArn)
+	}
+	certificate.detail.Status = status
+	if status == types.CertificateStatusIssued {
+		for i := range certificate.detail.DomainValidationOptions {
+			certificate.detail.DomainValidationOptions[i].ValidationStatus = types.DomainStatusSuccess
+		}
+	}
+
+	return nil
+}
+
+// SetInUseBy records the AWS resources (e.g. load balancer ARNs) using a certificate, which prevents its deletion.
+func (f *FakeACMService) SetInUseBy(certificateArn string, resourceArns []string) error {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	certificate, ok := f.certificates[certificateArn]
+	if !ok {
+		return f.notFound(certificateArn)
+	}
+	certificate.detail.InUseBy = resourceArns
+
+	return nil
+}
+
+func (f *FakeACMService) AddTagsToCertificate(ctx context.Context, params *acm.AddTagsToCertificateInput, optFns ...func(*acm.Options)) (*acm.AddTagsToCertificateOutput, error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	certificate, ok := f.certificates[aws.ToString(params.CertificateArn)]
+	if !ok {
+		return nil, f.notFound(aws.ToString(params.CertificateArn))
+	}
+	for _, tag := range params.Tags {
+		certificate.tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+
+	return &acm.AddTagsToCertificateOutput{}, nil
+}
+
+func (f *FakeACMService) DeleteCertificate(ctx context.Context, params *acm.DeleteCertificateInput, optFns ...func(*acm.Options)) (*acm.DeleteCertificateOutput, error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	certificateArn := aws.ToString(params.CertificateArn)
+	certificate, ok := f.certificates[certificateArn]
+	if !ok {
+		return nil, f.notFound(certificateArn)
+	}
+	if len(certificate.detail.InUseBy) > 0 {
+		return nil, &types.ResourceInUseException{Message: aws.String(fmt.Sprintf("Certificate '%s' is in use.", certificateArn))}
+	}
+	delete(f.certificates, certificateArn)
+
+	return &acm.DeleteCertificateOutput{}, nil
+}
+
+func (f *FakeACMService) DescribeCertificate(ctx context.Context, params *acm.DescribeCertificateInput, optFns ...func(*acm.Options)) (*acm.DescribeCertificateOutput, error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	certificate, ok := f.certificates[aws.ToString(params.CertificateArn)]
+	if !ok {
+		return nil, f.notFound(aws.ToString(params.CertificateArn))
+	}
+	detail := certificate.detail
+
+	return &acm.DescribeCertificateOutput{Certificate: &detail}, nil
+}
+
+func (f *FakeACMService) ExportCertificate(ctx context.Context, params *acm.ExportCertificateInput, optFns ...func(*acm.Options)) (*acm.ExportCertificateOutput, error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if _, ok := f.certificates[aws.ToString(params.CertificateArn)]; !ok {
+		return nil, f.notFound(aws.ToString(params.CertificateArn))
+	}
+
+	return nil, &types.ValidationException{Message: aws.String("Certificate export is not supported by FakeACMService.")}
+}
+
+func (f *FakeACMService) GetCertificate(ctx context.Context, params *acm.GetCertificateInput, optFns ...func(*acm.Options)) (*acm.GetCertificateOutput, error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	certificate, ok := f.certificates[aws.ToString(params.CertificateArn)]
+	if !ok {
+		return nil, f.notFound(aws.ToString(params.CertificateArn))
+	}
+	if certificate.certificatePEM == "" {
+		return nil, &types.RequestInProgressException{Message: aws.String("Certificate has not yet been issued.")}
+	}
+
+	output := &acm.GetCertificateOutput{Certificate: aws.String(certificate.certificatePEM)}
+	if certificate.certificateChain != "" {
+		output.CertificateChain = aws.String(certificate.certificateChain)
+	}
+
+	return output, nil
+}
+
+func (f *FakeACMService) ImportCertificate(ctx context.Context, params *acm.ImportCertificateInput, optFns ...func(*acm.Options)) (*acm.ImportCertificateOutput, error) {
+
+	block, _ := pem.Decode(params.Certificate)
+	if block == nil {
+		return nil, &types.ValidationException{Message: aws.String("Could not parse certificate.")}
+	}
+	x509Certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, &types.ValidationException{Message: aws.String(fmt.Sprintf("Could not parse certificate: %s", err))}
+	}
+	if len(params.PrivateKey) == 0 {
+		return nil, &types.ValidationException{Message: aws.String("A private key is required.")}
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	now := time.Now()
+	certificateArn := aws.ToString(params.CertificateArn)
+	certificate, ok := f.certificates[certificateArn]
+	if certificateArn != "" && !ok {
+		return nil, f.notFound(certificateArn)
+	}
+	if !ok {
+		certificateArn = fmt.Sprintf("arn:%s:acm:%s:%s:certificate/%s", agentPartition(f.Region), f.Region, f.AccountId, uuid.New().String())
+		certificate = &fakeACMCertificate{
+			detail: types.CertificateDetail{CertificateArn: aws.String(certificateArn), CreatedAt: &now},
+			tags:   map[string]string{},
+		}
+		for _, tag := range params.Tags {
+			certificate.tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+		}
+		f.certificates[certificateArn] = certificate
+	} else if len(params.Tags) > 0 {
+		return nil, &types.InvalidParameterException{Message: aws.String("Tags cannot be applied when re-importing a certificate.")}
+	}
+
+	// As with ACM, the domain name is taken from the subject CN (or, if there is none, the first subject alternative name.)
+	subjectAlternativeNames := append([]string{}, x509Certificate.DNSNames...)
+	if x509Certificate.Subject.CommonName != "" && !containsString(subjectAlternativeNames, x509Certificate.Subject.CommonName) {
+		subjectAlternativeNames = append([]string{x509Certificate.Subject.CommonName}, subjectAlternativeNames...)
+	}
+	certificate.detail.DomainName = aws.String(acmDomainName(x509Certificate))
+	certificate.detail.SubjectAlternativeNames = subjectAlternativeNames
+	certificate.detail.Serial = aws.String((&SecretReconciler{}).FormatX509SerialNumber(x509Certificate.SerialNumber))
+	if keyAlgorithm, err := acmKeyAlgorithm(x509Certificate.PublicKey); err == nil {
+		certificate.detail.KeyAlgorithm = types.KeyAlgorithm(keyAlgorithm)
+	}
+	certificate.detail.Subject = aws.String(x509Certificate.Subject.String())
+	certificate.detail.Issuer = aws.String(x509Certificate.Issuer.String())
+	certificate.detail.NotBefore = &x509Certificate.NotBefore
+	certificate.detail.NotAfter = &x509Certificate.NotAfter
+	certificate.detail.ImportedAt = &now
+	certificate.detail.Status = types.CertificateStatusIssued
+	certificate.detail.Type = types.CertificateTypeImported
+	certificate.certificatePEM = string(params.Certificate)
+	certificate.certificateChain = string(params.CertificateChain)
+
+	return &acm.ImportCertificateOutput{CertificateArn: aws.String(certificateArn)}, nil
+}
+
+func (f *FakeACMService) ListCertificates(ctx context.Context, params *acm.ListCertificatesInput, optFns ...func(*acm.Options)) (*acm.ListCertificatesOutput, error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// All certificates are returned in a single page.
+	output := &acm.ListCertificatesOutput{}
+	for certificateArn, certificate := range f.certificates {
+		if len(params.CertificateStatuses) > 0 {
+			matches := false
+			for _, status := range params.CertificateStatuses {
+				matches = matches || certificate.detail.Status == status
+			}
+			if !matches {
+				continue
+			}
+		}
+		// As with ACM, only RSA_2048 certificates are listed unless other key types are included.
+		keyTypes := []types.KeyAlgorithm{types.KeyAlgorithmRsa2048}
+		if params.Includes != nil && len(params.Includes.KeyTypes) > 0 {
+			keyTypes = params.Includes.KeyTypes
+		}
+		if certificate.detail.KeyAlgorithm != "" {
+			matches := false
+			for _, keyType := range keyTypes {
+				matches = matches || certificate.detail.KeyAlgorithm == keyType
+			}
+			if !matches {
+				continue
+			}
+		}
+		output.CertificateSummaryList = append(output.CertificateSummaryList, types.CertificateSummary{
+			CertificateArn: aws.String(certificateArn),
+			DomainName:     certificate.detail.DomainName,
+		})
+	}
+	sort.Slice(output.CertificateSummaryList, func(i, j int) bool {
+		return *output.CertificateSummaryList[i].CertificateArn < *output.CertificateSummaryList[j].CertificateArn
+	})
+
+	return output, nil
+}
+
+func (f *FakeACMService) ListTagsForCertificate(ctx context.Context, params *acm.ListTagsForCertificateInput, optFns ...func(*acm.Options)) (*acm.ListTagsForCertificateOutput, error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	certificate, ok := f.certificates[aws.ToString(params.CertificateArn)]
+	if !ok {
+		return nil, f.notFound(aws.ToString(params.CertificateArn))
+	}
+
+	output := &acm.ListTagsForCertificateOutput{}
+	for key, value := range certificate.tags {
+		output.Tags = append(output.Tags, types.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	sort.Slice(output.Tags, func(i, j int) bool {
+		return *output.Tags[i].Key < *output.Tags[j].Key
+	})
+
+	return output, nil
+}
+
+func (f *FakeACMService) RequestCertificate(ctx context.Context, params *acm.RequestCertificateInput, optFns ...func(*acm.Options)) (*acm.RequestCertificateOutput, error) {
+
+	domainName := aws.ToString(params.DomainName)
+	if domainName == "" {
+		return nil, &types.InvalidParameterException{Message: aws.String("A domain name is required.")}
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// As with ACM, requests with the same idempotency token return the same certificate.
+	if token := aws.ToString(params.IdempotencyToken); token != "" {
+		for certificateArn, certificate := range f.certificates {
+			if certificate.idempotencyToken == token {
+				return &acm.RequestCertificateOutput{CertificateArn: aws.String(certificateArn)}, nil
+			}
+		}
+	}
+
+	now := time.Now()
+	certificateArn := fmt.Sprintf("arn:%s:acm:%s:%s:certificate/%s", agentPartition(f.Region), f.Region, f.AccountId, uuid.New().String())
+	subjectAlternativeNames := []string{domainName}
+	for _, name := range params.SubjectAlternativeNames {
+		if !containsString(subjectAlternativeNames, name) {
+			subjectAlternativeNames = append(subjectAlternativeNames, name)
+		}
+	}
+
+	// Each domain is validated using a CNAME record derived from the domain name.
+	validationOptions := []types.DomainValidation{}
+	for _, name := range subjectAlternativeNames {
+		hash := sha256.Sum256([]byte(certificateArn + "|" + name))
+		recordName := "_" + hex.EncodeToString(hash[:8]) + "." + strings.TrimPrefix(name, "*.") + "."
+		validationOptions = append(validationOptions, types.DomainValidation{
+			DomainName:       aws.String(name),
+			ValidationDomain: aws.String(name),
+			ValidationMethod: types.ValidationMethodDns,
+			ValidationStatus: types.DomainStatusPendingValidation,
+			ResourceRecord: &types.ResourceRecord{
+				Name:  aws.String(recordName),
+				Type:  types.RecordTypeCname,
+				Value: aws.String("_" + hex.EncodeToString(hash[8:16]) + ".acm-validations.aws."),
+			},
+		})
+	}
+
+	certificate := &fakeACMCertificate{
+		detail: types.CertificateDetail{
+			CertificateArn:          aws.String(certificateArn),
+			CreatedAt:               &now,
+			DomainName:              aws.String(domainName),
+			SubjectAlternativeNames: subjectAlternativeNames,
+			DomainValidationOptions: validationOptions,
+			Status:                  types.CertificateStatusPendingValidation,
+			Type:                    types.CertificateTypeAmazonIssued,
+		},
+		tags: map[string]string{},
+	}
+	for _, tag := range params.Tags {
+		certificate.tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	certificate.idempotencyToken = aws.ToString(params.IdempotencyToken)
+	f.certificates[certificateArn] = certificate
+
+	return &acm.RequestCertificateOutput{CertificateArn: aws.String(certificateArn)}, nil
+}
+
+// Returns the error raised by ACM when a certificate does not exist.
+func (f *FakeACMService) notFound(certificateArn string) error {
+	return &types.ResourceNotFoundException{Message: aws.String(fmt.Sprintf("Could not find certificate %s.", certificateArn))}
+}
@@ -0,0 +1,45 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+	"github.com/aws/aws-sdk-go-v2/service/acm/types"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// RecordACMCertificateHealth records the health of the ACM certificate synchronized from the Secret, as described by ACM (its status, renewal eligibility, key algorithm and the AWS resources using it), in the certificate's record in the Secret's acm-certificates annotation. The certificate is only described if it was not already described during synchronization. A warning Event is recorded if ACM does not report the certificate as issued (e.g. it has expired or been revoked.)
+// Failure to describe the certificate is logged, but does not fail synchronization.
+func (r *SecretReconciler) RecordACMCertificateHealth(ctx context.Context, secret *corev1.Secret, acmClient ACMService, certificateDetails *CertificateDetails, record *ACMCertificateRecord) {
+
+	log := log.FromContext(ctx)
+
+	detail := certificateDetails.ACMCertificate
+	if detail == nil {
+		output, err := acmClient.DescribeCertificate(ctx, &acm.DescribeCertificateInput{CertificateArn: certificateDetails.CertificateArn})
+		if err != nil {
+			log.Error(err, "ACM certificate health check failed.")
+			return
+		}
+		detail = output.Certificate
+	}
+
+	record.Status = string(detail.Status)
+	record.RenewalEligibility = string(detail.RenewalEligibility)
+	record.KeyAlgorithm = string(detail.KeyAlgorithm)
+	record.InUseBy = detail.InUseBy
+
+	if detail.Status != "" && detail.Status != types.CertificateStatusIssued {
+		r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonACMCertificateUnhealthy, fmt.Sprintf("ACM certificate '%s' has status '%s'.", record.CertificateArn, detail.Status))
+	}
+}
@@ -0,0 +1,438 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"crypto/x509"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+	"github.com/aws/aws-sdk-go-v2/service/acm/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// How long a listing of ACM certificates is trusted before it is refreshed.
+	acmIndexTTL = 5 * time.Minute
+
+	// Maximum number of DescribeCertificate requests made concurrently when populating index entries (ACM throttles DescribeCertificate at 10 requests per second per account.)
+	acmDescribeConcurrency = 8
+)
+
+// ACMCertificateSummary describes an ACM certificate held in the ACM certificate index.
+type ACMCertificateSummary struct {
+	CertificateArn          string
+	DomainName              string
+	Serial                  string    // Populated on demand, since ListCertificates does not return serial numbers.
+	SubjectAlternativeNames []string  // Populated on demand, along with Serial.
+	Type                    string    // Populated on demand (see ImportUsage.)
+	ImportedAt              time.Time // Populated on demand, along with Type. Zero for certificates that were not imported.
+}
+
+// Cached ACM certificates for a single AWS account/region combination.
+type acmScopeIndex struct {
+	mutex       sync.Mutex
+	entries     map[string]*ACMCertificateSummary // Keyed by certificate ARN.
+	refreshedAt time.Time
+}
+
+// acmCertificateIndex is an in-memory index of ACM certificates shared by all reconcilers, so that searching for existing certificates does not require paging through ListCertificates on every reconcile.
+// Listings are refreshed once they are older than acmIndexTTL. Entries are updated when the agent imports or deletes a certificate.
+type acmCertificateIndex struct {
+	mutex  sync.Mutex
+	scopes map[string]*acmScopeIndex
+}
+
+var acmIndex = &acmCertificateIndex{scopes: map[string]*acmScopeIndex{}}
+
+// acmDomainLocks serializes synchronization of certificates for the same domain (within an ACM account/region), so that objects reconciled in parallel which hold the same certificate do not both import it.
+var acmDomainLocks = &keyedMutex{locks: map[string]*keyedMutexEntry{}}
+
+// keyedMutex provides a mutex for each key. Entries are removed once no longer in use.
+type keyedMutex struct {
+	mutex sync.Mutex
+	locks map[string]*keyedMutexEntry
+}
+
+type keyedMutexEntry struct {
+	mutex sync.Mutex
+	users int
+}
+
+// Lock acquires the mutex for the key, returning a function that releases it.
+func (k *keyedMutex) Lock(key string) func() {
+
+	k.mutex.Lock()
+	entry, ok := k.locks[key]
+	if !ok {
+		entry = &keyedMutexEntry{}
+		k.locks[key] = entry
+	}
+	entry.users++
+	k.mutex.Unlock()
+
+	entry.mutex.Lock()
+
+	return func() {
+		entry.mutex.Unlock()
+
+		k.mutex.Lock()
+		defer k.mutex.Unlock()
+		entry.users--
+		if entry.users == 0 {
+			delete(k.locks, key)
+		}
+	}
+}
+
+// Returns the index scope for ACM clients using the specified (optional) assumed role in the specified region.
+func acmIndexScope(roleArn string, region string) string {
+	return effectiveRoleArn(roleArn) + "|" + region
+}
+
+// Returns the (optional) assumed role and region identified by an index scope (see acmIndexScope.)
+func splitACMIndexScope(scope string) (string, string) {
+	separator := strings.LastIndex(scope, "|")
+	if separator < 0 {
+		return "", scope
+	}
+	return scope[:separator], scope[separator+1:]
+}
+
+func (i *acmCertificateIndex) scope(scope string) *acmScopeIndex {
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	scopeIndex, ok := i.scopes[scope]
+	if !ok {
+		scopeIndex = &acmScopeIndex{entries: map[string]*ACMCertificateSummary{}}
+		i.scopes[scope] = scopeIndex
+	}
+	return scopeIndex
+}
+
+// FindByDomains returns the indexed ACM certificates that may be the same certificate as one with the specified ACM domain name (see acmDomainName) and domain names, refreshing the listing for the scope first if it has expired.
+// ACM records a single domain name for each certificate in its listing (the subject CN or, if there is none, the first subject alternative name), which is the same for every copy of a certificate. Only candidates listed under the certificate's domain name are described (to retrieve their serial numbers and subject alternative names), since certificates listed under any other name cannot be the same certificate. Their full subject alternative names are then compared, ignoring order, case and any trailing dot.
+func (i *acmCertificateIndex) FindByDomains(ctx context.Context, acmClient ACMService, scope string, domainName string, domainNames []string) ([]ACMCertificateSummary, error) {
+
+	scopeIndex := i.scope(scope)
+
+	scopeIndex.mutex.Lock()
+	defer scopeIndex.mutex.Unlock()
+
+	if time.Since(scopeIndex.refreshedAt) > acmIndexTTL {
+		if err := scopeIndex.refresh(ctx, acmClient); err != nil {
+			return nil, err
+		}
+	}
+
+	wanted := normalizeDomainName(domainName)
+
+	candidates := []*ACMCertificateSummary{}
+	undescribed := []string{}
+	for certificateArn, entry := range scopeIndex.entries {
+		if normalizeDomainName(entry.DomainName) != wanted {
+			continue
+		}
+		candidates = append(candidates, entry)
+		if entry.Serial == "" || entry.SubjectAlternativeNames == nil {
+			undescribed = append(undescribed, certificateArn)
+		}
+	}
+	if err := scopeIndex.describe(ctx, acmClient, undescribed); err != nil {
+		return nil, err
+	}
+
+	output := []ACMCertificateSummary{}
+	for _, entry := range candidates {
+		if _, ok := scopeIndex.entries[entry.CertificateArn]; !ok {
+			continue
+		}
+
+		// A certificate recently imported by another process may not yet be described by ACM, and may be this certificate.
+		if entry.Serial == "" && entry.SubjectAlternativeNames == nil {
+			return nil, &propagationDelayError{certificateArn: entry.CertificateArn}
+		}
+
+		if !sameDomainNames(append([]string{entry.DomainName}, entry.SubjectAlternativeNames...), domainNames) {
+			continue
+		}
+
+		output = append(output, *entry)
+	}
+
+	return output, nil
+}
+
+// ImportUsage returns the number of imported certificates held in ACM for the scope, and the number of those imported (or last re-imported) within the past 365 days, refreshing the listing for the scope first if it has expired.
+// ListCertificates does not report the type of certificates, so each listed certificate is described the first time usage is checked.
+func (i *acmCertificateIndex) ImportUsage(ctx context.Context, acmClient ACMService, scope string) (int, int, error) {
+
+	scopeIndex := i.scope(scope)
+
+	scopeIndex.mutex.Lock()
+	defer scopeIndex.mutex.Unlock()
+
+	if time.Since(scopeIndex.refreshedAt) > acmIndexTTL {
+		if err := scopeIndex.refresh(ctx, acmClient); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	undescribed := []string{}
+	for certificateArn, entry := range scopeIndex.entries {
+		if entry.Type == "" {
+			undescribed = append(undescribed, certificateArn)
+		}
+	}
+	if err := scopeIndex.describe(ctx, acmClient, undescribed); err != nil {
+		return 0, 0, err
+	}
+
+	imported, importedInLastYear := 0, 0
+	for _, entry := range scopeIndex.entries {
+
+		if entry.Type != string(types.CertificateTypeImported) {
+			continue
+		}
+		imported++
+		if time.Since(entry.ImportedAt) < 365*24*time.Hour {
+			importedInLastYear++
+		}
+	}
+
+	return imported, importedInLastYear, nil
+}
+
+// Replaces the listing for the scope with the current contents of ACM.
+func (s *acmScopeIndex) refresh(ctx context.Context, acmClient ACMService) error {
+
+	log.FromContext(ctx).Info("Refreshing ACM certificate index...")
+
+	// AWS API for ACM provides no way (currently @v2.x) to search for certificates by domain, so we must iterate through (in pages of the maximum size.)
+	// Unless filtered otherwise, ACM lists only RSA_2048 certificates, so every key type is requested explicitly (otherwise, certificates with other keys would never be found, and would be imported again.)
+	// Only certificates with the statuses of imported certificates are listed: requested certificates that are pending validation (or have failed validation, or been revoked) cannot be duplicates, nor count towards import quotas, so need never be described.
+	entries := map[string]*ACMCertificateSummary{}
+	paginator := acm.NewListCertificatesPaginator(acmClient, &acm.ListCertificatesInput{
+		CertificateStatuses: []types.CertificateStatus{types.CertificateStatusIssued, types.CertificateStatusExpired},
+		Includes:            &types.Filters{KeyTypes: types.KeyAlgorithm("").Values()},
+		MaxItems:            aws.Int32(1000),
+	})
+	for paginator.HasMorePages() {
+		listOutput, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, acmCertificateSummary := range listOutput.CertificateSummaryList {
+			if acmCertificateSummary.CertificateArn == nil || acmCertificateSummary.DomainName == nil {
+				continue
+			}
+			entry := &ACMCertificateSummary{
+				CertificateArn: *acmCertificateSummary.CertificateArn,
+				DomainName:     *acmCertificateSummary.DomainName,
+			}
+			// The type of a certificate never changes, so is retained to avoid describing every certificate again when quotas are next checked.
+			if previous, ok := s.entries[entry.CertificateArn]; ok {
+				entry.Type = previous.Type
+				entry.ImportedAt = previous.ImportedAt
+			}
+			entries[entry.CertificateArn] = entry
+		}
+	}
+
+	// Recent imports may not yet be listed by ACM (see acmPropagationWindow), so are retained to avoid importing duplicates.
+	for certificateArn, previous := range s.entries {
+		if _, ok := entries[certificateArn]; !ok && time.Since(previous.ImportedAt) < acmPropagationWindow {
+			entries[certificateArn] = previous
+		}
+	}
+
+	s.entries = entries
+	s.refreshedAt = time.Now()
+
+	return nil
+}
+
+// Describes the ACM certificates with the specified ARNs, populating their entries with the details not returned by ListCertificates. Entries for certificates that no longer exist are removed, unless they were imported within acmPropagationWindow (since ACM may not yet describe them.) Must be called with the scope's mutex held.
+// Certificates are described concurrently (by up to acmDescribeConcurrency workers), since the entries of a newly listed account may each need to be described.
+func (s *acmScopeIndex) describe(ctx context.Context, acmClient ACMService, certificateArns []string) error {
+
+	if len(certificateArns) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var resultsMutex sync.Mutex
+	details := map[string]*types.CertificateDetail{}
+	var firstErr error
+
+	queue := make(chan string)
+	var workers sync.WaitGroup
+	for worker := 0; worker < acmDescribeConcurrency && worker < len(certificateArns); worker++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for certificateArn := range queue {
+				describeOutput, err := acmClient.DescribeCertificate(ctx, &acm.DescribeCertificateInput{CertificateArn: aws.String(certificateArn)})
+				resultsMutex.Lock()
+				if err == nil {
+					details[certificateArn] = describeOutput.Certificate
+				} else if !isACMResourceNotFound(err) && firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				resultsMutex.Unlock()
+			}
+		}()
+	}
+
+enqueue:
+	for _, certificateArn := range certificateArns {
+		select {
+		case queue <- certificateArn:
+		case <-ctx.Done():
+			break enqueue
+		}
+	}
+	close(queue)
+	workers.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	for _, certificateArn := range certificateArns {
+		entry, ok := s.entries[certificateArn]
+		if !ok {
+			continue
+		}
+		detail, ok := details[certificateArn]
+		if !ok {
+			if time.Since(entry.ImportedAt) >= acmPropagationWindow {
+				delete(s.entries, certificateArn)
+			}
+			continue
+		}
+		entry.Serial = aws.ToString(detail.Serial)
+		entry.SubjectAlternativeNames = append([]string{}, detail.SubjectAlternativeNames...)
+		entry.Type = string(detail.Type)
+		entry.ImportedAt = aws.ToTime(detail.ImportedAt)
+	}
+
+	return nil
+}
+
+// Records a certificate imported by the agent, replacing any existing entry with the same ARN (re-imports change the serial number.)
+func (i *acmCertificateIndex) Put(scope string, entry ACMCertificateSummary) {
+
+	scopeIndex := i.scope(scope)
+
+	scopeIndex.mutex.Lock()
+	defer scopeIndex.mutex.Unlock()
+
+	scopeIndex.entries[entry.CertificateArn] = &entry
+}
+
+// Expires the listing for the scope, so that it is refreshed when next searched (e.g. because another process may have imported certificates.)
+func (i *acmCertificateIndex) Expire(scope string) {
+
+	scopeIndex := i.scope(scope)
+
+	scopeIndex.mutex.Lock()
+	defer scopeIndex.mutex.Unlock()
+
+	scopeIndex.refreshedAt = time.Time{}
+}
+
+// RecentlyImported returns true if the agent imported the certificate, with the specified serial number, within acmPropagationWindow (i.e. ACM may not yet reflect the import.)
+func (i *acmCertificateIndex) RecentlyImported(scope string, certificateArn string, serial string) bool {
+
+	scopeIndex := i.scope(scope)
+
+	scopeIndex.mutex.Lock()
+	defer scopeIndex.mutex.Unlock()
+
+	entry, ok := scopeIndex.entries[certificateArn]
+	return ok && entry.Serial == serial && time.Since(entry.ImportedAt) < acmPropagationWindow
+}
+
+// Removes a certificate (e.g. one that has been deleted) from all scopes.
+func (i *acmCertificateIndex) Forget(certificateArn string) {
+
+	i.mutex.Lock()
+	scopes := make([]*acmScopeIndex, 0, len(i.scopes))
+	for _, scopeIndex := range i.scopes {
+		scopes = append(scopes, scopeIndex)
+	}
+	i.mutex.Unlock()
+
+	for _, scopeIndex := range scopes {
+		scopeIndex.mutex.Lock()
+		delete(scopeIndex.entries, certificateArn)
+		scopeIndex.mutex.Unlock()
+	}
+}
+
+// Returns the domain name ACM records for a certificate: its subject CN or, if it has none, its first subject alternative name.
+func acmDomainName(certificate *x509.Certificate) string {
+	if certificate.Subject.CommonName == "" && len(certificate.DNSNames) > 0 {
+		return certificate.DNSNames[0]
+	}
+	return certificate.Subject.CommonName
+}
+
+// Returns the domain names of a certificate (its subject CN, if any, and subject alternative names), as compared with those of ACM certificates.
+func certificateDomainNames(certificate *x509.Certificate) []string {
+	domainNames := append([]string{}, certificate.DNSNames...)
+	if certificate.Subject.CommonName != "" {
+		domainNames = append(domainNames, certificate.Subject.CommonName)
+	}
+	return domainNames
+}
+
+// Returns the domain name in a form suitable for comparison (DNS names are case-insensitive, and may be written fully-qualified with a trailing dot.) Wildcard labels are compared literally, so '*.example.com' matches only '*.example.com'.
+func normalizeDomainName(domainName string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domainName), "."))
+}
+
+func domainNameSet(domainNames []string) map[string]bool {
+	set := map[string]bool{}
+	for _, domainName := range domainNames {
+		if normalized := normalizeDomainName(domainName); normalized != "" {
+			set[normalized] = true
+		}
+	}
+	return set
+}
+
+// Returns true if both lists hold the same domain names, ignoring order, duplicates, case and any trailing dot.
+func sameDomainNames(a []string, b []string) bool {
+	aSet, bSet := domainNameSet(a), domainNameSet(b)
+	if len(aSet) != len(bSet) {
+		return false
+	}
+	for domainName := range aSet {
+		if !bSet[domainName] {
+			return false
+		}
+	}
+	return true
+}
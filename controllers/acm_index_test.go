@@ -0,0 +1,88 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+package controllers
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+)
+
+// FakeACMService that counts DescribeCertificate calls.
+type countingACMService struct {
+	*FakeACMService
+	describeCalls int32
+}
+
+func (c *countingACMService) DescribeCertificate(ctx context.Context, params *acm.DescribeCertificateInput, optFns ...func(*acm.Options)) (*acm.DescribeCertificateOutput, error) {
+	atomic.AddInt32(&c.describeCalls, 1)
+	return c.FakeACMService.DescribeCertificate(ctx, params, optFns...)
+}
+
+// Imports the certificate into the fake, returning its ARN.
+func importTestCertificate(t *testing.T, acmClient ACMService, certificate *testCertificate) string {
+	t.Helper()
+	output, err := acmClient.ImportCertificate(context.Background(), &acm.ImportCertificateInput{
+		Certificate: []byte(certificate.PEM),
+		PrivateKey:  []byte(testKeyPEM(t, certificate.key)),
+	})
+	if err != nil {
+		t.Fatalf("Could not import certificate: %s", err)
+	}
+	return aws.ToString(output.CertificateArn)
+}
+
+// Only certificates listed under the certificate's ACM domain name are described, and requested certificates that are not issued are not listed at all.
+func TestFindByDomainsDescribesOnlyCandidates(t *testing.T) {
+	ctx := context.Background()
+
+	acmClient := &countingACMService{FakeACMService: NewFakeACMService(testRegion, testAccountId)}
+	index := &acmCertificateIndex{scopes: map[string]*acmScopeIndex{}}
+	scope := acmIndexScope("", testRegion)
+
+	root := newTestRoot(t, "Test Root")
+	leaf := root.issueLeaf(t, newTestKey(t), "www.example.test", "example.test")
+	certificateArn := importTestCertificate(t, acmClient, leaf)
+
+	// Certificates for the same names, listed under another domain name, and for other names.
+	importTestCertificate(t, acmClient, root.issueLeaf(t, newTestKey(t), "example.test", "www.example.test"))
+	for _, domainName := range []string{"api.example.test", "mail.example.test", "other.test"} {
+		importTestCertificate(t, acmClient, root.issueLeaf(t, newTestKey(t), domainName))
+	}
+
+	// A requested certificate for the same domain name, pending validation.
+	if _, err := acmClient.RequestCertificate(ctx, &acm.RequestCertificateInput{DomainName: aws.String("www.example.test")}); err != nil {
+		t.Fatalf("Could not request certificate: %s", err)
+	}
+
+	matches, err := index.FindByDomains(ctx, acmClient, scope, acmDomainName(leaf.x509), certificateDomainNames(leaf.x509))
+	if err != nil {
+		t.Fatalf("Could not search index: %s", err)
+	}
+	if len(matches) != 1 || matches[0].CertificateArn != certificateArn {
+		t.Errorf("Found %v, expected only '%s'.", matches, certificateArn)
+	}
+	if calls := atomic.LoadInt32(&acmClient.describeCalls); calls != 1 {
+		t.Errorf("Made %d DescribeCertificate calls, expected 1.", calls)
+	}
+	if len(index.scope(scope).entries) != 5 {
+		t.Errorf("Indexed %d certificates, expected the 5 imported certificates.", len(index.scope(scope).entries))
+	}
+
+	// Described entries are not described again.
+	if _, err := index.FindByDomains(ctx, acmClient, scope, acmDomainName(leaf.x509), certificateDomainNames(leaf.x509)); err != nil {
+		t.Fatalf("Could not search index: %s", err)
+	}
+	if calls := atomic.LoadInt32(&acmClient.describeCalls); calls != 1 {
+		t.Errorf("Made %d DescribeCertificate calls, expected 1.", calls)
+	}
+}
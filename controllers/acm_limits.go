@@ -0,0 +1,93 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Validation of certificates against the constraints that ACM (and the AWS services that use ACM certificates) place on imports, so that a certificate ACM would reject is reported precisely before ACM is called, rather than as an ACM ValidationException.
+
+const (
+	// Maximum sizes of the PEM-encoded certificate, chain and private key accepted by ACM ImportCertificate.
+	acmMaxCertificateBytes = 32 * 1024
+	acmMaxChainBytes       = 2 * 1024 * 1024
+	acmMaxPrivateKeyBytes  = 5 * 1024
+
+	// Maximum validity period of publicly trusted TLS certificates (398 days, i.e. about 13 months.) Certificates valid for longer are rejected by browsers, so are only suitable for private use.
+	maxPublicCertificateValidity = 398 * 24 * time.Hour
+
+	// Number of intermediates beyond which a chain is reported as unusually long (since every intermediate is sent in each TLS handshake.)
+	maxRecommendedIntermediates = 4
+)
+
+// acmLimitError is returned when ACM would reject the import of a certificate (e.g. because it is too large, or is not an X.509 v3 certificate.) Such errors are not resolved by retrying.
+type acmLimitError struct {
+	violations []string
+}
+
+func (e *acmLimitError) Error() string {
+	return strings.Join(e.violations, " ")
+}
+
+// CheckACMLimits returns an acmLimitError if ACM would reject the import of the certificate, together with warnings describing features of the certificate that ACM accepts, but which some clients or integrated services reject (e.g. a validity period longer than 13 months, or a SHA-1 signature.)
+func (r *SecretReconciler) CheckACMLimits(certificateDetails *CertificateDetails) ([]string, error) {
+
+	leaf := certificateDetails.Certificate.x509
+	violations := []string{}
+	warnings := []string{}
+
+	if leaf.Version != 3 {
+		violations = append(violations, fmt.Sprintf("Certificate '%s' is an X.509 version %d certificate: ACM only imports version 3 certificates.", leaf.Subject.CommonName, leaf.Version))
+	}
+	if size := len(certificateDetails.Certificate.PEM); size > acmMaxCertificateBytes {
+		violations = append(violations, fmt.Sprintf("Certificate '%s' is %d bytes: ACM accepts certificates of at most %d bytes.", leaf.Subject.CommonName, size, acmMaxCertificateBytes))
+	}
+	if chainPEM := r.CertificateWrapperArrayToPEM(certificateDetails.Intermediates); chainPEM != nil && len(*chainPEM) > acmMaxChainBytes {
+		violations = append(violations, fmt.Sprintf("Certificate chain is %d bytes: ACM accepts chains of at most %d bytes.", len(*chainPEM), acmMaxChainBytes))
+	}
+	if size := len(certificateDetails.PrivateKey); size > acmMaxPrivateKeyBytes {
+		violations = append(violations, fmt.Sprintf("Private key is %d bytes: ACM accepts private keys of at most %d bytes.", size, acmMaxPrivateKeyBytes))
+	}
+	if len(violations) > 0 {
+		return nil, &acmLimitError{violations: violations}
+	}
+
+	if validity := leaf.NotAfter.Sub(leaf.NotBefore); validity > maxPublicCertificateValidity {
+		warnings = append(warnings, fmt.Sprintf("Certificate '%s' is valid for %d days: certificates valid for more than 398 days (13 months) are rejected by browsers if publicly trusted.", leaf.Subject.CommonName, int(validity.Hours()/24)))
+	}
+	if key, ok := leaf.PublicKey.(*rsa.PublicKey); ok && key.N.BitLen() < 2048 {
+		warnings = append(warnings, fmt.Sprintf("Certificate '%s' has an RSA-%d key: keys shorter than 2048 bits are considered weak and are not accepted by all clients.", leaf.Subject.CommonName, key.N.BitLen()))
+	}
+	for _, certificate := range append([]*CertificateWrapper{certificateDetails.Certificate}, certificateDetails.Intermediates...) {
+		if weakSignatureAlgorithm(certificate.x509.SignatureAlgorithm) {
+			warnings = append(warnings, fmt.Sprintf("Certificate '%s' is signed using %s, which is rejected by most clients.", certificate.x509.Subject.CommonName, certificate.x509.SignatureAlgorithm))
+		}
+	}
+	if len(certificateDetails.Intermediates) > maxRecommendedIntermediates {
+		warnings = append(warnings, fmt.Sprintf("Certificate chain holds %d intermediates: chains of more than %d intermediates enlarge every TLS handshake and are not accepted by all clients.", len(certificateDetails.Intermediates), maxRecommendedIntermediates))
+	}
+
+	return warnings, nil
+}
+
+// Returns true if the signature algorithm uses the MD2, MD5 or SHA-1 hash functions.
+func weakSignatureAlgorithm(algorithm x509.SignatureAlgorithm) bool {
+	switch algorithm {
+	case x509.MD2WithRSA, x509.MD5WithRSA, x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// ACM is eventually consistent: a certificate may not be returned by DescribeCertificate (or may be returned with its previous serial number) for a short time after it is imported.
+
+const (
+	// Number of times an imported certificate is described before its import is reported as not yet visible.
+	acmPropagationAttempts = 4
+
+	// Delay before the first re-check of an imported certificate. Doubles on each subsequent attempt.
+	acmPropagationRetryDelay = 1 * time.Second
+
+	// Period after import during which a missing or stale ACM certificate is attributed to propagation delay (rather than to an out-of-band change.)
+	acmPropagationWindow = 5 * time.Minute
+
+	// Delay before re-evaluating an object whose imported certificate was not yet visible.
+	acmPropagationRequeueDelay = 15 * time.Second
+)
+
+// propagationDelayError indicates that an ACM certificate imported by the agent is not yet visible (or not yet current) in ACM. Such errors are transient, and are resolved by retrying shortly.
+type propagationDelayError struct {
+	certificateArn string
+}
+
+func (e *propagationDelayError) Error() string {
+	return fmt.Sprintf("ACM certificate '%s' is not yet available following import: will retry.", e.certificateArn)
+}
+
+// VerifyImportedCertificate confirms that the ACM certificate has the specified serial number, re-checking with increasing delays while ACM catches up with an import. Returns a propagationDelayError if the certificate is still missing (or stale) after acmPropagationAttempts.
+func (r *SecretReconciler) VerifyImportedCertificate(ctx context.Context, acmClient ACMService, certificateArn string, serialNumber *big.Int) error {
+
+	log := log.FromContext(ctx)
+
+	delay := acmPropagationRetryDelay
+	for attempt := 1; ; attempt++ {
+
+		describeOutput, err := acmClient.DescribeCertificate(ctx, &acm.DescribeCertificateInput{CertificateArn: aws.String(certificateArn)})
+		if err != nil && !isACMResourceNotFound(err) {
+			return err
+		}
+		if err == nil {
+			if matches, _ := serialNumberMatches(serialNumber, aws.ToString(describeOutput.Certificate.Serial)); matches {
+				return nil
+			}
+		}
+
+		if attempt >= acmPropagationAttempts {
+			return &propagationDelayError{certificateArn: certificateArn}
+		}
+
+		log.Info(fmt.Sprintf("Imported ACM certificate is not yet available: re-checking in %s...", delay))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
@@ -0,0 +1,82 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+	"github.com/aws/aws-sdk-go-v2/service/acm/types"
+)
+
+// ACMService is the subset of the ACM API used by the agent. It is satisfied by the AWS SDK ACM client (*acm.Client) and by FakeACMService, and allows alternate certificate stores to be substituted for ACM.
+type ACMService interface {
+	AddTagsToCertificate(ctx context.Context, params *acm.AddTagsToCertificateInput, optFns ...func(*acm.Options)) (*acm.AddTagsToCertificateOutput, error)
+	DeleteCertificate(ctx context.Context, params *acm.DeleteCertificateInput, optFns ...func(*acm.Options)) (*acm.DeleteCertificateOutput, error)
+	DescribeCertificate(ctx context.Context, params *acm.DescribeCertificateInput, optFns ...func(*acm.Options)) (*acm.DescribeCertificateOutput, error)
+	ExportCertificate(ctx context.Context, params *acm.ExportCertificateInput, optFns ...func(*acm.Options)) (*acm.ExportCertificateOutput, error)
+	GetCertificate(ctx context.Context, params *acm.GetCertificateInput, optFns ...func(*acm.Options)) (*acm.GetCertificateOutput, error)
+	ImportCertificate(ctx context.Context, params *acm.ImportCertificateInput, optFns ...func(*acm.Options)) (*acm.ImportCertificateOutput, error)
+	ListCertificates(ctx context.Context, params *acm.ListCertificatesInput, optFns ...func(*acm.Options)) (*acm.ListCertificatesOutput, error)
+	ListTagsForCertificate(ctx context.Context, params *acm.ListTagsForCertificateInput, optFns ...func(*acm.Options)) (*acm.ListTagsForCertificateOutput, error)
+	RequestCertificate(ctx context.Context, params *acm.RequestCertificateInput, optFns ...func(*acm.Options)) (*acm.RequestCertificateOutput, error)
+}
+
+var _ ACMService = (*acm.Client)(nil)
+
+// ACMServiceFactory returns the ACMService for the specified region, using the supplied AWS configuration (which carries the credentials of any assumed IAM role.)
+type ACMServiceFactory func(cfg aws.Config, region string) ACMService
+
+// URL of the ACM API endpoint, in place of the standard regional endpoints (e.g. for LocalStack or moto, or partitions with nonstandard endpoints.) Requests are signed for the targeted region. Set before reconcilers are registered with the manager.
+var ACMEndpoint = ""
+
+// If true, the TLS certificate presented by the ACM API endpoint is not verified. Only intended for testing against emulators with self-signed certificates. Set before reconcilers are registered with the manager.
+var ACMEndpointInsecure = false
+
+// NewAWSACMService returns an ACMService backed by the ACM API in the specified region. This is the default ACMServiceFactory.
+func NewAWSACMService(cfg aws.Config, region string) ACMService {
+	regionalCfg := cfg.Copy()
+	regionalCfg.Region = region
+	return acm.NewFromConfig(regionalCfg, func(options *acm.Options) {
+		if ACMEndpoint != "" {
+			options.EndpointResolver = acm.EndpointResolverFromURL(ACMEndpoint)
+		}
+		if ACMEndpointInsecure {
+			options.HTTPClient = awshttp.NewBuildableClient().WithTransportOptions(func(transport *http.Transport) {
+				transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} // #nosec G402 -- explicitly requested (for testing only.)
+			})
+		}
+	})
+}
+
+// Returns true if the error indicates that the requested ACM certificate does not exist.
+func isACMResourceNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+	var notFoundErr *types.ResourceNotFoundException
+	return errors.As(err, &notFoundErr) || strings.Contains(err.Error(), "(ResourceNotFoundException)")
+}
+
+// Returns true if the error indicates that the ACM certificate is in use by another AWS resource (and so cannot be deleted.)
+func isACMResourceInUse(err error) bool {
+	if err == nil {
+		return false
+	}
+	var inUseErr *types.ResourceInUseException
+	return errors.As(err, &inUseErr) || strings.Contains(err.Error(), "(ResourceInUseException)")
+}
@@ -0,0 +1,106 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"Validitron/k8s-acm-certificate-agent/api/v1alpha1"
+)
+
+// ACMAgentConfigReconciler enables runtime configuration of the agent using the singleton ACMAgentConfig, and reports whether its spec is valid (and so applied.)
+// Settings are read by the other reconcilers as they are needed (see currentAgentConfig), so changes apply without restarting the agent.
+type ACMAgentConfigReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+}
+
+func (r *ACMAgentConfigReconciler) SetupWithManager(mgr ctrl.Manager) error {
+
+	// Settings are read from the manager's cache, which is kept current without querying the API server on each use.
+	agentConfigReader = mgr.GetCache()
+
+	// Tells the controller which object type this reconciler will handle.
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("acmagentconfig").
+		For(&v1alpha1.ACMAgentConfig{}).
+		WithOptions(controller.Options{RateLimiter: newRateLimiter(0)}).
+		WithLogConstructor(buildLogConstructor(mgr, "acmagentconfig-reconciler", v1alpha1.GroupVersion.Group, "ACMAgentConfig")). // When multiple controllers running with a single manager, the log auto-constructor does not work. Therefore we must do manually.
+		Complete(r)
+}
+
+func (r *ACMAgentConfigReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+
+	log := log.FromContext(ctx)
+
+	agentConfig := &v1alpha1.ACMAgentConfig{}
+	if err := r.Get(ctx, req.NamespacedName, agentConfig); err != nil {
+		if !k8serr.IsNotFound(err) {
+			log.Error(err, "Unable to retrieve ACMAgentConfig.")
+		} else if req.Name == v1alpha1.ACMAgentConfigName {
+			log.Info("ACMAgentConfig removed: environment configuration applies.")
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	log.V(1).Info(fmt.Sprintf("Processing ACMAgentConfig %s...", req.Name))
+
+	condition := metav1.Condition{
+		Type:               v1alpha1.ConditionApplied,
+		Status:             metav1.ConditionTrue,
+		Reason:             eventReasonConfigApplied,
+		Message:            "Configuration has been applied.",
+		ObservedGeneration: agentConfig.Generation,
+	}
+	if agentConfig.Name != v1alpha1.ACMAgentConfigName {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "Ignored"
+		condition.Message = fmt.Sprintf("Only the ACMAgentConfig named '%s' is read by the agent.", v1alpha1.ACMAgentConfigName)
+	} else if _, err := parseAgentConfigSpec(&agentConfig.Spec); err != nil {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = eventReasonConfigInvalid
+		condition.Message = fmt.Sprintf("Configuration is invalid and has not been applied (environment configuration applies): %s", err)
+	}
+
+	existing := meta.FindStatusCondition(agentConfig.Status.Conditions, condition.Type)
+	if existing != nil && existing.Status == condition.Status && existing.Reason == condition.Reason && existing.Message == condition.Message && agentConfig.Status.ObservedGeneration == agentConfig.Generation {
+		return ctrl.Result{}, nil
+	}
+
+	log.Info(condition.Message)
+	eventType := corev1.EventTypeNormal
+	if condition.Status == metav1.ConditionFalse {
+		eventType = corev1.EventTypeWarning
+	}
+	r.Recorder.Event(agentConfig, eventType, condition.Reason, condition.Message)
+
+	meta.SetStatusCondition(&agentConfig.Status.Conditions, condition)
+	agentConfig.Status.ObservedGeneration = agentConfig.Generation
+	if err := r.Status().Update(ctx, agentConfig); err != nil {
+		log.Error(err, "Failed to update ACMAgentConfig status.")
+		return requeueWithBackoff(err)
+	}
+
+	return ctrl.Result{}, nil
+}
@@ -0,0 +1,332 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+	"github.com/aws/aws-sdk-go-v2/service/acm/types"
+	"github.com/youmark/pkcs8"
+	corev1 "k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"Validitron/k8s-acm-certificate-agent/api/v1alpha1"
+)
+
+const (
+	// Interval at which ACM is polled for renewal of exported certificates. (ACM renews certificates in place, so the ARN does not change.)
+	certificateExportRefreshInterval = 1 * time.Hour
+)
+
+// ACMCertificateExportReconciler exports certificates (and their private keys) from ACM into TLS Secrets on behalf of ACMCertificateExports, re-exporting them whenever ACM renews the certificate.
+// This is the reverse of SecretReconciler: ACM is the source of truth and the Secret is the copy.
+type ACMCertificateExportReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// Maximum number of objects reconciled in parallel (default 1.)
+	MaxConcurrentReconciles int
+
+	// Delay before the first retry of an object whose reconciliation fails (doubling on each subsequent failure.) Defaults to 1 second.
+	RequeueDelay time.Duration
+
+	// Retries of failed objects, parking those that exceed MaxRetries. Set by SetupWithManager.
+	retries *retryLimiter
+}
+
+func (r *ACMCertificateExportReconciler) SetupWithManager(mgr ctrl.Manager) error {
+
+	r.retries = newRetryLimiter("acmcertificateexport", r.RequeueDelay)
+
+	// Tells the controller which object type this reconciler will handle. Changes to (or deletion of) owned Secrets also trigger reconciliation.
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("acmcertificateexport").
+		For(&v1alpha1.ACMCertificateExport{}).
+		Owns(&corev1.Secret{}).
+		WithOptions(controller.Options{RateLimiter: r.retries.rateLimiter, MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
+		WithLogConstructor(buildLogConstructor(mgr, "acmcertificateexport-reconciler", v1alpha1.GroupVersion.Group, "ACMCertificateExport")). // When multiple controllers running with a single manager, the log auto-constructor does not work. Therefore we must do manually.
+		Complete(r)
+}
+
+func (r *ACMCertificateExportReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+
+	log := log.FromContext(ctx)
+
+	export := &v1alpha1.ACMCertificateExport{}
+	if err := r.Get(ctx, req.NamespacedName, export); err != nil {
+		if !k8serr.IsNotFound(err) {
+			log.Error(err, "Unable to retrieve ACMCertificateExport.")
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	log.V(1).Info(fmt.Sprintf("Processing ACMCertificateExport %s...", req.NamespacedName))
+
+	// Object is marked for deletion - nothing to do (the Secret is garbage collected by K8s; the ACM certificate is never removed.)
+	if !export.ObjectMeta.DeletionTimestamp.IsZero() {
+		log.Info("ACMCertificateExport is marked for deletion: nothing to do.")
+		return ctrl.Result{}, nil
+	}
+
+	// Objects whose retries have been exhausted are not reconciled again until they change.
+	if r.retries.Parked(req, export.ResourceVersion) {
+		log.Info("ACMCertificateExport is parked (retries exhausted): nothing to do.")
+		return ctrl.Result{}, nil
+	}
+	exhausted := r.retries.Exhausted(req)
+
+	var result ctrl.Result
+	var exportErr error
+	if exhausted {
+		log.Info(retriesExhaustedMessage())
+		r.Recorder.Event(export, corev1.EventTypeWarning, eventReasonRetriesExhausted, retriesExhaustedMessage())
+		r.SetCondition(export, v1alpha1.ConditionExported, metav1.ConditionFalse, eventReasonRetriesExhausted, retriesExhaustedMessage())
+	} else {
+		result, exportErr = r.ExportCertificate(ctx, export)
+	}
+
+	export.Status.ObservedGeneration = export.Generation
+	if err := r.Status().Update(ctx, export); err != nil {
+		log.Error(err, "Failed to update ACMCertificateExport status.")
+		return requeueWithBackoff(err)
+	}
+
+	// Read after the status is updated, so that updating it does not end the parking.
+	if exhausted {
+		r.retries.Park(req, export.ResourceVersion)
+	}
+
+	return result, exportErr
+}
+
+// ExportCertificate ensures that the ACMCertificateExport's Secret holds the current version of the ACM certificate, recording the outcome in the status of the ACMCertificateExport (which is not persisted.)
+func (r *ACMCertificateExportReconciler) ExportCertificate(ctx context.Context, export *v1alpha1.ACMCertificateExport) (ctrl.Result, error) {
+
+	log := log.FromContext(ctx)
+
+	secret := &corev1.Secret{}
+	if err := r.Get(ctx, k8stypes.NamespacedName{Namespace: export.Namespace, Name: export.Spec.SecretName}, secret); err != nil {
+		if !k8serr.IsNotFound(err) {
+			log.Error(err, "Unable to retrieve Secret.")
+			return ctrl.Result{}, err
+		}
+		secret = nil
+	}
+
+	if secret != nil && !metav1.IsControlledBy(secret, export) {
+		r.SetCondition(export, v1alpha1.ConditionExported, metav1.ConditionFalse, "SecretConflict", fmt.Sprintf("Secret '%s' already exists and is not owned by this ACMCertificateExport.", export.Spec.SecretName))
+		return ctrl.Result{}, nil
+	}
+
+	certificateArn, err := arn.Parse(export.Spec.CertificateArn)
+	if err != nil {
+		r.SetCondition(export, v1alpha1.ConditionExported, metav1.ConditionFalse, "InvalidCertificateArn", fmt.Sprintf("'%s' is not a valid ACM certificate ARN.", export.Spec.CertificateArn))
+		return ctrl.Result{}, nil
+	}
+
+	cfg, err := loadAWSConfig(ctx, export.Spec.RoleArn)
+	if err != nil {
+		log.Error(err, "Failed to load AWS configuration.")
+		r.SetCondition(export, v1alpha1.ConditionExported, metav1.ConditionFalse, "AWSConfigurationError", err.Error())
+		return ctrl.Result{}, err
+	}
+	if err := checkARNPartition(certificateArn, cfg.Region); err != nil {
+		r.SetCondition(export, v1alpha1.ConditionExported, metav1.ConditionFalse, "InvalidCertificateArn", err.Error())
+		return ctrl.Result{}, nil
+	}
+
+	acmClient := NewAWSACMService(cfg, certificateArn.Region)
+
+	describeOutput, err := acmClient.DescribeCertificate(ctx, &acm.DescribeCertificateInput{CertificateArn: aws.String(export.Spec.CertificateArn)})
+	if err != nil {
+		if isACMResourceNotFound(err) {
+			r.SetCondition(export, v1alpha1.ConditionExported, metav1.ConditionFalse, "CertificateNotFound", fmt.Sprintf("ACM certificate '%s' does not exist.", export.Spec.CertificateArn))
+			return ctrl.Result{RequeueAfter: certificateExportRefreshInterval}, nil
+		}
+		log.Error(err, "ACM certificate lookup failed.")
+		r.SetCondition(export, v1alpha1.ConditionExported, metav1.ConditionFalse, "ACMError", err.Error())
+		return requeueWithBackoff(err)
+	}
+
+	if describeOutput.Certificate.Status != types.CertificateStatusIssued {
+		r.SetCondition(export, v1alpha1.ConditionExported, metav1.ConditionFalse, "NotIssued", fmt.Sprintf("ACM certificate status is '%s'.", describeOutput.Certificate.Status))
+		return ctrl.Result{RequeueAfter: certificateExportRefreshInterval}, nil
+	}
+
+	// Skip the export if the Secret already holds the current certificate (ACM charges for each export of a private certificate.)
+	secretReconciler := &SecretReconciler{Client: r.Client, Scheme: r.Scheme}
+	if secret != nil {
+		certificateDetails, err := secretReconciler.ParseCertificateDetails(secret)
+		if err == nil {
+			matches, _, err := secretReconciler.MatchACMCertificate(ctx, acmClient, export.Spec.CertificateArn, aws.ToString(describeOutput.Certificate.Serial), certificateDetails.Certificate.x509)
+			if err != nil {
+				log.Error(err, "ACM certificate body lookup failed.")
+			}
+			if matches {
+				r.SetCertificateStatus(export, certificateDetails)
+				r.SetCondition(export, v1alpha1.ConditionExported, metav1.ConditionTrue, "Exported", "Secret holds the current ACM certificate.")
+				return ctrl.Result{RequeueAfter: certificateExportRefreshInterval}, nil
+			}
+		}
+	}
+
+	// The private key is returned encrypted with a single-use passphrase.
+	passphraseBytes := make([]byte, 32)
+	if _, err := rand.Read(passphraseBytes); err != nil {
+		return ctrl.Result{}, err
+	}
+	passphrase := []byte(hex.EncodeToString(passphraseBytes))
+
+	log.Info(fmt.Sprintf("Exporting ACM certificate '%s'...", export.Spec.CertificateArn))
+	exportOutput, err := acmClient.ExportCertificate(ctx, &acm.ExportCertificateInput{
+		CertificateArn: aws.String(export.Spec.CertificateArn),
+		Passphrase:     passphrase,
+	})
+	if err != nil {
+		log.Error(err, "ACM certificate export failed.")
+		r.SetCondition(export, v1alpha1.ConditionExported, metav1.ConditionFalse, "ExportFailed", err.Error())
+		return requeueWithBackoff(err)
+	}
+
+	privateKeyPEM, err := r.DecryptPrivateKey(aws.ToString(exportOutput.PrivateKey), passphrase)
+	if err != nil {
+		log.Error(err, "Could not decrypt exported private key.")
+		r.SetCondition(export, v1alpha1.ConditionExported, metav1.ConditionFalse, "InvalidPrivateKey", err.Error())
+		return ctrl.Result{}, nil
+	}
+
+	chainPEM := strings.TrimSpace(aws.ToString(exportOutput.CertificateChain))
+	certificatePEM := strings.TrimSpace(aws.ToString(exportOutput.Certificate)) + "\n"
+	if chainPEM != "" {
+		certificatePEM += chainPEM + "\n"
+	}
+
+	if secret == nil {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: export.Namespace,
+				Name:      export.Spec.SecretName,
+			},
+			Type: corev1.SecretTypeTLS,
+		}
+		if err := ctrl.SetControllerReference(export, secret, r.Scheme); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	secret.Data = map[string][]byte{
+		corev1.TLSCertKey:       []byte(certificatePEM),
+		corev1.TLSPrivateKeyKey: privateKeyPEM,
+	}
+	if chainPEM != "" {
+		secret.Data["ca.crt"] = []byte(chainPEM + "\n")
+	}
+
+	if secret.ResourceVersion == "" {
+		log.Info(fmt.Sprintf("Creating Secret '%s'...", namespacedName(secret.ObjectMeta)))
+		err = r.Create(ctx, secret)
+	} else {
+		log.Info(fmt.Sprintf("Updating Secret '%s'...", namespacedName(secret.ObjectMeta)))
+		err = r.Update(ctx, secret)
+	}
+	if err != nil {
+		log.Error(err, "Failed to write Secret.")
+		r.SetCondition(export, v1alpha1.ConditionExported, metav1.ConditionFalse, "SecretWriteFailed", err.Error())
+		return requeueWithBackoff(err)
+	}
+
+	certificateDetails, err := secretReconciler.ParseCertificateDetails(secret)
+	if err != nil {
+		log.Error(err, "Could not parse exported certificate.")
+		r.SetCondition(export, v1alpha1.ConditionExported, metav1.ConditionFalse, "InvalidCertificate", err.Error())
+		return ctrl.Result{}, nil
+	}
+
+	if meta.IsStatusConditionTrue(export.Status.Conditions, v1alpha1.ConditionExported) {
+		// Re-exports following renewal do not change the condition, so would otherwise go unrecorded.
+		r.Recorder.Event(export, corev1.EventTypeNormal, eventReasonExported, fmt.Sprintf("Renewed ACM certificate '%s' exported.", export.Spec.CertificateArn))
+	}
+	r.SetCertificateStatus(export, certificateDetails)
+	r.SetCondition(export, v1alpha1.ConditionExported, metav1.ConditionTrue, "Exported", "Secret holds the current ACM certificate.")
+
+	return ctrl.Result{RequeueAfter: certificateExportRefreshInterval}, nil
+}
+
+// DecryptPrivateKey decrypts a PEM-encoded, encrypted PKCS#8 private key (as returned by ACM), returning the unencrypted PKCS#8 key in PEM format.
+func (r *ACMCertificateExportReconciler) DecryptPrivateKey(encryptedPEM string, passphrase []byte) ([]byte, error) {
+
+	block, _ := pem.Decode([]byte(encryptedPEM))
+	if block == nil {
+		return nil, fmt.Errorf("Could not decode exported private key.")
+	}
+
+	privateKey, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}), nil
+}
+
+// SetCertificateStatus records the serial number and expiry date of the exported certificate in the status of the ACMCertificateExport.
+func (r *ACMCertificateExportReconciler) SetCertificateStatus(export *v1alpha1.ACMCertificateExport, certificateDetails CertificateDetails) {
+
+	expiryDate := metav1.NewTime(certificateDetails.Certificate.x509.NotAfter)
+
+	export.Status.SerialNumber = (&SecretReconciler{}).FormatX509SerialNumber(certificateDetails.Certificate.x509.SerialNumber)
+	export.Status.ExpiryDate = &expiryDate
+}
+
+// SetCondition sets the specified condition in the status of the ACMCertificateExport, recording an Event if it has changed.
+func (r *ACMCertificateExportReconciler) SetCondition(export *v1alpha1.ACMCertificateExport, conditionType string, status metav1.ConditionStatus, reason string, message string) {
+
+	// Record an Event whenever a condition changes.
+	existing := meta.FindStatusCondition(export.Status.Conditions, conditionType)
+	if existing == nil || existing.Status != status || existing.Reason != reason {
+		eventType := corev1.EventTypeNormal
+		if status == metav1.ConditionFalse {
+			eventType = corev1.EventTypeWarning
+		}
+		r.Recorder.Event(export, eventType, reason, message)
+	}
+
+	meta.SetStatusCondition(&export.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: export.Generation,
+	})
+}
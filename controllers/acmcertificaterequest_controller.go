@@ -0,0 +1,373 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+	"github.com/aws/aws-sdk-go-v2/service/acm/types"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"Validitron/k8s-acm-certificate-agent/api/v1alpha1"
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// ACMCertificateRequestReconciler requests DNS-validated public certificates from ACM on behalf of ACMCertificateRequests. (DNS validation records are managed by ValidationRecordReconciler.)
+// Unlike imported certificates, these are issued and renewed by ACM itself, so no cert-manager Certificate or TLS Secret is involved.
+type ACMCertificateRequestReconciler struct {
+	client.Client
+	Scheme                    *runtime.Scheme
+	Recorder                  record.EventRecorder
+	EnableCertificateDeletion bool
+
+	// Maximum number of objects reconciled in parallel (default 1.)
+	MaxConcurrentReconciles int
+
+	// Delay before the first retry of an object whose reconciliation fails (doubling on each subsequent failure.) Defaults to 1 second.
+	RequeueDelay time.Duration
+
+	// Retries of failed objects, parking those that exceed MaxRetries. Set by SetupWithManager.
+	retries *retryLimiter
+}
+
+func (r *ACMCertificateRequestReconciler) SetupWithManager(mgr ctrl.Manager) error {
+
+	r.retries = newRetryLimiter("acmcertificaterequest", r.RequeueDelay)
+
+	// Tells the controller which object type this reconciler will handle.
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("acmcertificaterequest").
+		For(&v1alpha1.ACMCertificateRequest{}).
+		WithOptions(controller.Options{RateLimiter: r.retries.rateLimiter, MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
+		WithLogConstructor(buildLogConstructor(mgr, "acmcertificaterequest-reconciler", v1alpha1.GroupVersion.Group, "ACMCertificateRequest")). // When multiple controllers running with a single manager, the log auto-constructor does not work. Therefore we must do manually.
+		Complete(r)
+}
+
+func (r *ACMCertificateRequestReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+
+	log := log.FromContext(ctx)
+	finalizerID := global.DOMAIN_NAME + "/" + global.PACKAGE_NAME
+
+	certificateRequest := &v1alpha1.ACMCertificateRequest{}
+	if err := r.Get(ctx, req.NamespacedName, certificateRequest); err != nil {
+		if !k8serr.IsNotFound(err) {
+			log.Error(err, "Unable to retrieve ACMCertificateRequest.")
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	log.V(1).Info(fmt.Sprintf("Processing ACMCertificateRequest %s...", req.NamespacedName))
+
+	// Changes made to ACM are recorded in the audit trail against this object.
+	ctx = withAuditSubject(ctx, "ACMCertificateRequest", certificateRequest)
+
+	// Object is marked for deletion. If requested, remove the ACM certificate (best effort: failures are logged but do not block deletion.)
+	if !certificateRequest.ObjectMeta.DeletionTimestamp.IsZero() {
+
+		if containsString(certificateRequest.ObjectMeta.Finalizers, finalizerID) {
+
+			if r.EnableCertificateDeletion && certificateRequest.Spec.DeletePolicy == global.DELETE_POLICY_DELETE && certificateRequest.Status.CertificateArn != "" {
+				log.Info("Removing unused ACM certificate...")
+				cfg, err := loadAWSConfig(ctx, certificateRequest.Spec.RoleArn)
+				if err == nil {
+					err = deleteACMCertificates(ctx, NewAWSACMService, cfg, []string{certificateRequest.Status.CertificateArn})
+				}
+				if err != nil {
+					log.Error(err, "ACM certificate deletion failed.")
+					r.Recorder.Event(certificateRequest, corev1.EventTypeWarning, eventReasonACMError, fmt.Sprintf("ACM certificate deletion failed: %s", err))
+				}
+			}
+
+			certificateRequest.ObjectMeta.Finalizers = removeString(certificateRequest.ObjectMeta.Finalizers, finalizerID)
+			if err := r.Update(ctx, certificateRequest); err != nil {
+				return requeueWithBackoff(errors.Wrap(err, "Could not remove finalizer from ACMCertificateRequest."))
+			}
+		}
+
+		log.Info("ACMCertificateRequest is marked for deletion: clean up complete.")
+		return ctrl.Result{}, nil
+	}
+
+	// Register finalizer if it does not exist
+	if !containsString(certificateRequest.ObjectMeta.Finalizers, finalizerID) {
+		certificateRequest.ObjectMeta.Finalizers = append(certificateRequest.ObjectMeta.Finalizers, finalizerID)
+		if err := r.Update(ctx, certificateRequest); err != nil {
+			return requeueWithBackoff(errors.Wrap(err, "Could not add finalizer to ACMCertificateRequest."))
+		}
+	}
+
+	// Objects whose retries have been exhausted are not reconciled again until they change.
+	if r.retries.Parked(req, certificateRequest.ResourceVersion) {
+		log.Info("ACMCertificateRequest is parked (retries exhausted): nothing to do.")
+		return ctrl.Result{}, nil
+	}
+	exhausted := r.retries.Exhausted(req)
+
+	var result ctrl.Result
+	var requestErr error
+	if exhausted {
+		log.Info(retriesExhaustedMessage())
+		r.Recorder.Event(certificateRequest, corev1.EventTypeWarning, eventReasonRetriesExhausted, retriesExhaustedMessage())
+		r.SetCondition(certificateRequest, v1alpha1.ConditionIssued, metav1.ConditionFalse, eventReasonRetriesExhausted, retriesExhaustedMessage())
+	} else {
+		result, requestErr = r.RequestCertificate(ctx, certificateRequest)
+	}
+
+	certificateRequest.Status.ObservedGeneration = certificateRequest.Generation
+	if err := r.Status().Update(ctx, certificateRequest); err != nil {
+		log.Error(err, "Failed to update ACMCertificateRequest status.")
+		return requeueWithBackoff(err)
+	}
+
+	// Read after the status is updated, so that updating it does not end the parking.
+	if exhausted {
+		r.retries.Park(req, certificateRequest.ResourceVersion)
+	}
+
+	return result, requestErr
+}
+
+// RequestCertificate ensures that ACM holds a certificate matching the ACMCertificateRequest and drives it through DNS validation, recording the outcome in the status of the ACMCertificateRequest (which is not persisted.)
+func (r *ACMCertificateRequestReconciler) RequestCertificate(ctx context.Context, certificateRequest *v1alpha1.ACMCertificateRequest) (ctrl.Result, error) {
+
+	log := log.FromContext(ctx)
+
+	cfg, err := loadAWSConfig(ctx, certificateRequest.Spec.RoleArn)
+	if err != nil {
+		log.Error(err, "Failed to load AWS configuration.")
+		r.SetCondition(certificateRequest, v1alpha1.ConditionIssued, metav1.ConditionFalse, "AWSConfigurationError", err.Error())
+		return ctrl.Result{}, err
+	}
+
+	region := certificateRequest.Spec.Region
+	if region == "" {
+		region = cfg.Region
+	}
+	acmClient := NewAWSACMService(cfg, region)
+
+	// Check the previously requested certificate (if any) still exists and covers the requested domains. ACM certificates are immutable, so a change of domains requires a new certificate.
+	var acmCertificate *types.CertificateDetail
+	replacedCertificateArn := ""
+	if certificateRequest.Status.CertificateArn != "" {
+		describeOutput, err := acmClient.DescribeCertificate(ctx, &acm.DescribeCertificateInput{CertificateArn: aws.String(certificateRequest.Status.CertificateArn)})
+		if err != nil {
+			if !isACMResourceNotFound(err) {
+				log.Error(err, "ACM certificate lookup failed.")
+				return requeueWithBackoff(err)
+			}
+			log.Info(fmt.Sprintf("ACM certificate '%s' no longer exists: requesting a new certificate.", certificateRequest.Status.CertificateArn))
+		} else if !r.DomainNamesMatch(describeOutput.Certificate, certificateRequest.DomainNames()) {
+			log.Info(fmt.Sprintf("Requested domain names have changed: replacing ACM certificate '%s'.", certificateRequest.Status.CertificateArn))
+			replacedCertificateArn = certificateRequest.Status.CertificateArn
+		} else {
+			acmCertificate = describeOutput.Certificate
+		}
+	}
+
+	// Adopt an existing certificate awaiting validation for the same domain names, if there is one (e.g. if the ACMCertificateRequest has been recreated.)
+	if acmCertificate == nil && replacedCertificateArn == "" {
+		discoveredCertificateArn, err := r.FindPendingCertificate(ctx, acmClient, certificateRequest)
+		if err != nil {
+			log.Error(err, "Failed to enumerate existing ACM certificates.")
+			return requeueWithBackoff(err)
+		}
+		if discoveredCertificateArn != "" {
+			log.Info(fmt.Sprintf("Adopting existing ACM certificate '%s' awaiting validation.", discoveredCertificateArn))
+			certificateRequest.Status.CertificateArn = discoveredCertificateArn
+			r.Recorder.Event(certificateRequest, corev1.EventTypeNormal, eventReasonDiscovered, fmt.Sprintf("Existing ACM certificate '%s' adopted.", discoveredCertificateArn))
+			return requeueWithBackoff(nil)
+		}
+	}
+
+	if acmCertificate == nil {
+
+		domainNames := certificateRequest.DomainNames()
+
+		tags := (&SecretReconciler{}).CreateStandardTagArray(nil, certificateRequest.Namespace, certificateRequest.Name, nil)
+		for key, value := range certificateRequest.Spec.Tags {
+			tags = append(tags, types.Tag{Key: aws.String(key), Value: aws.String(value)})
+		}
+
+		log.Info(fmt.Sprintf("Requesting ACM certificate for '%s'...", strings.Join(domainNames, "', '")))
+		requestOutput, err := acmClient.RequestCertificate(ctx, &acm.RequestCertificateInput{
+			DomainName:              aws.String(certificateRequest.Spec.DomainName),
+			SubjectAlternativeNames: domainNames,
+			ValidationMethod:        types.ValidationMethodDns,
+			IdempotencyToken:        aws.String(r.IdempotencyToken(certificateRequest)),
+			Tags:                    tags,
+		})
+		auditRecord := AuditRecord{Action: auditActionRequest, Region: region, Tags: acmTagMap(tags)}
+		if err == nil {
+			auditRecord.CertificateArn = aws.ToString(requestOutput.CertificateArn)
+		}
+		recordAudit(ctx, auditRecord, err)
+		if err != nil {
+			log.Error(err, "ACM certificate request failed.")
+			r.SetCondition(certificateRequest, v1alpha1.ConditionIssued, metav1.ConditionFalse, "RequestFailed", err.Error())
+			return requeueWithBackoff(err)
+		}
+
+		certificateRequest.Status.CertificateArn = *requestOutput.CertificateArn
+		certificateRequest.Status.CertificateStatus = ""
+		certificateRequest.Status.ValidationRecords = nil
+		certificateRequest.Status.ExpiryDate = nil
+		meta.RemoveStatusCondition(&certificateRequest.Status.Conditions, v1alpha1.ConditionValidationRecordsPublished)
+		meta.RemoveStatusCondition(&certificateRequest.Status.Conditions, v1alpha1.ConditionValidated)
+		r.Recorder.Event(certificateRequest, corev1.EventTypeNormal, eventReasonRequested, fmt.Sprintf("ACM certificate requested as '%s'.", *requestOutput.CertificateArn))
+
+		// If requested, remove the superseded certificate (best effort: certificates still in use are retained.)
+		if replacedCertificateArn != "" && r.EnableCertificateDeletion && certificateRequest.Spec.DeletePolicy == global.DELETE_POLICY_DELETE {
+			if err := deleteACMCertificates(ctx, NewAWSACMService, cfg, []string{replacedCertificateArn}); err != nil {
+				log.Error(err, "ACM certificate deletion failed.")
+				r.Recorder.Event(certificateRequest, corev1.EventTypeWarning, eventReasonACMError, fmt.Sprintf("ACM certificate deletion failed: %s", err))
+			}
+		}
+
+		// ACM populates validation records asynchronously, so check back shortly.
+		r.SetCondition(certificateRequest, v1alpha1.ConditionIssued, metav1.ConditionFalse, "Requested", "Certificate has been requested from ACM.")
+		return requeueWithBackoff(nil)
+	}
+
+	certificateRequest.Status.CertificateStatus = string(acmCertificate.Status)
+	if acmCertificate.NotAfter != nil {
+		certificateRequest.Status.ExpiryDate = &metav1.Time{Time: *acmCertificate.NotAfter}
+	}
+
+	switch acmCertificate.Status {
+
+	case types.CertificateStatusIssued:
+		r.SetCondition(certificateRequest, v1alpha1.ConditionIssued, metav1.ConditionTrue, "Issued", "Certificate has been issued by ACM.")
+		return ctrl.Result{}, nil
+
+	case types.CertificateStatusPendingValidation:
+		r.SetCondition(certificateRequest, v1alpha1.ConditionIssued, metav1.ConditionFalse, "PendingValidation", "Certificate is awaiting DNS validation.")
+		return requeueWithBackoff(nil)
+
+	default:
+		// Terminal states (e.g. FAILED, VALIDATION_TIMED_OUT) require user intervention, such as changing the spec.
+		r.SetCondition(certificateRequest, v1alpha1.ConditionIssued, metav1.ConditionFalse, r.StatusToReason(acmCertificate.Status), fmt.Sprintf("ACM reports certificate status '%s'.", acmCertificate.Status))
+		return ctrl.Result{}, nil
+	}
+}
+
+// DomainNamesMatch returns true if the ACM certificate covers exactly the specified domain names (ignoring order, case and any trailing dot.)
+func (r *ACMCertificateRequestReconciler) DomainNamesMatch(acmCertificate *types.CertificateDetail, domainNames []string) bool {
+	return sameDomainNames(append([]string{aws.ToString(acmCertificate.DomainName)}, acmCertificate.SubjectAlternativeNames...), domainNames)
+}
+
+// FindPendingCertificate returns the ARN of an ACM-issued certificate awaiting validation which covers exactly the domain names requested, and which is not claimed by another ACMCertificateRequest. Returns an empty string if there is no such certificate.
+func (r *ACMCertificateRequestReconciler) FindPendingCertificate(ctx context.Context, acmClient ACMService, certificateRequest *v1alpha1.ACMCertificateRequest) (string, error) {
+
+	certificateRequestList := &v1alpha1.ACMCertificateRequestList{}
+	if err := r.List(ctx, certificateRequestList); err != nil {
+		return "", err
+	}
+	claimedCertificateArns := []string{}
+	for _, item := range certificateRequestList.Items {
+		if item.Status.CertificateArn != "" {
+			claimedCertificateArns = append(claimedCertificateArns, item.Status.CertificateArn)
+		}
+	}
+
+	paginator := acm.NewListCertificatesPaginator(acmClient, &acm.ListCertificatesInput{
+		CertificateStatuses: []types.CertificateStatus{types.CertificateStatusPendingValidation},
+	})
+	for paginator.HasMorePages() {
+		listOutput, err := paginator.NextPage(ctx)
+		if err != nil {
+			return "", err
+		}
+
+		for _, acmCertificateSummary := range listOutput.CertificateSummaryList {
+			if aws.ToString(acmCertificateSummary.DomainName) != certificateRequest.Spec.DomainName || containsString(claimedCertificateArns, aws.ToString(acmCertificateSummary.CertificateArn)) {
+				continue
+			}
+
+			describeOutput, err := acmClient.DescribeCertificate(ctx, &acm.DescribeCertificateInput{CertificateArn: acmCertificateSummary.CertificateArn})
+			if err != nil {
+				return "", err
+			}
+			if describeOutput.Certificate.Type == types.CertificateTypeAmazonIssued && r.DomainNamesMatch(describeOutput.Certificate, certificateRequest.DomainNames()) {
+				return *acmCertificateSummary.CertificateArn, nil
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// IdempotencyToken returns a token which is stable for a given ACMCertificateRequest and set of domain names, so that retried requests do not result in duplicate certificates.
+func (r *ACMCertificateRequestReconciler) IdempotencyToken(certificateRequest *v1alpha1.ACMCertificateRequest) string {
+
+	domainNames := certificateRequest.DomainNames()
+	sort.Strings(domainNames)
+
+	hash := sha256.Sum256([]byte(string(certificateRequest.UID) + "|" + strings.Join(domainNames, ",")))
+
+	// ACM idempotency tokens are limited to 32 alphanumeric characters.
+	return hex.EncodeToString(hash[:])[:32]
+}
+
+// StatusToReason converts an ACM certificate status (e.g. VALIDATION_TIMED_OUT) into a condition reason (e.g. ValidationTimedOut.)
+func (r *ACMCertificateRequestReconciler) StatusToReason(status types.CertificateStatus) string {
+
+	output := ""
+	for _, word := range strings.Split(strings.ToLower(string(status)), "_") {
+		if word == "" {
+			continue
+		}
+		output += strings.ToUpper(word[:1]) + word[1:]
+	}
+
+	if output == "" {
+		return "Unknown"
+	}
+	return output
+}
+
+func (r *ACMCertificateRequestReconciler) SetCondition(certificateRequest *v1alpha1.ACMCertificateRequest, conditionType string, status metav1.ConditionStatus, reason string, message string) {
+
+	// Record an Event whenever a condition changes.
+	existing := meta.FindStatusCondition(certificateRequest.Status.Conditions, conditionType)
+	if existing == nil || existing.Status != status || existing.Reason != reason {
+		eventType := corev1.EventTypeNormal
+		if status == metav1.ConditionFalse && reason != "Requested" && reason != "PendingValidation" {
+			eventType = corev1.EventTypeWarning
+		}
+		r.Recorder.Event(certificateRequest, eventType, reason, message)
+	}
+
+	meta.SetStatusCondition(&certificateRequest.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: certificateRequest.Generation,
+	})
+}
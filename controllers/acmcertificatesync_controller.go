@@ -0,0 +1,380 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+	"github.com/aws/aws-sdk-go-v2/service/acm/types"
+	corev1 "k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"Validitron/k8s-acm-certificate-agent/api/v1alpha1"
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// ACMCertificateSyncReconciler imports the certificate held in the Secret referenced by an ACMCertificateSync into ACM, and reports the outcome in the ACMCertificateSync status.
+// Unlike SecretReconciler, state is held in the ACMCertificateSync rather than as annotations on the Secret.
+type ACMCertificateSyncReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// If true, imports which would exceed the ACM quotas on imported certificates are refused (see SecretReconciler.CheckImportQuotas.)
+	EnableQuotaChecks bool
+
+	// Maximum number of objects reconciled in parallel (default 1.)
+	MaxConcurrentReconciles int
+
+	// Delay before the first retry of an object whose reconciliation fails (doubling on each subsequent failure.) Defaults to 1 second.
+	RequeueDelay time.Duration
+
+	// Retries of failed objects, parking those that exceed MaxRetries. Set by SetupWithManager.
+	retries *retryLimiter
+}
+
+const (
+	acmCertificateSyncSecretNameField = "spec.secretName"
+)
+
+func (r *ACMCertificateSyncReconciler) SetupWithManager(mgr ctrl.Manager) error {
+
+	r.retries = newRetryLimiter("acmcertificatesync", r.RequeueDelay)
+
+	// Index the Secret name so that changes to Secrets can be mapped back to the ACMCertificateSyncs that reference them.
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &v1alpha1.ACMCertificateSync{}, acmCertificateSyncSecretNameField, func(rawObj client.Object) []string {
+		sync := rawObj.(*v1alpha1.ACMCertificateSync)
+		if sync.Spec.SecretName == "" {
+			return nil
+		}
+		return []string{sync.Spec.SecretName}
+	}); err != nil {
+		return err
+	}
+
+	// Tells the controller which object type this reconciler will handle.
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("acmcertificatesync").
+		For(&v1alpha1.ACMCertificateSync{}).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.FindSyncsForSecret)).
+		WithOptions(controller.Options{RateLimiter: r.retries.rateLimiter, MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
+		WithLogConstructor(buildLogConstructor(mgr, "acmcertificatesync-reconciler", v1alpha1.GroupVersion.Group, "ACMCertificateSync")). // When multiple controllers running with a single manager, the log auto-constructor does not work. Therefore we must do manually.
+		Complete(r)
+}
+
+func (r *ACMCertificateSyncReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+
+	log := log.FromContext(ctx)
+
+	sync := &v1alpha1.ACMCertificateSync{}
+	if err := r.Get(ctx, req.NamespacedName, sync); err != nil {
+		if !k8serr.IsNotFound(err) {
+			log.Error(err, "Unable to retrieve ACMCertificateSync.")
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	log.V(1).Info(fmt.Sprintf("Processing ACMCertificateSync %s...", req.NamespacedName))
+
+	// Changes made to ACM are recorded in the audit trail against this object.
+	ctx = withAuditSubject(ctx, "ACMCertificateSync", sync)
+
+	// Object is marked for deletion - nothing to do (the operator never removes synced ACM certificates.)
+	if !sync.ObjectMeta.DeletionTimestamp.IsZero() {
+		log.Info("ACMCertificateSync is marked for deletion: nothing to do.")
+		return ctrl.Result{}, nil
+	}
+
+	// Objects whose retries have been exhausted are not reconciled again until they change.
+	if r.retries.Parked(req, sync.ResourceVersion) {
+		log.Info("ACMCertificateSync is parked (retries exhausted): nothing to do.")
+		return ctrl.Result{}, nil
+	}
+	exhausted := r.retries.Exhausted(req)
+
+	var result ctrl.Result
+	var syncErr error
+	if exhausted {
+		log.Info(retriesExhaustedMessage())
+		r.Recorder.Event(sync, corev1.EventTypeWarning, eventReasonRetriesExhausted, retriesExhaustedMessage())
+		r.SetCondition(sync, v1alpha1.ConditionImported, metav1.ConditionFalse, eventReasonRetriesExhausted, retriesExhaustedMessage())
+	} else {
+		result, syncErr = r.SyncSecret(ctx, sync)
+	}
+
+	sync.Status.ObservedGeneration = sync.Generation
+	if err := r.Status().Update(ctx, sync); err != nil {
+		log.Error(err, "Failed to update ACMCertificateSync status.")
+		return requeueWithBackoff(err)
+	}
+
+	// Read after the status is updated, so that updating it does not end the parking.
+	if exhausted {
+		r.retries.Park(req, sync.ResourceVersion)
+	}
+
+	return result, syncErr
+}
+
+// SyncSecret imports the referenced Secret into ACM, recording the outcome in the status of the ACMCertificateSync (which is not persisted.)
+func (r *ACMCertificateSyncReconciler) SyncSecret(ctx context.Context, sync *v1alpha1.ACMCertificateSync) (ctrl.Result, error) {
+
+	log := log.FromContext(ctx)
+
+	secret := &corev1.Secret{}
+	if err := r.Get(ctx, k8stypes.NamespacedName{Namespace: sync.Namespace, Name: sync.Spec.SecretName}, secret); err != nil {
+		if k8serr.IsNotFound(err) {
+			log.Info(fmt.Sprintf("Secret '%s/%s' not found: will retry.", sync.Namespace, sync.Spec.SecretName))
+			r.SetCondition(sync, v1alpha1.ConditionImported, metav1.ConditionFalse, "SecretNotFound", fmt.Sprintf("Secret '%s' does not exist.", sync.Spec.SecretName))
+			return requeueWithBackoff(nil)
+		}
+		log.Error(err, "Unable to retrieve Secret.")
+		return ctrl.Result{}, err
+	}
+
+	if !isCertificateSecret(secret) {
+		r.SetCondition(sync, v1alpha1.ConditionImported, metav1.ConditionFalse, "InvalidSecret", fmt.Sprintf("Secret '%s' is not of type '%s' and has no '%s', '%s' or '%s' annotation.", secret.Name, corev1.SecretTypeTLS, global.AGENT_CERTIFICATE_SECRET_ANNOTATION, global.AGENT_CERT_KEY_ANNOTATION, global.AGENT_PKCS12_KEY_ANNOTATION))
+		return ctrl.Result{}, nil
+	}
+
+	// Certificate parsing and ACM synchronization are shared with SecretReconciler.
+	secretReconciler := &SecretReconciler{Client: r.Client, Scheme: r.Scheme, EnableQuotaChecks: r.EnableQuotaChecks}
+
+	certificateDetails, err := secretReconciler.ParseCertificateDetails(secret)
+	if err != nil {
+		log.Error(err, "Could not parse certificate: aborting.")
+		reason := "InvalidCertificate"
+		var unsupportedKeyErr *unsupportedKeyError
+		if errors.As(err, &unsupportedKeyErr) {
+			reason = eventReasonUnsupportedKey
+		}
+		var keyMismatchErr *keyMismatchError
+		if errors.As(err, &keyMismatchErr) {
+			reason = eventReasonKeyMismatch
+		}
+		r.SetCondition(sync, v1alpha1.ConditionImported, metav1.ConditionFalse, reason, err.Error())
+		return ctrl.Result{}, nil
+	}
+
+	if fetchChainEnabled(secret) {
+		if _, err := secretReconciler.CompleteCertificateChain(ctx, &certificateDetails); err != nil {
+			log.Error(err, "Could not fetch missing intermediates.")
+			r.Recorder.Event(sync, corev1.EventTypeWarning, eventReasonChainIncomplete, fmt.Sprintf("Could not fetch missing intermediates: %s", err))
+		}
+	}
+
+	if certificateDetails.Certificate.x509.NotBefore.After(time.Now()) {
+		r.SetCondition(sync, v1alpha1.ConditionImported, metav1.ConditionFalse, "NotYetValid", "Certificate is not yet valid.")
+		return ctrl.Result{}, nil
+	}
+	if certificateDetails.Certificate.x509.NotAfter.Before(time.Now()) {
+		r.SetCondition(sync, v1alpha1.ConditionImported, metav1.ConditionFalse, "Expired", "Certificate has expired.")
+		return ctrl.Result{}, nil
+	}
+
+	warnings, err := secretReconciler.CheckACMLimits(&certificateDetails)
+	var limitErr *acmLimitError
+	if errors.As(err, &limitErr) {
+		r.SetCondition(sync, v1alpha1.ConditionImported, metav1.ConditionFalse, eventReasonACMLimitExceeded, limitErr.Error())
+		return ctrl.Result{}, nil
+	}
+	for _, warning := range warnings {
+		r.Recorder.Event(sync, corev1.EventTypeWarning, eventReasonACMLimitWarning, warning)
+	}
+
+	cfg, err := loadAWSConfig(ctx, sync.Spec.RoleArn)
+	if err != nil {
+		log.Error(err, "Failed to load AWS configuration.")
+		r.SetCondition(sync, v1alpha1.ConditionImported, metav1.ConditionFalse, "AWSConfigurationError", err.Error())
+		return ctrl.Result{}, err
+	}
+
+	region := sync.Spec.Region
+	if region == "" {
+		region = cfg.Region
+	}
+	acmClient := NewAWSACMService(cfg, region)
+
+	// The ARN held in status is the only record of any previous import.
+	certificateDetails.CertificateArn = nil
+	if sync.Status.CertificateArn != "" {
+		certificateDetails.CertificateArn = aws.String(sync.Status.CertificateArn)
+	}
+
+	regionalCtx := ctrl.LoggerInto(ctx, log.WithValues("region", region))
+	quotaClient := secretReconciler.serviceQuotasService(cfg, region)
+	imported, err := secretReconciler.SyncCertificateWithACM(regionalCtx, acmClient, quotaClient, acmIndexScope(sync.Spec.RoleArn, region), &certificateDetails)
+	if err != nil {
+		var notOwnedErr *certificateNotOwnedError
+		if errors.As(err, &notOwnedErr) {
+			r.SetCondition(sync, v1alpha1.ConditionImported, metav1.ConditionFalse, "NotOwned", err.Error())
+			r.NotifyImportFailed(regionalCtx, sync, region, err)
+			return ctrl.Result{}, nil
+		}
+		var quotaErr *quotaExceededError
+		if errors.As(err, &quotaErr) {
+			r.SetCondition(sync, v1alpha1.ConditionImported, metav1.ConditionFalse, eventReasonQuotaExceeded, err.Error())
+			r.Recorder.Event(sync, corev1.EventTypeWarning, eventReasonQuotaExceeded, err.Error())
+			r.NotifyImportFailed(regionalCtx, sync, region, err)
+			if quotaIncreaseRequested(secret) {
+				if requested, err := secretReconciler.RequestQuotaIncrease(regionalCtx, quotaClient, quotaErr); err != nil {
+					log.Error(err, "ACM quota increase request failed.")
+				} else if requested {
+					r.Recorder.Event(sync, corev1.EventTypeNormal, eventReasonQuotaIncreaseRequested, fmt.Sprintf("Increase to ACM quota '%s' requested in region '%s'.", acmQuotaNames[quotaErr.quota.Key], region))
+				}
+			}
+			return ctrl.Result{RequeueAfter: acmQuotaTTL}, nil
+		}
+		var deferredErr *importDeferredError
+		if errors.As(err, &deferredErr) {
+			r.SetCondition(sync, v1alpha1.ConditionImported, metav1.ConditionFalse, eventReasonImportDeferred, err.Error())
+			return ctrl.Result{RequeueAfter: time.Until(deferredErr.until)}, nil
+		}
+		var delayErr *propagationDelayError
+		if errors.As(err, &delayErr) {
+			log.Info(delayErr.Error())
+			r.SetCondition(sync, v1alpha1.ConditionImported, metav1.ConditionFalse, eventReasonPropagationDelayed, err.Error())
+			return ctrl.Result{RequeueAfter: acmPropagationRequeueDelay}, nil
+		}
+		var inProgressErr *importInProgressError
+		if errors.As(err, &inProgressErr) {
+			log.Info(inProgressErr.Error())
+			r.SetCondition(sync, v1alpha1.ConditionImported, metav1.ConditionFalse, eventReasonImportInProgress, err.Error())
+			return ctrl.Result{RequeueAfter: importLockRequeueDelay}, nil
+		}
+		var dryRunErr *dryRunError
+		if errors.As(err, &dryRunErr) {
+			// Re-checked periodically until the dry run ends.
+			r.SetCondition(sync, v1alpha1.ConditionImported, metav1.ConditionFalse, eventReasonDryRun, err.Error())
+			return ctrl.Result{RequeueAfter: maxRequeueDelay()}, nil
+		}
+		var permanentErr *permanentError
+		if errors.As(err, &permanentErr) {
+			// Not requeued: retrying will not help until the Secret (or ACMCertificateSync) changes.
+			r.SetCondition(sync, v1alpha1.ConditionImported, metav1.ConditionFalse, eventReasonImportRejected, err.Error())
+			r.Recorder.Event(sync, corev1.EventTypeWarning, eventReasonImportRejected, err.Error())
+			r.NotifyImportFailed(regionalCtx, sync, region, err)
+			return ctrl.Result{}, nil
+		}
+		r.SetCondition(sync, v1alpha1.ConditionImported, metav1.ConditionFalse, "ImportFailed", err.Error())
+		r.NotifyImportFailed(regionalCtx, sync, region, err)
+		return requeueWithBackoff(err)
+	}
+
+	sync.Status.CertificateArn = *certificateDetails.CertificateArn
+	sync.Status.SerialNumber = secretReconciler.FormatX509SerialNumber(certificateDetails.Certificate.x509.SerialNumber)
+	sync.Status.ExpiryDate = &metav1.Time{Time: certificateDetails.Certificate.x509.NotAfter}
+	r.SetCondition(sync, v1alpha1.ConditionImported, metav1.ConditionTrue, "Imported", fmt.Sprintf("Certificate is present in ACM region '%s'.", region))
+	if imported {
+		notification := newNotification(NotificationImported, "ACMCertificateSync", sync, fmt.Sprintf("Certificate imported into ACM as '%s'.", sync.Status.CertificateArn))
+		notification.CertificateArn = sync.Status.CertificateArn
+		notification.Region = region
+		notification.Expires = sync.Status.ExpiryDate.UTC().Format(time.RFC3339)
+		notify(regionalCtx, notification)
+	}
+
+	// Apply any additional tags.
+	if len(sync.Spec.Tags) > 0 {
+		tags := []types.Tag{}
+		for key, value := range sync.Spec.Tags {
+			tags = append(tags, types.Tag{Key: aws.String(key), Value: aws.String(value)})
+		}
+		_, err := acmClient.AddTagsToCertificate(ctx, &acm.AddTagsToCertificateInput{
+			CertificateArn: certificateDetails.CertificateArn,
+			Tags:           tags,
+		})
+		recordAudit(ctx, AuditRecord{Action: auditActionTag, CertificateArn: *certificateDetails.CertificateArn, Region: region, Tags: sync.Spec.Tags}, err)
+		if err != nil {
+			log.Error(err, "ACM certificate tagging failed.")
+			r.SetCondition(sync, v1alpha1.ConditionTagsApplied, metav1.ConditionFalse, "TaggingFailed", err.Error())
+			return requeueWithBackoff(err)
+		}
+		r.SetCondition(sync, v1alpha1.ConditionTagsApplied, metav1.ConditionTrue, "TagsApplied", fmt.Sprintf("%d tag(s) applied.", len(tags)))
+	} else {
+		meta.RemoveStatusCondition(&sync.Status.Conditions, v1alpha1.ConditionTagsApplied)
+	}
+
+	// Report whether the ACM certificate is being used by other AWS resources.
+	describeOutput, err := acmClient.DescribeCertificate(ctx, &acm.DescribeCertificateInput{CertificateArn: certificateDetails.CertificateArn})
+	if err != nil {
+		log.Error(err, "ACM certificate lookup failed.")
+		return requeueWithBackoff(err)
+	}
+	if len(describeOutput.Certificate.InUseBy) > 0 {
+		r.SetCondition(sync, v1alpha1.ConditionInUse, metav1.ConditionTrue, "InUse", fmt.Sprintf("Certificate is in use by %d AWS resource(s).", len(describeOutput.Certificate.InUseBy)))
+	} else {
+		r.SetCondition(sync, v1alpha1.ConditionInUse, metav1.ConditionFalse, "NotInUse", "Certificate is not in use by any AWS resources.")
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// NotifyImportFailed publishes a notification that the ACMCertificateSync's certificate could not be imported into the ACM region (see notify.)
+func (r *ACMCertificateSyncReconciler) NotifyImportFailed(ctx context.Context, sync *v1alpha1.ACMCertificateSync, region string, err error) {
+	notification := newNotification(NotificationImportFailed, "ACMCertificateSync", sync, err.Error())
+	notification.CertificateArn = sync.Status.CertificateArn
+	notification.Region = region
+	notify(ctx, notification)
+}
+
+func (r *ACMCertificateSyncReconciler) SetCondition(sync *v1alpha1.ACMCertificateSync, conditionType string, status metav1.ConditionStatus, reason string, message string) {
+
+	// Record an Event whenever a condition changes.
+	existing := meta.FindStatusCondition(sync.Status.Conditions, conditionType)
+	if existing == nil || existing.Status != status || existing.Reason != reason {
+		eventType := corev1.EventTypeNormal
+		if status == metav1.ConditionFalse && conditionType != v1alpha1.ConditionInUse {
+			eventType = corev1.EventTypeWarning
+		}
+		r.Recorder.Event(sync, eventType, reason, message)
+	}
+
+	meta.SetStatusCondition(&sync.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: sync.Generation,
+	})
+}
+
+// FindSyncsForSecret maps a Secret to the ACMCertificateSyncs that reference it.
+func (r *ACMCertificateSyncReconciler) FindSyncsForSecret(obj client.Object) []reconcile.Request {
+
+	syncList := &v1alpha1.ACMCertificateSyncList{}
+	if err := r.List(context.TODO(), syncList, client.InNamespace(obj.GetNamespace()), client.MatchingFields{acmCertificateSyncSecretNameField: obj.GetName()}); err != nil {
+		return nil
+	}
+
+	requests := []reconcile.Request{}
+	for _, sync := range syncList.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: k8stypes.NamespacedName{Namespace: sync.Namespace, Name: sync.Name}})
+	}
+
+	return requests
+}
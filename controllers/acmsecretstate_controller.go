@@ -0,0 +1,225 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	ctrlbuilder "sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"Validitron/k8s-acm-certificate-agent/api/v1alpha1"
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// ACMSecretStateReconciler materializes an ACMSecretState for each Secret synchronized by the agent (i.e. carrying a sync-status annotation), summarising its annotations, so that managed Secrets can be listed using kubectl. The ACMSecretState is owned by the Secret, and is deleted once the Secret is no longer synchronized.
+// No AWS calls are made: ACMSecretStates reflect the Secret's annotations as written by SecretReconciler.
+type ACMSecretStateReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// Maximum number of objects reconciled in parallel (default 1.)
+	MaxConcurrentReconciles int
+
+	// Delay before the first retry of an object whose reconciliation fails (doubling on each subsequent failure.) Defaults to 1 second.
+	RequeueDelay time.Duration
+
+	// Retries of failed objects, parking those that exceed MaxRetries. Set by SetupWithManager.
+	retries *retryLimiter
+}
+
+// Predicate passing events for Secrets that are (or were, until the update) synchronized by the agent. Deletions are ignored, since ACMSecretStates are deleted with their Secrets by garbage collection.
+var secretSyncedPredicate = predicate.Funcs{
+	CreateFunc: func(e event.CreateEvent) bool {
+		_, ok := e.Object.GetAnnotations()[global.AGENT_SYNC_STATUS_ANNOTATION]
+		return ok
+	},
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		_, oldOk := e.ObjectOld.GetAnnotations()[global.AGENT_SYNC_STATUS_ANNOTATION]
+		_, newOk := e.ObjectNew.GetAnnotations()[global.AGENT_SYNC_STATUS_ANNOTATION]
+		return oldOk || newOk
+	},
+	DeleteFunc: func(event.DeleteEvent) bool { return false },
+	GenericFunc: func(e event.GenericEvent) bool {
+		_, ok := e.Object.GetAnnotations()[global.AGENT_SYNC_STATUS_ANNOTATION]
+		return ok
+	},
+}
+
+func (r *ACMSecretStateReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.retries = newRetryLimiter("acmsecretstate", r.RequeueDelay)
+
+	// Tells the controller which object type this reconciler will handle. SecretReconciler also handles Secrets, so this controller must be named explicitly. ACMSecretStates that are changed or deleted by hand are restored.
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("acmsecretstate").
+		For(&corev1.Secret{}, ctrlbuilder.WithPredicates(secretSyncedPredicate)).
+		Owns(&v1alpha1.ACMSecretState{}).
+		WithOptions(controller.Options{RateLimiter: r.retries.rateLimiter, MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
+		WithLogConstructor(buildLogConstructor(mgr, "acmsecretstate-reconciler", "(core)", "secret")). // When multiple controllers running with a single manager, the log auto-constructor does not work. Therefore we must do manually.
+		Complete(r)
+}
+
+func (r *ACMSecretStateReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+
+	log := log.FromContext(ctx)
+
+	secret := &corev1.Secret{}
+	if err := r.Get(ctx, req.NamespacedName, secret); err != nil {
+		if !k8serr.IsNotFound(err) {
+			log.Error(err, "Unable to retrieve Secret.")
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	log.V(1).Info(fmt.Sprintf("Processing Secret %s...", req.NamespacedName))
+
+	// Objects whose retries have been exhausted are not reconciled again until they change.
+	if r.retries.Parked(req, secret.ResourceVersion) {
+		log.Info("Secret is parked (retries exhausted): nothing to do.")
+		return ctrl.Result{}, nil
+	}
+	if r.retries.Exhausted(req) {
+		log.Info(retriesExhaustedMessage())
+		r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonRetriesExhausted, retriesExhaustedMessage())
+		r.retries.Park(req, secret.ResourceVersion)
+		return ctrl.Result{}, nil
+	}
+
+	state := &v1alpha1.ACMSecretState{}
+	exists := true
+	if err := r.Get(ctx, req.NamespacedName, state); err != nil {
+		if !k8serr.IsNotFound(err) {
+			log.Error(err, "Unable to retrieve ACMSecretState.")
+			return ctrl.Result{}, err
+		}
+		exists = false
+	}
+	if exists && !metav1.IsControlledBy(state, secret) {
+		log.Info(fmt.Sprintf("ACMSecretState '%s' is not owned by the Secret: aborting.", req.NamespacedName))
+		return ctrl.Result{}, nil
+	}
+
+	syncStatus, synced := (&SecretReconciler{}).GetSyncStatus(secret)
+	if !synced || !secret.DeletionTimestamp.IsZero() {
+		if exists {
+			log.Info("Secret is no longer synchronized: deleting ACMSecretState...")
+			if err := r.Delete(ctx, state); err != nil && !k8serr.IsNotFound(err) {
+				log.Error(err, "Failed to delete ACMSecretState.")
+				return ctrl.Result{}, err
+			}
+		}
+		return ctrl.Result{}, nil
+	}
+
+	status := secretStateStatus(secret, syncStatus)
+
+	// The Secret was last found to be synchronized when it was first recorded as synchronized with its current certificate (or, for Secrets already synchronized when their ACMSecretState is created, at their last import.)
+	if status.State == global.SYNC_STATE_SYNCED {
+		previous := state.Status
+		if exists && previous.State == status.State && previous.CertificateArn == status.CertificateArn && previous.SerialNumber == status.SerialNumber {
+			status.LastSyncTime = previous.LastSyncTime
+		} else if !exists && status.LastImportTime != nil {
+			status.LastSyncTime = status.LastImportTime.DeepCopy()
+		}
+		if status.LastSyncTime == nil {
+			now := metav1.Now()
+			status.LastSyncTime = &now
+		}
+	} else if exists {
+		status.LastSyncTime = state.Status.LastSyncTime
+	}
+
+	if !exists {
+		state = &v1alpha1.ACMSecretState{ObjectMeta: metav1.ObjectMeta{Namespace: secret.Namespace, Name: secret.Name}}
+		if err := controllerutil.SetControllerReference(secret, state, r.Scheme); err != nil {
+			return ctrl.Result{}, err
+		}
+		state.Status = status
+		log.Info("Creating ACMSecretState...")
+		if err := r.Create(ctx, state); err != nil {
+			log.Error(err, "Failed to create ACMSecretState.")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+
+	if equality.Semantic.DeepEqual(state.Status, status) {
+		return ctrl.Result{}, nil
+	}
+
+	state.Status = status
+	log.V(1).Info("Updating ACMSecretState...")
+	if err := r.Update(ctx, state); err != nil {
+		log.Error(err, "Failed to update ACMSecretState.")
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// Returns the status of the Secret's ACMSecretState, taken from its annotations (other than LastSyncTime, which is left unset.)
+func secretStateStatus(secret *corev1.Secret, syncStatus SyncStatus) v1alpha1.ACMSecretStateStatus {
+
+	status := v1alpha1.ACMSecretStateStatus{
+		State:          syncStatus.State,
+		Message:        syncStatus.Message,
+		CertificateArn: secret.Annotations[global.AGENT_CERTIFICATE_ARN_ANNOTATION],
+		SerialNumber:   secret.Annotations[global.AGENT_CERTIFICATE_SERIAL_NUMBER_ANNOTATION],
+	}
+	if status.CertificateArn == "" {
+		status.CertificateArn = syncStatus.CertificateArn
+	}
+	if index := strings.LastIndex(status.CertificateArn, "/"); index >= 0 {
+		status.CertificateID = status.CertificateArn[index+1:]
+	}
+
+	for _, domainName := range trimSpaceFromSliceElements(strings.Split(secret.Annotations[global.AGENT_CERTIFICATE_DOMAIN_NAMES_ANNOTATION], ",")) {
+		if domainName != "" {
+			status.DomainNames = append(status.DomainNames, domainName)
+		}
+	}
+	if len(status.DomainNames) > 0 {
+		status.DomainName = status.DomainNames[0]
+	}
+
+	for _, record := range parseACMCertificateRecords(secret.Annotations[global.AGENT_ACM_CERTIFICATES_ANNOTATION]) {
+		if record.Region != "" && !containsString(status.Regions, record.Region) {
+			status.Regions = append(status.Regions, record.Region)
+		}
+	}
+	sort.Strings(status.Regions)
+
+	if expiryDate, err := time.Parse(global.ISO_8601_FORMAT, secret.Annotations[global.AGENT_CERTIFICATE_EXPIRY_DATE_ANNOTATION]); err == nil {
+		status.ExpiryDate = &metav1.Time{Time: expiryDate}
+	}
+	if lastImportTime, err := time.Parse(time.RFC3339, syncStatus.LastImportTime); err == nil {
+		status.LastImportTime = &metav1.Time{Time: lastImportTime}
+	}
+
+	return status
+}
@@ -0,0 +1,216 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"Validitron/k8s-acm-certificate-agent/api/v1alpha1"
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// Runtime configuration read from the singleton ACMAgentConfig. Settings are read from the manager's cache whenever they are needed, so that changes take effect without restarting the agent. Unset settings fall back to the environment configuration (e.g. TagTemplates, MaxRequeueDelay.)
+
+// agentConfigSettings holds the parsed spec of the ACMAgentConfig. The zero value applies the environment configuration throughout.
+type agentConfigSettings struct {
+	Regions              []string
+	RoleArn              string
+	TagTemplates         []TagTemplate // Nil if TagTemplates applies.
+	Namespaces           []string
+	ExcludedNamespaces   []string
+	MaxRequeueDelay      time.Duration // Zero if MaxRequeueDelay applies.
+	DryRun               bool
+	DeletePolicy         string
+	NotificationTopicArn string // Empty if NotificationTopicArn applies.
+	NotificationEventBus string // Empty if NotificationEventBus applies.
+}
+
+// Source of the ACMAgentConfig (the manager's cache), or nil if runtime configuration is disabled. Set by ACMAgentConfigReconciler.SetupWithManager.
+var agentConfigReader client.Reader
+
+// Settings parsed from the most recently read version of the ACMAgentConfig, so that its spec is only parsed when it changes.
+var parsedAgentConfig struct {
+	mutex           sync.Mutex
+	resourceVersion string
+	settings        agentConfigSettings
+	err             error
+}
+
+// Parses and validates the spec of an ACMAgentConfig.
+func parseAgentConfigSpec(spec *v1alpha1.ACMAgentConfigSpec) (agentConfigSettings, error) {
+
+	settings := agentConfigSettings{
+		DryRun:       spec.DryRun,
+		DeletePolicy: spec.DeletePolicy,
+	}
+
+	settings.Regions = uniqueNonEmptyStrings(spec.Regions)
+
+	if roleArn := strings.TrimSpace(spec.RoleArn); roleArn != "" {
+		parsedArn, err := arn.Parse(roleArn)
+		if err != nil {
+			return agentConfigSettings{}, fmt.Errorf("'%s' is not a valid IAM role ARN.", roleArn)
+		}
+		if err := checkARNPartition(parsedArn, ""); err != nil {
+			return agentConfigSettings{}, err
+		}
+		settings.RoleArn = roleArn
+	}
+
+	if len(spec.Tags) > 0 {
+		// Order tags by key, so that the tags applied do not depend on map ordering.
+		keys := []string{}
+		for key := range spec.Tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		settings.TagTemplates = []TagTemplate{}
+		for _, key := range keys {
+			template, err := newTagTemplate(key, spec.Tags[key])
+			if err != nil {
+				return agentConfigSettings{}, err
+			}
+			settings.TagTemplates = append(settings.TagTemplates, template)
+		}
+	}
+
+	settings.Namespaces = uniqueNonEmptyStrings(spec.Namespaces)
+	settings.ExcludedNamespaces = uniqueNonEmptyStrings(spec.ExcludedNamespaces)
+
+	if spec.MaxRequeueDelay != nil {
+		if spec.MaxRequeueDelay.Duration < minRequeueDelay || spec.MaxRequeueDelay.Duration > maxRequeueDelayLimit {
+			return agentConfigSettings{}, fmt.Errorf("Maximum requeue delay must be between %s and %s.", minRequeueDelay, maxRequeueDelayLimit)
+		}
+		settings.MaxRequeueDelay = spec.MaxRequeueDelay.Duration
+	}
+
+	if topicArn := strings.TrimSpace(spec.NotificationTopicArn); topicArn != "" {
+		parsedArn, err := arn.Parse(topicArn)
+		if err != nil {
+			return agentConfigSettings{}, fmt.Errorf("'%s' is not a valid SNS topic ARN.", topicArn)
+		}
+		if err := checkARNPartition(parsedArn, ""); err != nil {
+			return agentConfigSettings{}, err
+		}
+		settings.NotificationTopicArn = topicArn
+	}
+	settings.NotificationEventBus = strings.TrimSpace(spec.NotificationEventBus)
+
+	if settings.DeletePolicy != "" && !strings.EqualFold(settings.DeletePolicy, global.DELETE_POLICY_DELETE) && !strings.EqualFold(settings.DeletePolicy, global.DELETE_POLICY_RETAIN) {
+		return agentConfigSettings{}, fmt.Errorf("Delete policy '%s' must be one of '%s' or '%s'.", settings.DeletePolicy, global.DELETE_POLICY_DELETE, global.DELETE_POLICY_RETAIN)
+	}
+
+	return settings, nil
+}
+
+// Returns the distinct, non-empty elements of the slice (with surrounding space trimmed.)
+func uniqueNonEmptyStrings(slice []string) []string {
+	output := []string{}
+	for _, item := range trimSpaceFromSliceElements(slice) {
+		if item != "" && !containsString(output, item) {
+			output = append(output, item)
+		}
+	}
+	return output
+}
+
+// Returns the current runtime configuration. If runtime configuration is disabled, no ACMAgentConfig exists, or its spec is invalid, the environment configuration applies (i.e. the zero value is returned.)
+func currentAgentConfig() agentConfigSettings {
+
+	if agentConfigReader == nil {
+		return agentConfigSettings{}
+	}
+
+	agentConfig := &v1alpha1.ACMAgentConfig{}
+	if err := agentConfigReader.Get(context.Background(), types.NamespacedName{Name: v1alpha1.ACMAgentConfigName}, agentConfig); err != nil {
+		return agentConfigSettings{}
+	}
+
+	parsedAgentConfig.mutex.Lock()
+	defer parsedAgentConfig.mutex.Unlock()
+
+	if parsedAgentConfig.resourceVersion != agentConfig.ResourceVersion {
+		parsedAgentConfig.settings, parsedAgentConfig.err = parseAgentConfigSpec(&agentConfig.Spec)
+		parsedAgentConfig.resourceVersion = agentConfig.ResourceVersion
+	}
+	if parsedAgentConfig.err != nil {
+		return agentConfigSettings{}
+	}
+
+	return parsedAgentConfig.settings
+}
+
+// Returns the tag templates applied to ACM certificates: those of the ACMAgentConfig if set, otherwise TagTemplates.
+func tagTemplates() []TagTemplate {
+	if templates := currentAgentConfig().TagTemplates; templates != nil {
+		return templates
+	}
+	return TagTemplates
+}
+
+// Returns the IAM role to assume when communicating with AWS: the specified role if any, otherwise the role of the ACMAgentConfig (if set.)
+func effectiveRoleArn(roleArn string) string {
+	if roleArn != "" {
+		return roleArn
+	}
+	return currentAgentConfig().RoleArn
+}
+
+// Returns the ceiling for per-object exponential backoff: that of the ACMAgentConfig if set, otherwise MaxRequeueDelay.
+func maxRequeueDelay() time.Duration {
+	if delay := currentAgentConfig().MaxRequeueDelay; delay > 0 {
+		return delay
+	}
+	return MaxRequeueDelay
+}
+
+// Returns the SNS topic to which notifications are published: that of the ACMAgentConfig if set, otherwise NotificationTopicArn.
+func notificationTopicArn() string {
+	if topicArn := currentAgentConfig().NotificationTopicArn; topicArn != "" {
+		return topicArn
+	}
+	return NotificationTopicArn
+}
+
+// Returns the EventBridge event bus to which notifications are published: that of the ACMAgentConfig if set, otherwise NotificationEventBus.
+func notificationEventBus() string {
+	if eventBus := currentAgentConfig().NotificationEventBus; eventBus != "" {
+		return eventBus
+	}
+	return NotificationEventBus
+}
+
+// Returns true if Secrets in the namespace are synchronized with ACM, according to the namespace filters of the ACMAgentConfig.
+func namespaceSynchronized(namespace string) bool {
+	settings := currentAgentConfig()
+	if containsString(settings.ExcludedNamespaces, namespace) {
+		return false
+	}
+	return len(settings.Namespaces) == 0 || containsString(settings.Namespaces, namespace)
+}
+
+// dryRunError indicates that a change to ACM was not made because the ACMAgentConfig requests a dry run.
+type dryRunError struct {
+	action string
+}
+
+func (e *dryRunError) Error() string {
+	return fmt.Sprintf("Dry run: %s skipped.", e.action)
+}
@@ -0,0 +1,202 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// Completion of certificate chains by fetching missing intermediates from the 'CA Issuers' URLs in the Authority Information Access (AIA) extension of each certificate.
+
+const (
+	// Maximum number of intermediates that will be fetched for a single certificate.
+	aiaMaxDepth = 5
+	// How long fetched intermediates are cached.
+	aiaCacheTTL = 24 * time.Hour
+	// Maximum size of a fetched certificate.
+	aiaMaxResponseBytes = 1 << 20
+)
+
+var aiaHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// Fetched intermediates, keyed by URL. Shared by all reconcilers, since many Secrets are issued by the same intermediates.
+var aiaCache = &issuerCertificateCache{entries: map[string]issuerCertificateCacheEntry{}}
+
+type issuerCertificateCache struct {
+	mutex   sync.Mutex
+	entries map[string]issuerCertificateCacheEntry
+}
+
+type issuerCertificateCacheEntry struct {
+	certificate *x509.Certificate
+	fetchedAt   time.Time
+}
+
+// Returns true if the Secret is annotated to enable fetching of missing intermediates.
+func fetchChainEnabled(secret *corev1.Secret) bool {
+	enabled, _ := strconv.ParseBool(secret.Annotations[global.AGENT_FETCH_CHAIN_ANNOTATION])
+	return enabled
+}
+
+// CompleteCertificateChain appends any intermediates missing from the chain of the certificate, fetching them from the AIA 'CA Issuers' URLs of the topmost certificate in the chain. Returns true if the chain was extended.
+// Fetching stops once a root (self-signed) certificate is reached, since roots are not imported into ACM. An error is returned if an intermediate could not be fetched, in which case the chain is unchanged.
+func (r *SecretReconciler) CompleteCertificateChain(ctx context.Context, certificateDetails *CertificateDetails) (bool, error) {
+
+	log := log.FromContext(ctx)
+
+	// A chain that already reaches its root is complete.
+	if certificateDetails.CA != nil {
+		return false, nil
+	}
+
+	current := certificateDetails.Certificate.x509
+	if len(certificateDetails.Intermediates) > 0 {
+		current = certificateDetails.Intermediates[len(certificateDetails.Intermediates)-1].x509
+	}
+
+	fetched := []*CertificateWrapper{}
+	for i := 0; i < aiaMaxDepth; i++ {
+
+		if isSelfSigned(current) {
+			break
+		}
+		if len(current.IssuingCertificateURL) == 0 {
+			// A Secret holding only its leaf certificate is certainly incomplete. Otherwise, the topmost intermediate may simply be issued by a root.
+			if len(certificateDetails.Intermediates) == 0 && i == 0 {
+				return false, fmt.Errorf("Certificate '%s' has no CA Issuers URL from which its issuer can be fetched.", current.Subject.CommonName)
+			}
+			break
+		}
+
+		issuer, err := fetchIssuingCertificate(ctx, current)
+		if err != nil {
+			return false, err
+		}
+		if isSelfSigned(issuer) {
+			break
+		}
+
+		log.Info(fmt.Sprintf("Fetched missing intermediate '%s'.", issuer.Subject.CommonName))
+		fetched = append(fetched, &CertificateWrapper{
+			PEM:  strings.TrimSpace(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: issuer.Raw}))),
+			x509: issuer,
+		})
+		current = issuer
+	}
+
+	if len(fetched) == 0 {
+		return false, nil
+	}
+	certificateDetails.Intermediates = append(certificateDetails.Intermediates, fetched...)
+
+	return true, nil
+}
+
+// Fetches the certificate that issued the specified certificate, trying each of its CA Issuers URLs in turn.
+func fetchIssuingCertificate(ctx context.Context, certificate *x509.Certificate) (*x509.Certificate, error) {
+
+	var lastErr error
+	for _, url := range certificate.IssuingCertificateURL {
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			continue
+		}
+
+		issuer, err := aiaCache.get(ctx, url)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if err := certificate.CheckSignatureFrom(issuer); err != nil {
+			lastErr = fmt.Errorf("Certificate fetched from '%s' did not issue '%s'.", url, certificate.Subject.CommonName)
+			continue
+		}
+
+		return issuer, nil
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("Certificate '%s' has no HTTP CA Issuers URL.", certificate.Subject.CommonName)
+	}
+	return nil, lastErr
+}
+
+// Returns the certificate published at the URL, from the cache if possible.
+func (c *issuerCertificateCache) get(ctx context.Context, url string) (*x509.Certificate, error) {
+
+	c.mutex.Lock()
+	entry, ok := c.entries[url]
+	c.mutex.Unlock()
+	if ok && time.Since(entry.fetchedAt) < aiaCacheTTL {
+		return entry.certificate, nil
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := aiaHTTPClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("Could not fetch issuing certificate from '%s': %s", url, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Could not fetch issuing certificate from '%s': status %d.", url, response.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, aiaMaxResponseBytes))
+	if err != nil {
+		return nil, fmt.Errorf("Could not fetch issuing certificate from '%s': %s", url, err)
+	}
+
+	certificate, err := parseIssuerCertificate(body)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse issuing certificate from '%s': %s", url, err)
+	}
+
+	c.mutex.Lock()
+	c.entries[url] = issuerCertificateCacheEntry{certificate: certificate, fetchedAt: time.Now()}
+	c.mutex.Unlock()
+
+	return certificate, nil
+}
+
+// Parses a certificate published at a CA Issuers URL. These are usually DER-encoded, but are sometimes PEM-encoded. (PKCS#7 bundles are not supported.)
+func parseIssuerCertificate(data []byte) (*x509.Certificate, error) {
+
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("Unexpected PEM block '%s'.", block.Type)
+		}
+		data = block.Bytes
+	}
+
+	certificate, err := x509.ParseCertificate(data)
+	if err != nil {
+		return nil, errors.New("Not a DER or PEM-encoded X.509 certificate.")
+	}
+
+	return certificate, nil
+}
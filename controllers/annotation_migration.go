@@ -0,0 +1,240 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	cm "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	corev1 "k8s.io/api/core/v1"
+	networking "k8s.io/api/networking/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	gateway "sigs.k8s.io/gateway-api/apis/v1alpha2"
+
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// Default interval between migrations of version 1 annotations, which catch annotations re-applied from manifests written for earlier versions of the agent.
+const defaultAnnotationMigrationInterval = time.Hour
+
+// Number of objects listed in each request made by AnnotationMigrator.
+const annotationMigrationPageSize = 500
+
+// Kinds of object whose agent annotations are migrated. Kinds whose CRDs are not installed (e.g. Istio Gateways) are skipped.
+var annotatedKinds = []schema.GroupVersionKind{
+	corev1.SchemeGroupVersion.WithKind("Namespace"),
+	corev1.SchemeGroupVersion.WithKind("Secret"),
+	corev1.SchemeGroupVersion.WithKind("Service"),
+	networking.SchemeGroupVersion.WithKind("Ingress"),
+	cm.SchemeGroupVersion.WithKind("Certificate"),
+	gateway.SchemeGroupVersion.WithKind("Gateway"),
+	istioGatewayGVK,
+}
+
+// UpgradeAnnotationKey returns the current key of a version 1 agent annotation (one prefixed with global.V1_ANNOTATION_PREFIX), and true. Other keys are returned unchanged, with false.
+func UpgradeAnnotationKey(key string) (string, bool) {
+	if !strings.HasPrefix(key, global.V1_ANNOTATION_PREFIX+"/") {
+		return key, false
+	}
+	return global.ANNOTATION_PREFIX + strings.TrimPrefix(key, global.V1_ANNOTATION_PREFIX), true
+}
+
+// UpgradeAnnotations moves version 1 agent annotations to their current keys, in place, returning the (sorted) version 1 keys that were removed. Where both keys are present, the value of the current key is kept, since the agent's own writes only update current keys.
+func UpgradeAnnotations(annotations map[string]string) []string {
+
+	upgraded := []string{}
+	for key, value := range annotations {
+		currentKey, ok := UpgradeAnnotationKey(key)
+		if !ok {
+			continue
+		}
+		if _, exists := annotations[currentKey]; !exists {
+			annotations[currentKey] = value
+		}
+		delete(annotations, key)
+		upgraded = append(upgraded, key)
+	}
+	sort.Strings(upgraded)
+
+	return upgraded
+}
+
+// Upgrades the version 1 annotations of objects before they are cached, so that controllers, predicates and indexes only see current annotation keys (including on objects that AnnotationMigrator has yet to migrate.) Writes made by the agent from cached objects then also carry current keys.
+func transformUpgradeAnnotations(obj interface{}) (interface{}, error) {
+
+	object, ok := obj.(metav1.Object)
+	if !ok {
+		return obj, nil
+	}
+
+	// The annotations of unstructured objects (e.g. Istio Gateways) are returned as a copy, so must be set again.
+	annotations := object.GetAnnotations()
+	if len(UpgradeAnnotations(annotations)) > 0 {
+		object.SetAnnotations(annotations)
+	}
+
+	return obj, nil
+}
+
+// AnnotationMigrator upgrades the version 1 agent annotations of objects in place (see UpgradeAnnotations), so that objects annotated by earlier versions of the agent are not stranded when the annotation schema changes. Migration runs once before the manager is started (see Migrate), and then periodically on the leader.
+// Objects are read with an uncached client, since cached objects already carry upgraded annotations.
+type AnnotationMigrator struct {
+	Client client.Client
+
+	// Uncached reader (see manager.GetAPIReader.)
+	Reader client.Reader
+
+	// Interval between migrations. Defaults to defaultAnnotationMigrationInterval.
+	Interval time.Duration
+}
+
+// Start migrates annotations every Interval until the context is cancelled.
+func (m *AnnotationMigrator) Start(ctx context.Context) error {
+
+	interval := m.Interval
+	if interval <= 0 {
+		interval = defaultAnnotationMigrationInterval
+	}
+
+	ctx = log.IntoContext(ctx, log.Log.WithName("annotation-migration"))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			m.Migrate(ctx)
+		}
+	}
+}
+
+// NeedLeaderElection is true: a single replica migrates annotations.
+func (m *AnnotationMigrator) NeedLeaderElection() bool {
+	return true
+}
+
+// Migrate upgrades the version 1 annotations of every object of the annotated kinds, returning the number of objects migrated. Failures are logged (each kind's failures together), and the remaining objects (and kinds) are still migrated.
+func (m *AnnotationMigrator) Migrate(ctx context.Context) int {
+
+	log := log.FromContext(ctx)
+
+	migrated := 0
+	for _, gvk := range annotatedKinds {
+		count, err := m.migrateKind(ctx, gvk)
+		migrated += count
+		if err != nil {
+			log.Error(err, fmt.Sprintf("Failed to migrate the annotations of kind '%s'.", gvk.GroupKind()))
+		}
+	}
+	if migrated > 0 {
+		log.Info(fmt.Sprintf("Migrated the version 1 annotations of %d object(s) to '%s'.", migrated, global.ANNOTATION_PREFIX))
+	}
+
+	return migrated
+}
+
+// Migrates the annotations of every object of the kind, one page at a time. Objects that cannot be migrated (e.g. because the patch is denied by an admission webhook) are logged and skipped, and their errors are returned together once the remaining objects have been migrated. Only a failure to list the kind ends its migration early.
+func (m *AnnotationMigrator) migrateKind(ctx context.Context, gvk schema.GroupVersionKind) (int, error) {
+
+	log := log.FromContext(ctx)
+
+	list := &metav1.PartialObjectMetadataList{}
+	list.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+
+	migrated := 0
+	errs := []error{}
+	for {
+		if err := m.Reader.List(ctx, list, client.Limit(annotationMigrationPageSize), client.Continue(list.Continue)); err != nil {
+			if meta.IsNoMatchError(err) {
+				log.V(1).Info(fmt.Sprintf("Kind '%s' is not installed: skipping annotation migration.", gvk.GroupKind()))
+				return migrated, nil
+			}
+			return migrated, kerrors.NewAggregate(append(errs, err))
+		}
+		for i := range list.Items {
+			object := &list.Items[i]
+			object.SetGroupVersionKind(gvk)
+			ok, err := m.migrateObject(ctx, object)
+			if err != nil {
+				log.Error(err, fmt.Sprintf("Failed to migrate the annotations of %s '%s': skipping.", gvk.Kind, client.ObjectKeyFromObject(object)))
+				errs = append(errs, err)
+				continue
+			}
+			if ok {
+				migrated++
+			}
+		}
+		if list.Continue == "" {
+			return migrated, kerrors.NewAggregate(errs)
+		}
+	}
+}
+
+// Moves the object's version 1 annotations to their current keys using a merge patch, returning true if the object was migrated. The patch is conditional on the object's resource version, so that concurrent changes are not overwritten: objects that have changed are migrated on the next run.
+func (m *AnnotationMigrator) migrateObject(ctx context.Context, object *metav1.PartialObjectMetadata) (bool, error) {
+
+	log := log.FromContext(ctx)
+	kind, key := object.Kind, client.ObjectKeyFromObject(object)
+
+	original := object.GetAnnotations()
+	annotations := map[string]string{}
+	for k, v := range original {
+		annotations[k] = v
+	}
+	upgraded := UpgradeAnnotations(annotations)
+	if len(upgraded) == 0 {
+		return false, nil
+	}
+
+	changes := map[string]interface{}{}
+	for _, v1Key := range upgraded {
+		currentKey, _ := UpgradeAnnotationKey(v1Key)
+		changes[v1Key] = nil
+		if _, exists := original[currentKey]; !exists {
+			changes[currentKey] = annotations[currentKey]
+		} else if original[currentKey] != original[v1Key] {
+			log.Info(fmt.Sprintf("%s '%s' carries annotations '%s' and '%s' with different values: keeping the value of '%s'.", kind, key, v1Key, currentKey, currentKey))
+		}
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": object.ResourceVersion,
+			"annotations":     changes,
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if err := m.Client.Patch(ctx, object, client.RawPatch(types.MergePatchType, patch)); err != nil {
+		if k8serr.IsConflict(err) || k8serr.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	log.V(1).Info(fmt.Sprintf("Migrated annotations %s of %s '%s'.", strings.Join(upgraded, ", "), kind, key))
+
+	return true, nil
+}
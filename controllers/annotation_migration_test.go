@@ -0,0 +1,194 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// Version 1 keys of the agent annotations used in these tests.
+var (
+	v1EnabledAnnotation = global.V1_ANNOTATION_PREFIX + strings.TrimPrefix(global.AGENT_ENABLED_ANNOTATION, global.ANNOTATION_PREFIX)
+	v1RegionsAnnotation = global.V1_ANNOTATION_PREFIX + strings.TrimPrefix(global.AGENT_REGIONS_ANNOTATION, global.ANNOTATION_PREFIX)
+)
+
+// Annotation migration test cases: the annotations of an object, and those it carries once migrated.
+var annotationMigrationTests = []struct {
+	name        string
+	annotations map[string]string
+	expected    map[string]string
+	upgraded    []string
+}{
+	{"Version 1 keys only",
+		map[string]string{v1EnabledAnnotation: "true", v1RegionsAnnotation: "us-east-1", "example.com/other": "value"},
+		map[string]string{global.AGENT_ENABLED_ANNOTATION: "true", global.AGENT_REGIONS_ANNOTATION: "us-east-1", "example.com/other": "value"},
+		[]string{v1EnabledAnnotation, v1RegionsAnnotation}},
+	{"Both keys with the same value",
+		map[string]string{v1EnabledAnnotation: "true", global.AGENT_ENABLED_ANNOTATION: "true"},
+		map[string]string{global.AGENT_ENABLED_ANNOTATION: "true"},
+		[]string{v1EnabledAnnotation}},
+	{"Both keys with different values",
+		map[string]string{v1RegionsAnnotation: "us-east-1", global.AGENT_REGIONS_ANNOTATION: "ap-southeast-2"},
+		map[string]string{global.AGENT_REGIONS_ANNOTATION: "ap-southeast-2"},
+		[]string{v1RegionsAnnotation}},
+	{"Current keys only",
+		map[string]string{global.AGENT_ENABLED_ANNOTATION: "true", "example.com/other": "value"},
+		map[string]string{global.AGENT_ENABLED_ANNOTATION: "true", "example.com/other": "value"},
+		[]string{}},
+}
+
+func TestUpgradeAnnotations(t *testing.T) {
+	for _, test := range annotationMigrationTests {
+		t.Run(test.name, func(t *testing.T) {
+
+			annotations := map[string]string{}
+			for key, value := range test.annotations {
+				annotations[key] = value
+			}
+
+			upgraded := UpgradeAnnotations(annotations)
+			if !reflect.DeepEqual(upgraded, test.upgraded) {
+				t.Errorf("Upgraded %v, expected %v.", upgraded, test.upgraded)
+			}
+			if !reflect.DeepEqual(annotations, test.expected) {
+				t.Errorf("Annotations are %v, expected %v.", annotations, test.expected)
+			}
+		})
+	}
+}
+
+// Client that records the patches it applies, and fails those of the named objects.
+type recordingPatchClient struct {
+	client.Client
+	patches map[string]map[string]interface{}
+	failing map[string]bool
+}
+
+func (c *recordingPatchClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if c.failing[obj.GetName()] {
+		return fmt.Errorf("Patch of '%s' denied.", obj.GetName())
+	}
+	data, err := patch.Data(obj)
+	if err != nil {
+		return err
+	}
+	decoded := map[string]interface{}{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	c.patches[obj.GetName()] = decoded
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+func TestMigrateObject(t *testing.T) {
+	for _, test := range annotationMigrationTests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "tls", Annotations: test.annotations}}
+			fakeClient := newTestFakeClient(t, secret)
+			c := &recordingPatchClient{Client: fakeClient, patches: map[string]map[string]interface{}{}}
+			m := &AnnotationMigrator{Client: c, Reader: fakeClient}
+
+			object := &metav1.PartialObjectMetadata{}
+			object.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Secret"))
+			if err := fakeClient.Get(ctx, client.ObjectKeyFromObject(secret), object); err != nil {
+				t.Fatalf("Could not get Secret: %s", err)
+			}
+			resourceVersion := object.ResourceVersion
+
+			migrated, err := m.migrateObject(ctx, object)
+			if err != nil {
+				t.Fatalf("Could not migrate Secret: %s", err)
+			}
+			if migrated != (len(test.upgraded) > 0) {
+				t.Errorf("Migrated is %t, expected %t.", migrated, len(test.upgraded) > 0)
+			}
+
+			patch, patched := c.patches[secret.Name]
+			if len(test.upgraded) == 0 {
+				if patched {
+					t.Errorf("Secret without version 1 annotations was patched: %v", patch)
+				}
+				return
+			}
+			if !patched {
+				t.Fatalf("Secret was not patched.")
+			}
+
+			// Version 1 keys are removed, and current keys only set if the object does not carry them already.
+			metadata := patch["metadata"].(map[string]interface{})
+			if metadata["resourceVersion"] != resourceVersion {
+				t.Errorf("Patch is not conditional on the resource version: %v", metadata)
+			}
+			changes := metadata["annotations"].(map[string]interface{})
+			for _, v1Key := range test.upgraded {
+				if value, ok := changes[v1Key]; !ok || value != nil {
+					t.Errorf("Patch sets '%s' to %v, expected null.", v1Key, value)
+				}
+				currentKey, _ := UpgradeAnnotationKey(v1Key)
+				value, ok := changes[currentKey]
+				if _, exists := test.annotations[currentKey]; exists {
+					if ok {
+						t.Errorf("Patch overwrites existing annotation '%s' with %v.", currentKey, value)
+					}
+				} else if value != test.annotations[v1Key] {
+					t.Errorf("Patch sets '%s' to %v, expected '%s'.", currentKey, value, test.annotations[v1Key])
+				}
+			}
+			if len(changes) > 2*len(test.upgraded) {
+				t.Errorf("Patch changes unrelated annotations: %v", changes)
+			}
+
+			if err := fakeClient.Get(ctx, client.ObjectKeyFromObject(secret), secret); err != nil {
+				t.Fatalf("Could not get Secret: %s", err)
+			}
+			if !reflect.DeepEqual(secret.Annotations, test.expected) {
+				t.Errorf("Annotations are %v, expected %v.", secret.Annotations, test.expected)
+			}
+		})
+	}
+}
+
+// Objects that cannot be migrated are skipped, and their errors returned once the remaining objects are migrated.
+func TestMigrateKindSkipsFailedObjects(t *testing.T) {
+	ctx := context.Background()
+
+	objects := []client.Object{}
+	for _, name := range []string{"a", "b", "c"} {
+		objects = append(objects, &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Annotations: map[string]string{v1EnabledAnnotation: "true"}}})
+	}
+	fakeClient := newTestFakeClient(t, objects...)
+	c := &recordingPatchClient{Client: fakeClient, patches: map[string]map[string]interface{}{}, failing: map[string]bool{"a": true}}
+	m := &AnnotationMigrator{Client: c, Reader: fakeClient}
+
+	migrated, err := m.migrateKind(ctx, corev1.SchemeGroupVersion.WithKind("Secret"))
+	if err == nil || !strings.Contains(err.Error(), "'a'") {
+		t.Errorf("Error is %v, expected the failure to patch 'a'.", err)
+	}
+	if migrated != 2 {
+		t.Errorf("Migrated %d Secret(s), expected 2.", migrated)
+	}
+	for _, name := range []string{"b", "c"} {
+		if _, ok := c.patches[name]; !ok {
+			t.Errorf("Secret '%s' was not migrated.", name)
+		}
+	}
+}
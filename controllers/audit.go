@@ -0,0 +1,286 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/acm/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// Changes to ACM recorded in the audit trail.
+const (
+	auditActionImport   = "Import"
+	auditActionReimport = "Reimport"
+	auditActionTag      = "Tag"
+	auditActionDelete   = "Delete"
+	auditActionRequest  = "Request"
+	auditActionRetain   = "Retain" // The certificate's Secret was deleted, but the certificate was retained in ACM.
+)
+
+// Names of the sinks to which audit records can be sent (see NewAuditSinks.)
+const (
+	AuditSinkEvents     = "events"
+	AuditSinkS3         = "s3"
+	AuditSinkCloudWatch = "cloudwatch"
+)
+
+// AuditRecord describes a change made (or attempted) by the agent to a certificate in ACM.
+type AuditRecord struct {
+	Time           string            `json:"time"`
+	Action         string            `json:"action"`
+	CertificateArn string            `json:"certificateArn,omitempty"`
+	Region         string            `json:"region,omitempty"`
+	Agent          string            `json:"agent"`
+	ClusterName    string            `json:"clusterName,omitempty"`
+	Subject        string            `json:"subject,omitempty"` // The object whose reconciliation made the change (e.g. 'Secret default/example-tls'.)
+	OldSerial      string            `json:"oldSerial,omitempty"`
+	NewSerial      string            `json:"newSerial,omitempty"`
+	Tags           map[string]string `json:"tags,omitempty"`
+	Error          string            `json:"error,omitempty"` // Set if the change failed.
+}
+
+// AuditSink receives a record of each change made by the agent to ACM.
+type AuditSink interface {
+	// Name of the sink, used to label metrics (e.g. 's3'.)
+	Name() string
+	// Records the change. subject is the object whose reconciliation made the change, or nil if unknown.
+	Record(ctx context.Context, subject client.Object, record AuditRecord) error
+}
+
+// AuditConfig configures the sinks to which audit records are sent.
+type AuditConfig struct {
+	Sinks     []string // Any of AuditSinkEvents, AuditSinkS3 and AuditSinkCloudWatch.
+	S3Bucket  string
+	S3Prefix  string
+	LogGroup  string
+	LogStream string
+}
+
+// AuditSinks are the sinks to which changes made by the agent to ACM are recorded. Set before reconcilers are registered with the manager.
+var AuditSinks = []AuditSink{}
+
+type auditSubjectKey struct{}
+
+type auditSubject struct {
+	kind   string
+	object client.Object
+}
+
+// Returns a copy of the context identifying the object whose reconciliation makes any changes to ACM recorded using it.
+func withAuditSubject(ctx context.Context, kind string, object client.Object) context.Context {
+	return context.WithValue(ctx, auditSubjectKey{}, auditSubject{kind: kind, object: object})
+}
+
+// Sends a record of a change to ACM to each of the AuditSinks. Failures are logged (and counted), but do not fail reconciliation.
+func recordAudit(ctx context.Context, auditRecord AuditRecord, err error) {
+
+	if len(AuditSinks) == 0 {
+		return
+	}
+
+	log := log.FromContext(ctx)
+
+	auditRecord.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	auditRecord.Agent = global.PACKAGE_NAME
+	auditRecord.ClusterName = ClusterName
+	if err != nil {
+		auditRecord.Error = err.Error()
+	}
+	var subjectObject client.Object
+	if subject, ok := ctx.Value(auditSubjectKey{}).(auditSubject); ok {
+		subjectObject = subject.object
+		auditRecord.Subject = fmt.Sprintf("%s %s", subject.kind, client.ObjectKeyFromObject(subject.object))
+	}
+
+	for _, sink := range AuditSinks {
+		if err := sink.Record(ctx, subjectObject, auditRecord); err != nil {
+			log.Error(err, fmt.Sprintf("Failed to record ACM %s action in audit sink '%s'.", strings.ToLower(auditRecord.Action), sink.Name()))
+			auditFailuresTotal.WithLabelValues(sink.Name()).Inc()
+		}
+	}
+}
+
+// Returns the ACM tags as a map (for audit records.)
+func acmTagMap(tags []types.Tag) map[string]string {
+	if len(tags) == 0 {
+		return nil
+	}
+	tagMap := map[string]string{}
+	for _, tag := range tags {
+		tagMap[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return tagMap
+}
+
+// NewAuditSinks returns the sinks named in the configuration. Sinks that write to AWS use the agent's own credentials, in the region in which the agent is running.
+func NewAuditSinks(ctx context.Context, auditConfig AuditConfig, recorder record.EventRecorder) ([]AuditSink, error) {
+
+	sinks := []AuditSink{}
+	var cfg *aws.Config
+
+	for _, name := range auditConfig.Sinks {
+
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		if (name == AuditSinkS3 || name == AuditSinkCloudWatch) && cfg == nil {
+			loadedCfg, err := loadDefaultAWSConfig(ctx)
+			if err != nil {
+				return nil, err
+			}
+			cfg = &loadedCfg
+		}
+
+		switch name {
+		case AuditSinkEvents:
+			sinks = append(sinks, &EventAuditSink{Recorder: recorder})
+		case AuditSinkS3:
+			if auditConfig.S3Bucket == "" {
+				return nil, fmt.Errorf("An S3 bucket must be specified for the '%s' audit sink.", AuditSinkS3)
+			}
+			sinks = append(sinks, &S3AuditSink{Client: s3.NewFromConfig(*cfg), Bucket: auditConfig.S3Bucket, Prefix: auditConfig.S3Prefix})
+		case AuditSinkCloudWatch:
+			if auditConfig.LogGroup == "" {
+				return nil, fmt.Errorf("A log group must be specified for the '%s' audit sink.", AuditSinkCloudWatch)
+			}
+			logStream := auditConfig.LogStream
+			if logStream == "" {
+				logStream = global.PACKAGE_NAME
+				if ClusterName != "" {
+					logStream = ClusterName + "/" + logStream
+				}
+			}
+			sinks = append(sinks, &CloudWatchLogsAuditSink{Client: NewAWSCloudWatchLogsService(*cfg), LogGroup: auditConfig.LogGroup, LogStream: logStream})
+		default:
+			return nil, fmt.Errorf("Unknown audit sink '%s'. Expected one of: %s, %s, %s.", name, AuditSinkEvents, AuditSinkS3, AuditSinkCloudWatch)
+		}
+	}
+
+	return sinks, nil
+}
+
+// EventAuditSink records audit records as K8s Events against the object whose reconciliation made the change. Changes made without a known object (e.g. during clean-up) are not recorded.
+type EventAuditSink struct {
+	Recorder record.EventRecorder
+}
+
+func (s *EventAuditSink) Name() string {
+	return AuditSinkEvents
+}
+
+func (s *EventAuditSink) Record(ctx context.Context, subject client.Object, auditRecord AuditRecord) error {
+
+	if subject == nil {
+		return nil
+	}
+
+	value, err := json.Marshal(auditRecord)
+	if err != nil {
+		return err
+	}
+
+	eventType := corev1.EventTypeNormal
+	if auditRecord.Error != "" {
+		eventType = corev1.EventTypeWarning
+	}
+	s.Recorder.Event(subject, eventType, eventReasonAudit, string(value))
+
+	return nil
+}
+
+// S3Service is the subset of the S3 API used by the agent to write audit records. It is satisfied by the AWS SDK S3 client (*s3.Client.)
+type S3Service interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+}
+
+var _ S3Service = (*s3.Client)(nil)
+
+// S3AuditSink writes each audit record as a JSON object to an S3 bucket, under '{Prefix}/{yyyy}/{mm}/{dd}/'. (Retention and immutability, e.g. using S3 Object Lock, are configured on the bucket.)
+type S3AuditSink struct {
+	Client S3Service
+	Bucket string
+	Prefix string
+}
+
+func (s *S3AuditSink) Name() string {
+	return AuditSinkS3
+}
+
+func (s *S3AuditSink) Record(ctx context.Context, subject client.Object, auditRecord AuditRecord) error {
+
+	value, err := json.Marshal(auditRecord)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	key := path.Join(s.Prefix, now.Format("2006/01/02"), fmt.Sprintf("%s-%s.json", now.Format("150405.000000000"), uuid.NewString()))
+
+	_, err = s.Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.Bucket),
+		Key:         aws.String(key),
+		Body:        strings.NewReader(string(value)),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+// CloudWatchLogsAuditSink writes each audit record as a JSON log event to a CloudWatch Logs log stream, creating the stream (but not the log group) if necessary.
+type CloudWatchLogsAuditSink struct {
+	Client    CloudWatchLogsService
+	LogGroup  string
+	LogStream string
+
+	mutex         sync.Mutex
+	streamCreated bool
+}
+
+func (s *CloudWatchLogsAuditSink) Name() string {
+	return AuditSinkCloudWatch
+}
+
+func (s *CloudWatchLogsAuditSink) Record(ctx context.Context, subject client.Object, auditRecord AuditRecord) error {
+
+	value, err := json.Marshal(auditRecord)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.streamCreated {
+		if err := s.Client.CreateLogStream(ctx, s.LogGroup, s.LogStream); err != nil && !isCloudWatchLogsResourceAlreadyExists(err) {
+			return err
+		}
+		s.streamCreated = true
+	}
+
+	return s.Client.PutLogEvent(ctx, s.LogGroup, s.LogStream, time.Now(), string(value))
+}
@@ -0,0 +1,192 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// Loads the AWS configuration, assuming the specified IAM role (if not empty, otherwise the role of the ACMAgentConfig, if set.)
+// The AWS go library automatically retrieves region, service account-linked role ARN and web identity token from environment variables. See https://aws.github.io/aws-sdk-go-v2/docs/configuring-sdk/
+// These will be automatically set for the pod in which the operator is running as long as the K8s service account is configured appropriately, see the project README and optionally https://docs.aws.amazon.com/eks/latest/userguide/specify-service-account-role.html
+// Outside AWS, the region, credentials and endpoint can instead be set explicitly (see AWSOverrides.)
+// An awsCredentialsError is returned if the agent's own credentials are unavailable (see CheckAWSCredentials.)
+func loadAWSConfig(ctx context.Context, roleArn string) (aws.Config, error) {
+
+	if err := CheckAWSCredentials(ctx); err != nil {
+		return aws.Config{}, err
+	}
+
+	cfg, err := loadDefaultAWSConfig(ctx)
+	if err != nil {
+		return cfg, err
+	}
+
+	// If requested, use another AWS account by assuming the specified IAM role (the agent's own role must be trusted by the target role.)
+	roleArn = effectiveRoleArn(roleArn)
+	if roleArn != "" {
+		parsedArn, err := arn.Parse(roleArn)
+		if err != nil {
+			return cfg, fmt.Errorf("'%s' is not a valid IAM role ARN.", roleArn)
+		}
+		if err := checkARNPartition(parsedArn, cfg.Region); err != nil {
+			return cfg, err
+		}
+		log.FromContext(ctx).Info(fmt.Sprintf("Using assumed IAM role '%s'...", roleArn))
+		cfg = assumeRole(cfg, roleArn)
+	}
+
+	return cfg, nil
+}
+
+// Returns a copy of the AWS configuration whose credentials are obtained by assuming the specified IAM role via STS.
+func assumeRole(cfg aws.Config, roleArn string) aws.Config {
+
+	stsClient := sts.NewFromConfig(cfg)
+	provider := stscreds.NewAssumeRoleProvider(stsClient, roleArn, func(options *stscreds.AssumeRoleOptions) {
+		options.RoleSessionName = global.PACKAGE_NAME
+	})
+
+	output := cfg.Copy()
+	output.Credentials = aws.NewCredentialsCache(provider)
+
+	return output
+}
+
+// Returns all (unique) ACM certificate ARNs recorded in the specified annotations, including regional, CloudFront, acm-certificates and leaf-certificates ARNs.
+func annotatedCertificateArns(annotations map[string]string) []string {
+
+	output := []string{}
+	for _, record := range parseACMCertificateRecords(annotations[global.AGENT_ACM_CERTIFICATES_ANNOTATION]) {
+		if record.CertificateArn != "" && !containsString(output, record.CertificateArn) {
+			output = append(output, record.CertificateArn)
+		}
+	}
+	for _, leafRecord := range parseLeafCertificateRecords(annotations[global.AGENT_LEAF_CERTIFICATES_ANNOTATION]) {
+		for _, record := range leafRecord.ACMCertificates {
+			if record.CertificateArn != "" && !containsString(output, record.CertificateArn) {
+				output = append(output, record.CertificateArn)
+			}
+		}
+	}
+	for key, value := range annotations {
+		if key != global.AGENT_CERTIFICATE_ARN_ANNOTATION && key != global.AGENT_CLOUDFRONT_CERTIFICATE_ARN_ANNOTATION && !strings.HasPrefix(key, global.AGENT_CERTIFICATE_ARN_ANNOTATION+".") {
+			continue
+		}
+		if value != "" && !containsString(output, value) {
+			output = append(output, value)
+		}
+	}
+
+	return output
+}
+
+// Returns true if the annotations (or, if not annotated, the ACMAgentConfig) request that ACM certificates are deleted alongside the K8s object.
+func hasDeletePolicy(annotations map[string]string) bool {
+	deletePolicy, ok := annotations[global.AGENT_DELETE_POLICY_ANNOTATION]
+	if !ok {
+		deletePolicy = currentAgentConfig().DeletePolicy
+	}
+	return strings.EqualFold(deletePolicy, global.DELETE_POLICY_DELETE)
+}
+
+// Deletes the ACM certificates with the specified ARNs, skipping any that are in use by other AWS resources.
+// Certificates that no longer exist are ignored.
+func deleteACMCertificates(ctx context.Context, newACMService ACMServiceFactory, cfg aws.Config, certificateArns []string) error {
+
+	log := log.FromContext(ctx)
+
+	for _, certificateArn := range certificateArns {
+
+		parsedArn, err := arn.Parse(certificateArn)
+		if err != nil {
+			log.Info(fmt.Sprintf("'%s' is not a valid ARN: skipping.", certificateArn))
+			continue
+		}
+
+		acmClient := newACMService(cfg, parsedArn.Region)
+
+		describeOutput, err := acmClient.DescribeCertificate(ctx, &acm.DescribeCertificateInput{CertificateArn: aws.String(certificateArn)})
+		if err != nil {
+			if isACMResourceNotFound(err) {
+				log.Info(fmt.Sprintf("ACM certificate '%s' no longer exists: skipping.", certificateArn))
+				continue
+			}
+			return err
+		}
+
+		if len(describeOutput.Certificate.InUseBy) > 0 {
+			log.Info(fmt.Sprintf("ACM certificate '%s' is in use by %d AWS resource(s) and will not be deleted.", certificateArn, len(describeOutput.Certificate.InUseBy)))
+			continue
+		}
+
+		if currentAgentConfig().DryRun {
+			log.Info(fmt.Sprintf("Dry run: ACM certificate '%s' would be deleted.", certificateArn))
+			continue
+		}
+
+		log.Info(fmt.Sprintf("Deleting ACM certificate '%s'...", certificateArn))
+		_, err = acmClient.DeleteCertificate(ctx, &acm.DeleteCertificateInput{CertificateArn: aws.String(certificateArn)})
+		recordAudit(ctx, AuditRecord{Action: auditActionDelete, CertificateArn: certificateArn, Region: parsedArn.Region, OldSerial: aws.ToString(describeOutput.Certificate.Serial)}, err)
+		if isACMResourceInUse(err) {
+			// ACM may report a certificate as in use after DescribeCertificate does not (e.g. while a load balancer listener is being attached or detached.)
+			log.Info(fmt.Sprintf("ACM certificate '%s' is in use by another AWS resource and will not be deleted.", certificateArn))
+			continue
+		}
+		if err != nil && !isACMResourceNotFound(err) {
+			return err
+		}
+		acmIndex.Forget(certificateArn)
+	}
+
+	return nil
+}
+
+// certificateArnMismatchError indicates that an annotated ACM certificate ARN is malformed, or belongs to a region or account other than the one targeted. ACM would report such certificates as not found (leading to a further import), so retrying will not help until the annotation is corrected.
+type certificateArnMismatchError struct {
+	certificateArn string
+	reason         string
+}
+
+func (e *certificateArnMismatchError) Error() string {
+	return fmt.Sprintf("Annotated ACM certificate ARN '%s' %s: correct or remove the annotation.", e.certificateArn, e.reason)
+}
+
+// Returns a certificateArnMismatchError if the ACM certificate ARN is malformed, or does not belong to the specified region, account (if known) and the agent's partition.
+func checkCertificateArn(certificateArn string, region string, account string) error {
+
+	parsedArn, err := arn.Parse(certificateArn)
+	if err != nil || parsedArn.Service != "acm" || !strings.HasPrefix(parsedArn.Resource, "certificate/") {
+		return &certificateArnMismatchError{certificateArn: certificateArn, reason: "is not an ACM certificate ARN"}
+	}
+	if err := checkARNPartition(parsedArn, region); err != nil {
+		return &certificateArnMismatchError{certificateArn: certificateArn, reason: fmt.Sprintf("belongs to AWS partition '%s', not '%s'", parsedArn.Partition, agentPartition(region))}
+	}
+	if parsedArn.Region != region {
+		return &certificateArnMismatchError{certificateArn: certificateArn, reason: fmt.Sprintf("belongs to region '%s', not '%s'", parsedArn.Region, region)}
+	}
+	if account != "" && parsedArn.AccountID != account {
+		return &certificateArnMismatchError{certificateArn: certificateArn, reason: fmt.Sprintf("belongs to account '%s', not '%s'", parsedArn.AccountID, account)}
+	}
+
+	return nil
+}
@@ -0,0 +1,247 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Keys of the Secret from which AWS credentials are read (see SecretCredentialsProvider.) These match the AWS environment variables, so the same Secret can be used with 'envFrom'.
+const (
+	awsAccessKeyIdKey     = "AWS_ACCESS_KEY_ID"
+	awsSecretAccessKeyKey = "AWS_SECRET_ACCESS_KEY"
+	awsSessionTokenKey    = "AWS_SESSION_TOKEN"
+	awsRegionKey          = "AWS_REGION"
+)
+
+const (
+	// Interval at which AWS credentials are re-read from their Secret, so that rotated credentials are used.
+	awsCredentialsSecretTTL = 5 * time.Minute
+
+	// Interval at which the availability of the agent's own AWS credentials is re-checked (see CheckAWSCredentials.) Objects are re-evaluated at this interval while credentials are unavailable.
+	awsCredentialsCheckInterval = time.Minute
+)
+
+// AWSSettings overrides the AWS region, credentials and endpoint otherwise obtained from the default credential chain (environment, IRSA web identity or instance metadata), for example in clusters outside AWS or when testing against a local AWS emulator.
+type AWSSettings struct {
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Secret holding the credentials (and optionally region), used if AccessKeyID is not set.
+	CredentialsSecret *SecretCredentialsProvider
+	// URL of an endpoint serving all AWS APIs (e.g. 'http://localstack:4566'.)
+	Endpoint string
+}
+
+// AWS settings applied whenever the AWS configuration is loaded. Set before reconcilers are registered with the manager.
+var AWSOverrides = AWSSettings{}
+
+// SecretCredentialsProvider reads AWS credentials from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and (optional) AWS_SESSION_TOKEN keys of a Secret. The Secret may also hold the region (AWS_REGION.)
+type SecretCredentialsProvider struct {
+	// Reader used to retrieve the Secret. Since the AWS configuration is loaded before the manager's cache is started, this is typically the manager's API reader.
+	Reader client.Reader
+	Key    types.NamespacedName
+
+	mutex     sync.Mutex
+	data      map[string][]byte
+	fetchedAt time.Time
+}
+
+// Returns the contents of the Secret, re-reading it once awsCredentialsSecretTTL has elapsed.
+func (p *SecretCredentialsProvider) read(ctx context.Context) (map[string][]byte, error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.data == nil || time.Since(p.fetchedAt) > awsCredentialsSecretTTL {
+		secret := &corev1.Secret{}
+		if err := p.Reader.Get(ctx, p.Key, secret); err != nil {
+			return nil, fmt.Errorf("Unable to read AWS credentials from Secret '%s': %w", p.Key, err)
+		}
+		p.data = secret.Data
+		p.fetchedAt = time.Now()
+	}
+
+	return p.data, nil
+}
+
+// Retrieve implements aws.CredentialsProvider.
+func (p *SecretCredentialsProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+
+	data, err := p.read(ctx)
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+
+	if len(data[awsAccessKeyIdKey]) == 0 || len(data[awsSecretAccessKeyKey]) == 0 {
+		return aws.Credentials{}, fmt.Errorf("Secret '%s' must hold the keys '%s' and '%s'.", p.Key, awsAccessKeyIdKey, awsSecretAccessKeyKey)
+	}
+
+	return aws.Credentials{
+		AccessKeyID:     string(data[awsAccessKeyIdKey]),
+		SecretAccessKey: string(data[awsSecretAccessKeyKey]),
+		SessionToken:    string(data[awsSessionTokenKey]),
+		Source:          fmt.Sprintf("Secret %s", p.Key),
+		CanExpire:       true,
+		Expires:         time.Now().Add(awsCredentialsSecretTTL),
+	}, nil
+}
+
+// Region returns the region held in the Secret, or an empty string if none.
+func (p *SecretCredentialsProvider) Region(ctx context.Context) (string, error) {
+	data, err := p.read(ctx)
+	if err != nil {
+		return "", err
+	}
+	return string(data[awsRegionKey]), nil
+}
+
+// Loads the AWS configuration of the agent's own identity, applying AWSOverrides. (Use loadAWSConfig to assume a role.)
+func loadDefaultAWSConfig(ctx context.Context) (aws.Config, error) {
+
+	optFns := []func(*config.LoadOptions) error{}
+
+	region := AWSOverrides.Region
+
+	if AWSOverrides.AccessKeyID != "" {
+		optFns = append(optFns, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(AWSOverrides.AccessKeyID, AWSOverrides.SecretAccessKey, AWSOverrides.SessionToken)))
+	} else if AWSOverrides.CredentialsSecret != nil {
+		if region == "" {
+			secretRegion, err := AWSOverrides.CredentialsSecret.Region(ctx)
+			if err != nil {
+				return aws.Config{}, err
+			}
+			region = secretRegion
+		}
+		optFns = append(optFns, config.WithCredentialsProvider(AWSOverrides.CredentialsSecret))
+	}
+
+	// Explicit credentials are used outside AWS, where (slow) attempts to reach instance metadata would fail.
+	if AWSOverrides.AccessKeyID != "" || AWSOverrides.CredentialsSecret != nil {
+		optFns = append(optFns, config.WithEC2IMDSClientEnableState(imds.ClientDisabled))
+	}
+
+	if region != "" {
+		optFns = append(optFns, config.WithRegion(region))
+	}
+
+	if AWSOverrides.Endpoint != "" {
+		endpoint := AWSOverrides.Endpoint
+		optFns = append(optFns, config.WithEndpointResolverWithOptions(aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+			return aws.Endpoint{URL: endpoint, SigningRegion: region, HostnameImmutable: true}, nil
+		})))
+	}
+
+	return config.LoadDefaultConfig(ctx, optFns...)
+}
+
+// awsCredentialsError indicates that the agent's own AWS credentials could not be obtained (e.g. its service account is not configured for IRSA), so that no AWS API can be called until its configuration is corrected.
+type awsCredentialsError struct {
+	cause error
+	hint  string
+}
+
+func (e *awsCredentialsError) Error() string {
+	return fmt.Sprintf("AWS credentials are unavailable (%s): %s", strings.TrimSuffix(e.cause.Error(), "."), e.hint)
+}
+
+func (e *awsCredentialsError) Unwrap() error {
+	return e.cause
+}
+
+// The outcome of the most recent check of the agent's own AWS credentials.
+var awsCredentialsStatus = &awsCredentialsState{}
+
+type awsCredentialsState struct {
+	mutex     sync.Mutex
+	err       error
+	checkedAt time.Time
+}
+
+// CheckAWSCredentials returns an awsCredentialsError if the agent's own AWS credentials cannot be obtained, re-checking at most every awsCredentialsCheckInterval. (For IRSA, obtaining credentials exchanges the service account token for those of its role, so a missing or untrusted role is detected as well as missing configuration.)
+// Changes in availability are logged once, rather than on every reconcile.
+func CheckAWSCredentials(ctx context.Context) error {
+
+	status := awsCredentialsStatus
+	status.mutex.Lock()
+	defer status.mutex.Unlock()
+
+	if !status.checkedAt.IsZero() && time.Since(status.checkedAt) < awsCredentialsCheckInterval {
+		return status.err
+	}
+
+	err := retrieveAWSCredentials(ctx)
+	if err != nil && (status.err == nil || status.err.Error() != err.Error()) {
+		log.FromContext(ctx).Error(err, "AWS credentials are unavailable: no certificates will be synchronized with ACM until they are.")
+	} else if err == nil && status.err != nil {
+		log.FromContext(ctx).Info("AWS credentials are available.")
+	}
+	status.err = err
+	status.checkedAt = time.Now()
+
+	return err
+}
+
+// AWSCredentialsReadyCheck is a readiness check (see healthz.Checker) that fails while the agent's own AWS credentials are unavailable.
+func AWSCredentialsReadyCheck(req *http.Request) error {
+	return CheckAWSCredentials(req.Context())
+}
+
+// Obtains the agent's own AWS credentials, returning an awsCredentialsError (describing how the agent's configuration may be corrected) if they are unavailable.
+func retrieveAWSCredentials(ctx context.Context) error {
+
+	cfg, err := loadDefaultAWSConfig(ctx)
+	if err == nil {
+		if cfg.Credentials == nil {
+			err = errors.New("No AWS credentials are configured.")
+		} else {
+			_, err = cfg.Credentials.Retrieve(ctx)
+		}
+	}
+	if err == nil {
+		return nil
+	}
+
+	return &awsCredentialsError{cause: err, hint: awsCredentialsHint()}
+}
+
+// Returns a suggestion for correcting the source of the agent's own AWS credentials.
+func awsCredentialsHint() string {
+	switch {
+	case AWSOverrides.AccessKeyID != "":
+		return "Check the access key configured for the agent."
+	case AWSOverrides.CredentialsSecret != nil:
+		return fmt.Sprintf("Check that Secret '%s' exists, and holds the keys '%s' and '%s' of a valid access key.", AWSOverrides.CredentialsSecret.Key, awsAccessKeyIdKey, awsSecretAccessKeyKey)
+	case os.Getenv("AWS_ROLE_ARN") != "" && os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "":
+		return fmt.Sprintf("Check that IAM role '%s' exists and that its trust policy allows the agent's service account (via the cluster's OIDC provider) to assume it.", os.Getenv("AWS_ROLE_ARN"))
+	case os.Getenv("AWS_ROLE_ARN") != "" || os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "":
+		return "IRSA is only partly configured: check that the EKS pod identity webhook is running, then restart the agent."
+	default:
+		return "Annotate the agent's service account with 'eks.amazonaws.com/role-arn' (IRSA) and restart the agent or, outside AWS, set 'awsCredentialsSecret'."
+	}
+}
@@ -0,0 +1,156 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// Default interval between checks of AWS connectivity.
+	defaultAWSHealthCheckInterval = time.Minute
+
+	// Maximum duration of each check of AWS connectivity.
+	awsHealthCheckTimeout = 30 * time.Second
+)
+
+// AWSHealthChecker periodically checks that the agent can reach AWS with valid credentials, by identifying itself to STS (GetCallerIdentity) and listing ACM certificates in its own region. It is added to the manager as a Runnable, and its results are served by the agent's health and readiness checks.
+type AWSHealthChecker struct {
+	// Interval between checks. Defaults to defaultAWSHealthCheckInterval.
+	Interval time.Duration
+
+	// Duration without a successful check after which the agent is reported as unhealthy (so that it is restarted, e.g. to pick up a replaced IRSA token.) Zero if the agent is never reported as unhealthy.
+	FailureThreshold time.Duration
+
+	mutex       sync.Mutex
+	startedAt   time.Time
+	lastErr     error
+	lastChecked time.Time
+	lastSuccess time.Time
+}
+
+// Start implements manager.Runnable, checking AWS connectivity every Interval until the context is cancelled.
+func (c *AWSHealthChecker) Start(ctx context.Context) error {
+
+	interval := c.Interval
+	if interval <= 0 {
+		interval = defaultAWSHealthCheckInterval
+	}
+
+	ctx = log.IntoContext(ctx, log.Log.WithName("aws-health-check"))
+
+	c.mutex.Lock()
+	c.startedAt = time.Now()
+	c.mutex.Unlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		c.check(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable: every replica checks its own connectivity.
+func (c *AWSHealthChecker) NeedLeaderElection() bool {
+	return false
+}
+
+// Checks AWS connectivity, recording the outcome. Changes in connectivity are logged once, rather than on every check.
+func (c *AWSHealthChecker) check(ctx context.Context) {
+
+	log := log.FromContext(ctx)
+
+	checkCtx, cancel := context.WithTimeout(ctx, awsHealthCheckTimeout)
+	defer cancel()
+	err := checkAWSConnectivity(checkCtx)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err != nil && (c.lastErr == nil || c.lastErr.Error() != err.Error()) {
+		log.Error(err, "AWS health check failed.")
+	} else if err == nil && c.lastErr != nil {
+		log.Info("AWS health check succeeded.")
+	}
+	c.lastErr = err
+	c.lastChecked = time.Now()
+	if err == nil {
+		c.lastSuccess = c.lastChecked
+	}
+}
+
+// Identifies the agent to STS and lists ACM certificates in its region (if known), returning the first error encountered.
+func checkAWSConnectivity(ctx context.Context) error {
+
+	cfg, err := loadDefaultAWSConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("Failed to load AWS configuration: %s", err)
+	}
+
+	if _, err := sts.NewFromConfig(cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{}); err != nil {
+		return fmt.Errorf("STS GetCallerIdentity failed: %s", err)
+	}
+
+	if cfg.Region != "" {
+		if _, err := NewAWSACMService(cfg, cfg.Region).ListCertificates(ctx, &acm.ListCertificatesInput{MaxItems: aws.Int32(1)}); err != nil {
+			return fmt.Errorf("ACM ListCertificates failed in region '%s': %s", cfg.Region, err)
+		}
+	}
+
+	return nil
+}
+
+// ReadyCheck is a readiness check (see healthz.Checker) that fails until AWS connectivity has been confirmed, and while the most recent check failed.
+func (c *AWSHealthChecker) ReadyCheck(req *http.Request) error {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.lastChecked.IsZero() {
+		return errors.New("AWS connectivity has not yet been checked.")
+	}
+	return c.lastErr
+}
+
+// HealthCheck is a health check (see healthz.Checker) that fails once no check has succeeded for FailureThreshold.
+func (c *AWSHealthChecker) HealthCheck(req *http.Request) error {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.FailureThreshold <= 0 || c.startedAt.IsZero() {
+		return nil
+	}
+
+	since := c.lastSuccess
+	if since.IsZero() {
+		since = c.startedAt
+	}
+	if time.Since(since) > c.FailureThreshold {
+		return fmt.Errorf("No AWS health check has succeeded for %s: %s", time.Since(since).Round(time.Second), c.lastErr)
+	}
+	return nil
+}
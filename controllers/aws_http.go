@@ -0,0 +1,159 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// awsAPIError is an error returned by an AWS API invoked using awsHTTPClient.
+type awsAPIError struct {
+	Service string
+	Code    string
+	Message string
+}
+
+func (e *awsAPIError) Error() string {
+	return fmt.Sprintf("AWS %s request failed (%s): %s", e.Service, e.Code, e.Message)
+}
+
+// Returns true if the error is an AWS API error with the specified code (ignoring any namespace prefix, e.g. 'com.amazonaws.logs#'.)
+func isAWSAPIError(err error, code string) bool {
+	var apiErr *awsAPIError
+	return errors.As(err, &apiErr) && (apiErr.Code == code || strings.HasSuffix(apiErr.Code, "#"+code))
+}
+
+// awsHTTPClient invokes an AWS API directly, signing requests with the credentials of the AWS configuration. It is used for APIs of which the agent uses only one or two operations (so that their SDK clients are not required.)
+type awsHTTPClient struct {
+	cfg        aws.Config
+	service    string // Signing name and endpoint prefix of the API (e.g. 'logs'.)
+	signer     *v4.Signer
+	httpClient *http.Client
+}
+
+func newAWSHTTPClient(cfg aws.Config, service string) *awsHTTPClient {
+	return &awsHTTPClient{
+		cfg:        cfg,
+		service:    service,
+		signer:     v4.NewSigner(),
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Invokes an operation of an API using the JSON protocol (e.g. CloudWatch Logs, EventBridge), returning the response body. target is the operation's 'X-Amz-Target' (e.g. 'Logs_20140328.PutLogEvents'.)
+func (c *awsHTTPClient) postJSON(ctx context.Context, region string, target string, input interface{}) ([]byte, error) {
+
+	body, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.post(ctx, region, "application/x-amz-json-1.1", map[string]string{"X-Amz-Target": target}, body)
+}
+
+// Invokes an operation of an API using the Query protocol (e.g. SNS), returning the response body. values must include the 'Action' and 'Version' of the operation.
+func (c *awsHTTPClient) postQuery(ctx context.Context, region string, values url.Values) ([]byte, error) {
+	return c.post(ctx, region, "application/x-www-form-urlencoded; charset=utf-8", nil, []byte(values.Encode()))
+}
+
+func (c *awsHTTPClient) post(ctx context.Context, region string, contentType string, headers map[string]string, body []byte) ([]byte, error) {
+
+	if region == "" {
+		region = c.cfg.Region
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint(region), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	credentials, err := c.cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	payloadHash := sha256.Sum256(body)
+	if err := c.signer.SignHTTP(ctx, credentials, req, hex.EncodeToString(payloadHash[:]), c.service, region, time.Now()); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, c.parseError(resp.Status, responseBody)
+	}
+
+	return responseBody, nil
+}
+
+// Returns the URL of the API's endpoint in the region, as resolved by the AWS configuration's endpoint resolver (if any, see AWSSettings.Endpoint.)
+func (c *awsHTTPClient) endpoint(region string) string {
+	if c.cfg.EndpointResolverWithOptions != nil {
+		if endpoint, err := c.cfg.EndpointResolverWithOptions.ResolveEndpoint(c.service, region); err == nil && endpoint.URL != "" {
+			return endpoint.URL
+		}
+	}
+	return fmt.Sprintf("https://%s.%s.%s/", c.service, region, partitionDNSSuffix(region))
+}
+
+// Returns the error described by the body of a failed response (JSON for the JSON protocol, XML for the Query protocol.)
+func (c *awsHTTPClient) parseError(status string, body []byte) error {
+
+	apiErr := &awsAPIError{Service: c.service}
+
+	jsonError := struct {
+		Type         string `json:"__type"`
+		Message      string `json:"message"`
+		MessageUpper string `json:"Message"`
+	}{}
+	xmlError := struct {
+		Code    string `xml:"Error>Code"`
+		Message string `xml:"Error>Message"`
+	}{}
+	if json.Unmarshal(body, &jsonError) == nil && jsonError.Type != "" {
+		apiErr.Code = jsonError.Type
+		apiErr.Message = jsonError.Message + jsonError.MessageUpper
+	} else if xml.Unmarshal(body, &xmlError) == nil && xmlError.Code != "" {
+		apiErr.Code = xmlError.Code
+		apiErr.Message = xmlError.Message
+	} else {
+		apiErr.Code = status
+		apiErr.Message = strings.TrimSpace(string(body))
+	}
+
+	return apiErr
+}
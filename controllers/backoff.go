@@ -0,0 +1,269 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"golang.org/x/time/rate"
+	"k8s.io/client-go/util/workqueue"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/ratelimiter"
+)
+
+const (
+	// Delay before the first retry of an object. Doubles on each subsequent failure, up to MaxRequeueDelay.
+	minRequeueDelay = 1 * time.Second
+
+	// Upper bound on the maximum requeue delay, however configured.
+	maxRequeueDelayLimit = 24 * time.Hour
+
+	// Minimum pause applied to all reconcilers when AWS reports throttling without specifying a Retry-After interval.
+	defaultThrottlingDelay = 30 * time.Second
+)
+
+// RequeueJitter is the maximum fraction by which per-object requeue delays are randomly extended, so that objects which fail together (e.g. during an AWS outage) are not all retried together. Set before reconcilers are registered with the manager.
+var RequeueJitter = 0.1
+
+// MaxRetries is the number of consecutive times reconciliation of an object may fail (or be retried) before the object is parked: it is then not retried until it changes (0 for no limit.) Set before reconcilers are registered with the manager.
+var MaxRetries = 0
+
+// MaxRequeueDelay is the ceiling for the per-object exponential backoff applied when reconciliation fails or must be retried. Set before reconcilers are registered with the manager.
+var MaxRequeueDelay = 5 * time.Minute
+
+// Tracks the time until which AWS has asked the agent to back off.
+type awsThrottlingState struct {
+	mutex sync.Mutex
+	until time.Time
+}
+
+var awsThrottling = &awsThrottlingState{}
+
+// Returns the remaining time during which AWS API calls should be avoided.
+func (s *awsThrottlingState) remaining() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return time.Until(s.until)
+}
+
+// Extends the throttling window if the error indicates that AWS is throttling requests. Returns true if the error was a throttling error.
+func (s *awsThrottlingState) record(err error) bool {
+
+	if err == nil || retry.IsErrorThrottles(retry.DefaultThrottles).IsErrorThrottle(err) != aws.TrueTernary {
+		return false
+	}
+
+	delay := defaultThrottlingDelay
+	var responseError *smithyhttp.ResponseError
+	if errors.As(err, &responseError) && responseError.Response != nil {
+		if seconds, parseErr := strconv.Atoi(responseError.Response.Header.Get("Retry-After")); parseErr == nil && seconds > 0 {
+			delay = time.Duration(seconds) * time.Second
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if until := time.Now().Add(delay); until.After(s.until) {
+		s.until = until
+	}
+
+	return true
+}
+
+// Rate limiter which delays every object for the remainder of any AWS throttling window.
+type awsThrottlingRateLimiter struct{}
+
+func (awsThrottlingRateLimiter) When(item interface{}) time.Duration {
+	if remaining := awsThrottling.remaining(); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+func (awsThrottlingRateLimiter) Forget(item interface{}) {}
+
+func (awsThrottlingRateLimiter) NumRequeues(item interface{}) int { return 0 }
+
+// Caps the delays of another rate limiter at the current maximum requeue delay (see maxRequeueDelay), so that changes to the ACMAgentConfig apply to existing work queues.
+type maxRequeueDelayRateLimiter struct {
+	ratelimiter.RateLimiter
+}
+
+func (l maxRequeueDelayRateLimiter) When(item interface{}) time.Duration {
+	delay := l.RateLimiter.When(item)
+	if ceiling := maxRequeueDelay(); delay > ceiling {
+		return ceiling
+	}
+	return delay
+}
+
+// Randomly extends the delays of another rate limiter by up to RequeueJitter.
+type jitterRateLimiter struct {
+	ratelimiter.RateLimiter
+}
+
+func (l jitterRateLimiter) When(item interface{}) time.Duration {
+	delay := l.RateLimiter.When(item)
+	if RequeueJitter > 0 {
+		delay += time.Duration(rand.Float64() * RequeueJitter * float64(delay))
+	}
+	return delay
+}
+
+// Builds the rate limiter used by all reconcilers: per-object exponential backoff starting at requeueDelay (capped at the maximum requeue delay, and jittered), an overall rate limit, and a shared pause while AWS is throttling requests.
+// If requeueDelay is zero, backoff starts at minRequeueDelay.
+func newRateLimiter(requeueDelay time.Duration) ratelimiter.RateLimiter {
+	if requeueDelay <= 0 {
+		requeueDelay = minRequeueDelay
+	}
+	return workqueue.NewMaxOfRateLimiter(
+		jitterRateLimiter{maxRequeueDelayRateLimiter{workqueue.NewItemExponentialFailureRateLimiter(requeueDelay, maxRequeueDelayLimit)}},
+		&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(10), 100)},
+		awsThrottlingRateLimiter{},
+	)
+}
+
+// Records each retry of an object in the retry metrics of the controller (see reconcileRetriesTotal.) Retries are not reported per object, since the metric's cardinality would grow with the number of objects: the retries of each Secret are recorded in its retry-count annotation instead.
+type retryMetricsRateLimiter struct {
+	ratelimiter.RateLimiter
+	controller string
+}
+
+func (l retryMetricsRateLimiter) When(item interface{}) time.Duration {
+	delay := l.RateLimiter.When(item)
+	reconcileRetriesTotal.WithLabelValues(l.controller).Inc()
+	return delay
+}
+
+// Requeues the object being reconciled using the rate limiter. If err is nil, the object is retried without reporting an error (e.g. while waiting for a dependency to become available.)
+// AWS throttling errors additionally pause reconciliation of all objects until the throttling window has passed.
+func requeueWithBackoff(err error) (ctrl.Result, error) {
+	if err == nil {
+		return ctrl.Result{Requeue: true}, nil
+	}
+	awsThrottling.record(err)
+	return ctrl.Result{}, err
+}
+
+// Codes of AWS API errors rejecting a request as invalid (e.g. a malformed certificate, or an invalid tag), which retrying the same request will not resolve.
+var permanentAPIErrorCodes = map[string]bool{
+	"ValidationException":       true,
+	"InvalidParameterException": true,
+	"InvalidArnException":       true,
+	"InvalidTagException":       true,
+	"TooManyTagsException":      true,
+	"TagPolicyException":        true,
+}
+
+// permanentError wraps a failure that retrying will not resolve until the object being reconciled changes (e.g. ACM rejecting a certificate as malformed.) Objects failing with a permanentError are given a terminal status and are not requeued. Transient failures (e.g. throttling, network or server errors) are not wrapped, and are retried with backoff.
+type permanentError struct {
+	err  error
+	code string // Code of the AWS API error.
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// classifyError wraps err in a permanentError if it is an AWS API error rejecting the request as invalid (see permanentAPIErrorCodes.) Other errors are returned unchanged.
+func classifyError(err error) error {
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && permanentAPIErrorCodes[apiErr.ErrorCode()] {
+		return &permanentError{err: err, code: apiErr.ErrorCode()}
+	}
+	return err
+}
+
+// retryLimiter applies a reconciler's rate limiter, and parks objects which have been retried MaxRetries consecutive times so that they are not retried again until they change.
+// A nil retryLimiter never parks objects.
+type retryLimiter struct {
+	rateLimiter ratelimiter.RateLimiter
+	controller  string // Name of the controller, by which its retries are reported.
+	mutex       sync.Mutex
+	parked      map[ctrl.Request]string // Revision (e.g. resource version) of each parked object when it was parked.
+}
+
+// Returns a retryLimiter for the named controller, whose per-object backoff starts at requeueDelay (see newRateLimiter.)
+func newRetryLimiter(controller string, requeueDelay time.Duration) *retryLimiter {
+	return &retryLimiter{
+		rateLimiter: retryMetricsRateLimiter{RateLimiter: newRateLimiter(requeueDelay), controller: controller},
+		controller:  controller,
+		parked:      map[ctrl.Request]string{},
+	}
+}
+
+// NumRequeues returns the number of consecutive times the object has been retried (0 for a nil retryLimiter.)
+func (l *retryLimiter) NumRequeues(req ctrl.Request) int {
+	if l == nil {
+		return 0
+	}
+	return l.rateLimiter.NumRequeues(req)
+}
+
+// Parked returns true if the object has been parked and has not changed since (i.e. its revision is the same.) Otherwise, the object is no longer parked.
+func (l *retryLimiter) Parked(req ctrl.Request, revision string) bool {
+
+	if l == nil {
+		return false
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	parkedRevision, ok := l.parked[req]
+	if ok && parkedRevision == revision {
+		return true
+	}
+	if ok {
+		delete(l.parked, req)
+	}
+	return false
+}
+
+// Exhausted returns true if the object has been retried MaxRetries consecutive times (and so should be parked.)
+func (l *retryLimiter) Exhausted(req ctrl.Request) bool {
+	return l != nil && MaxRetries > 0 && l.rateLimiter.NumRequeues(req) >= MaxRetries
+}
+
+// Park stops the object from being retried until its revision changes (see Parked.) The revision should be read after any terminal status has been recorded on the object.
+func (l *retryLimiter) Park(req ctrl.Request, revision string) {
+
+	if l == nil {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.parked[req] = revision
+	objectsParkedTotal.WithLabelValues(l.controller).Inc()
+}
+
+// Returns the message recorded against objects that are parked.
+func retriesExhaustedMessage() string {
+	return fmt.Sprintf("Reconciliation has been retried %d times without success: retries are suspended until the object changes.", MaxRetries)
+}
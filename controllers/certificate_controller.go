@@ -14,32 +14,91 @@ import (
 	"context"
 	"fmt"
 	"strconv"
+	"strings"
+	"time"
 
 	cm "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
 	"github.com/pkg/errors"
 	corev1 "k8s.io/api/core/v1"
 	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	"Validitron/k8s-acm-certificate-agent/global"
 )
 
 // CertificateReconciler allows certificate-agent to be enabled by annotating the cert-manager Certificate rather than the Secret itself.
-// The only responsibility of CertificateReconciler is to add/remove management annotations from the Secret.
-// Annotations are then picked up by SecretReconciler which does the actual work of communicating with ACM.
+// The main responsibility of CertificateReconciler is to add/remove management annotations from the Secret.
+// Annotations are then picked up by SecretReconciler which does the actual work of communicating with ACM. The outcome (as recorded in the Secret's sync-status annotation) is reported back as an 'ACMSynced' condition in the status of the Certificate.
 type CertificateReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// If true, ACM certificates are deleted alongside Certificates annotated with a 'Delete' delete-policy.
+	EnableCertificateDeletion bool
+
+	// Maximum number of objects reconciled in parallel (default 1.)
+	MaxConcurrentReconciles int
+
+	// Delay before the first retry of an object whose reconciliation fails (doubling on each subsequent failure.) Defaults to 1 second.
+	RequeueDelay time.Duration
+
+	// Retries of failed objects, parking those that exceed MaxRetries. Set by SetupWithManager.
+	retries *retryLimiter
 }
 
+// Condition type, reported in the status of managed Certificates, that describes the state of synchronization with ACM.
+const certificateConditionACMSynced cm.CertificateConditionType = "ACMSynced"
+
+// Configuration annotations that, when set on a Certificate, are copied to the Secret it manages.
+var inheritedAnnotations = []string{
+	global.AGENT_REGIONS_ANNOTATION,
+	global.AGENT_TAGS_ANNOTATION,
+	global.AGENT_FETCH_CHAIN_ANNOTATION,
+	global.AGENT_CHECK_REVOCATION_ANNOTATION,
+	global.AGENT_ASSUME_ROLE_ARN_ANNOTATION,
+	global.AGENT_DELETE_POLICY_ANNOTATION,
+	global.AGENT_USE_FOR_ANNOTATION,
+	global.AGENT_LISTENER_ARNS_ANNOTATION,
+	global.AGENT_LISTENER_CERTIFICATE_ANNOTATION,
+}
+
+const (
+	certificateSecretNameField = "spec.secretName"
+)
+
 func (r *CertificateReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	// Tells the controller which object type this reconciler will handle.
+
+	r.retries = newRetryLimiter("certificate", r.RequeueDelay)
+
+	// Index the Secret name so that Secrets (re-)created by cert-manager can be mapped back to the Certificates that manage them.
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &cm.Certificate{}, certificateSecretNameField, func(rawObj client.Object) []string {
+		certificate := rawObj.(*cm.Certificate)
+		if certificate.Spec.SecretName == "" {
+			return nil
+		}
+		return []string{certificate.Spec.SecretName}
+	}); err != nil {
+		return err
+	}
+
+	// Tells the controller which object type this reconciler will handle. Changes to managed Secrets (e.g. once synchronized with ACM), and the re-creation of Secrets by cert-manager, also trigger reconciliation of their Certificate.
 	return ctrl.NewControllerManagedBy(mgr).
+		Named("certificate").
 		For(&cm.Certificate{}).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.FindCertificateForSecret)).
+		WithOptions(controller.Options{RateLimiter: r.retries.rateLimiter, MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
 		WithLogConstructor(buildLogConstructor(mgr, "certificate-reconciler", "cert-manager.io", "certificate")). // When multiple controllers running with a single manager, the log auto-constructor does not work. Therefore we must do manually.
 		Complete(r)
 }
@@ -54,10 +113,13 @@ func (r *CertificateReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		if !k8serr.IsNotFound(err) {
 			log.Error(err, fmt.Sprintf("Unable to retrieve Certificate '%s'.", req.NamespacedName))
 		}
-		return ctrl.Result{RequeueAfter: defaultRequeueLatency}, client.IgnoreNotFound(err)
+		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
-	log.Info(fmt.Sprintf("Processing Certificate %s...", req.NamespacedName))
+	log.V(1).Info(fmt.Sprintf("Processing Certificate %s...", req.NamespacedName))
+
+	// Changes made to ACM are recorded in the audit trail against this object.
+	ctx = withAuditSubject(ctx, "Certificate", certificate)
 
 	// Certificate is marked for deletion, so clean up annotations (if they exist) on the Secret regardless of the management state.
 	if !certificate.ObjectMeta.DeletionTimestamp.IsZero() {
@@ -67,6 +129,26 @@ func (r *CertificateReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 
 			// Secret may not yet exist, so fail silently if we can't get it.
 			secret, err := r.GetSecret(certificate)
+
+			// If requested, remove the ACM certificate(s) associated with this Certificate. This is best effort: failures are logged but do not block deletion.
+			if r.EnableCertificateDeletion && hasDeletePolicy(certificate.Annotations) {
+				certificateArns := annotatedCertificateArns(certificate.Annotations)
+				if err == nil {
+					certificateArns = annotatedCertificateArns(secret.Annotations)
+				}
+				if len(certificateArns) > 0 {
+					log.Info("Removing unused ACM certificates...")
+					cfg, cfgErr := loadAWSConfig(ctx, certificate.Annotations[global.AGENT_ASSUME_ROLE_ARN_ANNOTATION])
+					if cfgErr == nil {
+						cfgErr = deleteACMCertificates(ctx, NewAWSACMService, cfg, certificateArns)
+					}
+					if cfgErr != nil {
+						log.Error(cfgErr, "ACM certificate deletion failed.")
+						r.Recorder.Event(certificate, corev1.EventTypeWarning, eventReasonACMError, fmt.Sprintf("ACM certificate deletion failed: %s", cfgErr))
+					}
+				}
+			}
+
 			if err == nil {
 
 				log.Info(fmt.Sprintf("Stripping annotations from Certificate-managed Secret '%s'...", secret.Name))
@@ -85,12 +167,12 @@ func (r *CertificateReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 			if !k8serr.IsNotFound(err) {
 				log.Error(err, fmt.Sprintf("Unable to retrieve Certificate '%s'.", req.NamespacedName))
 			}
-			return ctrl.Result{RequeueAfter: defaultRequeueLatency}, client.IgnoreNotFound(err)
+			return ctrl.Result{}, client.IgnoreNotFound(err)
 		}
 
 		certificate.ObjectMeta.Finalizers = removeString(certificate.ObjectMeta.Finalizers, finalizerID)
 		if err := r.Update(ctx, certificate); err != nil {
-			return ctrl.Result{RequeueAfter: defaultRequeueLatency}, errors.Wrap(err, "Could not remove finalizer from Certificate.")
+			return requeueWithBackoff(errors.Wrap(err, "Could not remove finalizer from Certificate."))
 		}
 
 		log.Info("Certificate is marked for deletion: clean up complete.")
@@ -101,16 +183,28 @@ func (r *CertificateReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 	if !containsString(certificate.ObjectMeta.Finalizers, finalizerID) {
 		certificate.ObjectMeta.Finalizers = append(certificate.ObjectMeta.Finalizers, finalizerID)
 		if err := r.Update(ctx, certificate); err != nil {
-			return ctrl.Result{RequeueAfter: defaultRequeueLatency}, errors.Wrap(err, "Could not add finalizer to Certificate.")
+			return requeueWithBackoff(errors.Wrap(err, "Could not add finalizer to Certificate."))
 		}
 	}
 
+	// Objects whose retries have been exhausted are not reconciled again until they change.
+	if r.retries.Parked(req, certificate.ResourceVersion) {
+		log.Info("Certificate is parked (retries exhausted): nothing to do.")
+		return ctrl.Result{}, nil
+	}
+	if r.retries.Exhausted(req) {
+		log.Info(retriesExhaustedMessage())
+		r.Recorder.Event(certificate, corev1.EventTypeWarning, eventReasonRetriesExhausted, retriesExhaustedMessage())
+		r.retries.Park(req, certificate.ResourceVersion)
+		return ctrl.Result{}, nil
+	}
+
 	// Retrieve linked Secret...
 	secret, err := r.GetSecret(certificate)
 	if err != nil {
 		if k8serr.IsNotFound(err) {
 			log.Info(fmt.Sprintf("Certificate-managed Secret '%s' not found: will retry.", certificate.Namespace+"/"+certificate.Spec.SecretName))
-			return ctrl.Result{RequeueAfter: defaultRequeueLatency}, nil
+			return requeueWithBackoff(nil)
 		} else {
 			log.Error(err, "Unable to retrieve Certificate-managed Secret.")
 			return ctrl.Result{}, err
@@ -132,8 +226,18 @@ func (r *CertificateReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		if secretInheritsFrom == string(certificate.UID) {
 			secretIsManagedByThisCertificate = true
 		} else {
-			log.Info(fmt.Sprintf("Secret '%s' is annotated as managed, but not by this Certificate: aborting.", namespacedName(secret.ObjectMeta)))
-			return ctrl.Result{}, nil
+			exists, err := r.CertificateExists(ctx, certificate.Namespace, secretInheritsFrom)
+			if err != nil {
+				log.Error(err, "Unable to list Certificates.")
+				return requeueWithBackoff(err)
+			}
+			if exists {
+				log.Info(fmt.Sprintf("Secret '%s' is annotated as managed, but not by this Certificate: aborting.", namespacedName(secret.ObjectMeta)))
+				return ctrl.Result{}, nil
+			}
+			// The Certificate from which the Secret inherits no longer exists (e.g. it was deleted and re-created, or restored from a backup with a new UID, without the agent's finalizer running.) Adopt the Secret rather than leaving it orphaned.
+			log.Info(fmt.Sprintf("Secret '%s' is annotated as managed by a Certificate that no longer exists: adopting.", namespacedName(secret.ObjectMeta)))
+			secretIsManagedByThisCertificate = true
 		}
 	}
 
@@ -157,31 +261,42 @@ func (r *CertificateReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 			if err != nil {
 				// Log the problem but allow the certificate to be
 				log.Error(err, "Unable to update Secret.")
+			} else {
+				r.Recorder.Event(certificate, corev1.EventTypeNormal, eventReasonAnnotationsRemoved, fmt.Sprintf("Agent annotations removed from Secret '%s'.", secret.Name))
 			}
 		}
 
-		return ctrl.Result{}, nil
+		return r.RemoveSyncCondition(ctx, certificate)
 	}
 
 	// If the secret is marked as agent enabled and managed by this certificate...
 	if secretAgentEnabled && secretIsManagedByThisCertificate {
 
+		// Keep configuration annotations set on the Certificate in step with the Secret. Secrets annotated before owner references were introduced (or adopted from a deleted Certificate) are also brought under this Certificate's ownership.
+		secretPatch := client.MergeFrom(secret.DeepCopy())
+		ownershipModified := r.SetSecretOwnership(secret, certificate)
+		if r.CopyInheritedAnnotations(secret, certificate) || ownershipModified {
+			log.Info(fmt.Sprintf("Updating inherited annotations on Certificate-managed Secret '%s'...", namespacedName(secret.ObjectMeta)))
+			if err := r.Patch(ctx, secret, secretPatch); err != nil {
+				log.Error(err, "Unable to update Secret.")
+				return requeueWithBackoff(err)
+			}
+		}
+
 		// Check to see if the secret as a certificateARN that we can cache (in case the secret is accidentally deleted.)
 		secretCertificateArn, ok := secret.Annotations[global.AGENT_CERTIFICATE_ARN_ANNOTATION]
 		if ok && secretCertificateArn != "" && certificate.Annotations[global.AGENT_CERTIFICATE_ARN_ANNOTATION] != secretCertificateArn {
 
 			log.Info("Persisting ACM certificate ARN back to Certificate...")
-			certificate.Annotations[global.AGENT_CERTIFICATE_ARN_ANNOTATION] = secretCertificateArn
-			if err := r.Update(ctx, certificate); err != nil {
-				return ctrl.Result{RequeueAfter: defaultRequeueLatency}, errors.Wrap(err, "Could not add annotation to Certificate.")
+			certificatePatch := client.MergeFrom(certificate.DeepCopy())
+			setAnnotation(certificate, global.AGENT_CERTIFICATE_ARN_ANNOTATION, secretCertificateArn)
+			if err := r.Patch(ctx, certificate, certificatePatch); err != nil {
+				return requeueWithBackoff(errors.Wrap(err, "Could not add annotation to Certificate."))
 			}
 
-		} else {
-			// Otherwise, nothing to do.
-			log.Info("Secret is configured for agent management: nothing to do.")
 		}
 
-		return ctrl.Result{}, nil
+		return r.UpdateSyncCondition(ctx, certificate, secret)
 	}
 
 	// Otherwise... mark Secret as agent-enabled.
@@ -189,12 +304,126 @@ func (r *CertificateReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 	annotationErr := r.AddSecretManagementAnnotations(secret, certificate)
 	if annotationErr != nil {
 		log.Error(annotationErr, "Unable to update Secret.")
-		return ctrl.Result{RequeueAfter: defaultRequeueLatency}, annotationErr
+		return requeueWithBackoff(annotationErr)
+	}
+	r.Recorder.Event(certificate, corev1.EventTypeNormal, eventReasonAnnotationsAdded, fmt.Sprintf("Agent annotations added to Secret '%s'.", secret.Name))
+
+	return r.UpdateSyncCondition(ctx, certificate, secret)
+}
+
+// FindCertificateForSecret maps a Secret to the cert-manager Certificate that manages it (if any.) Secrets without agent annotations (e.g. because cert-manager has just re-created them) are mapped to the agent-enabled Certificates that name them, so that annotations and the cached ACM certificate ARN are reapplied without waiting for the Certificate to change.
+func (r *CertificateReconciler) FindCertificateForSecret(obj client.Object) []reconcile.Request {
+
+	annotations := obj.GetAnnotations()
+	if certificateName := annotations[cm.CertificateNameKey]; certificateName != "" && annotations[global.AGENT_INHERITS_FROM_ANNOTATION] != "" {
+		return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: obj.GetNamespace(), Name: certificateName}}}
+	}
+
+	certificates := &cm.CertificateList{}
+	if err := r.List(context.TODO(), certificates, client.InNamespace(obj.GetNamespace()), client.MatchingFields{certificateSecretNameField: obj.GetName()}); err != nil {
+		return nil
+	}
+
+	requests := []reconcile.Request{}
+	for _, certificate := range certificates.Items {
+		if enabled, _ := strconv.ParseBool(certificate.Annotations[global.AGENT_ENABLED_ANNOTATION]); enabled {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: certificate.Namespace, Name: certificate.Name}})
+		}
+	}
+	return requests
+}
+
+// UpdateSyncCondition reports the state of the managed Secret's synchronization with ACM as a condition in the status of the Certificate, so that it is visible to 'kubectl describe' and 'cmctl status'.
+func (r *CertificateReconciler) UpdateSyncCondition(ctx context.Context, certificate *cm.Certificate, secret *corev1.Secret) (ctrl.Result, error) {
+
+	status := cmmeta.ConditionUnknown
+	reason := global.SYNC_STATE_PENDING
+	message := fmt.Sprintf("Waiting for Secret '%s' to be synchronized with ACM.", secret.Name)
+
+	if syncStatus, ok := (&SecretReconciler{}).GetSyncStatus(secret); ok {
+		reason = syncStatus.State
+		switch syncStatus.State {
+		case global.SYNC_STATE_SYNCED:
+			status = cmmeta.ConditionTrue
+			message = fmt.Sprintf("Certificate is synchronized with ACM certificate '%s'.", syncStatus.CertificateArn)
+			if syncStatus.LastImportTime != "" {
+				message = fmt.Sprintf("%s Last imported at %s.", message, syncStatus.LastImportTime)
+			}
+		case global.SYNC_STATE_FAILED, global.SYNC_STATE_REVOKED:
+			status = cmmeta.ConditionFalse
+			message = syncStatus.Message
+		default:
+			if syncStatus.Message != "" {
+				message = syncStatus.Message
+			}
+		}
+	}
+
+	if !r.SetCondition(certificate, certificateConditionACMSynced, status, reason, message) {
+		log.FromContext(ctx).Info("Secret is configured for agent management: nothing to do.")
+		return ctrl.Result{}, nil
+	}
+
+	if err := r.Status().Update(ctx, certificate); err != nil {
+		return requeueWithBackoff(errors.Wrap(err, "Could not update Certificate status."))
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// RemoveSyncCondition removes the ACM sync condition (if present) from the status of a Certificate that is no longer managed.
+func (r *CertificateReconciler) RemoveSyncCondition(ctx context.Context, certificate *cm.Certificate) (ctrl.Result, error) {
+
+	conditions := []cm.CertificateCondition{}
+	for _, condition := range certificate.Status.Conditions {
+		if condition.Type != certificateConditionACMSynced {
+			conditions = append(conditions, condition)
+		}
+	}
+	if len(conditions) == len(certificate.Status.Conditions) {
+		return ctrl.Result{}, nil
+	}
+
+	certificate.Status.Conditions = conditions
+	if err := r.Status().Update(ctx, certificate); err != nil {
+		return requeueWithBackoff(errors.Wrap(err, "Could not update Certificate status."))
 	}
 
 	return ctrl.Result{}, nil
 }
 
+// SetCondition sets the specified condition in the status of the Certificate (which is not persisted), preserving conditions owned by cert-manager. Returns true if the condition was modified.
+func (r *CertificateReconciler) SetCondition(certificate *cm.Certificate, conditionType cm.CertificateConditionType, status cmmeta.ConditionStatus, reason string, message string) bool {
+
+	now := metav1.Now()
+	condition := cm.CertificateCondition{
+		Type:               conditionType,
+		Status:             status,
+		LastTransitionTime: &now,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: certificate.Generation,
+	}
+
+	for i, existing := range certificate.Status.Conditions {
+		if existing.Type != conditionType {
+			continue
+		}
+		if existing.Status == status && existing.Reason == reason && existing.Message == message && existing.ObservedGeneration == certificate.Generation {
+			return false
+		}
+		if existing.Status == status {
+			// Only status changes count as transitions.
+			condition.LastTransitionTime = existing.LastTransitionTime
+		}
+		certificate.Status.Conditions[i] = condition
+		return true
+	}
+
+	certificate.Status.Conditions = append(certificate.Status.Conditions, condition)
+	return true
+}
+
 func (r *CertificateReconciler) GetSecret(certificate *cm.Certificate) (*corev1.Secret, error) {
 	secretName := certificate.Spec.SecretName
 	if secretName == "" {
@@ -211,24 +440,139 @@ func (r *CertificateReconciler) GetSecret(certificate *cm.Certificate) (*corev1.
 }
 
 func (r *CertificateReconciler) DeleteSecretManagementAnnotations(secret *corev1.Secret) error {
+	patch := client.MergeFrom(secret.DeepCopy())
+
 	delete(secret.Annotations, global.AGENT_ENABLED_ANNOTATION)
 	delete(secret.Annotations, global.AGENT_INHERITS_FROM_ANNOTATION)
 	delete(secret.Annotations, global.AGENT_CERTIFICATE_ARN_ANNOTATION)
 	delete(secret.Annotations, global.AGENT_CERTIFICATE_EXPIRY_DATE_ANNOTATION)
 	delete(secret.Annotations, global.AGENT_CERTIFICATE_SERIAL_NUMBER_ANNOTATION)
+	delete(secret.Annotations, global.AGENT_SYNC_STATUS_ANNOTATION)
+	delete(secret.Annotations, global.AGENT_RETRY_COUNT_ANNOTATION)
+	delete(secret.Annotations, global.AGENT_PARSE_FAILURE_ANNOTATION)
+	delete(secret.Annotations, global.AGENT_DATA_HASH_ANNOTATION)
+	delete(secret.Annotations, global.AGENT_CERTIFICATE_HASH_ANNOTATION)
+	delete(secret.Annotations, global.AGENT_CONFIG_HASH_ANNOTATION)
+	delete(secret.Annotations, global.AGENT_ACM_CERTIFICATES_ANNOTATION)
+	delete(secret.Annotations, global.AGENT_LEAF_CERTIFICATES_ANNOTATION)
+	for _, key := range inheritedAnnotations {
+		delete(secret.Annotations, key)
+	}
+	for key := range secret.Annotations {
+		if strings.HasPrefix(key, global.AGENT_CERTIFICATE_ARN_ANNOTATION+".") {
+			delete(secret.Annotations, key)
+		}
+	}
+	r.RemoveSecretOwnership(secret)
+
+	return r.Patch(context.TODO(), secret, patch)
+}
+
+// SetSecretOwnership records the Certificate as the owner of the Secret: in the Secret's inherits-from annotation, and as an owner reference (so that the relationship is visible to K8s tooling and the garbage collector.) Owner references added by the agent for other Certificates are removed. Returns true if the Secret was modified.
+func (r *CertificateReconciler) SetSecretOwnership(secret *corev1.Secret, certificate *cm.Certificate) bool {
+
+	modified := false
+
+	if secret.Annotations[global.AGENT_INHERITS_FROM_ANNOTATION] != string(certificate.UID) {
+		setAnnotation(secret, global.AGENT_INHERITS_FROM_ANNOTATION, string(certificate.UID))
+		modified = true
+	}
+
+	ownerReferences := []metav1.OwnerReference{}
+	hasOwnerReference := false
+	for _, ownerReference := range secret.OwnerReferences {
+		if ownerReference.UID == certificate.UID {
+			hasOwnerReference = true
+		} else if isAgentOwnerReference(ownerReference) {
+			modified = true
+			continue
+		}
+		ownerReferences = append(ownerReferences, ownerReference)
+	}
+
+	// cert-manager may already have added a (controller) owner reference for the Certificate.
+	if !hasOwnerReference {
+		ownerReferences = append(ownerReferences, metav1.OwnerReference{
+			APIVersion: cm.SchemeGroupVersion.String(),
+			Kind:       cm.CertificateKind,
+			Name:       certificate.Name,
+			UID:        certificate.UID,
+		})
+		modified = true
+	}
 
-	return r.Update(context.TODO(), secret, &client.UpdateOptions{})
+	secret.OwnerReferences = ownerReferences
+	return modified
+}
+
+// RemoveSecretOwnership removes the owner references added to the Secret by the agent, so that (as with cert-manager's default behaviour) the Secret is not garbage collected when the Certificate is deleted. Owner references added by cert-manager are left in place.
+func (r *CertificateReconciler) RemoveSecretOwnership(secret *corev1.Secret) {
+
+	ownerReferences := []metav1.OwnerReference{}
+	for _, ownerReference := range secret.OwnerReferences {
+		if !isAgentOwnerReference(ownerReference) {
+			ownerReferences = append(ownerReferences, ownerReference)
+		}
+	}
+
+	secret.OwnerReferences = ownerReferences
+}
+
+// CertificateExists returns true if a Certificate with the specified UID exists in the namespace.
+func (r *CertificateReconciler) CertificateExists(ctx context.Context, namespace string, uid string) (bool, error) {
+
+	certificates := &cm.CertificateList{}
+	if err := r.List(ctx, certificates, client.InNamespace(namespace)); err != nil {
+		return false, err
+	}
+
+	for _, certificate := range certificates.Items {
+		if string(certificate.UID) == uid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Returns true if the owner reference refers to a Certificate and was added by the agent (i.e. it is not the controller reference that cert-manager adds when configured with '--enable-certificate-owner-ref'.)
+func isAgentOwnerReference(ownerReference metav1.OwnerReference) bool {
+	return ownerReference.APIVersion == cm.SchemeGroupVersion.String() && ownerReference.Kind == cm.CertificateKind && (ownerReference.Controller == nil || !*ownerReference.Controller)
 }
 
 func (r *CertificateReconciler) AddSecretManagementAnnotations(secret *corev1.Secret, certificate *cm.Certificate) error {
-	secret.Annotations[global.AGENT_ENABLED_ANNOTATION] = "true"
-	secret.Annotations[global.AGENT_INHERITS_FROM_ANNOTATION] = string(certificate.UID)
+	patch := client.MergeFrom(secret.DeepCopy())
+
+	setAnnotation(secret, global.AGENT_ENABLED_ANNOTATION, "true")
+	r.SetSecretOwnership(secret, certificate)
 
 	// Propagate cached ARN to Secret (e.g. in case Secret was manually deleted in order to trigger a cert-manager reissue...)
 	certificateArn, ok := certificate.Annotations[global.AGENT_CERTIFICATE_ARN_ANNOTATION]
 	if ok && certificateArn != "" {
-		secret.Annotations[global.AGENT_CERTIFICATE_ARN_ANNOTATION] = certificateArn
+		setAnnotation(secret, global.AGENT_CERTIFICATE_ARN_ANNOTATION, certificateArn)
+	}
+
+	r.CopyInheritedAnnotations(secret, certificate)
+
+	return r.Patch(context.TODO(), secret, patch)
+}
+
+// CopyInheritedAnnotations copies configuration annotations from the Certificate to the Secret, removing any that are no longer set on the Certificate. Returns true if the Secret was modified.
+func (r *CertificateReconciler) CopyInheritedAnnotations(secret *corev1.Secret, certificate *cm.Certificate) bool {
+
+	modified := false
+
+	for _, key := range inheritedAnnotations {
+		certificateValue, certificateHasKey := certificate.Annotations[key]
+		secretValue, secretHasKey := secret.Annotations[key]
+
+		if certificateHasKey && (!secretHasKey || secretValue != certificateValue) {
+			setAnnotation(secret, key, certificateValue)
+			modified = true
+		} else if !certificateHasKey && secretHasKey {
+			delete(secret.Annotations, key)
+			modified = true
+		}
 	}
 
-	return r.Update(context.TODO(), secret, &client.UpdateOptions{})
+	return modified
 }
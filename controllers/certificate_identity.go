@@ -0,0 +1,117 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Certificates are identified by the SHA-256 fingerprint of their DER encoding, which is compared with the certificate body returned by ACM's GetCertificate. Serial numbers (which are only unique per CA, so may collide across CAs) are compared first, since identical certificates always have identical serial numbers, and are used in place of the fingerprint if the body cannot be retrieved or parsed.
+
+// Returns the SHA-256 fingerprint of the certificate.
+func certificateFingerprint(certificate *x509.Certificate) [sha256.Size]byte {
+	return sha256.Sum256(certificate.Raw)
+}
+
+// Returns the SHA-256 fingerprint of the first certificate in the PEM data (e.g. the certificate body returned by ACM), or false if it holds no certificate.
+func pemCertificateFingerprint(pemData string) ([sha256.Size]byte, bool) {
+	rest := []byte(pemData)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return [sha256.Size]byte{}, false
+		}
+		if block.Type == "CERTIFICATE" {
+			return sha256.Sum256(block.Bytes), true
+		}
+	}
+}
+
+// Returns the bytes of the serial number's two's complement encoding (as used by DER), omitting the leading zero byte of positive serial numbers (so that they are formatted as before negative serial numbers were supported.)
+func serialNumberBytes(number *big.Int) []byte {
+
+	if number.Sign() >= 0 {
+		return number.Bytes()
+	}
+
+	// Two's complement of a negative number, using the fewest bytes that preserve its sign.
+	length := new(big.Int).Add(number, big.NewInt(1)).BitLen()/8 + 1
+	twosComplement := new(big.Int).Add(new(big.Int).Lsh(big.NewInt(1), uint(8*length)), number)
+	output := make([]byte, length)
+	return twosComplement.FillBytes(output)
+}
+
+// Returns true if the serial number (as parsed by x509) matches the serial number reported by ACM (colon-separated hexadecimal bytes, e.g. '0a:1b:...'.) ACM reports the bytes of the serial number's DER encoding, so negative serial numbers (which are issued by some CAs) are reported in two's complement, and positive serial numbers may be reported with a leading zero byte. The second result is false if ACM's serial number could not be parsed.
+func serialNumberMatches(serialNumber *big.Int, acmSerial string) (bool, bool) {
+
+	digits := strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(strings.TrimSpace(acmSerial)))
+	if len(digits)%2 > 0 {
+		digits = "0" + digits
+	}
+	acmBytes, err := hex.DecodeString(digits)
+	if err != nil || len(acmBytes) == 0 {
+		return false, false
+	}
+
+	acmSerialNumber := new(big.Int).SetBytes(acmBytes)
+	if serialNumber.Cmp(acmSerialNumber) == 0 {
+		return true, true
+	}
+
+	// Interpret as two's complement.
+	if acmBytes[0]&0x80 > 0 {
+		acmSerialNumber.Sub(acmSerialNumber, new(big.Int).Lsh(big.NewInt(1), uint(8*len(acmBytes))))
+		return serialNumber.Cmp(acmSerialNumber) == 0, true
+	}
+
+	return false, true
+}
+
+// MatchACMCertificate returns true if the ACM certificate with the specified ARN and serial number (as returned by DescribeCertificate) is the certificate, comparing their fingerprints. Also returns the output of GetCertificate (which holds the ACM certificate's chain), or nil if the serial numbers differ (in which case the certificate body is not retrieved.)
+func (r *SecretReconciler) MatchACMCertificate(ctx context.Context, acmClient ACMService, certificateArn string, acmSerial string, certificate *x509.Certificate) (bool, *acm.GetCertificateOutput, error) {
+
+	log := log.FromContext(ctx)
+
+	serialMatches, ok := serialNumberMatches(certificate.SerialNumber, acmSerial)
+	if ok && !serialMatches {
+		return false, nil, nil
+	}
+
+	getOutput, err := acmClient.GetCertificate(ctx, &acm.GetCertificateInput{CertificateArn: aws.String(certificateArn)})
+	if err != nil {
+		return false, nil, err
+	}
+
+	fingerprint, ok := pemCertificateFingerprint(aws.ToString(getOutput.Certificate))
+	if !ok {
+		log.Info("ACM certificate body could not be parsed: comparing serial numbers only.")
+		return serialMatches, getOutput, nil
+	}
+	if fingerprint != certificateFingerprint(certificate) {
+		if serialMatches {
+			log.Info("ACM certificate has the same serial number as the Secret's certificate, but a different fingerprint.")
+		}
+		return false, getOutput, nil
+	}
+
+	return true, getOutput, nil
+}
@@ -0,0 +1,173 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Construction of the certificate chain imported into ACM from the certificates held by a Secret.
+// Chains are built using x509 path building (rather than by comparing subject and issuer names), so that cross-signed intermediates, re-ordered RDNs and duplicate subjects are handled correctly.
+
+// BuildCertificateChain identifies the leaf certificate among the certificates held by a Secret and returns it, along with the intermediates (leafwards -> rootwards) of the shortest chain that verifies it. A self-signed root terminating the chain is returned separately, since it is not imported into ACM.
+// Chains terminate at a self-signed root or, if the Secret does not hold the root, at the topmost certificate it does hold. An error is returned if no chain can be verified, or if any certificate is not part of a valid chain.
+func (r *SecretReconciler) BuildCertificateChain(certificates []*CertificateWrapper) (*CertificateWrapper, []*CertificateWrapper, *CertificateWrapper, error) {
+
+	// Ignore duplicate copies of the same certificate.
+	wrappers := map[string]*CertificateWrapper{}
+	unique := []*CertificateWrapper{}
+	for _, certificate := range certificates {
+		if _, ok := wrappers[string(certificate.x509.Raw)]; ok {
+			continue
+		}
+		wrappers[string(certificate.x509.Raw)] = certificate
+		unique = append(unique, certificate)
+	}
+
+	// Find leaf certificate = the first that did not issue any other certificate.
+	var leaf *CertificateWrapper
+	for i, certificate := range unique {
+		isIssuer := false
+		for j, otherCertificate := range unique {
+			if i != j && issuedBy(otherCertificate.x509, certificate.x509) {
+				isIssuer = true
+				break
+			}
+		}
+		if !isIssuer {
+			leaf = certificate
+			break
+		}
+	}
+	if leaf == nil {
+		return nil, nil, nil, errors.New("Could not find leaf certificate.")
+	}
+
+	// Self-signed roots, and certificates whose issuer is not held by the Secret, are trust anchors. All other certificates are candidate intermediates.
+	roots := x509.NewCertPool()
+	intermediates := x509.NewCertPool()
+	for i, certificate := range unique {
+		isAnchor := isSelfSigned(certificate.x509)
+		if !isAnchor {
+			isAnchor = true
+			for j, otherCertificate := range unique {
+				if i != j && issuedBy(certificate.x509, otherCertificate.x509) {
+					isAnchor = false
+					break
+				}
+			}
+		}
+		if isAnchor {
+			roots.AddCert(certificate.x509)
+		} else if certificate != leaf {
+			intermediates.AddCert(certificate.x509)
+		}
+	}
+
+	// Verify at a time within the validity period of the leaf, so that an expired or not yet valid leaf is reported by the caller (rather than as an invalid chain.)
+	verifyAt := time.Now()
+	if verifyAt.Before(leaf.x509.NotBefore) {
+		verifyAt = leaf.x509.NotBefore
+	} else if verifyAt.After(leaf.x509.NotAfter) {
+		verifyAt = leaf.x509.NotAfter
+	}
+
+	chains, err := leaf.x509.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   verifyAt,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Could not verify certificate chain: %s", err)
+	}
+
+	used := map[string]bool{}
+	var best []*x509.Certificate
+	for _, chain := range chains {
+		for _, certificate := range chain {
+			used[string(certificate.Raw)] = true
+		}
+		if best == nil || preferChain(chain, best) {
+			best = chain
+		}
+	}
+
+	// Verify that every certificate is part of a valid chain.
+	for _, certificate := range unique {
+		if !used[string(certificate.x509.Raw)] {
+			return nil, nil, nil, fmt.Errorf("Certificate '%s' is not part of a valid chain.", certificate.x509.Subject.CommonName)
+		}
+	}
+
+	var root *CertificateWrapper
+	chainIntermediates := []*CertificateWrapper{}
+	for i, certificate := range best[1:] {
+		if i == len(best)-2 && isSelfSigned(certificate) {
+			root = wrappers[string(certificate.Raw)]
+			break
+		}
+		chainIntermediates = append(chainIntermediates, wrappers[string(certificate.Raw)])
+	}
+
+	return leaf, chainIntermediates, root, nil
+}
+
+// Returns true if the certificates held by a Secret are in the order in which their chain is imported into ACM: the leaf, followed by its intermediates (leafwards -> rootwards) and, optionally, its root, each held once.
+func isNormalizedBundle(certificates []*CertificateWrapper, leaf *CertificateWrapper, intermediates []*CertificateWrapper, root *CertificateWrapper) bool {
+
+	expected := append([]*CertificateWrapper{leaf}, intermediates...)
+	if root != nil && len(certificates) == len(expected)+1 {
+		expected = append(expected, root)
+	}
+	if len(certificates) != len(expected) {
+		return false
+	}
+	for i, certificate := range certificates {
+		if !certificate.x509.Equal(expected[i].x509) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns true if chain a is preferred over chain b for import into ACM: that is, if it holds fewer intermediates or, if both hold the same number, terminates in a self-signed root (and so can be verified in full.)
+func preferChain(a, b []*x509.Certificate) bool {
+	aLength, aRooted := chainLength(a)
+	bLength, bRooted := chainLength(b)
+	if aLength != bLength {
+		return aLength < bLength
+	}
+	return aRooted && !bRooted
+}
+
+// Returns the number of intermediates in the chain (excluding the leaf and any self-signed root), and whether the chain terminates in a self-signed root.
+func chainLength(chain []*x509.Certificate) (int, bool) {
+	if len(chain) > 1 && isSelfSigned(chain[len(chain)-1]) {
+		return len(chain) - 2, true
+	}
+	return len(chain) - 1, false
+}
+
+// Returns true if the certificate was issued (and signed) by the specified issuer.
+func issuedBy(certificate *x509.Certificate, issuer *x509.Certificate) bool {
+	return bytes.Equal(certificate.RawIssuer, issuer.RawSubject) && certificate.CheckSignatureFrom(issuer) == nil
+}
+
+// Returns true if the certificate is self-signed (i.e. is a root.)
+func isSelfSigned(certificate *x509.Certificate) bool {
+	return issuedBy(certificate, certificate)
+}
@@ -0,0 +1,144 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+package controllers
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestBuildCertificateChain(t *testing.T) {
+
+	root := newTestRoot(t, "Test Root")
+	intermediate := root.issueIntermediate(t, "Test Intermediate")
+	subIntermediate := intermediate.issueIntermediate(t, "Test Sub-intermediate")
+	leaf := subIntermediate.issueLeaf(t, newTestKey(t), "www.example.test")
+	otherLeaf := subIntermediate.issueLeaf(t, newTestKey(t), "api.example.test")
+
+	tests := []struct {
+		name         string
+		certificates []*testCertificate
+		// Expected chain, or nil if an error is expected.
+		intermediates []*testCertificate
+		root          *testCertificate
+		normalized    bool
+	}{
+		{"Leaf only", []*testCertificate{leaf}, []*testCertificate{}, nil, true},
+		{"Ordered without root", []*testCertificate{leaf, subIntermediate, intermediate}, []*testCertificate{subIntermediate, intermediate}, nil, true},
+		{"Ordered with root", []*testCertificate{leaf, subIntermediate, intermediate, root}, []*testCertificate{subIntermediate, intermediate}, root, true},
+		{"Shuffled", []*testCertificate{intermediate, leaf, root, subIntermediate}, []*testCertificate{subIntermediate, intermediate}, root, false},
+		{"Reversed", []*testCertificate{root, intermediate, subIntermediate, leaf}, []*testCertificate{subIntermediate, intermediate}, root, false},
+		{"Duplicated intermediate", []*testCertificate{leaf, subIntermediate, intermediate, subIntermediate}, []*testCertificate{subIntermediate, intermediate}, nil, false},
+		{"Adjacent duplicated intermediate", []*testCertificate{leaf, subIntermediate, subIntermediate, intermediate}, []*testCertificate{subIntermediate, intermediate}, nil, false},
+		{"Duplicated leaf", []*testCertificate{leaf, subIntermediate, leaf, intermediate}, []*testCertificate{subIntermediate, intermediate}, nil, false},
+		{"Shuffled with duplicates", []*testCertificate{intermediate, leaf, subIntermediate, root, leaf, intermediate}, []*testCertificate{subIntermediate, intermediate}, root, false},
+		{"Missing intermediate", []*testCertificate{leaf, intermediate}, nil, nil, false},
+		{"Second leaf", []*testCertificate{leaf, otherLeaf, subIntermediate, intermediate}, nil, nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			wrappers := []*CertificateWrapper{}
+			for _, certificate := range test.certificates {
+				wrappers = append(wrappers, certificate.wrapper())
+			}
+
+			builtLeaf, intermediates, builtRoot, err := (&SecretReconciler{}).BuildCertificateChain(wrappers)
+			if test.intermediates == nil {
+				if err == nil {
+					t.Fatalf("Expected an error, found chain of %d intermediate(s).", len(intermediates))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Could not build chain: %s", err)
+			}
+
+			if !builtLeaf.x509.Equal(leaf.x509) {
+				t.Errorf("Leaf is '%s', expected '%s'.", builtLeaf.x509.Subject.CommonName, leaf.x509.Subject.CommonName)
+			}
+			if len(intermediates) != len(test.intermediates) {
+				t.Fatalf("Found %d intermediate(s), expected %d.", len(intermediates), len(test.intermediates))
+			}
+			for i, intermediate := range intermediates {
+				if !intermediate.x509.Equal(test.intermediates[i].x509) {
+					t.Errorf("Intermediate %d is '%s', expected '%s'.", i, intermediate.x509.Subject.CommonName, test.intermediates[i].x509.Subject.CommonName)
+				}
+			}
+			if (builtRoot == nil) != (test.root == nil) || (builtRoot != nil && !builtRoot.x509.Equal(test.root.x509)) {
+				t.Errorf("Root is %v, expected %v.", builtRoot, test.root)
+			}
+
+			if normalized := isNormalizedBundle(wrappers, builtLeaf, intermediates, builtRoot); normalized != test.normalized {
+				t.Errorf("isNormalizedBundle is %t, expected %t.", normalized, test.normalized)
+			}
+		})
+	}
+}
+
+func TestParsePEMCertificatesReEncodes(t *testing.T) {
+
+	root := newTestRoot(t, "Test Root")
+	leaf := root.issueLeaf(t, newTestKey(t), "www.example.test")
+
+	// The same certificate, encoded with 76-character lines (rather than 64), as produced by some tools.
+	body := strings.TrimSuffix(strings.TrimPrefix(leaf.PEM, "-----BEGIN CERTIFICATE-----\n"), "\n-----END CERTIFICATE-----")
+	encoded := base64.StdEncoding.EncodeToString(leaf.x509.Raw)
+	lines := []string{}
+	for len(encoded) > 76 {
+		lines = append(lines, encoded[:76])
+		encoded = encoded[76:]
+	}
+	rewrapped := "-----BEGIN CERTIFICATE-----\n" + strings.Join(append(lines, encoded), "\n") + "\n-----END CERTIFICATE-----"
+
+	tests := []struct {
+		name   string
+		bundle string
+	}{
+		{"Canonical", testBundle(leaf, root)},
+		{"CRLF line endings", strings.ReplaceAll(testBundle(leaf, root), "\n", "\r\n")},
+		{"Surrounding whitespace", "\n\n  " + leaf.PEM + "\n\n\t" + root.PEM + "  \n\n"},
+		{"Text between certificates", "subject=CN = www.example.test\n" + leaf.PEM + "\nsubject=CN = Test Root\n" + root.PEM + "\n"},
+		{"PEM headers", "-----BEGIN CERTIFICATE-----\nProc-Type: 4,ENCRYPTED\nComment: test\n\n" + body + "\n-----END CERTIFICATE-----\n" + root.PEM + "\n"},
+		{"Line length", rewrapped + "\n" + root.PEM + "\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			certificates, err := (&SecretReconciler{}).ParsePEMCertificates([]byte(test.bundle), "tls.crt")
+			if err != nil {
+				t.Fatalf("Could not parse certificates: %s", err)
+			}
+			if len(certificates) != 2 {
+				t.Fatalf("Found %d certificate(s), expected 2.", len(certificates))
+			}
+			for i, expected := range []*testCertificate{leaf, root} {
+				if certificates[i].PEM != expected.PEM {
+					t.Errorf("Certificate %d was encoded as '%s', expected '%s'.", i, certificates[i].PEM, expected.PEM)
+				}
+				if !certificates[i].x509.Equal(expected.x509) {
+					t.Errorf("Certificate %d is '%s', expected '%s'.", i, certificates[i].x509.Subject.CommonName, expected.x509.Subject.CommonName)
+				}
+			}
+		})
+	}
+}
+
+func TestParsePEMCertificatesRejectsCorruptCertificates(t *testing.T) {
+
+	leaf := newTestRoot(t, "Test Root").issueLeaf(t, newTestKey(t), "www.example.test")
+	corrupt := strings.Replace(leaf.PEM, "\n", "\n!!!!", 1)
+
+	if _, err := (&SecretReconciler{}).ParsePEMCertificates([]byte(corrupt), "tls.crt"); err == nil {
+		t.Errorf("Expected an error parsing a corrupt certificate.")
+	}
+}
@@ -0,0 +1,58 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// CloudWatchLogsService is the subset of the CloudWatch Logs API used by the agent to write audit records.
+type CloudWatchLogsService interface {
+	CreateLogStream(ctx context.Context, logGroupName string, logStreamName string) error
+	PutLogEvent(ctx context.Context, logGroupName string, logStreamName string, timestamp time.Time, message string) error
+}
+
+// Returns true if the error indicates that the log stream (or group) already exists.
+func isCloudWatchLogsResourceAlreadyExists(err error) bool {
+	return isAWSAPIError(err, "ResourceAlreadyExistsException")
+}
+
+// awsCloudWatchLogsService invokes the CloudWatch Logs API directly (see awsHTTPClient), since only two of its operations are used.
+type awsCloudWatchLogsService struct {
+	client *awsHTTPClient
+}
+
+// NewAWSCloudWatchLogsService returns a CloudWatchLogsService backed by the CloudWatch Logs API in the region of the AWS configuration.
+func NewAWSCloudWatchLogsService(cfg aws.Config) CloudWatchLogsService {
+	return &awsCloudWatchLogsService{client: newAWSHTTPClient(cfg, "logs")}
+}
+
+func (s *awsCloudWatchLogsService) CreateLogStream(ctx context.Context, logGroupName string, logStreamName string) error {
+	_, err := s.client.postJSON(ctx, "", "Logs_20140328.CreateLogStream", map[string]interface{}{
+		"logGroupName":  logGroupName,
+		"logStreamName": logStreamName,
+	})
+	return err
+}
+
+func (s *awsCloudWatchLogsService) PutLogEvent(ctx context.Context, logGroupName string, logStreamName string, timestamp time.Time, message string) error {
+	_, err := s.client.postJSON(ctx, "", "Logs_20140328.PutLogEvents", map[string]interface{}{
+		"logGroupName":  logGroupName,
+		"logStreamName": logStreamName,
+		"logEvents": []map[string]interface{}{
+			{"timestamp": timestamp.UnixMilli(), "message": message},
+		},
+	})
+	return err
+}
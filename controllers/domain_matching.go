@@ -0,0 +1,181 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// Policies matching the host names of load balancer resources to the domain names of the certificates synced from Secrets (see the 'domain-matching' annotation):
+// 'Exact' only matches certificates naming the host; 'Wildcard' (default) also matches wildcard certificates at the same level as the host (e.g. '*.example.com' for 'www.example.com'); 'WildcardAnyDepth' also matches wildcard certificates for any parent domain of the host (e.g. '*.example.com' for 'a.b.example.com'); 'Mapped' matches host names according to the rules of a ConfigMap (see domainMappingRule.)
+
+// domainMappingRule maps the host names matching a regular expression to the certificates that serve them: those naming Domain (if set), held by Secrets whose labels match SecretSelector (if set.) Rules are read (as a YAML or JSON list) from the 'rules' key of the ConfigMap named by an object's 'domain-mapping' annotation, and the first rule matching a host name applies.
+type domainMappingRule struct {
+	Host           string `json:"host"`
+	Domain         string `json:"domain,omitempty"`
+	SecretSelector string `json:"secretSelector,omitempty"`
+
+	hostPattern *regexp.Regexp
+	selector    labels.Selector
+}
+
+// domainMatcher determines whether the certificate synced from a Secret can serve a host name, under one of the domain matching policies.
+type domainMatcher struct {
+	policy string
+	rules  []domainMappingRule // 'Mapped' policy only. Host names matched by no rule are matched as under the 'Wildcard' policy.
+}
+
+// Matcher applying the default ('Wildcard') policy.
+var defaultDomainMatcher = domainMatcher{policy: global.DOMAIN_MATCHING_WILDCARD}
+
+// invalidDomainMatchingError is returned when an object's domain matching policy (or the ConfigMap holding its domain mapping) is invalid, so that retrying will not help until it is corrected.
+type invalidDomainMatchingError struct {
+	message string
+}
+
+func (e *invalidDomainMatchingError) Error() string {
+	return e.message
+}
+
+// Returns the domain names recorded against the Secret by secret_controller, which extracts them from the subject alternative names of its certificate.
+func secretDomainNames(secret *corev1.Secret) []string {
+	domainNamesAnnotation := secret.Annotations[global.AGENT_CERTIFICATE_DOMAIN_NAMES_ANNOTATION]
+	if domainNamesAnnotation == "" {
+		return []string{}
+	}
+	return trimSpaceFromSliceElements(strings.Split(domainNamesAnnotation, ","))
+}
+
+// Matches returns true if the certificate synced from the Secret can serve the host name, and whether it names the host name itself (rather than covering it by wildcard or mapping.)
+func (m domainMatcher) Matches(secret *corev1.Secret, hostName string) (bool, bool) {
+
+	domainNames := secretDomainNames(secret)
+	exact := containsStringIgnoringCase(domainNames, hostName)
+
+	switch m.policy {
+	case global.DOMAIN_MATCHING_EXACT:
+		return exact, exact
+	case global.DOMAIN_MATCHING_WILDCARD_ANY_DEPTH:
+		for _, domainName := range domainNames {
+			if isWildcardWithinRegistrableDomain(domainName) && strings.HasSuffix(strings.ToLower(hostName), strings.ToLower(domainName[1:])) {
+				return true, exact
+			}
+		}
+		return exact, exact
+	case global.DOMAIN_MATCHING_MAPPED:
+		for _, rule := range m.rules {
+			if !rule.hostPattern.MatchString(hostName) {
+				continue
+			}
+			matches := (rule.Domain == "" || containsStringIgnoringCase(domainNames, rule.Domain)) && (rule.selector == nil || rule.selector.Matches(labels.Set(secret.Labels)))
+			return matches, exact
+		}
+	}
+
+	if exact {
+		return true, true
+	}
+	wildcardHost, ok := convertToWildcardHost(hostName)
+	return ok && containsStringIgnoringCase(domainNames, wildcardHost), false
+}
+
+// Parses domain mapping rules (see domainMappingRule.)
+func parseDomainMappingRules(value string) ([]domainMappingRule, error) {
+
+	rules := []domainMappingRule{}
+	if err := yaml.Unmarshal([]byte(value), &rules); err != nil {
+		return nil, fmt.Errorf("Could not parse rules: %s", err)
+	}
+	if len(rules) == 0 {
+		return nil, errors.New("No rules are defined.")
+	}
+
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Host == "" {
+			return nil, fmt.Errorf("Rule %d does not define a host pattern.", i)
+		}
+		if rule.Domain == "" && rule.SecretSelector == "" {
+			return nil, fmt.Errorf("Rule %d defines neither a domain nor a Secret selector.", i)
+		}
+		hostPattern, err := regexp.Compile(rule.Host)
+		if err != nil {
+			return nil, fmt.Errorf("Rule %d has an invalid host pattern: %s", i, err)
+		}
+		rule.hostPattern = hostPattern
+		if rule.SecretSelector != "" {
+			if rule.selector, err = labels.Parse(rule.SecretSelector); err != nil {
+				return nil, fmt.Errorf("Rule %d has an invalid Secret selector: %s", i, err)
+			}
+		}
+	}
+
+	return rules, nil
+}
+
+// getDomainMatcher returns the matcher applying the domain matching policy requested by the object's 'domain-matching' annotation, reading the rules of the 'Mapped' policy from the ConfigMap (in the object's namespace) named by its 'domain-mapping' annotation. An invalidDomainMatchingError is returned if the policy or its rules are invalid.
+func getDomainMatcher(ctx context.Context, c client.Client, object client.Object) (domainMatcher, error) {
+
+	policy := strings.TrimSpace(object.GetAnnotations()[global.AGENT_DOMAIN_MATCHING_ANNOTATION])
+	for _, candidate := range []string{global.DOMAIN_MATCHING_EXACT, global.DOMAIN_MATCHING_WILDCARD, global.DOMAIN_MATCHING_WILDCARD_ANY_DEPTH, global.DOMAIN_MATCHING_MAPPED} {
+		if strings.EqualFold(policy, candidate) {
+			policy = candidate
+		}
+	}
+
+	switch policy {
+	case "", global.DOMAIN_MATCHING_WILDCARD:
+		return defaultDomainMatcher, nil
+	case global.DOMAIN_MATCHING_EXACT, global.DOMAIN_MATCHING_WILDCARD_ANY_DEPTH:
+		return domainMatcher{policy: policy}, nil
+	case global.DOMAIN_MATCHING_MAPPED:
+		return getDomainMappingMatcher(ctx, c, object)
+	}
+
+	return domainMatcher{}, &invalidDomainMatchingError{message: fmt.Sprintf("Invalid '%s' annotation '%s': must be one of '%s', '%s', '%s' or '%s'.", global.AGENT_DOMAIN_MATCHING_ANNOTATION, policy, global.DOMAIN_MATCHING_EXACT, global.DOMAIN_MATCHING_WILDCARD, global.DOMAIN_MATCHING_WILDCARD_ANY_DEPTH, global.DOMAIN_MATCHING_MAPPED)}
+}
+
+// Returns the matcher applying the 'Mapped' policy, with rules read from the ConfigMap named by the object's 'domain-mapping' annotation (see getDomainMatcher.)
+func getDomainMappingMatcher(ctx context.Context, c client.Client, object client.Object) (domainMatcher, error) {
+
+	name := strings.TrimSpace(object.GetAnnotations()[global.AGENT_DOMAIN_MAPPING_ANNOTATION])
+	if name == "" {
+		return domainMatcher{}, &invalidDomainMatchingError{message: fmt.Sprintf("The '%s' annotation must name a ConfigMap when the '%s' annotation is '%s'.", global.AGENT_DOMAIN_MAPPING_ANNOTATION, global.AGENT_DOMAIN_MATCHING_ANNOTATION, global.DOMAIN_MATCHING_MAPPED)}
+	}
+
+	configMap := &corev1.ConfigMap{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: object.GetNamespace(), Name: name}, configMap); err != nil {
+		if k8serr.IsNotFound(err) {
+			return domainMatcher{}, &invalidDomainMatchingError{message: fmt.Sprintf("Domain mapping ConfigMap '%s' does not exist.", name)}
+		}
+		return domainMatcher{}, err
+	}
+
+	rules, err := parseDomainMappingRules(configMap.Data[global.DOMAIN_MAPPING_RULES_KEY])
+	if err != nil {
+		return domainMatcher{}, &invalidDomainMatchingError{message: fmt.Sprintf("Invalid domain mapping ConfigMap '%s': %s", name, err)}
+	}
+
+	return domainMatcher{policy: global.DOMAIN_MATCHING_MAPPED, rules: rules}, nil
+}
@@ -0,0 +1,40 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	elbv2 "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+)
+
+// ELBService is the subset of the Elastic Load Balancing (v2) API used by the agent to rotate certificates on ALB/NLB listeners. It is satisfied by the AWS SDK client (*elasticloadbalancingv2.Client.)
+type ELBService interface {
+	AddListenerCertificates(ctx context.Context, params *elbv2.AddListenerCertificatesInput, optFns ...func(*elbv2.Options)) (*elbv2.AddListenerCertificatesOutput, error)
+	DescribeListenerCertificates(ctx context.Context, params *elbv2.DescribeListenerCertificatesInput, optFns ...func(*elbv2.Options)) (*elbv2.DescribeListenerCertificatesOutput, error)
+	DescribeListeners(ctx context.Context, params *elbv2.DescribeListenersInput, optFns ...func(*elbv2.Options)) (*elbv2.DescribeListenersOutput, error)
+	DescribeTags(ctx context.Context, params *elbv2.DescribeTagsInput, optFns ...func(*elbv2.Options)) (*elbv2.DescribeTagsOutput, error)
+	ModifyListener(ctx context.Context, params *elbv2.ModifyListenerInput, optFns ...func(*elbv2.Options)) (*elbv2.ModifyListenerOutput, error)
+	RemoveListenerCertificates(ctx context.Context, params *elbv2.RemoveListenerCertificatesInput, optFns ...func(*elbv2.Options)) (*elbv2.RemoveListenerCertificatesOutput, error)
+}
+
+var _ ELBService = (*elbv2.Client)(nil)
+
+// ELBServiceFactory returns the ELBService for the specified region, using the supplied AWS configuration (which carries the credentials of any assumed IAM role.)
+type ELBServiceFactory func(cfg aws.Config, region string) ELBService
+
+// NewAWSELBService returns an ELBService backed by the Elastic Load Balancing API in the specified region. This is the default ELBServiceFactory.
+func NewAWSELBService(cfg aws.Config, region string) ELBService {
+	regionalCfg := cfg.Copy()
+	regionalCfg.Region = region
+	return elbv2.NewFromConfig(regionalCfg)
+}
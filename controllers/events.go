@@ -0,0 +1,57 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+package controllers
+
+// Reasons used when recording K8s Events against managed objects. (Reasons should be UpperCamelCase.)
+const (
+	eventReasonImported                = "Imported"
+	eventReasonCertificateArnChanged   = "CertificateArnChanged"
+	eventReasonParseFailed             = "ParseFailed"
+	eventReasonInvalidCertificate      = "InvalidCertificate"
+	eventReasonACMError                = "ACMError"
+	eventReasonDeleted                 = "Deleted"
+	eventReasonAnnotationsAdded        = "AnnotationsAdded"
+	eventReasonAnnotationsRemoved      = "AnnotationsRemoved"
+	eventReasonDecorated               = "Decorated"
+	eventReasonUnmatchedHosts          = "UnmatchedHosts"
+	eventReasonInvalidAnnotation       = "InvalidAnnotation"
+	eventReasonRequested               = "Requested"
+	eventReasonProvisioned             = "Provisioned"
+	eventReasonDiscovered              = "Discovered"
+	eventReasonIssued                  = "Issued"
+	eventReasonExported                = "Exported"
+	eventReasonNotOwned                = "NotOwned"
+	eventReasonNearingExpiry           = "NearingExpiry"
+	eventReasonDriftDetected           = "DriftDetected"
+	eventReasonUnsupportedKey          = "UnsupportedKey"
+	eventReasonChainIncomplete         = "ChainIncomplete"
+	eventReasonKeyMismatch             = "KeyMismatch"
+	eventReasonQuotaExceeded           = "QuotaExceeded"
+	eventReasonQuotaIncreaseRequested  = "QuotaIncreaseRequested"
+	eventReasonImportDeferred          = "ImportDeferred"
+	eventReasonImportLimitApproaching  = "ImportLimitApproaching"
+	eventReasonListenerUpdated         = "ListenerUpdated"
+	eventReasonListenerError           = "ListenerError"
+	eventReasonDryRun                  = "DryRun"
+	eventReasonConfigApplied           = "ConfigApplied"
+	eventReasonConfigInvalid           = "ConfigInvalid"
+	eventReasonPropagationDelayed      = "PropagationDelayed"
+	eventReasonImportInProgress        = "ImportInProgress"
+	eventReasonRetriesExhausted        = "RetriesExhausted"
+	eventReasonAudit                   = "ACMAudit"
+	eventReasonPartitionMismatch       = "PartitionMismatch"
+	eventReasonCertificateArnMismatch  = "CertificateArnMismatch"
+	eventReasonACMCertificateUnhealthy = "ACMCertificateUnhealthy"
+	eventReasonRevoked                 = "Revoked"
+	eventReasonRevocationCheckFailed   = "RevocationCheckFailed"
+	eventReasonACMLimitExceeded        = "ACMLimitExceeded"
+	eventReasonACMLimitWarning         = "ACMLimitWarning"
+	eventReasonImportRejected          = "ImportRejected"
+	eventReasonTooManyCertificates     = "TooManyCertificates"
+)
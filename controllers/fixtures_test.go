@@ -0,0 +1,135 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+package controllers
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test certificate, with the key that signs the certificates it issues.
+type testCertificate struct {
+	x509 *x509.Certificate
+	key  crypto.Signer
+	PEM  string
+}
+
+// Wrapper of the certificate, as returned by ParsePEMCertificates.
+func (c *testCertificate) wrapper() *CertificateWrapper {
+	return &CertificateWrapper{PEM: c.PEM, x509: c.x509}
+}
+
+// Returns a new ECDSA P-256 key (which, unlike RSA keys, is quick to generate.)
+func newTestKey(t testing.TB) crypto.Signer {
+	return newTestECKey(t, elliptic.P256())
+}
+
+// Returns a new ECDSA key on the curve.
+func newTestECKey(t testing.TB, curve elliptic.Curve) crypto.Signer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key: %s", err)
+	}
+	return key
+}
+
+// Returns the PKCS#8 PEM encoding of the private key.
+func testKeyPEM(t testing.TB, key crypto.Signer) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("Could not encode key: %s", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+// Returns a new self-signed root certificate authority.
+func newTestRoot(t testing.TB, commonName string) *testCertificate {
+	key := newTestKey(t)
+	return issueTestCertificate(t, nil, key, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: commonName},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	})
+}
+
+// Returns a new intermediate certificate authority issued by this certificate authority.
+func (c *testCertificate) issueIntermediate(t testing.TB, commonName string) *testCertificate {
+	key := newTestKey(t)
+	return issueTestCertificate(t, c, key, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: commonName},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	})
+}
+
+// Returns a new leaf certificate for the key, issued by this certificate authority. The first domain name is also the certificate's common name.
+func (c *testCertificate) issueLeaf(t testing.TB, key crypto.Signer, domainNames ...string) *testCertificate {
+	return issueTestCertificate(t, c, key, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: domainNames[0]},
+		DNSNames:    domainNames,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+}
+
+// Issues a certificate from the template, valid for 90 days, for the public key of the key. A random serial number is assigned unless the template sets one. The certificate is self-signed if the issuer is nil.
+func issueTestCertificate(t testing.TB, issuer *testCertificate, key crypto.Signer, template *x509.Certificate) *testCertificate {
+	t.Helper()
+
+	if template.SerialNumber == nil {
+		serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+		if err != nil {
+			t.Fatalf("Could not generate serial number: %s", err)
+		}
+		template.SerialNumber = serialNumber
+	}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(90 * 24 * time.Hour)
+
+	parent, signer := template, key
+	if issuer != nil {
+		parent, signer = issuer.x509, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), signer)
+	if err != nil {
+		t.Fatalf("Could not create certificate: %s", err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Could not parse certificate: %s", err)
+	}
+
+	return &testCertificate{
+		x509: certificate,
+		key:  key,
+		PEM:  strings.TrimSpace(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))),
+	}
+}
+
+// Returns the PEM bundle holding the certificates, in order.
+func testBundle(certificates ...*testCertificate) string {
+	encoded := []string{}
+	for _, certificate := range certificates {
+		encoded = append(encoded, certificate.PEM)
+	}
+	return strings.Join(encoded, "\n") + "\n"
+}
@@ -0,0 +1,267 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	gateway "sigs.k8s.io/gateway-api/apis/v1alpha2"
+
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// GatewayReconciler injects ACM certificate ARNs into the TLS options of HTTPS listeners on Gateway API (gateway.networking.k8s.io) Gateway objects, for consumption by the AWS Gateway API controller.
+// Host names are taken from the listener itself or, if not set, from the HTTPRoutes attached to the listener.
+type GatewayReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// Maximum number of objects reconciled in parallel (default 1.)
+	MaxConcurrentReconciles int
+
+	// Delay before the first retry of an object whose reconciliation fails (doubling on each subsequent failure.) Defaults to 1 second.
+	RequeueDelay time.Duration
+
+	// Retries of failed objects, parking those that exceed MaxRetries. Set by SetupWithManager.
+	retries *retryLimiter
+}
+
+func (r *GatewayReconciler) SetupWithManager(mgr ctrl.Manager) error {
+
+	r.retries = newRetryLimiter("gateway", r.RequeueDelay)
+
+	if err := indexSecretsByType(mgr); err != nil {
+		return err
+	}
+
+	// Tells the controller which object type this reconciler will handle.
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("gateway").
+		For(&gateway.Gateway{}).
+		Watches(&source.Kind{Type: &gateway.HTTPRoute{}}, handler.EnqueueRequestsFromMapFunc(r.FindGatewaysForRoute)).
+		WithOptions(controller.Options{RateLimiter: r.retries.rateLimiter, MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
+		WithLogConstructor(buildLogConstructor(mgr, "gateway-reconciler", gateway.GroupName, "gateway")). // When multiple controllers running with a single manager, the log auto-constructor does not work. Therefore we must do manually.
+		Complete(r)
+}
+
+func (r *GatewayReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+
+	log := log.FromContext(ctx)
+
+	gw := &gateway.Gateway{}
+	if err := r.Get(ctx, req.NamespacedName, gw); err != nil {
+		if !k8serr.IsNotFound(err) {
+			log.Error(err, "Unable to retrieve Gateway.")
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	log.V(1).Info(fmt.Sprintf("Processing Gateway %s...", req.NamespacedName))
+
+	// Object is marked for deletion - nothing to do (the operator never removes synced ACM certificates.)
+	if !gw.ObjectMeta.DeletionTimestamp.IsZero() {
+		log.Info("Gateway is marked for deletion: nothing to do.")
+		return ctrl.Result{}, nil
+	}
+
+	// Detect if Gateway is annotated to enable ACM certificate management.
+	certificateAgentEnabledAnnotation, certificateAgentEnabled := gw.Annotations[global.AGENT_ENABLED_ANNOTATION]
+	if certificateAgentEnabled {
+		certificateAgentEnabled, _ = strconv.ParseBool(certificateAgentEnabledAnnotation)
+	}
+
+	if !certificateAgentEnabled {
+		log.Info(fmt.Sprintf("Gateway '%s' is not marked as managed.", req.NamespacedName))
+		return ctrl.Result{}, nil
+	}
+
+	// Objects whose retries have been exhausted are not reconciled again until they change.
+	if r.retries.Parked(req, gw.ResourceVersion) {
+		log.Info("Gateway is parked (retries exhausted): nothing to do.")
+		return ctrl.Result{}, nil
+	}
+	if r.retries.Exhausted(req) {
+		log.Info(retriesExhaustedMessage())
+		r.Recorder.Event(gw, corev1.EventTypeWarning, eventReasonRetriesExhausted, retriesExhaustedMessage())
+		r.retries.Park(req, gw.ResourceVersion)
+		return ctrl.Result{}, nil
+	}
+
+	routeList := &gateway.HTTPRouteList{}
+	if err := r.List(ctx, routeList); err != nil {
+		log.Error(err, "Could not list HTTPRoutes.")
+		return ctrl.Result{}, err
+	}
+
+	secrets, err := listTLSSecrets(ctx, r.Client)
+	if err != nil {
+		log.Error(err, "Could not list Secrets.")
+		return ctrl.Result{}, err
+	}
+
+	var hasUnmatchedHostName bool
+	unmatchedHostNames := []string{}
+	modified := false
+
+	for i := range gw.Spec.Listeners {
+		listener := &gw.Spec.Listeners[i]
+
+		// Only listeners that terminate TLS require a certificate.
+		if listener.Protocol != gateway.HTTPSProtocolType {
+			continue
+		}
+		if listener.TLS != nil && listener.TLS.Mode != nil && *listener.TLS.Mode == gateway.TLSModePassthrough {
+			continue
+		}
+
+		hostNames := r.GetListenerHostNames(gw, listener, routeList.Items)
+		if len(hostNames) == 0 {
+			log.Info(fmt.Sprintf("Listener '%s' has no host names: skipping.", listener.Name))
+			continue
+		}
+
+		// The AWS Gateway API controller accepts a single certificate per listener.
+		certificateArns := []string{}
+		for _, hostName := range hostNames {
+			certificateArn, err := findCertificateArnForHost(secrets, hostName)
+			if err != nil {
+				hasUnmatchedHostName = true
+				unmatchedHostNames = append(unmatchedHostNames, hostName)
+				continue
+			}
+			if !containsString(certificateArns, certificateArn) {
+				certificateArns = append(certificateArns, certificateArn)
+			}
+		}
+		if len(certificateArns) == 0 {
+			continue
+		}
+		if len(certificateArns) > 1 {
+			log.Info(fmt.Sprintf("Host names for listener '%s' require more than one certificate: only the first will be used.", listener.Name))
+		}
+
+		if listener.TLS == nil {
+			mode := gateway.TLSModeTerminate
+			listener.TLS = &gateway.GatewayTLSConfig{Mode: &mode}
+		}
+		if listener.TLS.Options == nil {
+			listener.TLS.Options = map[gateway.AnnotationKey]gateway.AnnotationValue{}
+		}
+		optionKey := gateway.AnnotationKey(global.AWS_GATEWAY_CERTIFICATE_ARN_OPTION)
+		if string(listener.TLS.Options[optionKey]) != certificateArns[0] {
+			listener.TLS.Options[optionKey] = gateway.AnnotationValue(certificateArns[0])
+			modified = true
+		}
+	}
+
+	if modified {
+		log.Info("Adding ACM certificate ARNs to Gateway listeners...")
+		if err := r.Update(ctx, gw, &client.UpdateOptions{}); err != nil {
+			log.Error(err, "Failed to persist ACM certificate ARN(s) back to Gateway.")
+			return ctrl.Result{}, err
+		}
+		r.Recorder.Event(gw, corev1.EventTypeNormal, eventReasonDecorated, "ACM certificate ARN(s) added to HTTPS listeners.")
+	}
+
+	if hasUnmatchedHostName {
+		log.Info("At least one host name was not reconciled with a certificate ARN: will retry.")
+		r.Recorder.Event(gw, corev1.EventTypeWarning, eventReasonUnmatchedHosts, fmt.Sprintf("No ACM certificate found for host(s): %s.", strings.Join(unmatchedHostNames, ", ")))
+		return requeueWithBackoff(nil)
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// GetListenerHostNames returns the host names served by a Gateway listener: either the listener's own host name, or the host names of all HTTPRoutes attached to it.
+func (r *GatewayReconciler) GetListenerHostNames(gw *gateway.Gateway, listener *gateway.Listener, routes []gateway.HTTPRoute) []string {
+
+	hostNames := []string{}
+
+	if listener.Hostname != nil && *listener.Hostname != "" {
+		return append(hostNames, string(*listener.Hostname))
+	}
+
+	for _, route := range routes {
+		for _, parentRef := range route.Spec.ParentRefs {
+			if !r.ParentRefMatches(parentRef, route.Namespace, gw) {
+				continue
+			}
+			if parentRef.SectionName != nil && *parentRef.SectionName != listener.Name {
+				continue
+			}
+			for _, hostName := range route.Spec.Hostnames {
+				if !containsString(hostNames, string(hostName)) {
+					hostNames = append(hostNames, string(hostName))
+				}
+			}
+		}
+	}
+
+	return hostNames
+}
+
+// ParentRefMatches returns true if the route parent reference (for a route in routeNamespace) refers to the Gateway.
+func (r *GatewayReconciler) ParentRefMatches(parentRef gateway.ParentRef, routeNamespace string, gw *gateway.Gateway) bool {
+
+	if parentRef.Group != nil && string(*parentRef.Group) != gateway.GroupName {
+		return false
+	}
+	if parentRef.Kind != nil && string(*parentRef.Kind) != "Gateway" {
+		return false
+	}
+
+	namespace := routeNamespace
+	if parentRef.Namespace != nil {
+		namespace = string(*parentRef.Namespace)
+	}
+
+	return namespace == gw.Namespace && string(parentRef.Name) == gw.Name
+}
+
+// FindGatewaysForRoute maps an HTTPRoute to the Gateways to which it is attached.
+func (r *GatewayReconciler) FindGatewaysForRoute(obj client.Object) []reconcile.Request {
+
+	route, ok := obj.(*gateway.HTTPRoute)
+	if !ok {
+		return nil
+	}
+
+	requests := []reconcile.Request{}
+	for _, parentRef := range route.Spec.ParentRefs {
+		if parentRef.Kind != nil && string(*parentRef.Kind) != "Gateway" {
+			continue
+		}
+		namespace := route.Namespace
+		if parentRef.Namespace != nil {
+			namespace = string(*parentRef.Namespace)
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: namespace, Name: string(parentRef.Name)}})
+	}
+
+	return requests
+}
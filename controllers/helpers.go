@@ -2,20 +2,18 @@ package controllers
 
 import (
 	"strings"
-	"time"
 
 	"github.com/go-logr/logr"
 	"k8s.io/klog/v2"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"Validitron/k8s-acm-certificate-agent/global"
 )
 
 // Internal helper methods should be camelCased.
 
-const (
-	defaultRequeueLatency = 20 * time.Second
-)
-
 // Helper functions to check and remove string from a slice of strings.
 func containsString(slice []string, target string) bool {
 	for _, item := range slice {
@@ -52,11 +50,17 @@ func trimSpaceFromSliceElements(slice []string) (result []string) {
 	return
 }
 
+// ControllerLoggers holds the loggers of controllers whose log level differs from the agent's, keyed by controller name (e.g. 'secret'.) Set before reconcilers are registered with the manager.
+var ControllerLoggers = map[string]logr.Logger{}
+
 func buildLogConstructor(mgr ctrl.Manager, controllerName string, controllerGroup string, controllerKind string) func(req *reconcile.Request) logr.Logger {
 
 	// Adapted from https://github.com/kubernetes-sigs/controller-runtime/blob/c066edcfdcaeb6503e0c50cb7ed7fa82db15f130/pkg/builder/controller.go
 
 	log := mgr.GetLogger()
+	if controllerLog, ok := ControllerLoggers[strings.TrimSuffix(controllerName, "-reconciler")]; ok {
+		log = controllerLog
+	}
 
 	lowerCamelCaseKind := strings.ToLower(controllerKind[:1]) + controllerKind[1:]
 
@@ -76,6 +80,21 @@ func buildLogConstructor(mgr ctrl.Manager, controllerName string, controllerGrou
 
 }
 
+// Returns the key of the annotation used to record the ACM certificate ARN for a specific region.
+func regionalCertificateArnAnnotation(region string) string {
+	return global.AGENT_CERTIFICATE_ARN_ANNOTATION + "." + region
+}
+
+// Sets an annotation on the object, first initializing its annotations if it has none (e.g. a Secret created by a controller that sets no annotations.) Annotations should always be set using this function, since writing to a nil map panics.
+func setAnnotation(obj client.Object, key string, value string) {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[key] = value
+	obj.SetAnnotations(annotations)
+}
+
 func namespacedName(meta ctrl.ObjectMeta) string {
 	return meta.Namespace + "/" + meta.Name
 }
@@ -0,0 +1,169 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	cm "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	corev1 "k8s.io/api/core/v1"
+	networking "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// Annotations are written to objects that have none (i.e. whose annotations are nil, as when created by a controller that sets no annotations) without panicking. See setAnnotation.
+
+// Returns a fake client holding the objects.
+func newTestFakeClient(t *testing.T, objects ...client.Object) client.Client {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatalf("Could not build scheme: %s", err)
+	}
+	if err := cm.AddToScheme(scheme); err != nil {
+		t.Fatalf("Could not build scheme: %s", err)
+	}
+	return fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build()
+}
+
+// Fails the test if the object, as stored by the client, does not carry the annotations.
+func requireAnnotations(t *testing.T, c client.Client, obj client.Object, expected map[string]string) {
+	t.Helper()
+	if err := c.Get(context.Background(), client.ObjectKeyFromObject(obj), obj); err != nil {
+		t.Fatalf("Could not get object: %s", err)
+	}
+	for key, value := range expected {
+		if actual, ok := obj.GetAnnotations()[key]; !ok || actual != value {
+			t.Errorf("Annotation '%s' is '%s', expected '%s'.", key, actual, value)
+		}
+	}
+}
+
+func TestSetAnnotation(t *testing.T) {
+
+	for _, obj := range []client.Object{&corev1.Secret{}, &networking.Ingress{}, &corev1.Service{}} {
+		setAnnotation(obj, global.AGENT_ENABLED_ANNOTATION, "true")
+		if value := obj.GetAnnotations()[global.AGENT_ENABLED_ANNOTATION]; value != "true" {
+			t.Errorf("Annotation of %T is '%s', expected 'true'.", obj, value)
+		}
+	}
+
+	// Existing annotations are kept.
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"example.com/other": "value"}}}
+	setAnnotation(secret, global.AGENT_ENABLED_ANNOTATION, "true")
+	if len(secret.Annotations) != 2 || secret.Annotations["example.com/other"] != "value" {
+		t.Errorf("Annotations are %v, expected the existing annotation to be kept.", secret.Annotations)
+	}
+}
+
+func TestAddSecretManagementAnnotationsWithoutAnnotations(t *testing.T) {
+
+	certificateArn := "arn:aws:acm:ap-southeast-2:123456789012:certificate/1"
+	tests := []struct {
+		name                   string
+		certificateAnnotations map[string]string
+		expected               map[string]string
+	}{
+		{"Certificate without annotations", nil, map[string]string{
+			global.AGENT_ENABLED_ANNOTATION:       "true",
+			global.AGENT_INHERITS_FROM_ANNOTATION: "certificate-uid",
+		}},
+		{"Certificate with annotations", map[string]string{
+			global.AGENT_ENABLED_ANNOTATION:         "true",
+			global.AGENT_CERTIFICATE_ARN_ANNOTATION: certificateArn,
+			global.AGENT_REGIONS_ANNOTATION:         "ap-southeast-2,us-east-1",
+		}, map[string]string{
+			global.AGENT_ENABLED_ANNOTATION:         "true",
+			global.AGENT_INHERITS_FROM_ANNOTATION:   "certificate-uid",
+			global.AGENT_CERTIFICATE_ARN_ANNOTATION: certificateArn,
+			global.AGENT_REGIONS_ANNOTATION:         "ap-southeast-2,us-east-1",
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "tls"}, Type: corev1.SecretTypeTLS}
+			certificate := &cm.Certificate{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "tls", UID: types.UID("certificate-uid"), Annotations: test.certificateAnnotations}}
+			c := newTestFakeClient(t, secret, certificate)
+
+			r := &CertificateReconciler{Client: c, Scheme: c.Scheme(), Recorder: record.NewFakeRecorder(10)}
+			if err := r.AddSecretManagementAnnotations(secret, certificate); err != nil {
+				t.Fatalf("Could not add annotations: %s", err)
+			}
+			requireAnnotations(t, c, secret, test.expected)
+		})
+	}
+}
+
+func TestIngressCertificateAnnotationsWithoutAnnotations(t *testing.T) {
+
+	certificateArn := "arn:aws:acm:ap-southeast-2:123456789012:certificate/1"
+	ingress := &networking.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"}}
+	c := newTestFakeClient(t, ingress)
+	r := &IngressReconciler{Client: c, Scheme: c.Scheme(), Recorder: record.NewFakeRecorder(10), SSLPolicy: "ELBSecurityPolicy-TLS13-1-2-2021-06"}
+
+	if err := r.AddIngressCertificateAnnotation(ingress, certificateArn, []string{certificateArn}); err != nil {
+		t.Fatalf("Could not add certificate annotation: %s", err)
+	}
+	requireAnnotations(t, c, ingress, map[string]string{
+		global.ALB_INGRESS_CERTIFICATE_ARN_ANNOTATION:    certificateArn,
+		global.AGENT_MANAGED_CERTIFICATE_ARNS_ANNOTATION: certificateArn,
+	})
+
+	ingress = &networking.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "unmanaged"}}
+	c = newTestFakeClient(t, ingress)
+	r.Client = c
+	if err := r.AddIngressCertificateAnnotation(ingress, certificateArn, nil); err != nil {
+		t.Fatalf("Could not add certificate annotation: %s", err)
+	}
+	requireAnnotations(t, c, ingress, map[string]string{global.ALB_INGRESS_CERTIFICATE_ARN_ANNOTATION: certificateArn})
+
+	ingress = &networking.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "https"}}
+	c = newTestFakeClient(t, ingress)
+	r.Client = c
+	if err := r.ReconcileIngressHTTPSAnnotations(context.Background(), ingress, nil); err != nil {
+		t.Fatalf("Could not add HTTPS annotations: %s", err)
+	}
+	requireAnnotations(t, c, ingress, map[string]string{global.ALB_INGRESS_SSL_POLICY_ANNOTATION: r.SSLPolicy})
+
+	ingress = &networking.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "removed"}}
+	c = newTestFakeClient(t, ingress)
+	r.Client = c
+	if err := r.RemoveIngressCertificateAnnotation(ingress); err != nil {
+		t.Fatalf("Could not remove certificate annotation: %s", err)
+	}
+}
+
+func TestServiceWithoutAnnotations(t *testing.T) {
+
+	service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"}, Spec: corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer}}
+	c := newTestFakeClient(t, service)
+	r := &ServiceReconciler{Client: c, Scheme: c.Scheme(), Recorder: record.NewFakeRecorder(10), retries: newRetryLimiter("service", 0)}
+
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(service)}); err != nil {
+		t.Fatalf("Could not reconcile Service: %s", err)
+	}
+	if err := c.Get(context.Background(), client.ObjectKeyFromObject(service), service); err != nil {
+		t.Fatalf("Could not get Service: %s", err)
+	}
+	if len(service.Annotations) != 0 {
+		t.Errorf("Service without annotations was annotated: %v", service.Annotations)
+	}
+}
@@ -0,0 +1,261 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// Shared logic used by reconcilers that decorate load balancer resources (Ingress, Gateway, ...) with the ARNs of ACM certificates that serve their host names.
+
+const (
+	secretTypeField = "type"
+)
+
+var (
+	secretTypeIndexOnce sync.Once
+	secretTypeIndexErr  error
+)
+
+// Index the type field on Secrets so we can filter these efficiently. Safe to call from multiple reconcilers.
+// Secrets of other types which are declared to hold a certificate, or name the data key holding it (see isCertificateSecret), are also indexed as TLS Secrets.
+func indexSecretsByType(mgr ctrl.Manager) error {
+	secretTypeIndexOnce.Do(func() {
+		secretTypeIndexErr = mgr.GetFieldIndexer().IndexField(context.Background(), &corev1.Secret{}, secretTypeField, func(rawObj client.Object) []string {
+			secret := rawObj.(*corev1.Secret)
+			if secret.Type == "" {
+				return nil
+			}
+			if secret.Type != corev1.SecretTypeTLS && isCertificateSecret(secret) {
+				return []string{string(secret.Type), string(corev1.SecretTypeTLS)}
+			}
+			return []string{string(secret.Type)}
+		})
+	})
+	return secretTypeIndexErr
+}
+
+// Lists TLS certificates stored as K8S Secrets, optionally restricted by further list options (e.g. namespace.) Requires indexSecretsByType to have been called during setup.
+func listTLSSecrets(ctx context.Context, c client.Client, opts ...client.ListOption) ([]corev1.Secret, error) {
+	secretList := &corev1.SecretList{}
+	// Documentation on how to use ListOptions is thin on the ground. See 'Options' in https://pkg.go.dev/sigs.k8s.io/controller-runtime/pkg/client. Searching by field requires an index - see indexSecretsByType().
+	err := c.List(ctx, secretList, append([]client.ListOption{client.MatchingFields{secretTypeField: string(corev1.SecretTypeTLS)}}, opts...)...)
+	return secretList.Items, err
+}
+
+// Returns the namespaces and label selector to which an object restricts the Secrets searched for its certificates (see the 'secret-namespaces' and 'secret-selector' annotations.) No namespaces, or a nil selector, means no restriction.
+func getSecretScope(annotations map[string]string) ([]string, labels.Selector, error) {
+
+	namespaces := []string{}
+	for _, namespace := range strings.Split(annotations[global.AGENT_SECRET_NAMESPACES_ANNOTATION], ",") {
+		namespace = strings.TrimSpace(namespace)
+		if namespace != "" && !containsString(namespaces, namespace) {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+
+	var selector labels.Selector
+	if value := strings.TrimSpace(annotations[global.AGENT_SECRET_SELECTOR_ANNOTATION]); value != "" {
+		var err error
+		selector, err = labels.Parse(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not parse '%s' annotation: %s", global.AGENT_SECRET_SELECTOR_ANNOTATION, err)
+		}
+	}
+
+	return namespaces, selector, nil
+}
+
+// Lists TLS Secrets in the specified namespaces (or all namespaces, if none are specified) whose labels match the selector (if not nil.)
+func listScopedTLSSecrets(ctx context.Context, c client.Client, namespaces []string, selector labels.Selector) ([]corev1.Secret, error) {
+
+	opts := []client.ListOption{}
+	if selector != nil {
+		opts = append(opts, client.MatchingLabelsSelector{Selector: selector})
+	}
+
+	if len(namespaces) == 0 {
+		return listTLSSecrets(ctx, c, opts...)
+	}
+
+	secrets := []corev1.Secret{}
+	for _, namespace := range namespaces {
+		namespaceSecrets, err := listTLSSecrets(ctx, c, append(opts, client.InNamespace(namespace))...)
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, namespaceSecrets...)
+	}
+	return secrets, nil
+}
+
+// Finds the ARN of an ACM certificate capable of serving the host name, by processing TLS Secrets which have been processed by secret_controller and synced with ACM.
+// If several certificates match, the one that expires last is selected (see selectCertificateArnForHost.)
+func findCertificateArnForHost(secrets []corev1.Secret, hostName string) (string, error) {
+	return selectCertificateArnForHost(secrets, hostName, global.CERTIFICATE_SELECTION_LATEST_EXPIRY, defaultDomainMatcher)
+}
+
+// A Secret whose certificate can serve a host name.
+type certificateCandidate struct {
+	secret         *corev1.Secret
+	certificateArn string
+	expiryDate     time.Time // Zero if unknown.
+	exact          bool      // False if the host name is only matched by a wildcard.
+}
+
+// Returns true if the candidate is preferred over another under the selection policy. Ties are broken by preferring exact matches, then by Secret namespace and name, so that selection does not depend on the order in which Secrets are listed.
+func (c *certificateCandidate) preferredTo(other *certificateCandidate, policy string) bool {
+	if strings.EqualFold(policy, global.CERTIFICATE_SELECTION_MOST_SPECIFIC) && c.exact != other.exact {
+		return c.exact
+	}
+	if !c.expiryDate.Equal(other.expiryDate) {
+		return c.expiryDate.After(other.expiryDate)
+	}
+	if c.exact != other.exact {
+		return c.exact
+	}
+	return namespacedName(c.secret.ObjectMeta) < namespacedName(other.secret.ObjectMeta)
+}
+
+// Finds the ARN of an ACM certificate capable of serving the host name (see findCertificateArnForHost), as determined by the domain matcher, selecting between matching certificates according to the policy:
+// 'LatestExpiry' (default) selects the certificate that expires last, so that a certificate that is about to be replaced is not selected during rotation; 'MostSpecific' selects a certificate naming the host over a wildcard certificate, and otherwise the certificate that expires last.
+func selectCertificateArnForHost(secrets []corev1.Secret, hostName string, policy string, matcher domainMatcher) (string, error) {
+
+	var selected *certificateCandidate
+	for i := range secrets {
+
+		secret := &secrets[i]
+
+		certificateArn, ok := certificateArnForSecret(secret)
+		if !ok {
+			continue
+		}
+
+		matches, exact := matcher.Matches(secret, hostName)
+		if !matches {
+			continue
+		}
+
+		candidate := &certificateCandidate{
+			secret:         secret,
+			certificateArn: certificateArn,
+			exact:          exact,
+		}
+		if expiryDate, err := time.Parse(time.RFC3339, secret.Annotations[global.AGENT_CERTIFICATE_EXPIRY_DATE_ANNOTATION]); err == nil {
+			candidate.expiryDate = expiryDate
+		}
+
+		if selected == nil || candidate.preferredTo(selected, policy) {
+			selected = candidate
+		}
+	}
+
+	if selected == nil {
+		return "", fmt.Errorf("Certificate ARN could not be identified for host '%s'", hostName)
+	}
+
+	return selected.certificateArn, nil
+}
+
+// Returns true if the Secret is in one of the namespaces (if any are specified) and its labels match the selector (if not nil.)
+func secretInScope(secret client.Object, namespaces []string, selector labels.Selector) bool {
+	if len(namespaces) > 0 && !containsString(namespaces, secret.GetNamespace()) {
+		return false
+	}
+	return selector == nil || selector.Matches(labels.Set(secret.GetLabels()))
+}
+
+// Predicate passing changes to Secrets that affect the certificate ARNs of the objects they serve: creation and deletion, and updates to the ARN, expiry date or domain names recorded by secret_controller.
+var certificateSecretChangedPredicate = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		for _, key := range []string{global.AGENT_CERTIFICATE_ARN_ANNOTATION, global.AGENT_CERTIFICATE_EXPIRY_DATE_ANNOTATION, global.AGENT_CERTIFICATE_DOMAIN_NAMES_ANNOTATION} {
+			if e.ObjectOld.GetAnnotations()[key] != e.ObjectNew.GetAnnotations()[key] {
+				return true
+			}
+		}
+		return false
+	},
+}
+
+// Returns the ARN of the ACM certificate synced from the Secret by secret_controller, unless the Secret has not been synced or its certificate has expired.
+func certificateArnForSecret(secret *corev1.Secret) (string, bool) {
+
+	// Secret must have an ARN annotation, otherwise ignore it.
+	certificateArn, ok := secret.Annotations[global.AGENT_CERTIFICATE_ARN_ANNOTATION]
+	if !ok || certificateArn == "" {
+		return "", false
+	}
+
+	// If the Secret has an expiry date, check it and ignore it if it has expired.
+	expiryDateIso, ok := secret.Annotations[global.AGENT_CERTIFICATE_EXPIRY_DATE_ANNOTATION]
+	if ok && expiryDateIso != "" {
+		expiryDate, err := time.Parse(time.RFC3339, expiryDateIso)
+		if err == nil {
+			if time.Now().After(expiryDate) {
+				return "", false
+			}
+		}
+	}
+
+	return certificateArn, true
+}
+
+// Returns the wildcard domain name covering the host name at the same level (e.g. '*.example.com' for 'www.example.com'), or false if that wildcard would be broader than the host's registrable domain (e.g. '*.com' for 'example.com', or '*.co.uk' for 'example.co.uk'), since no valid certificate can name it.
+func convertToWildcardHost(hostName string) (string, bool) {
+
+	components := strings.Split(hostName, ".")
+	if len(components) < 2 {
+		return "", false
+	}
+	wildcardHost := "*." + strings.Join(components[1:], ".")
+	if !isWildcardWithinRegistrableDomain(wildcardHost) {
+		return "", false
+	}
+	return wildcardHost, true
+
+}
+
+// Returns true if the domain name is a wildcard whose base is a registrable domain (per the public suffix list) or one of its subdomains: e.g. '*.example.com' or '*.dev.example.co.uk', but not '*.com' or '*.co.uk'.
+func isWildcardWithinRegistrableDomain(domainName string) bool {
+	if !strings.HasPrefix(domainName, "*.") {
+		return false
+	}
+	_, err := publicsuffix.EffectiveTLDPlusOne(strings.ToLower(strings.TrimSuffix(domainName[2:], ".")))
+	return err == nil
+}
+
+// Returns true if the domain name (or the base of a wildcard) is a registrable domain under an ICANN-managed public suffix, or one of its subdomains (e.g. 'www.example.com' or '*.example.co.uk'), so that ACM can issue a public certificate naming it. IP addresses and names under private suffixes (e.g. 'api.svc.cluster.local' or 'app.corp.internal') are not public domain names.
+func isPublicDomainName(domainName string) bool {
+	name := strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(domainName, "*."), "."))
+	if net.ParseIP(name) != nil {
+		return false
+	}
+	if _, icann := publicsuffix.PublicSuffix(name); !icann {
+		return false
+	}
+	_, err := publicsuffix.EffectiveTLDPlusOne(name)
+	return err == nil
+}
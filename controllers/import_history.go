@@ -0,0 +1,108 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Limiting of the number of times each ACM certificate is (re-)imported, so that a Secret whose certificate changes repeatedly (e.g. because two issuers are fighting over it) does not exhaust ACM's import quotas.
+// The dates of recent imports are recorded in a tag on the ACM certificate itself, so that the history survives restarts of the agent and is shared between clusters.
+
+const (
+	// Period over which imports of each ACM certificate are counted.
+	importHistoryWindow = 365 * 24 * time.Hour
+
+	// Format of the dates recorded in the import history tag.
+	importHistoryDateFormat = "2006-01-02"
+
+	// Maximum length of an ACM tag value.
+	maxTagValueLength = 256
+)
+
+// ImportHistoryTagKey is the key of the tag recording the dates on which the agent has imported an ACM certificate within the past 365 days. Set before reconcilers are registered with the manager.
+var ImportHistoryTagKey = "tron/importHistory"
+
+// CertificateImportLimit is the maximum number of times the agent will import each ACM certificate within any 365-day period (0 for no limit.) Once three-quarters of the limit has been used, re-imports are also limited to one per day. Set before reconcilers are registered with the manager.
+var CertificateImportLimit = 20
+
+// importDeferredError indicates that re-importing an ACM certificate has been deferred, because it has already been imported too many times within the past 365 days.
+type importDeferredError struct {
+	certificateArn string
+	imports        int
+	until          time.Time
+}
+
+func (e *importDeferredError) Error() string {
+	return fmt.Sprintf("ACM certificate '%s' has been imported %d time(s) in the last 365 days (limit %d): re-import deferred until %s.", e.certificateArn, e.imports, CertificateImportLimit, e.until.UTC().Format(time.RFC3339))
+}
+
+// Returns the number of imports within the past 365 days from which a warning is given, and re-imports are limited to one per day.
+func importLimitWarningThreshold() int {
+	return (CertificateImportLimit*3 + 3) / 4
+}
+
+// Parses the value of an import history tag, returning the dates within the past 365 days (oldest first.) Malformed entries are ignored.
+func parseImportHistory(value string, now time.Time) []time.Time {
+
+	output := []time.Time{}
+	for _, entry := range strings.Fields(value) {
+		date, err := time.Parse(importHistoryDateFormat, entry)
+		if err != nil || now.Sub(date) >= importHistoryWindow {
+			continue
+		}
+		output = append(output, date)
+	}
+
+	sort.Slice(output, func(i, j int) bool { return output[i].Before(output[j]) })
+
+	return output
+}
+
+// Formats an import history tag value from the dates of imports (oldest first.) The oldest dates are dropped if the value would exceed the maximum length of an ACM tag value.
+func formatImportHistory(dates []time.Time) string {
+
+	entries := []string{}
+	length := 0
+	for i := len(dates) - 1; i >= 0; i-- {
+		entry := dates[i].UTC().Format(importHistoryDateFormat)
+		if length+len(entry) > maxTagValueLength {
+			break
+		}
+		entries = append([]string{entry}, entries...)
+		length += len(entry) + 1
+	}
+
+	return strings.Join(entries, " ")
+}
+
+// Returns an importDeferredError if re-importing the ACM certificate now would exceed CertificateImportLimit, or if the certificate has already been imported today and is approaching the limit.
+func checkImportLimit(certificateArn string, history []time.Time, now time.Time) error {
+
+	if CertificateImportLimit <= 0 {
+		return nil
+	}
+
+	if len(history) >= CertificateImportLimit {
+		// Wait until enough imports have passed out of the window to allow one more.
+		return &importDeferredError{certificateArn: certificateArn, imports: len(history), until: history[len(history)-CertificateImportLimit].Add(importHistoryWindow)}
+	}
+
+	today := now.UTC().Truncate(24 * time.Hour)
+	if len(history) >= importLimitWarningThreshold() && !history[len(history)-1].Before(today) {
+		return &importDeferredError{certificateArn: certificateArn, imports: len(history), until: today.Add(24 * time.Hour)}
+	}
+
+	return nil
+}
@@ -0,0 +1,242 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/google/uuid"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// Import locks serialize the search for existing ACM certificates, and the import, of certificates for the same domain (within an ACM account/region) across agent processes, so that objects holding the same certificate (e.g. Secrets in blue/green namespaces) that are reconciled concurrently by different processes (e.g. separate components, or replicas during a rollout) do not both import it. (acmDomainLocks serializes reconciles within a process.)
+// Each lock is a Lease, held for no longer than importLockDuration. The Lease records the ACM certificate found or imported, which is added to the ACM certificate index of the next process to acquire it (since ACM may not yet list a recent import.)
+// ACM does not support idempotent imports, so the Lease also records when each import was started (before ImportCertificate is called) and the ARN of the imported certificate (as soon as it is returned.) If a process exits before recording the certificate in the object's annotations (or even before learning its ARN), the next process to acquire the lock waits for ACM to list the certificate rather than importing it again.
+
+const (
+	// Maximum time for which an import lock is held (e.g. if the process holding it exits without releasing it.)
+	importLockDuration = 2 * time.Minute
+
+	// Delay before re-evaluating an object whose certificate is being imported by another process.
+	importLockRequeueDelay = 15 * time.Second
+
+	// Prefix of the names of import lock Leases.
+	importLockNamePrefix = "acm-certificate-agent-import-"
+
+	// Annotations of import lock Leases recording when the most recent import was started (RFC 3339), and by which agent.
+	importLockImportStartedAnnotation   = global.ANNOTATION_PREFIX + "/import-started"
+	importLockImportStartedByAnnotation = global.ANNOTATION_PREFIX + "/import-started-by"
+)
+
+// Client used to manage import lock Leases, which must not be cached (since Leases are only read when a lock is acquired.) Import locks are disabled if unset. Set by main.
+var ImportLockClient client.Client
+
+// Namespace holding import lock Leases (the agent's own namespace.) Set by main.
+var ImportLockNamespace string
+
+// Identity recorded as the holder of import locks acquired by this process.
+var importLockIdentity = func() string {
+	hostname, _ := os.Hostname()
+	return hostname + "_" + uuid.New().String()
+}()
+
+// importInProgressError indicates that another agent process holds the import lock for a certificate's domain, or that an import by another process was interrupted before ACM listed the certificate. Such errors are transient, and are resolved by retrying shortly.
+type importInProgressError struct {
+	domainName  string
+	holder      string
+	interrupted bool
+}
+
+func (e *importInProgressError) Error() string {
+	if e.interrupted {
+		return fmt.Sprintf("Import of a certificate for '%s' by agent '%s' was interrupted: waiting for ACM to list the certificate before importing it again.", e.domainName, e.holder)
+	}
+	return fmt.Sprintf("Import of a certificate for '%s' is in progress in agent '%s'.", e.domainName, e.holder)
+}
+
+// importLock is an import lock held by this process. A nil importLock (used when import locks are disabled) does nothing.
+type importLock struct {
+	lease      *coordinationv1.Lease
+	domainName string
+
+	// Set if the previous holder started an import within acmPropagationWindow without recording its ARN (e.g. because it exited, or the import request timed out), in which case ACM may not yet list the certificate it imported.
+	interruptedBy    string
+	interruptedUntil time.Time
+}
+
+// Returns the name of the Lease locking imports for the domain within the index scope.
+func importLockName(scope string, domainName string) string {
+	hash := sha256.Sum256([]byte(scope + "|" + normalizeDomainName(domainName)))
+	return importLockNamePrefix + hex.EncodeToString(hash[:])[:32]
+}
+
+// acquireImportLock acquires the import lock for the domain within the index scope. An importInProgressError is returned if another process holds the lock.
+// If another process found or imported a certificate within acmPropagationWindow, the index listing for the scope is refreshed (and the certificate it recorded is added to the index), so that a certificate it has just imported is found rather than imported again.
+func acquireImportLock(ctx context.Context, scope string, domainName string) (*importLock, error) {
+
+	if ImportLockClient == nil || ImportLockNamespace == "" {
+		return nil, nil
+	}
+
+	now := metav1.NewMicroTime(time.Now())
+	lease := &coordinationv1.Lease{}
+	key := types.NamespacedName{Namespace: ImportLockNamespace, Name: importLockName(scope, domainName)}
+	if err := ImportLockClient.Get(ctx, key, lease); err != nil {
+		if !k8serr.IsNotFound(err) {
+			return nil, err
+		}
+		lease = &coordinationv1.Lease{ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name}}
+		lease.Spec = coordinationv1.LeaseSpec{
+			HolderIdentity:       pointer.String(importLockIdentity),
+			LeaseDurationSeconds: pointer.Int32(int32(importLockDuration.Seconds())),
+			AcquireTime:          &now,
+			RenewTime:            &now,
+		}
+		if err := ImportLockClient.Create(ctx, lease); err != nil {
+			if k8serr.IsAlreadyExists(err) {
+				return nil, &importInProgressError{domainName: domainName, holder: "unknown"}
+			}
+			return nil, err
+		}
+		return &importLock{lease: lease, domainName: domainName}, nil
+	}
+
+	holder := pointer.StringDeref(lease.Spec.HolderIdentity, "")
+	var renewedAt time.Time
+	if lease.Spec.RenewTime != nil {
+		renewedAt = lease.Spec.RenewTime.Time
+	}
+	expiresAt := renewedAt.Add(time.Duration(pointer.Int32Deref(lease.Spec.LeaseDurationSeconds, 0)) * time.Second)
+	if holder != "" && holder != importLockIdentity && time.Now().Before(expiresAt) {
+		return nil, &importInProgressError{domainName: domainName, holder: holder}
+	}
+
+	lock := &importLock{lease: lease, domainName: domainName}
+	certificateArn := lease.Annotations[global.AGENT_CERTIFICATE_ARN_ANNOTATION]
+	importStartedAt, _ := time.Parse(time.RFC3339Nano, lease.Annotations[importLockImportStartedAnnotation])
+	if certificateArn == "" && time.Since(importStartedAt) < acmPropagationWindow {
+		lock.interruptedBy = lease.Annotations[importLockImportStartedByAnnotation]
+		lock.interruptedUntil = importStartedAt.Add(acmPropagationWindow)
+	}
+	if holder != importLockIdentity {
+		if time.Since(renewedAt) < acmPropagationWindow || time.Since(importStartedAt) < acmPropagationWindow {
+			log.FromContext(ctx).Info(fmt.Sprintf("Certificates for '%s' were recently synchronized by agent '%s': refreshing ACM certificate index.", domainName, holder))
+			acmIndex.Expire(scope)
+			if certificateArn != "" {
+				importedAt := importStartedAt
+				if importedAt.IsZero() {
+					importedAt = renewedAt
+				}
+				acmIndex.Put(scope, ACMCertificateSummary{CertificateArn: certificateArn, DomainName: domainName, ImportedAt: importedAt})
+			}
+		}
+	}
+
+	lease.Spec.HolderIdentity = pointer.String(importLockIdentity)
+	lease.Spec.LeaseDurationSeconds = pointer.Int32(int32(importLockDuration.Seconds()))
+	lease.Spec.AcquireTime = &now
+	lease.Spec.RenewTime = &now
+	lease.Spec.LeaseTransitions = pointer.Int32(pointer.Int32Deref(lease.Spec.LeaseTransitions, 0) + 1)
+	if err := ImportLockClient.Update(ctx, lease); err != nil {
+		if k8serr.IsConflict(err) {
+			return nil, &importInProgressError{domainName: domainName, holder: "unknown"}
+		}
+		return nil, err
+	}
+
+	return lock, nil
+}
+
+// CheckInterruptedImport returns an importInProgressError if the previous holder of the lock was interrupted while importing a certificate, and ACM may not yet list it.
+func (l *importLock) CheckInterruptedImport() error {
+	if l == nil || l.interruptedBy == "" || time.Now().After(l.interruptedUntil) {
+		return nil
+	}
+	return &importInProgressError{domainName: l.domainName, holder: l.interruptedBy, interrupted: true}
+}
+
+// StartImport records that an import is about to be started, renewing the lock. The import must not proceed if this fails, since an interrupted import could not then be detected.
+func (l *importLock) StartImport(ctx context.Context) error {
+
+	if l == nil {
+		return nil
+	}
+
+	now := metav1.NewMicroTime(time.Now())
+	l.lease.Spec.RenewTime = &now
+	setAnnotation(l.lease, importLockImportStartedAnnotation, now.UTC().Format(time.RFC3339Nano))
+	setAnnotation(l.lease, importLockImportStartedByAnnotation, importLockIdentity)
+	delete(l.lease.Annotations, global.AGENT_CERTIFICATE_ARN_ANNOTATION)
+
+	return ImportLockClient.Update(ctx, l.lease)
+}
+
+// ImportFailed records that the import started by StartImport was rejected by ACM (so that no certificate was imported.) Other failures (e.g. timeouts) are not recorded, since ACM may nevertheless have imported the certificate.
+func (l *importLock) ImportFailed(ctx context.Context, err error) {
+
+	var apiErr smithy.APIError
+	if l == nil || !errors.As(err, &apiErr) {
+		return
+	}
+
+	delete(l.lease.Annotations, importLockImportStartedAnnotation)
+	delete(l.lease.Annotations, importLockImportStartedByAnnotation)
+	if err := ImportLockClient.Update(ctx, l.lease); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to record failed import in import lock.")
+	}
+}
+
+// Imported records the ARN of an imported certificate, as soon as it is known. Failure to record it is logged (and only matters if this process then exits before the ARN is recorded in the object's annotations.)
+func (l *importLock) Imported(ctx context.Context, certificateArn string) {
+
+	if l == nil {
+		return
+	}
+
+	setAnnotation(l.lease, global.AGENT_CERTIFICATE_ARN_ANNOTATION, certificateArn)
+	if err := ImportLockClient.Update(ctx, l.lease); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to record imported certificate in import lock.")
+	}
+}
+
+// Release releases the lock. The Lease is retained (marked as expired), recording this process as its last holder and the ARN of the ACM certificate found or imported (if any.) Failure to release the lock is logged, and the lock then expires after importLockDuration.
+func (l *importLock) Release(ctx context.Context, certificateArn string) {
+
+	if l == nil {
+		return
+	}
+
+	now := metav1.NewMicroTime(time.Now())
+	l.lease.Spec.RenewTime = &now
+	l.lease.Spec.LeaseDurationSeconds = pointer.Int32(0)
+	if certificateArn != "" {
+		setAnnotation(l.lease, global.AGENT_CERTIFICATE_ARN_ANNOTATION, certificateArn)
+	}
+
+	if err := ImportLockClient.Update(ctx, l.lease); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to release import lock.")
+	}
+}
@@ -13,44 +13,129 @@ package controllers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/cert-manager/cert-manager/pkg/apis/certmanager"
+	cm "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
 	corev1 "k8s.io/api/core/v1"
 	networking "k8s.io/api/networking/v1"
 	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	ctrlbuilder "sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
+	"Validitron/k8s-acm-certificate-agent/api/v1alpha1"
 	"Validitron/k8s-acm-certificate-agent/global"
 )
 
 // IngressReconciler injects ACM certificate annotations into ALB-enabled Ingress objects by finding a matching SSL-containing Secret.
+// If certificate requests are enabled, Ingresses may instead ask for an ACM-issued certificate covering their hosts (see ACMCertificateRequestReconciler.)
 type IngressReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme                    *runtime.Scheme
+	Recorder                  record.EventRecorder
+	EnableCertificateRequests bool
+
+	// Names of ingress classes treated as ALB-backed (default 'alb'.) Ingresses whose IngressClass is implemented by the AWS Load Balancer Controller are always treated as ALB-backed.
+	IngressClasses []string
+
+	// Annotation into which certificate ARNs are written (default 'alb.ingress.kubernetes.io/certificate-arn'), allowing other controllers that accept ACM ARNs to be targeted.
+	CertificateArnAnnotation string
+
+	// Maximum number of certificate ARNs written to an Ingress's certificate ARN annotation (default 25, the default AWS quota on the certificates of an Application Load Balancer.) See LimitListenerCertificates.
+	ListenerCertificateLimit int
+
+	// Source of the certificates of Ingresses that do not carry the 'certificate-source' (or 'request-certificate') annotation: 'Imported' (default), 'Requested' or 'PreferRequested' (see certificateSource.) ACM-issued certificates are only requested if EnableCertificateRequests is set.
+	CertificateSource string
+
+	// Value of the ALB ssl-policy annotation (e.g. 'ELBSecurityPolicy-TLS13-1-2-2021-06') added to Ingresses that do not set it once they are decorated with certificate ARNs, or empty if the annotation is not added.
+	SSLPolicy string
+
+	// If true, Ingresses that declare HTTP listeners (in their listen-ports annotation) are given an ALB ssl-redirect annotation redirecting HTTP to their HTTPS listener once they are decorated with certificate ARNs, unless they carry the agent's ssl-redirect annotation (see sslRedirectPolicy.)
+	SSLRedirect bool
+
+	// If true, host names are taken from spec.tls[].hosts (rather than spec.rules[].host), and certificate ARNs are read from the Secrets named by spec.tls[].secretName rather than by searching all TLS Secrets for matching host names.
+	UseTLSHosts bool
+
+	// If true, host names that cannot be matched to a certificate are covered by a cert-manager Certificate created by the agent (see ReconcileProvisionedCertificate.)
+	EnableCertificateProvisioning bool
+
+	// Issuer of provisioned Certificates, unless an Ingress carries the 'issuer' or 'cluster-issuer' annotation. If unset, only annotated Ingresses have Certificates provisioned.
+	DefaultIssuer *cmmeta.ObjectReference
+
+	// Maximum number of objects reconciled in parallel (default 1.)
+	MaxConcurrentReconciles int
+
+	// Delay before the first retry of an object whose reconciliation fails (doubling on each subsequent failure.) Defaults to 1 second.
+	RequeueDelay time.Duration
+
+	// Retries of failed objects, parking those that exceed MaxRetries. Set by SetupWithManager.
+	retries *retryLimiter
+}
+
+// HostCertificates records which ACM certificate serves each host name of an Ingress, and which host names could not be matched to a certificate. It is recorded (as JSON) in the Ingress's host-certificates annotation.
+type HostCertificates struct {
+	Hosts     map[string]string `json:"hosts,omitempty"` // Keyed by host name.
+	Unmatched []string          `json:"unmatched,omitempty"`
+	Dropped   []string          `json:"dropped,omitempty"` // Host names whose certificate could not be attached without exceeding the listener certificate limit (see LimitListenerCertificates.)
 }
 
 func (r *IngressReconciler) SetupWithManager(mgr ctrl.Manager) error {
 
-	// Index the type field on Secrets so we can filter these efficiently.
-	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &corev1.Secret{}, "type", func(rawObj client.Object) []string {
-		secret := rawObj.(*corev1.Secret)
-		if secret.Type == "" {
-			return nil
-		}
-		return []string{string(secret.Type)}
-	}); err != nil {
+	r.retries = newRetryLimiter("ingress", r.RequeueDelay)
+	r.Client = namespaceDefaultsClient{Client: r.Client}
+
+	if err := indexSecretsByType(mgr); err != nil {
 		return err
 	}
 
 	// Tells the controller which object type this reconciler will handle.
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&networking.Ingress{}).
+	builder := ctrl.NewControllerManagedBy(mgr).
+		Named("ingress").
+		For(&networking.Ingress{})
+
+	// Re-evaluate Ingresses when the ACMCertificateRequests they own change state (e.g. a certificate is issued.)
+	if r.EnableCertificateRequests {
+		builder = builder.Owns(&v1alpha1.ACMCertificateRequest{})
+	}
+
+	// Re-create provisioned Certificates if they are deleted (or changed) by hand.
+	if r.EnableCertificateProvisioning {
+		builder = builder.Owns(&cm.Certificate{})
+	}
+
+	// Re-evaluate Ingresses when IngressClasses change (e.g. a class is created after the Ingresses that use it.)
+	builder = builder.Watches(&source.Kind{Type: &networking.IngressClass{}}, handler.EnqueueRequestsFromMapFunc(r.FindIngressesForClass))
+
+	// Re-evaluate Ingresses when the ConfigMaps holding their domain mappings change.
+	builder = builder.Watches(&source.Kind{Type: &corev1.ConfigMap{}}, handler.EnqueueRequestsFromMapFunc(r.FindIngressesForConfigMap))
+
+	// Re-evaluate Ingresses when the defaults set on their Namespace change (e.g. the namespace is enrolled.)
+	builder = builder.Watches(&source.Kind{Type: &corev1.Namespace{}}, handler.EnqueueRequestsFromMapFunc(r.FindIngressesForNamespace), ctrlbuilder.WithPredicates(namespaceDefaultsChangedPredicate))
+
+	// Re-evaluate Ingresses when the certificates serving them change (e.g. a renewed certificate is imported into ACM), rather than waiting for the Ingress to change.
+	builder = builder.Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.FindIngressesForSecret), ctrlbuilder.WithPredicates(certificateSecretChangedPredicate))
+
+	return builder.
+		WithOptions(controller.Options{RateLimiter: r.retries.rateLimiter, MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
 		WithLogConstructor(buildLogConstructor(mgr, "ingress-reconciler", "networking.k8s.io", "ingress")). // When multiple controllers running with a single manager, the log auto-constructor does not work. Therefore we must do manually.
 		Complete(r)
 }
@@ -67,7 +152,12 @@ func (r *IngressReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
-	log.Info(fmt.Sprintf("Processing Ingress %s...", req.NamespacedName))
+	log.V(1).Info(fmt.Sprintf("Processing Ingress %s...", req.NamespacedName))
+
+	if err := applyNamespaceDefaults(ctx, r.Client, ingress); err != nil {
+		log.Error(err, "Unable to retrieve Namespace.")
+		return ctrl.Result{}, err
+	}
 
 	// Object is marked for deletion - nothing to do (the operator never removes synced ACM certificates.)
 	if !ingress.ObjectMeta.DeletionTimestamp.IsZero() {
@@ -86,42 +176,54 @@ func (r *IngressReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 		return ctrl.Result{}, nil
 	}
 
-	// Make sure ingress is using ALB.
-	ingressClass, ok := ingress.Annotations[global.ALB_INGRESS_CLASS_ANNOTATION]
-	if !ok || ingressClass != "alb" {
-		log.Info(fmt.Sprintf("Ingres class annotation '%s' is either missing or not set as 'alb': aborting.", global.ALB_INGRESS_CLASS_ANNOTATION))
+	// Objects whose retries have been exhausted are not reconciled again until they change.
+	if r.retries.Parked(req, ingress.ResourceVersion) {
+		log.Info("Ingress is parked (retries exhausted): nothing to do.")
 		return ctrl.Result{}, nil
 	}
-
-	// Make sure SSL is expected.
-	serializedListenPorts, ok := ingress.Annotations[global.ALB_INGRESS_LISTEN_PORTS_ANNOTATION]
-	if !ok || serializedListenPorts == "" {
-		log.Info(fmt.Sprintf("Ingress does not define a '%s' annotation: aborting.", global.ALB_INGRESS_LISTEN_PORTS_ANNOTATION))
+	if r.retries.Exhausted(req) {
+		log.Info(retriesExhaustedMessage())
+		r.Recorder.Event(ingress, corev1.EventTypeWarning, eventReasonRetriesExhausted, retriesExhaustedMessage())
+		r.retries.Park(req, ingress.ResourceVersion)
 		return ctrl.Result{}, nil
 	}
 
-	var listenPorts []map[string]int32 // Expected JSON structure is an array of integer-valued maps [{'HTTP':0},{'HTTPS':0},...]
-	err := json.Unmarshal([]byte(serializedListenPorts), &listenPorts)
+	// Make sure ingress is using ALB (or another supported ingress class.)
+	ingressClass, supported, err := r.GetIngressClass(ctx, ingress)
 	if err != nil {
-		log.Error(err, "Could not deserialize contents of '%s' annotation.", global.ALB_INGRESS_LISTEN_PORTS_ANNOTATION)
+		log.Error(err, "Unable to retrieve IngressClass.")
+		return ctrl.Result{}, err
+	}
+	if !supported {
+		log.Info(fmt.Sprintf("Ingress class '%s' is not one of the supported classes (%s) and is not implemented by '%s': aborting.", ingressClass, strings.Join(r.ingressClasses(), ", "), global.ALB_INGRESS_CONTROLLER))
 		return ctrl.Result{}, nil
 	}
 
-	httpsExpected := false
-	for _, listenPort := range listenPorts {
-		_, ok := listenPort["HTTPS"]
-		if ok {
-			httpsExpected = true
-			break
+	// Make sure SSL is expected. If the listen ports are not declared, HTTPS is expected if the Ingress declares TLS hosts.
+	httpsExpected := len(ingress.Spec.TLS) > 0
+	serializedListenPorts, ok := ingress.Annotations[global.ALB_INGRESS_LISTEN_PORTS_ANNOTATION]
+	if (!ok || serializedListenPorts == "") && !httpsExpected {
+		log.Info(fmt.Sprintf("Ingress does not define a '%s' annotation or TLS hosts: aborting.", global.ALB_INGRESS_LISTEN_PORTS_ANNOTATION))
+		return ctrl.Result{}, nil
+	}
+
+	var listenPorts []ListenPort
+	if ok && serializedListenPorts != "" {
+		listenPorts, err = ParseListenPorts(serializedListenPorts)
+		if err != nil {
+			log.Error(err, fmt.Sprintf("Could not deserialize contents of '%s' annotation.", global.ALB_INGRESS_LISTEN_PORTS_ANNOTATION))
+			r.Recorder.Event(ingress, corev1.EventTypeWarning, eventReasonInvalidAnnotation, fmt.Sprintf("Could not deserialize contents of '%s' annotation: %s", global.ALB_INGRESS_LISTEN_PORTS_ANNOTATION, err))
+			return ctrl.Result{}, nil
 		}
+		_, httpsExpected = httpsListenPort(listenPorts)
 	}
 
-	ingressARNAnnotation, ingressHasARNAnnotation := ingress.Annotations[global.ALB_INGRESS_CERTIFICATE_ARN_ANNOTATION]
+	ingressARNAnnotation, ingressHasARNAnnotation := ingress.Annotations[r.certificateArnAnnotation()]
 
 	if !httpsExpected {
 		log.Info(fmt.Sprintf("'%s' annotation does not require HTTPS.", global.ALB_INGRESS_LISTEN_PORTS_ANNOTATION))
 
-		if ingressHasARNAnnotation {
+		if ingressHasARNAnnotation || ingress.Annotations[global.AGENT_MANAGED_SSL_REDIRECT_ANNOTATION] != "" {
 			log.Info("Removing ACM certificate ARNs from Ingress...")
 
 			err = r.RemoveIngressCertificateAnnotation(ingress)
@@ -135,7 +237,152 @@ func (r *IngressReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 	}
 
 	// Extract unique list of hosts from spec.
+	hostNames := r.GetHostNames(ingress)
+
+	// Secrets searched for certificates may be restricted by namespace and/or label selector.
+	namespaces, selector, err := getSecretScope(ingress.Annotations)
+	if err != nil {
+		log.Error(err, "Invalid Secret scope: aborting.")
+		r.Recorder.Event(ingress, corev1.EventTypeWarning, eventReasonInvalidAnnotation, err.Error())
+		return ctrl.Result{}, nil
+	}
+
+	// Host names are matched to the domain names of certificates according to the Ingress's domain matching policy.
+	matcher, err := getDomainMatcher(ctx, r.Client, ingress)
+	var invalidMatchingErr *invalidDomainMatchingError
+	if errors.As(err, &invalidMatchingErr) {
+		log.Error(err, "Invalid domain matching policy: aborting.")
+		r.Recorder.Event(ingress, corev1.EventTypeWarning, eventReasonInvalidAnnotation, err.Error())
+		return ctrl.Result{}, nil
+	}
+	if err != nil {
+		log.Error(err, "Unable to retrieve domain mapping.")
+		return ctrl.Result{}, err
+	}
+
+	// If requested, use a certificate issued by ACM rather than one imported from a Secret. Where ACM is only preferred, imported certificates are used for host names that ACM cannot be expected to validate, and until ACM has issued the certificate.
+	certificateSource := r.certificateSource(ingress)
+	if certificateSource == global.CERTIFICATE_SOURCE_PREFER_REQUESTED && r.EnableCertificateRequests {
+		if reason := r.certificateRequestIneligibility(ingress, hostNames); reason != "" {
+			log.V(1).Info(fmt.Sprintf("%s Using imported certificates.", reason))
+			certificateSource = global.CERTIFICATE_SOURCE_IMPORTED
+		}
+	}
+	if certificateSource != global.CERTIFICATE_SOURCE_IMPORTED && r.EnableCertificateRequests {
+
+		if len(hostNames) == 0 {
+			log.Info("Ingress does not define any host names: aborting.")
+			return ctrl.Result{}, nil
+		}
+
+		certificateRequest, err := r.ReconcileCertificateRequest(ctx, ingress, hostNames)
+		if err != nil {
+			log.Error(err, "Failed to reconcile ACMCertificateRequest.")
+			return requeueWithBackoff(err)
+		}
+
+		// Changes to the ACMCertificateRequest will trigger reconciliation of the Ingress.
+		if meta.IsStatusConditionTrue(certificateRequest.Status.Conditions, v1alpha1.ConditionIssued) && certificateRequest.Status.CertificateArn != "" {
+			return ctrl.Result{}, r.DecorateWithRequestedCertificate(ctx, ingress, certificateRequest, hostNames, listenPorts)
+		}
+		if certificateSource == global.CERTIFICATE_SOURCE_REQUESTED {
+			log.Info(fmt.Sprintf("Waiting for ACM to issue certificate requested by ACMCertificateRequest '%s'.", namespacedName(certificateRequest.ObjectMeta)))
+			return ctrl.Result{}, nil
+		}
+		log.Info(fmt.Sprintf("ACM has not issued the certificate requested by ACMCertificateRequest '%s': using imported certificates until it does.", namespacedName(certificateRequest.ObjectMeta)))
+	}
+
+	// Retrieve certificate ARNs for hosts by processing TLS certificates stored as K8S Secrets which have been processed by secret_controller and synced with ACM.
+	var certificateArns []string
+	var hostCertificates HostCertificates
+	if r.UseTLSHosts {
+		certificateArns, hostCertificates, err = r.FindCertificateArnsForTLS(ctx, ingress, namespaces, selector, matcher)
+	} else {
+		certificateArns, hostCertificates, err = r.FindCertificateArnsForHosts(ctx, ingress, hostNames, namespaces, selector, matcher)
+	}
+	if err != nil {
+		log.Error(err, "Could not retrieve Secrets.")
+		return ctrl.Result{}, err
+	}
+	// If we can't find an ARN for a given hostname, we can still save the ones we can find - but retry so reconciliation is re-attempted.
+	unmatchedHostNames := hostCertificates.Unmatched
+	hasUnmatchedHostName := len(unmatchedHostNames) > 0
+
+	// The AWS Load Balancer Controller rejects Ingresses with more certificates than their listeners accept, so consolidate certificates (and drop the host names that cannot then be served) rather than writing an annotation that would be rejected. Retrying will not help until the Ingress or its certificates change.
+	certificateCount := len(certificateArns)
+	certificateArns, droppedHostNames, err := r.LimitListenerCertificates(ctx, ingress, certificateArns, &hostCertificates, namespaces, selector, matcher)
+	if err != nil {
+		log.Error(err, "Could not retrieve Secrets.")
+		return ctrl.Result{}, err
+	}
+	if len(certificateArns) < certificateCount {
+		log.Info(fmt.Sprintf("Host names require %d ACM certificates, more than the limit of %d per listener: consolidated to %d.", certificateCount, r.listenerCertificateLimit(), len(certificateArns)))
+	}
+	if len(droppedHostNames) > 0 {
+		r.Recorder.Event(ingress, corev1.EventTypeWarning, eventReasonTooManyCertificates, fmt.Sprintf("ACM certificates for all host names would exceed the limit of %d per listener: host(s) not served over HTTPS: %s.", r.listenerCertificateLimit(), strings.Join(droppedHostNames, ", ")))
+	}
+
+	// Update annotation, preserving any ARNs not managed by the agent (unless the Ingress's policy is to replace them.)
+	arnAnnotation := r.MergeCertificateArns(ingress, certificateArns)
+	if !ingressHasARNAnnotation || ingressARNAnnotation != arnAnnotation || r.ManagedCertificateArnsChanged(ingress, certificateArns) {
+		log.Info("Adding ACM certificate ARNs to Ingress...")
+
+		err = r.AddIngressCertificateAnnotation(ingress, arnAnnotation, certificateArns)
+		if err != nil {
+			log.Error(err, "Failed to persist ACM certificate ARN(s) back to Ingress.")
+			return ctrl.Result{}, err
+		}
+		r.Recorder.Event(ingress, corev1.EventTypeNormal, eventReasonDecorated, fmt.Sprintf("ACM certificate ARN(s) set to '%s'.", arnAnnotation))
+	}
+	if arnAnnotation != "" {
+		if err := r.ReconcileIngressHTTPSAnnotations(ctx, ingress, listenPorts); err != nil {
+			log.Error(err, "Failed to add HTTPS annotations to Ingress.")
+			return ctrl.Result{}, err
+		}
+	}
+
+	r.RecordHostCertificates(ctx, ingress, hostCertificates)
+
+	// If requested, have cert-manager issue a certificate for the unmatched host names. Once it has been issued and imported into ACM, the change to its Secret triggers reconciliation of the Ingress.
+	if r.EnableCertificateProvisioning && !r.UseTLSHosts && hasUnmatchedHostName {
+		issuerRef, err := r.GetIssuer(ingress)
+		if err != nil {
+			log.Error(err, "Invalid issuer: aborting.")
+			r.Recorder.Event(ingress, corev1.EventTypeWarning, eventReasonInvalidAnnotation, err.Error())
+			return ctrl.Result{}, nil
+		}
+		if issuerRef != nil {
+			if _, err := r.ReconcileProvisionedCertificate(ctx, ingress, *issuerRef, hostNames, unmatchedHostNames); err != nil {
+				log.Error(err, "Failed to reconcile provisioned Certificate.")
+				return requeueWithBackoff(err)
+			}
+		}
+	}
+
+	if hasUnmatchedHostName {
+		log.Info("At least one host name was not reconciled with a certificate ARN: will retry.")
+		r.Recorder.Event(ingress, corev1.EventTypeWarning, eventReasonUnmatchedHosts, fmt.Sprintf("No ACM certificate found for host(s): %s.", strings.Join(unmatchedHostNames, ", ")))
+		return requeueWithBackoff(nil)
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// GetHostNames returns the unique host names served by the Ingress, taken from its rules or (if UseTLSHosts is set) its TLS section.
+func (r *IngressReconciler) GetHostNames(ingress *networking.Ingress) []string {
+
 	hostNames := []string{}
+	if r.UseTLSHosts {
+		for _, tls := range ingress.Spec.TLS {
+			for _, host := range tls.Hosts {
+				if host != "" && !containsString(hostNames, host) {
+					hostNames = append(hostNames, host)
+				}
+			}
+		}
+		return hostNames
+	}
+
 	for _, rule := range ingress.Spec.Rules {
 		if rule.Host == "" {
 			continue
@@ -144,105 +391,724 @@ func (r *IngressReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 			hostNames = append(hostNames, rule.Host)
 		}
 	}
+	return hostNames
+}
+
+// FindCertificateArnsForHosts returns the ARNs of the ACM certificates serving the host names (as determined by the Ingress's domain matcher, see getDomainMatcher), found by searching all TLS Secrets (in the specified namespaces and matching the selector, if set), along with the certificate found for each host name (and any host names for which no certificate was found.)
+// Where several certificates serve a host name, the certificate is selected according to the Ingress's 'certificate-selection' annotation (see selectCertificateArnForHost.)
+func (r *IngressReconciler) FindCertificateArnsForHosts(ctx context.Context, ingress *networking.Ingress, hostNames []string, namespaces []string, selector labels.Selector, matcher domainMatcher) ([]string, HostCertificates, error) {
 
-	// Retrieve certificate ARNs for hosts by processing TLS certificates stored as K8S Secrets which have been processed by secret_controller and synced with ACM.
-	secretList := &corev1.SecretList{}
-	// Documentation on how to use ListOptions is thin on the ground. See 'Options' in https://pkg.go.dev/sigs.k8s.io/controller-runtime/pkg/client. Searching by field requires an index - see SetupWithManager().
-	listErr := r.List(context.TODO(), secretList, client.MatchingFields{"type": string(corev1.SecretTypeTLS)})
-	if listErr != nil {
-		log.Error(listErr, "Could not list Secrets.")
-		return ctrl.Result{}, listErr
-	}
-	var hasUnmatchedHostName bool
 	certificateArns := []string{}
+	hostCertificates := HostCertificates{Hosts: map[string]string{}}
+	if len(hostNames) == 0 {
+		return certificateArns, hostCertificates, nil
+	}
+
+	secrets, err := listScopedTLSSecrets(ctx, r.Client, namespaces, selector)
+	if err != nil {
+		return nil, HostCertificates{}, err
+	}
 	for _, hostName := range hostNames {
-		certificateArn, err := r.FindCertificateArnForHost(secretList.Items, hostName)
+		certificateArn, err := selectCertificateArnForHost(secrets, hostName, ingress.Annotations[global.AGENT_CERTIFICATE_SELECTION_ANNOTATION], matcher)
 		if err != nil {
-			// If we can't find an ARN for a given hostname, we can still save the ones we can find - but return an error so reconciliation is re-attempted.
-			hasUnmatchedHostName = true
+			hostCertificates.Unmatched = append(hostCertificates.Unmatched, hostName)
 			continue
 		}
+		hostCertificates.Hosts[hostName] = certificateArn
 		if !containsString(certificateArns, certificateArn) {
 			certificateArns = append(certificateArns, certificateArn)
 		}
 	}
 
-	// Update annotation.
-	arnAnnotation := strings.Join(certificateArns, ",")
-	if !ingressHasARNAnnotation || ingressARNAnnotation != arnAnnotation {
-		log.Info("Adding ACM certificate ARNs to Ingress...")
+	return certificateArns, hostCertificates, nil
+}
 
-		err = r.AddIngressCertificateAnnotation(ingress, arnAnnotation)
-		if err != nil {
-			log.Error(err, "Failed to persist ACM certificate ARN(s) back to Ingress.")
-			return ctrl.Result{}, err
+// FindCertificateArnsForTLS returns the ARNs of the ACM certificates synced from the Secrets named in the Ingress's TLS section, along with the host names of any entries whose Secret is missing or has not been synced.
+// Host names of entries that do not name a Secret are matched by searching all TLS Secrets, subject to any namespaces and selector (see FindCertificateArnsForHosts.) Secrets named explicitly are not subject to these restrictions.
+func (r *IngressReconciler) FindCertificateArnsForTLS(ctx context.Context, ingress *networking.Ingress, namespaces []string, selector labels.Selector, matcher domainMatcher) ([]string, HostCertificates, error) {
+
+	certificateArns := []string{}
+	hostCertificates := HostCertificates{Hosts: map[string]string{}}
+	unnamedHostNames := []string{}
+	for _, tls := range ingress.Spec.TLS {
+
+		if tls.SecretName == "" {
+			unnamedHostNames = append(unnamedHostNames, tls.Hosts...)
+			continue
+		}
+
+		secret := &corev1.Secret{}
+		if err := r.Get(ctx, types.NamespacedName{Namespace: ingress.Namespace, Name: tls.SecretName}, secret); err != nil {
+			if !k8serr.IsNotFound(err) {
+				return nil, HostCertificates{}, err
+			}
+			hostCertificates.Unmatched = append(hostCertificates.Unmatched, tls.Hosts...)
+			continue
+		}
+
+		certificateArn, ok := certificateArnForSecret(secret)
+		if !ok {
+			hostCertificates.Unmatched = append(hostCertificates.Unmatched, tls.Hosts...)
+			continue
+		}
+		for _, hostName := range tls.Hosts {
+			hostCertificates.Hosts[hostName] = certificateArn
+		}
+		if !containsString(certificateArns, certificateArn) {
+			certificateArns = append(certificateArns, certificateArn)
 		}
 	}
 
-	if hasUnmatchedHostName {
-		log.Info("At least one host name was not reconciled with a certificate ARN: will retry.")
-		return ctrl.Result{RequeueAfter: defaultRequeueLatency}, nil
+	unnamedCertificateArns, unnamedHostCertificates, err := r.FindCertificateArnsForHosts(ctx, ingress, unnamedHostNames, namespaces, selector, matcher)
+	if err != nil {
+		return nil, HostCertificates{}, err
+	}
+	for _, certificateArn := range unnamedCertificateArns {
+		if !containsString(certificateArns, certificateArn) {
+			certificateArns = append(certificateArns, certificateArn)
+		}
+	}
+	for hostName, certificateArn := range unnamedHostCertificates.Hosts {
+		hostCertificates.Hosts[hostName] = certificateArn
 	}
+	hostCertificates.Unmatched = append(hostCertificates.Unmatched, unnamedHostCertificates.Unmatched...)
 
-	return ctrl.Result{}, nil
+	return certificateArns, hostCertificates, nil
 }
 
-func (r *IngressReconciler) FindCertificateArnForHost(secrets []corev1.Secret, hostName string) (string, error) {
+// RecordHostCertificates records (as JSON) the certificate serving each host name of the Ingress in its host-certificates annotation, so that the reason a host is not served over HTTPS can be seen without consulting logs.
+func (r *IngressReconciler) RecordHostCertificates(ctx context.Context, ingress *networking.Ingress, hostCertificates HostCertificates) {
 
-	// Generate the wildcard form of the hostName (at the same level) so we can match against wildcard certificates.
-	wildcardHostName := r.ConvertToWildcardHost(hostName)
+	log := log.FromContext(ctx)
 
-	for _, secret := range secrets {
+	value, err := json.Marshal(hostCertificates)
+	if err != nil || ingress.Annotations[global.AGENT_HOST_CERTIFICATES_ANNOTATION] == string(value) {
+		return
+	}
 
-		// Secret must have an ARN annotation, otherwise ignore it.
-		certificateArn, ok := secret.Annotations[global.AGENT_CERTIFICATE_ARN_ANNOTATION]
-		if !ok || certificateArn == "" {
-			continue
-		}
+	patch := client.MergeFrom(ingress.DeepCopy())
+	setAnnotation(ingress, global.AGENT_HOST_CERTIFICATES_ANNOTATION, string(value))
+	if err := r.Patch(ctx, ingress, patch); err != nil {
+		log.Error(err, "Failed to record host certificates on Ingress.")
+	}
+}
 
-		// If the Secret has an expiry date, check it and ignore it if it has expired.
-		expiryDateIso, ok := secret.Annotations[global.AGENT_CERTIFICATE_EXPIRY_DATE_ANNOTATION]
-		if ok && expiryDateIso != "" {
-			expiryDate, err := time.Parse(time.RFC3339, expiryDateIso)
-			if err == nil {
-				if time.Now().After(expiryDate) {
-					continue
-				}
+// GetIngressClass returns the name of the Ingress's class, and whether it is supported: either because it is one of the configured ingress classes, or because its IngressClass is implemented by the AWS Load Balancer Controller.
+// The class is taken from spec.ingressClassName, the deprecated 'kubernetes.io/ingress.class' annotation or, if neither is set, the cluster's default IngressClass.
+func (r *IngressReconciler) GetIngressClass(ctx context.Context, ingress *networking.Ingress) (string, bool, error) {
+
+	var ingressClass *networking.IngressClass
+
+	className := ingress.Annotations[global.ALB_INGRESS_CLASS_ANNOTATION]
+	if ingress.Spec.IngressClassName != nil && *ingress.Spec.IngressClassName != "" {
+		className = *ingress.Spec.IngressClassName
+	}
+
+	if className == "" {
+		ingressClassList := &networking.IngressClassList{}
+		if err := r.List(ctx, ingressClassList); err != nil {
+			return "", false, err
+		}
+		for i := range ingressClassList.Items {
+			if isDefault, _ := strconv.ParseBool(ingressClassList.Items[i].Annotations[networking.AnnotationIsDefaultIngressClass]); isDefault {
+				ingressClass = &ingressClassList.Items[i]
+				className = ingressClass.Name
+				break
 			}
 		}
+	}
+
+	if className == "" {
+		return "", false, nil
+	}
+	if containsString(r.ingressClasses(), className) {
+		return className, true, nil
+	}
+
+	if ingressClass == nil {
+		ingressClass = &networking.IngressClass{}
+		if err := r.Get(ctx, types.NamespacedName{Name: className}, ingressClass); err != nil {
+			return className, false, client.IgnoreNotFound(err)
+		}
+	}
+
+	return className, ingressClass.Spec.Controller == global.ALB_INGRESS_CONTROLLER, nil
+}
+
+// FindIngressesForClass maps an IngressClass to the Ingresses that use it (or, for the default IngressClass, that do not specify a class.)
+func (r *IngressReconciler) FindIngressesForClass(obj client.Object) []reconcile.Request {
+
+	ingressList := &networking.IngressList{}
+	if err := r.List(context.TODO(), ingressList); err != nil {
+		return nil
+	}
+
+	isDefault, _ := strconv.ParseBool(obj.GetAnnotations()[networking.AnnotationIsDefaultIngressClass])
+
+	requests := []reconcile.Request{}
+	for _, ingress := range ingressList.Items {
+		className := ingress.Annotations[global.ALB_INGRESS_CLASS_ANNOTATION]
+		if ingress.Spec.IngressClassName != nil && *ingress.Spec.IngressClassName != "" {
+			className = *ingress.Spec.IngressClassName
+		}
+		if className == obj.GetName() || (className == "" && isDefault) {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: ingress.Namespace, Name: ingress.Name}})
+		}
+	}
+
+	return requests
+}
+
+// Returns true if the Ingress (listed from the cache) is annotated, or its Namespace is annotated by default, to enable ACM certificate management. The Ingress's annotations are completed with the defaults set on its Namespace.
+func (r *IngressReconciler) ingressEnabled(ingress *networking.Ingress) bool {
+	if err := applyNamespaceDefaults(context.TODO(), r.Client, ingress); err != nil {
+		return false
+	}
+	enabled, _ := strconv.ParseBool(ingress.Annotations[global.AGENT_ENABLED_ANNOTATION])
+	return enabled
+}
+
+// FindIngressesForNamespace maps a Namespace to the Ingresses within it.
+func (r *IngressReconciler) FindIngressesForNamespace(obj client.Object) []reconcile.Request {
+
+	ingressList := &networking.IngressList{}
+	if err := r.List(context.TODO(), ingressList, client.InNamespace(obj.GetName())); err != nil {
+		return nil
+	}
+
+	requests := []reconcile.Request{}
+	for _, ingress := range ingressList.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: ingress.Namespace, Name: ingress.Name}})
+	}
 
-		// secret_controller automatically extracts domains supported by each ACM-synced certificate from the SAN field (DNSName=%) and stores them as an annotation.
-		domainNamesAnnotation, ok := secret.Annotations[global.AGENT_CERTIFICATE_DOMAIN_NAMES_ANNOTATION]
-		if !ok || domainNamesAnnotation == "" {
+	return requests
+}
+
+// FindIngressesForConfigMap maps a ConfigMap to the enabled Ingresses (in the same namespace) whose 'domain-mapping' annotation names it.
+func (r *IngressReconciler) FindIngressesForConfigMap(obj client.Object) []reconcile.Request {
+
+	ingressList := &networking.IngressList{}
+	if err := r.List(context.TODO(), ingressList, client.InNamespace(obj.GetNamespace())); err != nil {
+		return nil
+	}
+
+	requests := []reconcile.Request{}
+	for i := range ingressList.Items {
+		ingress := &ingressList.Items[i]
+		if !r.ingressEnabled(ingress) {
 			continue
 		}
+		if strings.TrimSpace(ingress.Annotations[global.AGENT_DOMAIN_MAPPING_ANNOTATION]) == obj.GetName() {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: ingress.Namespace, Name: ingress.Name}})
+		}
+	}
+
+	return requests
+}
 
-		domainNames := trimSpaceFromSliceElements(strings.Split(domainNamesAnnotation, ","))
-		if containsStringIgnoringCase(domainNames, hostName) || containsStringIgnoringCase(domainNames, wildcardHostName) {
-			return certificateArn, nil
+// FindIngressesForSecret maps a certificate Secret to the enabled Ingresses it may serve: those naming it in their TLS section (if UseTLSHosts is set), those with a host name covered by its certificate (and within whose Secret scope it falls), and those already using its ACM certificate.
+func (r *IngressReconciler) FindIngressesForSecret(obj client.Object) []reconcile.Request {
+
+	secret, ok := obj.(*corev1.Secret)
+	if !ok || !isCertificateSecret(secret) {
+		return nil
+	}
+
+	ingressList := &networking.IngressList{}
+	if err := r.List(context.TODO(), ingressList); err != nil {
+		return nil
+	}
+
+	certificateArn := secret.Annotations[global.AGENT_CERTIFICATE_ARN_ANNOTATION]
+
+	requests := []reconcile.Request{}
+	for i := range ingressList.Items {
+		ingress := &ingressList.Items[i]
+		if !r.ingressEnabled(ingress) {
+			continue
+		}
+		if r.IngressUsesSecret(ingress, secret, certificateArn) {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: ingress.Namespace, Name: ingress.Name}})
 		}
+	}
+
+	return requests
+}
+
+// IngressUsesSecret returns true if the Ingress's certificate ARNs may depend on the Secret (see FindIngressesForSecret.)
+func (r *IngressReconciler) IngressUsesSecret(ingress *networking.Ingress, secret *corev1.Secret, certificateArn string) bool {
+
+	if certificateArn != "" && containsString(trimSpaceFromSliceElements(strings.Split(ingress.Annotations[r.certificateArnAnnotation()], ",")), certificateArn) {
+		return true
+	}
+
+	if r.UseTLSHosts && ingress.Namespace == secret.Namespace {
+		for _, tls := range ingress.Spec.TLS {
+			if tls.SecretName == secret.Name {
+				return true
+			}
+		}
+	}
+
+	namespaces, selector, err := getSecretScope(ingress.Annotations)
+	if err != nil || !secretInScope(secret, namespaces, selector) {
+		return false
+	}
+	matcher, err := getDomainMatcher(context.TODO(), r.Client, ingress)
+	if err != nil {
+		matcher = defaultDomainMatcher
+	}
+	for _, hostName := range r.GetHostNames(ingress) {
+		if matches, _ := matcher.Matches(secret, hostName); matches {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the names of the ingress classes treated as ALB-backed.
+func (r *IngressReconciler) ingressClasses() []string {
+	if len(r.IngressClasses) == 0 {
+		return []string{global.ALB_INGRESS_CLASS}
+	}
+	return r.IngressClasses
+}
 
+// Returns the key of the annotation into which certificate ARNs are written.
+func (r *IngressReconciler) certificateArnAnnotation() string {
+	if r.CertificateArnAnnotation == "" {
+		return global.ALB_INGRESS_CERTIFICATE_ARN_ANNOTATION
 	}
+	return r.CertificateArnAnnotation
+}
+
+// Returns true if certificate ARNs not managed by the agent should be removed from the Ingress's annotation (see the 'certificate-arn-policy' annotation.)
+func (r *IngressReconciler) replacesCertificateArns(ingress *networking.Ingress) bool {
+	return strings.EqualFold(ingress.Annotations[global.AGENT_CERTIFICATE_ARN_POLICY_ANNOTATION], global.CERTIFICATE_ARN_POLICY_REPLACE)
+}
 
-	return "", fmt.Errorf("Certificate ARN could not be identified for host '%s'", hostName)
+// Returns the ARNs listed in the (comma-separated) annotation.
+func splitCertificateArns(annotation string) []string {
+	certificateArns := []string{}
+	for _, certificateArn := range strings.Split(annotation, ",") {
+		certificateArn = strings.TrimSpace(certificateArn)
+		if certificateArn != "" && !containsString(certificateArns, certificateArn) {
+			certificateArns = append(certificateArns, certificateArn)
+		}
+	}
+	return certificateArns
 }
 
-func (r *IngressReconciler) ConvertToWildcardHost(hostName string) string {
+// MergeCertificateArns returns the value of the Ingress's certificate ARN annotation holding the specified agent-managed ARNs.
+// Unless the Ingress's policy is to replace them, ARNs in the current annotation that were not added by the agent (i.e. are not recorded in the 'managed-certificate-arns' annotation) are preserved ahead of the agent's ARNs.
+func (r *IngressReconciler) MergeCertificateArns(ingress *networking.Ingress, managedArns []string) string {
 
-	components := strings.Split(hostName, ".")
-	return "*." + strings.Join(components[1:], ".")
+	if r.replacesCertificateArns(ingress) {
+		return strings.Join(managedArns, ",")
+	}
+
+	previouslyManagedArns := splitCertificateArns(ingress.Annotations[global.AGENT_MANAGED_CERTIFICATE_ARNS_ANNOTATION])
+	certificateArns := []string{}
+	for _, certificateArn := range splitCertificateArns(ingress.Annotations[r.certificateArnAnnotation()]) {
+		if !containsString(previouslyManagedArns, certificateArn) {
+			certificateArns = append(certificateArns, certificateArn)
+		}
+	}
+	for _, certificateArn := range managedArns {
+		if !containsString(certificateArns, certificateArn) {
+			certificateArns = append(certificateArns, certificateArn)
+		}
+	}
+
+	return strings.Join(certificateArns, ",")
+}
 
+// ManagedCertificateArnsChanged returns true if the agent-managed ARNs recorded on the Ingress differ from those specified.
+func (r *IngressReconciler) ManagedCertificateArnsChanged(ingress *networking.Ingress, managedArns []string) bool {
+	return ingress.Annotations[global.AGENT_MANAGED_CERTIFICATE_ARNS_ANNOTATION] != strings.Join(managedArns, ",")
 }
 
+// RemoveIngressCertificateAnnotation removes the agent-managed ARNs from the Ingress, deleting the certificate ARN annotation unless it holds ARNs that are preserved (see MergeCertificateArns), together with any SSL redirect annotation added by the agent (see ReconcileIngressHTTPSAnnotations.)
 func (r *IngressReconciler) RemoveIngressCertificateAnnotation(ingress *networking.Ingress) error {
-	delete(ingress.Annotations, global.ALB_INGRESS_CERTIFICATE_ARN_ANNOTATION)
-	return r.Update(context.TODO(), ingress, &client.UpdateOptions{})
+	patch := client.MergeFrom(ingress.DeepCopy())
+	if arnAnnotation := r.MergeCertificateArns(ingress, nil); arnAnnotation != "" {
+		setAnnotation(ingress, r.certificateArnAnnotation(), arnAnnotation)
+	} else {
+		delete(ingress.Annotations, r.certificateArnAnnotation())
+	}
+	delete(ingress.Annotations, global.AGENT_MANAGED_CERTIFICATE_ARNS_ANNOTATION)
+	delete(ingress.Annotations, global.AGENT_HOST_CERTIFICATES_ANNOTATION)
+	if managedKey := ingress.Annotations[global.AGENT_MANAGED_SSL_REDIRECT_ANNOTATION]; managedKey != "" {
+		delete(ingress.Annotations, managedKey)
+		delete(ingress.Annotations, global.AGENT_MANAGED_SSL_REDIRECT_ANNOTATION)
+	}
+	return r.Patch(context.TODO(), ingress, patch)
 }
 
-func (r *IngressReconciler) AddIngressCertificateAnnotation(ingress *networking.Ingress, certificateArns string) error {
+// AddIngressCertificateAnnotation sets the Ingress's certificate ARN annotation, and records the ARNs within it that are managed by the agent.
+func (r *IngressReconciler) AddIngressCertificateAnnotation(ingress *networking.Ingress, certificateArns string, managedArns []string) error {
+
+	// Patch (rather than update) so that concurrent changes made by other controllers (e.g. the AWS Load Balancer Controller) do not cause conflicts.
+	patch := client.MergeFrom(ingress.DeepCopy())
 
 	// Certificate ARN annotation for ALB can hold multiple (comma-separated) ARN values, see https://stackoverflow.com/questions/63433182/can-we-use-multiple-aws-acm-certificates-at-nginx-ingress-contoller-or-multiple
-	ingress.Annotations[global.ALB_INGRESS_CERTIFICATE_ARN_ANNOTATION] = certificateArns
-	return r.Update(context.TODO(), ingress, &client.UpdateOptions{})
+	setAnnotation(ingress, r.certificateArnAnnotation(), certificateArns)
+	if len(managedArns) > 0 {
+		setAnnotation(ingress, global.AGENT_MANAGED_CERTIFICATE_ARNS_ANNOTATION, strings.Join(managedArns, ","))
+	} else {
+		delete(ingress.Annotations, global.AGENT_MANAGED_CERTIFICATE_ARNS_ANNOTATION)
+	}
+	return r.Patch(context.TODO(), ingress, patch)
+
+}
+
+// ReconcileIngressHTTPSAnnotations adds the ALB annotations configuring the Ingress's HTTPS listeners (see SSLPolicy, and sslRedirectPolicy) that it does not already carry. Listeners are those declared by the Ingress's listen-ports annotation (nil if it has none, in which case the Ingress has only an HTTPS listener on the default port.)
+// The redirect annotation added by the agent is recorded in the Ingress's managed-ssl-redirect annotation, so that it can be updated as the Ingress's listeners change, and removed when the redirect is no longer required. Annotations not added by the agent are never changed.
+func (r *IngressReconciler) ReconcileIngressHTTPSAnnotations(ctx context.Context, ingress *networking.Ingress, listenPorts []ListenPort) error {
+
+	patch := client.MergeFrom(ingress.DeepCopy())
+	changes := []string{}
+
+	if _, ok := ingress.Annotations[global.ALB_INGRESS_SSL_POLICY_ANNOTATION]; !ok && r.SSLPolicy != "" {
+		setAnnotation(ingress, global.ALB_INGRESS_SSL_POLICY_ANNOTATION, r.SSLPolicy)
+		changes = append(changes, fmt.Sprintf("'%s' set to '%s'", global.ALB_INGRESS_SSL_POLICY_ANNOTATION, r.SSLPolicy))
+	}
+
+	// HTTP listeners are only redirected to an HTTPS listener declared alongside them.
+	redirectKey, redirectValue := "", ""
+	httpsPort, hasHTTPS := httpsListenPort(listenPorts)
+	for _, listenPort := range listenPorts {
+		if !hasHTTPS || listenPort.Protocol != "HTTP" {
+			continue
+		}
+		switch r.sslRedirectPolicy(ingress) {
+		case global.SSL_REDIRECT_POLICY_ANNOTATION:
+			redirectKey, redirectValue = global.ALB_INGRESS_SSL_REDIRECT_ANNOTATION, strconv.Itoa(int(httpsPort))
+		case global.SSL_REDIRECT_POLICY_ACTIONS:
+			redirectKey, redirectValue = global.ALB_INGRESS_SSL_REDIRECT_ACTION_ANNOTATION, fmt.Sprintf(`{"Type":"redirect","RedirectConfig":{"Protocol":"HTTPS","Port":"%d","StatusCode":"HTTP_301"}}`, httpsPort)
+		}
+		break
+	}
+
+	managedKey := ingress.Annotations[global.AGENT_MANAGED_SSL_REDIRECT_ANNOTATION]
+	if managedKey != "" && managedKey != redirectKey {
+		delete(ingress.Annotations, managedKey)
+		delete(ingress.Annotations, global.AGENT_MANAGED_SSL_REDIRECT_ANNOTATION)
+		changes = append(changes, fmt.Sprintf("'%s' removed", managedKey))
+	}
+	if value, ok := ingress.Annotations[redirectKey]; redirectKey != "" && (!ok || managedKey == redirectKey) && value != redirectValue {
+		setAnnotation(ingress, redirectKey, redirectValue)
+		setAnnotation(ingress, global.AGENT_MANAGED_SSL_REDIRECT_ANNOTATION, redirectKey)
+		changes = append(changes, fmt.Sprintf("'%s' set to '%s'", redirectKey, redirectValue))
+	}
+
+	if len(changes) == 0 {
+		return nil
+	}
+	if err := r.Patch(ctx, ingress, patch); err != nil {
+		return err
+	}
+	r.Recorder.Event(ingress, corev1.EventTypeNormal, eventReasonDecorated, fmt.Sprintf("HTTPS annotation(s) updated: %s.", strings.Join(changes, ", ")))
+
+	return nil
+}
+
+// Returns the Ingress's SSL redirect policy: that of its ssl-redirect annotation if set (and valid), otherwise 'Annotation' if SSLRedirect is set, or 'None'.
+func (r *IngressReconciler) sslRedirectPolicy(ingress *networking.Ingress) string {
+	for _, policy := range []string{global.SSL_REDIRECT_POLICY_ANNOTATION, global.SSL_REDIRECT_POLICY_ACTIONS, global.SSL_REDIRECT_POLICY_NONE} {
+		if strings.EqualFold(ingress.Annotations[global.AGENT_SSL_REDIRECT_ANNOTATION], policy) {
+			return policy
+		}
+	}
+	if r.SSLRedirect {
+		return global.SSL_REDIRECT_POLICY_ANNOTATION
+	}
+	return global.SSL_REDIRECT_POLICY_NONE
+}
+
+// Returns the source of the Ingress's certificates: that of its certificate-source annotation if set (and valid), otherwise 'Requested' if its request-certificate annotation is true (or 'Imported' if it is false), otherwise CertificateSource (default 'Imported'.)
+func (r *IngressReconciler) certificateSource(ingress *networking.Ingress) string {
+	sources := []string{global.CERTIFICATE_SOURCE_IMPORTED, global.CERTIFICATE_SOURCE_REQUESTED, global.CERTIFICATE_SOURCE_PREFER_REQUESTED}
+	for _, source := range sources {
+		if strings.EqualFold(strings.TrimSpace(ingress.Annotations[global.AGENT_CERTIFICATE_SOURCE_ANNOTATION]), source) {
+			return source
+		}
+	}
+	if value, ok := ingress.Annotations[global.AGENT_REQUEST_CERTIFICATE_ANNOTATION]; ok {
+		if requestCertificate, _ := strconv.ParseBool(value); requestCertificate {
+			return global.CERTIFICATE_SOURCE_REQUESTED
+		}
+		return global.CERTIFICATE_SOURCE_IMPORTED
+	}
+	for _, source := range sources {
+		if strings.EqualFold(r.CertificateSource, source) {
+			return source
+		}
+	}
+	return global.CERTIFICATE_SOURCE_IMPORTED
+}
+
+// ValidateCertificateSource returns an error if the value is not a certificate source ('Imported', 'Requested' or 'PreferRequested', in any case.)
+func ValidateCertificateSource(value string) error {
+	if !strings.EqualFold(value, global.CERTIFICATE_SOURCE_IMPORTED) && !strings.EqualFold(value, global.CERTIFICATE_SOURCE_REQUESTED) && !strings.EqualFold(value, global.CERTIFICATE_SOURCE_PREFER_REQUESTED) {
+		return fmt.Errorf("'%s' must be one of '%s', '%s' or '%s'.", value, global.CERTIFICATE_SOURCE_IMPORTED, global.CERTIFICATE_SOURCE_REQUESTED, global.CERTIFICATE_SOURCE_PREFER_REQUESTED)
+	}
+	return nil
+}
+
+// Returns the reason why ACM cannot be expected to issue a certificate for the Ingress without intervention, or an empty string if it can: every host name must be a public domain name, and the Ingress must name the Route53 hosted zone(s) into which DNS validation records are published.
+func (r *IngressReconciler) certificateRequestIneligibility(ingress *networking.Ingress, hostNames []string) string {
+
+	if len(hostNames) == 0 {
+		return "Ingress does not define any host names."
+	}
+	if strings.TrimSpace(ingress.Annotations[global.AGENT_HOSTED_ZONE_ID_ANNOTATION]) == "" {
+		return fmt.Sprintf("Ingress does not name a Route53 hosted zone for DNS validation (see the '%s' annotation.)", global.AGENT_HOSTED_ZONE_ID_ANNOTATION)
+	}
+	for _, hostName := range hostNames {
+		if !isPublicDomainName(hostName) {
+			return fmt.Sprintf("Host name '%s' is not a public domain name.", hostName)
+		}
+	}
+
+	return ""
+}
+
+// DecorateWithRequestedCertificate sets the Ingress's certificate ARN annotation to the ARN of the certificate issued by ACM for its ACMCertificateRequest, replacing any managed ARNs of imported certificates.
+func (r *IngressReconciler) DecorateWithRequestedCertificate(ctx context.Context, ingress *networking.Ingress, certificateRequest *v1alpha1.ACMCertificateRequest, hostNames []string, listenPorts []ListenPort) error {
+
+	log := log.FromContext(ctx)
+
+	ingressARNAnnotation, ingressHasARNAnnotation := ingress.Annotations[r.certificateArnAnnotation()]
+
+	managedArns := []string{certificateRequest.Status.CertificateArn}
+	arnAnnotation := r.MergeCertificateArns(ingress, managedArns)
+	if !ingressHasARNAnnotation || ingressARNAnnotation != arnAnnotation || r.ManagedCertificateArnsChanged(ingress, managedArns) {
+		log.Info("Adding ACM certificate ARN to Ingress...")
+		if err := r.AddIngressCertificateAnnotation(ingress, arnAnnotation, managedArns); err != nil {
+			log.Error(err, "Failed to persist ACM certificate ARN(s) back to Ingress.")
+			return err
+		}
+		r.Recorder.Event(ingress, corev1.EventTypeNormal, eventReasonDecorated, fmt.Sprintf("ACM certificate ARN(s) set to '%s'.", arnAnnotation))
+	}
+	if err := r.ReconcileIngressHTTPSAnnotations(ctx, ingress, listenPorts); err != nil {
+		log.Error(err, "Failed to add HTTPS annotations to Ingress.")
+		return err
+	}
+
+	hostCertificates := HostCertificates{Hosts: map[string]string{}}
+	for _, hostName := range hostNames {
+		hostCertificates.Hosts[hostName] = certificateRequest.Status.CertificateArn
+	}
+	r.RecordHostCertificates(ctx, ingress, hostCertificates)
+
+	return nil
+}
+
+// ReconcileCertificateRequest creates (or updates) an ACMCertificateRequest, owned by the Ingress, for a certificate covering the specified host names.
+func (r *IngressReconciler) ReconcileCertificateRequest(ctx context.Context, ingress *networking.Ingress, hostNames []string) (*v1alpha1.ACMCertificateRequest, error) {
+
+	log := log.FromContext(ctx)
+
+	spec := v1alpha1.ACMCertificateRequestSpec{
+		DomainName:   hostNames[0],
+		RoleArn:      ingress.Annotations[global.AGENT_ASSUME_ROLE_ARN_ANNOTATION],
+		DeletePolicy: global.DELETE_POLICY_RETAIN,
+	}
+	if len(hostNames) > 1 {
+		spec.SubjectAlternativeNames = hostNames[1:]
+	}
+	if hasDeletePolicy(ingress.Annotations) {
+		spec.DeletePolicy = global.DELETE_POLICY_DELETE
+	}
+
+	// The hosted zone annotation may list several (comma-separated) hosted zones, so is passed through to the ACMCertificateRequest unchanged.
+	hostedZoneIDs := ingress.Annotations[global.AGENT_HOSTED_ZONE_ID_ANNOTATION]
+
+	certificateRequest := &v1alpha1.ACMCertificateRequest{}
+	err := r.Get(ctx, types.NamespacedName{Namespace: ingress.Namespace, Name: ingress.Name}, certificateRequest)
+	if err != nil {
+		if !k8serr.IsNotFound(err) {
+			return nil, err
+		}
+
+		certificateRequest = &v1alpha1.ACMCertificateRequest{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: ingress.Namespace,
+				Name:      ingress.Name,
+			},
+			Spec: spec,
+		}
+		if hostedZoneIDs != "" {
+			certificateRequest.Annotations = map[string]string{global.AGENT_HOSTED_ZONE_ID_ANNOTATION: hostedZoneIDs}
+		}
+		if err := ctrl.SetControllerReference(ingress, certificateRequest, r.Scheme); err != nil {
+			return nil, err
+		}
+
+		log.Info(fmt.Sprintf("Creating ACMCertificateRequest '%s'...", namespacedName(certificateRequest.ObjectMeta)))
+		if err := r.Create(ctx, certificateRequest); err != nil {
+			return nil, err
+		}
+		return certificateRequest, nil
+	}
+
+	if !metav1.IsControlledBy(certificateRequest, ingress) {
+		return nil, fmt.Errorf("ACMCertificateRequest '%s' already exists and is not owned by this Ingress.", namespacedName(certificateRequest.ObjectMeta))
+	}
+
+	if !reflect.DeepEqual(certificateRequest.Spec, spec) || certificateRequest.Annotations[global.AGENT_HOSTED_ZONE_ID_ANNOTATION] != hostedZoneIDs {
+		log.Info(fmt.Sprintf("Updating ACMCertificateRequest '%s'...", namespacedName(certificateRequest.ObjectMeta)))
+		patch := client.MergeFrom(certificateRequest.DeepCopy())
+		certificateRequest.Spec = spec
+		if hostedZoneIDs != "" {
+			setAnnotation(certificateRequest, global.AGENT_HOSTED_ZONE_ID_ANNOTATION, hostedZoneIDs)
+		} else {
+			delete(certificateRequest.Annotations, global.AGENT_HOSTED_ZONE_ID_ANNOTATION)
+		}
+		if err := r.Patch(ctx, certificateRequest, patch); err != nil {
+			return nil, err
+		}
+	}
+
+	return certificateRequest, nil
+}
+
+// Import settings that, when set on an Ingress, are copied to the Certificates provisioned for it.
+var provisionedCertificateAnnotations = []string{
+	global.AGENT_REGIONS_ANNOTATION,
+	global.AGENT_TAGS_ANNOTATION,
+	global.AGENT_ASSUME_ROLE_ARN_ANNOTATION,
+	global.AGENT_DELETE_POLICY_ANNOTATION,
+}
+
+// ParseIssuerReference parses a 'Kind/name' cert-manager issuer reference (e.g. 'ClusterIssuer/letsencrypt'.) If the kind is omitted, the name refers to an Issuer.
+func ParseIssuerReference(value string) (*cmmeta.ObjectReference, error) {
+
+	kind, name := cm.IssuerKind, strings.TrimSpace(value)
+	if parts := strings.SplitN(name, "/", 2); len(parts) == 2 {
+		kind, name = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	}
+
+	if kind != cm.IssuerKind && kind != cm.ClusterIssuerKind {
+		return nil, fmt.Errorf("'%s' is not a valid issuer kind: expected '%s' or '%s'.", kind, cm.IssuerKind, cm.ClusterIssuerKind)
+	}
+	if name == "" {
+		return nil, fmt.Errorf("'%s' is not a valid issuer: expected '[Kind/]name'.", value)
+	}
+
+	return &cmmeta.ObjectReference{Name: name, Kind: kind, Group: certmanager.GroupName}, nil
+}
+
+// GetIssuer returns the cert-manager issuer of Certificates provisioned for the Ingress: that named by its 'cluster-issuer' or 'issuer' annotation, otherwise DefaultIssuer. Returns nil if there is none.
+func (r *IngressReconciler) GetIssuer(ingress *networking.Ingress) (*cmmeta.ObjectReference, error) {
+
+	clusterIssuer := strings.TrimSpace(ingress.Annotations[global.AGENT_CLUSTER_ISSUER_ANNOTATION])
+	issuer := strings.TrimSpace(ingress.Annotations[global.AGENT_ISSUER_ANNOTATION])
+
+	switch {
+	case clusterIssuer != "" && issuer != "":
+		return nil, fmt.Errorf("Only one of the '%s' and '%s' annotations may be set.", global.AGENT_ISSUER_ANNOTATION, global.AGENT_CLUSTER_ISSUER_ANNOTATION)
+	case clusterIssuer != "":
+		return &cmmeta.ObjectReference{Name: clusterIssuer, Kind: cm.ClusterIssuerKind, Group: certmanager.GroupName}, nil
+	case issuer != "":
+		return &cmmeta.ObjectReference{Name: issuer, Kind: cm.IssuerKind, Group: certmanager.GroupName}, nil
+	}
+
+	return r.DefaultIssuer, nil
+}
+
+// ReconcileProvisionedCertificate creates (or updates) an agent-enabled cert-manager Certificate, owned by the Ingress, covering its unmatched host names. Host names already covered by the Certificate are retained for as long as the Ingress serves them, so that the Certificate is not re-issued once its own host names have been matched.
+func (r *IngressReconciler) ReconcileProvisionedCertificate(ctx context.Context, ingress *networking.Ingress, issuerRef cmmeta.ObjectReference, hostNames []string, unmatchedHostNames []string) (*cm.Certificate, error) {
+
+	log := log.FromContext(ctx)
+
+	name := ingress.Name + "-acm"
+
+	certificate := &cm.Certificate{}
+	err := r.Get(ctx, types.NamespacedName{Namespace: ingress.Namespace, Name: name}, certificate)
+	if err != nil && !k8serr.IsNotFound(err) {
+		return nil, err
+	}
+	exists := err == nil
+	if exists && !metav1.IsControlledBy(certificate, ingress) {
+		return nil, fmt.Errorf("Certificate '%s' already exists and is not owned by this Ingress.", namespacedName(certificate.ObjectMeta))
+	}
+
+	dnsNames := []string{}
+	for _, hostName := range certificate.Spec.DNSNames {
+		if containsString(hostNames, hostName) {
+			dnsNames = append(dnsNames, hostName)
+		}
+	}
+	for _, hostName := range unmatchedHostNames {
+		if !containsString(dnsNames, hostName) {
+			dnsNames = append(dnsNames, hostName)
+		}
+	}
+	sort.Strings(dnsNames)
+
+	spec := cm.CertificateSpec{
+		SecretName: name + "-tls",
+		DNSNames:   dnsNames,
+		IssuerRef:  issuerRef,
+	}
+
+	// The Certificate is enabled for import into ACM, with the Ingress's import settings.
+	annotations := map[string]string{global.AGENT_ENABLED_ANNOTATION: "true"}
+	for _, key := range provisionedCertificateAnnotations {
+		if value, ok := ingress.Annotations[key]; ok {
+			annotations[key] = value
+		}
+	}
+
+	if !exists {
+		certificate = &cm.Certificate{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   ingress.Namespace,
+				Name:        name,
+				Annotations: annotations,
+			},
+			Spec: spec,
+		}
+		if err := ctrl.SetControllerReference(ingress, certificate, r.Scheme); err != nil {
+			return nil, err
+		}
+
+		log.Info(fmt.Sprintf("Creating Certificate '%s'...", namespacedName(certificate.ObjectMeta)))
+		if err := r.Create(ctx, certificate); err != nil {
+			return nil, err
+		}
+		r.Recorder.Event(ingress, corev1.EventTypeNormal, eventReasonProvisioned, fmt.Sprintf("Certificate '%s' created for host(s): %s.", certificate.Name, strings.Join(dnsNames, ", ")))
+		return certificate, nil
+	}
+
+	annotationsChanged := false
+	for _, key := range append(provisionedCertificateAnnotations, global.AGENT_ENABLED_ANNOTATION) {
+		value, ok := annotations[key]
+		currentValue, currentOk := certificate.Annotations[key]
+		if ok != currentOk || value != currentValue {
+			annotationsChanged = true
+		}
+	}
+	if !reflect.DeepEqual(certificate.Spec.DNSNames, spec.DNSNames) || certificate.Spec.SecretName != spec.SecretName || certificate.Spec.IssuerRef != spec.IssuerRef || annotationsChanged {
+		log.Info(fmt.Sprintf("Updating Certificate '%s'...", namespacedName(certificate.ObjectMeta)))
+		patch := client.MergeFrom(certificate.DeepCopy())
+		certificate.Spec.DNSNames = spec.DNSNames
+		certificate.Spec.SecretName = spec.SecretName
+		certificate.Spec.IssuerRef = spec.IssuerRef
+		for _, key := range provisionedCertificateAnnotations {
+			delete(certificate.Annotations, key)
+		}
+		for key, value := range annotations {
+			setAnnotation(certificate, key, value)
+		}
+		if err := r.Patch(ctx, certificate, patch); err != nil {
+			return nil, err
+		}
+		r.Recorder.Event(ingress, corev1.EventTypeNormal, eventReasonProvisioned, fmt.Sprintf("Certificate '%s' updated for host(s): %s.", certificate.Name, strings.Join(dnsNames, ", ")))
+	}
 
+	return certificate, nil
 }
@@ -0,0 +1,305 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+	"github.com/aws/aws-sdk-go-v2/service/acm/types"
+	corev1 "k8s.io/api/core/v1"
+	networking "k8s.io/api/networking/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// End-to-end tests of certificate synchronization (Secret -> ACM -> Secret annotations -> Ingress decoration.) See suite_test.go.
+
+// A Secret's certificate is imported into ACM, its ARN is recorded on the Secret, and the Ingress serving its domain is decorated with the ARN.
+func TestSecretImportAndIngressDecoration(t *testing.T) {
+	requireEnvtest(t)
+	ctx := context.Background()
+
+	namespace := createTestNamespace(t)
+	domainName := namespace + ".example.test"
+	root := newTestRoot(t, "Test Root")
+	intermediate := root.issueIntermediate(t, "Test Intermediate")
+	key := newTestKey(t)
+	leaf := intermediate.issueLeaf(t, key, domainName)
+
+	secret := createTestSecret(t, namespace, "tls", key, map[string]string{global.AGENT_ENABLED_ANNOTATION: "true"}, leaf, intermediate)
+	certificateArn := waitForCertificateArn(t, secret, leaf)
+
+	detail := describeTestCertificate(t, certificateArn)
+	if aws.ToString(detail.DomainName) != domainName {
+		t.Errorf("ACM certificate has domain name '%s', expected '%s'.", aws.ToString(detail.DomainName), domainName)
+	}
+	if certificate, err := testACM.GetCertificate(ctx, &acm.GetCertificateInput{CertificateArn: aws.String(certificateArn)}); err != nil {
+		t.Errorf("Could not get ACM certificate: %s", err)
+	} else if aws.ToString(certificate.CertificateChain) != intermediate.PEM {
+		t.Errorf("ACM certificate chain is '%s', expected the intermediate certificate.", aws.ToString(certificate.CertificateChain))
+	}
+
+	synced := getTestSecret(t, secret)
+	if syncStatus, ok := (&SecretReconciler{}).GetSyncStatus(synced); !ok {
+		t.Errorf("Secret has no sync status.")
+	} else if syncStatus.State != global.SYNC_STATE_SYNCED {
+		t.Errorf("Sync status is '%s', expected '%s'.", syncStatus.State, global.SYNC_STATE_SYNCED)
+	}
+	if synced.Annotations[global.AGENT_CERTIFICATE_DOMAIN_NAMES_ANNOTATION] != domainName {
+		t.Errorf("Domain names annotation is '%s', expected '%s'.", synced.Annotations[global.AGENT_CERTIFICATE_DOMAIN_NAMES_ANNOTATION], domainName)
+	}
+
+	ingress := createTestIngress(t, namespace, "web", domainName)
+	waitForIngressCertificateArns(t, ingress, certificateArn)
+}
+
+// An Opaque Secret declared to hold a certificate is imported as a TLS Secret, and its ARN is used to decorate Ingresses.
+func TestOpaqueSecretImport(t *testing.T) {
+	requireEnvtest(t)
+
+	namespace := createTestNamespace(t)
+	domainName := namespace + ".example.test"
+	key := newTestKey(t)
+	leaf := newTestRoot(t, "Test Root").issueLeaf(t, key, domainName)
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "opaque", Annotations: map[string]string{
+			global.AGENT_ENABLED_ANNOTATION:            "true",
+			global.AGENT_CERTIFICATE_SECRET_ANNOTATION: "true",
+		}},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       []byte(testBundle(leaf)),
+			corev1.TLSPrivateKeyKey: []byte(testKeyPEM(t, key)),
+		},
+	}
+	if err := testClient.Create(context.Background(), secret); err != nil {
+		t.Fatalf("Could not create Secret: %s", err)
+	}
+	certificateArn := waitForCertificateArn(t, secret, leaf)
+
+	ingress := createTestIngress(t, namespace, "web", domainName)
+	waitForIngressCertificateArns(t, ingress, certificateArn)
+}
+
+// A renewed certificate is re-imported over the existing ACM certificate, so that its ARN (and the Ingress serving it) is unchanged.
+func TestCertificateRotation(t *testing.T) {
+	requireEnvtest(t)
+	ctx := context.Background()
+
+	namespace := createTestNamespace(t)
+	domainName := namespace + ".example.test"
+	root := newTestRoot(t, "Test Root")
+	key := newTestKey(t)
+	leaf := root.issueLeaf(t, key, domainName)
+
+	secret := createTestSecret(t, namespace, "tls", key, map[string]string{global.AGENT_ENABLED_ANNOTATION: "true"}, leaf)
+	certificateArn := waitForCertificateArn(t, secret, leaf)
+	ingress := createTestIngress(t, namespace, "web", domainName)
+	waitForIngressCertificateArns(t, ingress, certificateArn)
+
+	renewedKey := newTestKey(t)
+	renewed := root.issueLeaf(t, renewedKey, domainName)
+	current := getTestSecret(t, secret)
+	current.Data[corev1.TLSPrivateKeyKey] = []byte(testKeyPEM(t, renewedKey))
+	current.Data[corev1.TLSCertKey] = []byte(testBundle(renewed))
+	if err := testClient.Update(ctx, current); err != nil {
+		t.Fatalf("Could not update Secret: %s", err)
+	}
+
+	if renewedArn := waitForCertificateArn(t, secret, renewed); renewedArn != certificateArn {
+		t.Errorf("Renewed certificate was imported as '%s', expected re-import over '%s'.", renewedArn, certificateArn)
+	}
+	if detail := describeTestCertificate(t, certificateArn); aws.ToString(detail.Serial) != (&SecretReconciler{}).FormatX509SerialNumber(renewed.x509.SerialNumber) {
+		t.Errorf("ACM certificate has serial number '%s', expected that of the renewed certificate.", aws.ToString(detail.Serial))
+	}
+	if arns := testCertificateArnsFor(t, domainName); len(arns) != 1 {
+		t.Errorf("Found %d ACM certificates for '%s', expected 1.", len(arns), domainName)
+	}
+	waitForIngressCertificateArns(t, ingress, certificateArn)
+}
+
+// The ACM certificate of a Secret with the 'Delete' delete policy is deleted with the Secret (once the agent's finalizer has run.)
+func TestCertificateDeletion(t *testing.T) {
+	requireEnvtest(t)
+	ctx := context.Background()
+
+	namespace := createTestNamespace(t)
+	domainName := namespace + ".example.test"
+	key := newTestKey(t)
+	leaf := newTestRoot(t, "Test Root").issueLeaf(t, key, domainName)
+
+	secret := createTestSecret(t, namespace, "tls", key, map[string]string{
+		global.AGENT_ENABLED_ANNOTATION:       "true",
+		global.AGENT_DELETE_POLICY_ANNOTATION: global.DELETE_POLICY_DELETE,
+	}, leaf)
+	certificateArn := waitForCertificateArn(t, secret, leaf)
+	eventually(t, func() (bool, string) {
+		return containsString(getTestSecret(t, secret).Finalizers, secretFinalizerID), "Secret does not hold the agent's finalizer."
+	})
+
+	if err := testClient.Delete(ctx, secret); err != nil {
+		t.Fatalf("Could not delete Secret: %s", err)
+	}
+	eventually(t, func() (bool, string) {
+		err := testClient.Get(ctx, client.ObjectKeyFromObject(secret), &corev1.Secret{})
+		return k8serr.IsNotFound(err), "Secret has not been deleted."
+	})
+	if containsString(testACM.CertificateArns(), certificateArn) {
+		t.Errorf("ACM certificate '%s' was not deleted with the Secret.", certificateArn)
+	}
+}
+
+// A certificate held by several Secrets is imported into ACM once, and the existing ACM certificate is re-used by the others.
+func TestDuplicateDetection(t *testing.T) {
+	requireEnvtest(t)
+
+	namespace := createTestNamespace(t)
+	replicaNamespace := createTestNamespace(t)
+	domainName := namespace + ".example.test"
+	key := newTestKey(t)
+	leaf := newTestRoot(t, "Test Root").issueLeaf(t, key, domainName)
+
+	secret := createTestSecret(t, namespace, "tls", key, map[string]string{global.AGENT_ENABLED_ANNOTATION: "true"}, leaf)
+	certificateArn := waitForCertificateArn(t, secret, leaf)
+
+	replica := createTestSecret(t, replicaNamespace, "tls", key, map[string]string{global.AGENT_ENABLED_ANNOTATION: "true"}, leaf)
+	if replicaArn := waitForCertificateArn(t, replica, leaf); replicaArn != certificateArn {
+		t.Errorf("Duplicate certificate was imported as '%s', expected re-use of '%s'.", replicaArn, certificateArn)
+	}
+	if arns := testCertificateArnsFor(t, domainName); len(arns) != 1 {
+		t.Errorf("Found %d ACM certificates for '%s', expected 1.", len(arns), domainName)
+	}
+}
+
+// Creates a Namespace with a generated name, returning its name.
+func createTestNamespace(t *testing.T) string {
+	t.Helper()
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "test-"}}
+	if err := testClient.Create(context.Background(), namespace); err != nil {
+		t.Fatalf("Could not create Namespace: %s", err)
+	}
+	return namespace.Name
+}
+
+// Creates a 'kubernetes.io/tls' Secret holding the key and the certificates (in order.)
+func createTestSecret(t *testing.T, namespace string, name string, key crypto.Signer, annotations map[string]string, certificates ...*testCertificate) *corev1.Secret {
+	t.Helper()
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Annotations: annotations},
+		Type:       corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       []byte(testBundle(certificates...)),
+			corev1.TLSPrivateKeyKey: []byte(testKeyPEM(t, key)),
+		},
+	}
+	if err := testClient.Create(context.Background(), secret); err != nil {
+		t.Fatalf("Could not create Secret: %s", err)
+	}
+	return secret
+}
+
+// Creates an agent-enabled ALB Ingress serving the host name over HTTPS.
+func createTestIngress(t *testing.T, namespace string, name string, hostName string) *networking.Ingress {
+	t.Helper()
+	pathType := networking.PathTypePrefix
+	ingress := &networking.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Annotations: map[string]string{
+			global.AGENT_ENABLED_ANNOTATION:            "true",
+			global.ALB_INGRESS_CLASS_ANNOTATION:        global.ALB_INGRESS_CLASS,
+			global.ALB_INGRESS_LISTEN_PORTS_ANNOTATION: `[{"HTTPS":443}]`,
+		}},
+		Spec: networking.IngressSpec{Rules: []networking.IngressRule{{
+			Host: hostName,
+			IngressRuleValue: networking.IngressRuleValue{HTTP: &networking.HTTPIngressRuleValue{Paths: []networking.HTTPIngressPath{{
+				Path:     "/",
+				PathType: &pathType,
+				Backend:  networking.IngressBackend{Service: &networking.IngressServiceBackend{Name: "web", Port: networking.ServiceBackendPort{Number: 80}}},
+			}}}},
+		}}},
+	}
+	if err := testClient.Create(context.Background(), ingress); err != nil {
+		t.Fatalf("Could not create Ingress: %s", err)
+	}
+	return ingress
+}
+
+// Returns the current state of the Secret.
+func getTestSecret(t *testing.T, secret *corev1.Secret) *corev1.Secret {
+	t.Helper()
+	current := &corev1.Secret{}
+	if err := testClient.Get(context.Background(), client.ObjectKeyFromObject(secret), current); err != nil {
+		t.Fatalf("Could not get Secret: %s", err)
+	}
+	return current
+}
+
+// Waits until the Secret records that the certificate has been imported into ACM (i.e. its certificate-arn annotation names an ACM certificate with the certificate's serial number), returning the ARN.
+func waitForCertificateArn(t *testing.T, secret *corev1.Secret, certificate *testCertificate) string {
+	t.Helper()
+	serialNumber := (&SecretReconciler{}).FormatX509SerialNumber(certificate.x509.SerialNumber)
+	certificateArn := ""
+	eventually(t, func() (bool, string) {
+		current := getTestSecret(t, secret)
+		certificateArn = current.Annotations[global.AGENT_CERTIFICATE_ARN_ANNOTATION]
+		if certificateArn == "" || current.Annotations[global.AGENT_CERTIFICATE_SERIAL_NUMBER_ANNOTATION] != serialNumber {
+			return false, fmt.Sprintf("Secret '%s' does not record the import of certificate %s (sync status '%s').", client.ObjectKeyFromObject(secret), serialNumber, current.Annotations[global.AGENT_SYNC_STATUS_ANNOTATION])
+		}
+		return true, ""
+	})
+	if !containsString(testACM.CertificateArns(), certificateArn) {
+		t.Fatalf("Secret names ACM certificate '%s', which does not exist.", certificateArn)
+	}
+	return certificateArn
+}
+
+// Waits until the Ingress's certificate ARN annotation names (only) the certificates.
+func waitForIngressCertificateArns(t *testing.T, ingress *networking.Ingress, certificateArns ...string) {
+	t.Helper()
+	expected := strings.Join(certificateArns, ",")
+	eventually(t, func() (bool, string) {
+		current := &networking.Ingress{}
+		if err := testClient.Get(context.Background(), client.ObjectKeyFromObject(ingress), current); err != nil {
+			return false, err.Error()
+		}
+		actual := current.Annotations[global.ALB_INGRESS_CERTIFICATE_ARN_ANNOTATION]
+		return actual == expected, fmt.Sprintf("Ingress certificate ARNs are '%s', expected '%s'.", actual, expected)
+	})
+}
+
+// Returns the FakeACMService's description of the certificate.
+func describeTestCertificate(t *testing.T, certificateArn string) *types.CertificateDetail {
+	t.Helper()
+	output, err := testACM.DescribeCertificate(context.Background(), &acm.DescribeCertificateInput{CertificateArn: aws.String(certificateArn)})
+	if err != nil {
+		t.Fatalf("Could not describe ACM certificate '%s': %s", certificateArn, err)
+	}
+	return output.Certificate
+}
+
+// Returns the ARNs of the ACM certificates for the domain name.
+func testCertificateArnsFor(t *testing.T, domainName string) []string {
+	t.Helper()
+	certificateArns := []string{}
+	for _, certificateArn := range testACM.CertificateArns() {
+		if aws.ToString(describeTestCertificate(t, certificateArn).DomainName) == domainName {
+			certificateArns = append(certificateArns, certificateArn)
+		}
+	}
+	return certificateArns
+}
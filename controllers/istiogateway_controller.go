@@ -0,0 +1,297 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// Istio Gateways are handled as unstructured objects, so that the agent does not depend on Istio's client libraries.
+var istioGatewayGVK = schema.GroupVersionKind{Group: "networking.istio.io", Version: "v1beta1", Kind: "Gateway"}
+
+// The subset of the Istio Gateway spec used by IstioGatewayReconciler.
+type istioGatewaySpec struct {
+	Selector map[string]string    `json:"selector,omitempty"`
+	Servers  []istioGatewayServer `json:"servers,omitempty"`
+}
+
+type istioGatewayServer struct {
+	Hosts []string `json:"hosts,omitempty"`
+}
+
+// IstioGatewayReconciler injects ACM certificate annotations into the LoadBalancer (NLB/CLB) Services that front Istio ingress gateways, by matching the hosts of Istio (networking.istio.io) Gateway objects to SSL-containing Secrets.
+// Because several Gateways may select the same ingress gateway, the ARNs assigned to a Service cover the hosts of all annotated Gateways that select it.
+type IstioGatewayReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// Maximum number of objects reconciled in parallel (default 1.)
+	MaxConcurrentReconciles int
+
+	// Delay before the first retry of an object whose reconciliation fails (doubling on each subsequent failure.) Defaults to 1 second.
+	RequeueDelay time.Duration
+
+	// Retries of failed objects, parking those that exceed MaxRetries. Set by SetupWithManager.
+	retries *retryLimiter
+}
+
+func (r *IstioGatewayReconciler) SetupWithManager(mgr ctrl.Manager) error {
+
+	r.retries = newRetryLimiter("istiogateway", r.RequeueDelay)
+
+	if err := indexSecretsByType(mgr); err != nil {
+		return err
+	}
+
+	// Tells the controller which object type this reconciler will handle. Istio Gateways share their kind with Gateway API Gateways, so this controller must be named explicitly.
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("istiogateway").
+		For(newIstioGateway()).
+		WithOptions(controller.Options{RateLimiter: r.retries.rateLimiter, MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
+		WithLogConstructor(buildLogConstructor(mgr, "istiogateway-reconciler", istioGatewayGVK.Group, "gateway")). // When multiple controllers running with a single manager, the log auto-constructor does not work. Therefore we must do manually.
+		Complete(r)
+}
+
+func (r *IstioGatewayReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+
+	log := log.FromContext(ctx)
+
+	gw := newIstioGateway()
+	if err := r.Get(ctx, req.NamespacedName, gw); err != nil {
+		if !k8serr.IsNotFound(err) {
+			log.Error(err, "Unable to retrieve Istio Gateway.")
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	log.V(1).Info(fmt.Sprintf("Processing Istio Gateway %s...", req.NamespacedName))
+
+	// Object is marked for deletion - nothing to do (the operator never removes synced ACM certificates.)
+	if !gw.GetDeletionTimestamp().IsZero() {
+		log.Info("Istio Gateway is marked for deletion: nothing to do.")
+		return ctrl.Result{}, nil
+	}
+
+	if !r.IsEnabled(gw) {
+		log.Info(fmt.Sprintf("Istio Gateway '%s' is not marked as managed.", req.NamespacedName))
+		return ctrl.Result{}, nil
+	}
+
+	// Objects whose retries have been exhausted are not reconciled again until they change.
+	if r.retries.Parked(req, gw.GetResourceVersion()) {
+		log.Info("Istio Gateway is parked (retries exhausted): nothing to do.")
+		return ctrl.Result{}, nil
+	}
+	if r.retries.Exhausted(req) {
+		log.Info(retriesExhaustedMessage())
+		r.Recorder.Event(gw, corev1.EventTypeWarning, eventReasonRetriesExhausted, retriesExhaustedMessage())
+		r.retries.Park(req, gw.GetResourceVersion())
+		return ctrl.Result{}, nil
+	}
+
+	spec, err := r.GetSpec(gw)
+	if err != nil {
+		log.Error(err, "Could not parse Istio Gateway: aborting.")
+		return ctrl.Result{}, nil
+	}
+	if len(spec.Selector) == 0 {
+		log.Info("Istio Gateway does not define a selector: aborting.")
+		return ctrl.Result{}, nil
+	}
+
+	services, err := r.FindServicesForSelector(ctx, spec.Selector)
+	if err != nil {
+		log.Error(err, "Could not list Services.")
+		return ctrl.Result{}, err
+	}
+	if len(services) == 0 {
+		log.Info("No Service of type LoadBalancer selects the Istio ingress gateway: will retry.")
+		return requeueWithBackoff(nil)
+	}
+
+	gatewayList := &unstructured.UnstructuredList{}
+	gatewayList.SetGroupVersionKind(istioGatewayGVK.GroupVersion().WithKind(istioGatewayGVK.Kind + "List"))
+	if err := r.List(ctx, gatewayList); err != nil {
+		log.Error(err, "Could not list Istio Gateways.")
+		return ctrl.Result{}, err
+	}
+
+	// Retrieve certificate ARNs for hosts by processing TLS certificates stored as K8S Secrets which have been processed by secret_controller and synced with ACM.
+	secrets, err := listTLSSecrets(ctx, r.Client)
+	if err != nil {
+		log.Error(err, "Could not list Secrets.")
+		return ctrl.Result{}, err
+	}
+
+	var hasUnmatchedHostName bool
+	unmatchedHostNames := []string{}
+
+	for i := range services {
+		service := &services[i]
+
+		// Gather the hosts of every annotated Gateway that selects the Service's ingress gateway.
+		hostNames := []string{}
+		for j := range gatewayList.Items {
+			other := &gatewayList.Items[j]
+			if !r.IsEnabled(other) || !other.GetDeletionTimestamp().IsZero() {
+				continue
+			}
+			otherSpec, err := r.GetSpec(other)
+			if err != nil || !r.SelectorMatchesService(otherSpec.Selector, service) {
+				continue
+			}
+			for _, hostName := range r.GetHostNames(otherSpec) {
+				if !containsString(hostNames, hostName) {
+					hostNames = append(hostNames, hostName)
+				}
+			}
+		}
+		sort.Strings(hostNames)
+
+		certificateArns := []string{}
+		for _, hostName := range hostNames {
+			certificateArn, err := findCertificateArnForHost(secrets, hostName)
+			if err != nil {
+				// Only hosts belonging to this Gateway are reported, since other Gateways report their own.
+				if containsString(r.GetHostNames(spec), hostName) && !containsString(unmatchedHostNames, hostName) {
+					hasUnmatchedHostName = true
+					unmatchedHostNames = append(unmatchedHostNames, hostName)
+				}
+				continue
+			}
+			if !containsString(certificateArns, certificateArn) {
+				certificateArns = append(certificateArns, certificateArn)
+			}
+		}
+
+		// Update annotation.
+		arnAnnotation := strings.Join(certificateArns, ",")
+		serviceARNAnnotation, serviceHasARNAnnotation := service.Annotations[global.AWS_LOAD_BALANCER_SSL_CERT_ANNOTATION]
+		if len(certificateArns) > 0 && (!serviceHasARNAnnotation || serviceARNAnnotation != arnAnnotation) {
+			log.Info(fmt.Sprintf("Adding ACM certificate ARNs to Service '%s'...", namespacedName(service.ObjectMeta)))
+
+			// Certificate ARN annotation for NLB/CLB can hold multiple (comma-separated) ARN values.
+			patch := client.MergeFrom(service.DeepCopy())
+			setAnnotation(service, global.AWS_LOAD_BALANCER_SSL_CERT_ANNOTATION, arnAnnotation)
+			if err := r.Patch(ctx, service, patch); err != nil {
+				log.Error(err, "Failed to persist ACM certificate ARN(s) back to Service.")
+				return ctrl.Result{}, err
+			}
+			r.Recorder.Event(gw, corev1.EventTypeNormal, eventReasonDecorated, fmt.Sprintf("ACM certificate ARN(s) on Service '%s' set to '%s'.", namespacedName(service.ObjectMeta), arnAnnotation))
+		}
+	}
+
+	if hasUnmatchedHostName {
+		log.Info("At least one host name was not reconciled with a certificate ARN: will retry.")
+		r.Recorder.Event(gw, corev1.EventTypeWarning, eventReasonUnmatchedHosts, fmt.Sprintf("No ACM certificate found for host(s): %s.", strings.Join(unmatchedHostNames, ", ")))
+		return requeueWithBackoff(nil)
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// IsEnabled returns true if the Istio Gateway is annotated to enable ACM certificate management.
+func (r *IstioGatewayReconciler) IsEnabled(gw *unstructured.Unstructured) bool {
+	enabled, _ := strconv.ParseBool(gw.GetAnnotations()[global.AGENT_ENABLED_ANNOTATION])
+	return enabled
+}
+
+// GetSpec extracts the selector and servers from an Istio Gateway.
+func (r *IstioGatewayReconciler) GetSpec(gw *unstructured.Unstructured) (istioGatewaySpec, error) {
+
+	spec := istioGatewaySpec{}
+	rawSpec, ok := gw.Object["spec"].(map[string]interface{})
+	if !ok {
+		return spec, nil
+	}
+	err := runtime.DefaultUnstructuredConverter.FromUnstructured(rawSpec, &spec)
+
+	return spec, err
+}
+
+// GetHostNames returns the host names served by an Istio Gateway. Namespace prefixes (e.g. 'prod/example.com') are removed, and the catch-all host '*' is ignored since no certificate can be matched to it.
+func (r *IstioGatewayReconciler) GetHostNames(spec istioGatewaySpec) []string {
+
+	hostNames := []string{}
+	for _, server := range spec.Servers {
+		for _, host := range server.Hosts {
+			if index := strings.Index(host, "/"); index >= 0 {
+				host = host[index+1:]
+			}
+			host = strings.TrimSpace(host)
+			if host == "" || host == "*" || containsString(hostNames, host) {
+				continue
+			}
+			hostNames = append(hostNames, host)
+		}
+	}
+
+	return hostNames
+}
+
+// FindServicesForSelector returns the Services of type LoadBalancer that front the ingress gateway Pods selected by an Istio Gateway.
+func (r *IstioGatewayReconciler) FindServicesForSelector(ctx context.Context, selector map[string]string) ([]corev1.Service, error) {
+
+	serviceList := &corev1.ServiceList{}
+	if err := r.List(ctx, serviceList); err != nil {
+		return nil, err
+	}
+
+	services := []corev1.Service{}
+	for _, service := range serviceList.Items {
+		if r.SelectorMatchesService(selector, &service) {
+			services = append(services, service)
+		}
+	}
+
+	return services, nil
+}
+
+// SelectorMatchesService returns true if the Service is of type LoadBalancer and selects (at least) the Pods matched by the Istio Gateway selector.
+func (r *IstioGatewayReconciler) SelectorMatchesService(selector map[string]string, service *corev1.Service) bool {
+
+	if len(selector) == 0 || service.Spec.Type != corev1.ServiceTypeLoadBalancer {
+		return false
+	}
+
+	for key, value := range selector {
+		if serviceValue, ok := service.Spec.Selector[key]; !ok || serviceValue != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newIstioGateway() *unstructured.Unstructured {
+	gw := &unstructured.Unstructured{}
+	gw.SetGroupVersionKind(istioGatewayGVK)
+	return gw
+}
@@ -0,0 +1,102 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ListenPort is a listener declared by an Ingress's ALB listen-ports annotation.
+type ListenPort struct {
+	Protocol string // 'HTTP' or 'HTTPS'.
+	Port     int32
+}
+
+// ParseListenPorts parses the value of an ALB listen-ports annotation: a JSON list of maps from protocol to port, e.g. '[{"HTTP":80},{"HTTPS":443}]'. As well as the form documented by the AWS Load Balancer Controller, ports given as strings (e.g. '[{"HTTPS":"8443"}]'), maps listing several protocols (e.g. '[{"HTTP":80,"HTTPS":443}]'), lists mixing these forms, and protocols in lower case are accepted. Listeners are returned in the order declared (those of each map ordered by protocol.)
+func ParseListenPorts(value string) ([]ListenPort, error) {
+
+	entries := []map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(value), &entries); err != nil {
+		return nil, fmt.Errorf("'%s' is not a JSON list of listen ports: %s", value, err)
+	}
+
+	listenPorts := []ListenPort{}
+	for _, entry := range entries {
+
+		protocols := []string{}
+		for protocol := range entry {
+			protocols = append(protocols, protocol)
+		}
+		sort.Strings(protocols)
+
+		for _, protocol := range protocols {
+			normalized := strings.ToUpper(strings.TrimSpace(protocol))
+			if normalized != "HTTP" && normalized != "HTTPS" {
+				return nil, fmt.Errorf("Unsupported listen protocol '%s': must be 'HTTP' or 'HTTPS'.", protocol)
+			}
+			port, err := parseListenPort(entry[protocol])
+			if err != nil {
+				return nil, err
+			}
+			listenPorts = append(listenPorts, ListenPort{Protocol: normalized, Port: port})
+		}
+	}
+	if len(listenPorts) == 0 {
+		return nil, errors.New("No listen ports are defined.")
+	}
+
+	return listenPorts, nil
+}
+
+// Parses a port given as a JSON number or string.
+func parseListenPort(raw json.RawMessage) (int32, error) {
+
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return 0, err
+	}
+
+	var port int64
+	switch value := value.(type) {
+	case float64:
+		if value != float64(int64(value)) {
+			return 0, fmt.Errorf("Invalid listen port %v.", value)
+		}
+		port = int64(value)
+	case string:
+		var err error
+		if port, err = strconv.ParseInt(strings.TrimSpace(value), 10, 32); err != nil {
+			return 0, fmt.Errorf("Invalid listen port '%s'.", value)
+		}
+	default:
+		return 0, fmt.Errorf("Invalid listen port %s.", string(raw))
+	}
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("Invalid listen port %d.", port)
+	}
+
+	return int32(port), nil
+}
+
+// Returns the port of the first HTTPS listener, and whether there is one.
+func httpsListenPort(listenPorts []ListenPort) (int32, bool) {
+	for _, listenPort := range listenPorts {
+		if listenPort.Protocol == "HTTPS" {
+			return listenPort.Port, true
+		}
+	}
+	return 0, false
+}
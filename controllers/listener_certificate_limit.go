@@ -0,0 +1,128 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"sort"
+
+	networking "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Default maximum number of certificate ARNs written to an Ingress: the default AWS quota on the certificates of an Application Load Balancer (excluding its default certificate.) The AWS Load Balancer Controller fails to reconcile Ingresses whose listeners would exceed the quota.
+const defaultListenerCertificateLimit = 25
+
+// Returns the maximum number of certificate ARNs that may be written to an Ingress's certificate ARN annotation.
+func (r *IngressReconciler) listenerCertificateLimit() int {
+	if r.ListenerCertificateLimit <= 0 {
+		return defaultListenerCertificateLimit
+	}
+	return r.ListenerCertificateLimit
+}
+
+// LimitListenerCertificates reduces the agent-managed certificate ARNs serving the Ingress's host names so that, together with any ARNs preserved in its annotation (see MergeCertificateArns), they do not exceed the listener certificate limit. The certificate serving each host name is updated, and host names that can no longer be served are removed from hostCertificates and returned.
+// Certificates are chosen by the number of remaining host names each can serve (so that wildcard certificates, and certificates naming several of the hosts, are preferred over those naming one), from every in-scope certificate able to serve a host name rather than only those selected for each host. Ties are broken in favour of the certificates already selected, in their original order (which is preserved, since the first certificate is the listener's default.)
+func (r *IngressReconciler) LimitListenerCertificates(ctx context.Context, ingress *networking.Ingress, certificateArns []string, hostCertificates *HostCertificates, namespaces []string, selector labels.Selector, matcher domainMatcher) ([]string, []string, error) {
+
+	limit := r.listenerCertificateLimit() - len(splitCertificateArns(r.MergeCertificateArns(ingress, nil)))
+	if len(certificateArns) <= limit {
+		return certificateArns, nil, nil
+	}
+
+	// Host names that each certificate can serve.
+	coverage := map[string][]string{}
+	hostNames := []string{}
+	for hostName, certificateArn := range hostCertificates.Hosts {
+		coverage[certificateArn] = append(coverage[certificateArn], hostName)
+		hostNames = append(hostNames, hostName)
+	}
+	sort.Strings(hostNames)
+
+	secrets, err := listScopedTLSSecrets(ctx, r.Client, namespaces, selector)
+	if err != nil {
+		return nil, nil, err
+	}
+	candidates := append([]string{}, certificateArns...)
+	for i := range secrets {
+		certificateArn, ok := certificateArnForSecret(&secrets[i])
+		if !ok {
+			continue
+		}
+		for _, hostName := range hostNames {
+			if matches, _ := matcher.Matches(&secrets[i], hostName); matches && !containsString(coverage[certificateArn], hostName) {
+				coverage[certificateArn] = append(coverage[certificateArn], hostName)
+			}
+		}
+		if len(coverage[certificateArn]) > 0 && !containsString(candidates, certificateArn) {
+			candidates = append(candidates, certificateArn)
+		}
+	}
+
+	selected := []string{}
+	unserved := append([]string{}, hostNames...)
+	for len(unserved) > 0 && len(selected) < limit {
+		best, bestCount := "", 0
+		for _, certificateArn := range candidates {
+			if containsString(selected, certificateArn) {
+				continue
+			}
+			count := 0
+			for _, hostName := range coverage[certificateArn] {
+				if containsString(unserved, hostName) {
+					count++
+				}
+			}
+			if count > bestCount {
+				best, bestCount = certificateArn, count
+			}
+		}
+		if bestCount == 0 {
+			break
+		}
+		selected = append(selected, best)
+		remaining := []string{}
+		for _, hostName := range unserved {
+			if !containsString(coverage[best], hostName) {
+				remaining = append(remaining, hostName)
+			}
+		}
+		unserved = remaining
+	}
+
+	limitedArns := []string{}
+	for _, certificateArn := range candidates {
+		if containsString(selected, certificateArn) {
+			limitedArns = append(limitedArns, certificateArn)
+		}
+	}
+
+	// Host names keep their selected certificate where it is still attached, and are otherwise served by the first attached certificate able to serve them.
+	droppedHostNames := []string{}
+	for _, hostName := range hostNames {
+		if containsString(limitedArns, hostCertificates.Hosts[hostName]) {
+			continue
+		}
+		delete(hostCertificates.Hosts, hostName)
+		for _, certificateArn := range limitedArns {
+			if containsString(coverage[certificateArn], hostName) {
+				hostCertificates.Hosts[hostName] = certificateArn
+				break
+			}
+		}
+		if _, ok := hostCertificates.Hosts[hostName]; !ok {
+			droppedHostNames = append(droppedHostNames, hostName)
+		}
+	}
+	hostCertificates.Dropped = droppedHostNames
+
+	return limitedArns, droppedHostNames, nil
+}
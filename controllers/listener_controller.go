@@ -0,0 +1,308 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	elbv2 "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	elbv2types "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+	corev1 "k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// ListenerReconciler rotates the certificates of ALB/NLB listeners named by a Secret's 'listener-arns' annotation, so that load balancers provisioned outside the cluster (and so not managed by the AWS Load Balancer Controller) pick up each newly imported ACM certificate.
+type ListenerReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// Factory returning the Elastic Load Balancing service used in each region (default NewAWSELBService.)
+	ELBServiceFactory ELBServiceFactory
+
+	// Maximum number of objects reconciled in parallel (default 1.)
+	MaxConcurrentReconciles int
+
+	// Delay before the first retry of an object whose reconciliation fails (doubling on each subsequent failure.) Defaults to 1 second.
+	RequeueDelay time.Duration
+
+	// Retries of failed objects, parking those that exceed MaxRetries. Set by SetupWithManager.
+	retries *retryLimiter
+}
+
+// Returns the configured ELBServiceFactory, defaulting to the Elastic Load Balancing API.
+func (r *ListenerReconciler) elbServiceFactory() ELBServiceFactory {
+	if r.ELBServiceFactory == nil {
+		return NewAWSELBService
+	}
+	return r.ELBServiceFactory
+}
+
+func (r *ListenerReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.retries = newRetryLimiter("listener", r.RequeueDelay)
+
+	// Tells the controller which object type this reconciler will handle. SecretReconciler also handles Secrets, so this controller must be named explicitly.
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("listener").
+		For(&corev1.Secret{}).
+		WithEventFilter(predicate.NewPredicateFuncs(func(obj client.Object) bool {
+
+			// Only handle Secrets that name load balancer listeners.
+			_, ok := obj.GetAnnotations()[global.AGENT_LISTENER_ARNS_ANNOTATION]
+			return ok
+
+		})).
+		WithOptions(controller.Options{RateLimiter: r.retries.rateLimiter, MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
+		WithLogConstructor(buildLogConstructor(mgr, "listener-reconciler", "(core)", "secret")). // When multiple controllers running with a single manager, the log auto-constructor does not work. Therefore we must do manually.
+		Complete(r)
+}
+
+func (r *ListenerReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+
+	log := log.FromContext(ctx)
+
+	secret := &corev1.Secret{}
+	if err := r.Get(ctx, req.NamespacedName, secret); err != nil {
+		if !k8serr.IsNotFound(err) {
+			log.Error(err, "Unable to retrieve Secret.")
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	log.V(1).Info(fmt.Sprintf("Processing listeners of Secret %s...", req.NamespacedName))
+
+	// Object is marked for deletion - nothing to do (listeners keep their current certificates.)
+	if !secret.ObjectMeta.DeletionTimestamp.IsZero() {
+		log.Info("Secret is marked for deletion: nothing to do.")
+		return ctrl.Result{}, nil
+	}
+
+	listenerArns := []string{}
+	for _, listenerArn := range trimSpaceFromSliceElements(strings.Split(secret.Annotations[global.AGENT_LISTENER_ARNS_ANNOTATION], ",")) {
+		if listenerArn != "" && !containsString(listenerArns, listenerArn) {
+			listenerArns = append(listenerArns, listenerArn)
+		}
+	}
+	if len(listenerArns) == 0 {
+		log.Info("Secret does not name any load balancer listeners: nothing to do.")
+		return ctrl.Result{}, nil
+	}
+
+	// Objects whose retries have been exhausted are not reconciled again until they change.
+	if r.retries.Parked(req, secret.ResourceVersion) {
+		log.Info("Secret is parked (retries exhausted): nothing to do.")
+		return ctrl.Result{}, nil
+	}
+	if r.retries.Exhausted(req) {
+		log.Info(retriesExhaustedMessage())
+		r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonRetriesExhausted, retriesExhaustedMessage())
+		r.retries.Park(req, secret.ResourceVersion)
+		return ctrl.Result{}, nil
+	}
+
+	cfg, err := loadAWSConfig(ctx, secret.Annotations[global.AGENT_ASSUME_ROLE_ARN_ANNOTATION])
+	if err != nil {
+		log.Error(err, "Failed to load AWS configuration.")
+		return ctrl.Result{}, err
+	}
+
+	additional := strings.EqualFold(strings.TrimSpace(secret.Annotations[global.AGENT_LISTENER_CERTIFICATE_ANNOTATION]), global.LISTENER_CERTIFICATE_ADDITIONAL)
+
+	previousCertificateArns := []string{}
+	for _, certificateArn := range trimSpaceFromSliceElements(strings.Split(secret.Annotations[global.AGENT_LISTENER_CERTIFICATE_ARNS_ANNOTATION], ",")) {
+		if certificateArn != "" {
+			previousCertificateArns = append(previousCertificateArns, certificateArn)
+		}
+	}
+
+	secretReconciler := &SecretReconciler{}
+	appliedCertificateArns := []string{}
+	var hasFailedListener bool
+	for _, listenerArn := range listenerArns {
+
+		parsedArn, err := arn.Parse(listenerArn)
+		if err != nil {
+			log.Info(fmt.Sprintf("'%s' is not a valid ARN: skipping.", listenerArn))
+			r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonInvalidAnnotation, fmt.Sprintf("'%s' is not a valid load balancer listener ARN.", listenerArn))
+			continue
+		}
+		if err := checkARNPartition(parsedArn, cfg.Region); err != nil {
+			log.Info(fmt.Sprintf("%s Skipping.", err))
+			r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonPartitionMismatch, err.Error())
+			continue
+		}
+
+		// Listeners can only use ACM certificates from their own region.
+		certificateArn := secretReconciler.GetRegionalCertificateArn(secret, parsedArn.Region)
+		if certificateArn == nil {
+			log.Info(fmt.Sprintf("No ACM certificate has been imported into region '%s' for listener '%s': will retry once imported.", parsedArn.Region, listenerArn))
+			continue
+		}
+
+		elbClient := r.elbServiceFactory()(cfg, parsedArn.Region)
+		updated, err := r.UpdateListenerCertificate(ctx, elbClient, listenerArn, *certificateArn, previousCertificateArns, additional)
+		if err != nil {
+			log.Error(err, fmt.Sprintf("Failed to update certificate of listener '%s'.", listenerArn))
+			r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonListenerError, fmt.Sprintf("Could not update certificate of listener '%s': %s", listenerArn, err))
+			hasFailedListener = true
+			continue
+		}
+		if updated {
+			r.Recorder.Event(secret, corev1.EventTypeNormal, eventReasonListenerUpdated, fmt.Sprintf("Listener '%s' now uses ACM certificate '%s'.", listenerArn, *certificateArn))
+		}
+		if !containsString(appliedCertificateArns, *certificateArn) {
+			appliedCertificateArns = append(appliedCertificateArns, *certificateArn)
+		}
+	}
+
+	// Record the ACM certificates applied to listeners, so that they can be removed once replaced. Previous values are kept until all listeners have been updated.
+	if hasFailedListener {
+		for _, certificateArn := range previousCertificateArns {
+			if !containsString(appliedCertificateArns, certificateArn) {
+				appliedCertificateArns = append(appliedCertificateArns, certificateArn)
+			}
+		}
+	}
+	appliedAnnotation := strings.Join(appliedCertificateArns, ",")
+	if appliedAnnotation != secret.Annotations[global.AGENT_LISTENER_CERTIFICATE_ARNS_ANNOTATION] {
+		patch := client.MergeFrom(secret.DeepCopy())
+		if appliedAnnotation == "" {
+			delete(secret.Annotations, global.AGENT_LISTENER_CERTIFICATE_ARNS_ANNOTATION)
+		} else {
+			setAnnotation(secret, global.AGENT_LISTENER_CERTIFICATE_ARNS_ANNOTATION, appliedAnnotation)
+		}
+		if err := r.Patch(ctx, secret, patch); err != nil {
+			log.Error(err, "Failed to record listener certificate ARN(s) on Secret.")
+			return ctrl.Result{}, err
+		}
+	}
+
+	if hasFailedListener {
+		log.Info("At least one listener could not be updated: will retry.")
+		return requeueWithBackoff(nil)
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// UpdateListenerCertificate ensures the listener uses the ACM certificate, returning true if the listener was changed.
+// By default the certificate replaces the listener's default certificate (ModifyListener.) If additional is true, it is instead added to the listener's certificate list (AddListenerCertificates), and any of the previously applied certificates from the same region are removed.
+// Listeners of load balancers managed by the AWS Load Balancer Controller are refused, since the controller would revert any change.
+func (r *ListenerReconciler) UpdateListenerCertificate(ctx context.Context, elbClient ELBService, listenerArn string, certificateArn string, previousCertificateArns []string, additional bool) (bool, error) {
+
+	log := log.FromContext(ctx)
+
+	describeOutput, err := elbClient.DescribeListeners(ctx, &elbv2.DescribeListenersInput{ListenerArns: []string{listenerArn}})
+	if err != nil {
+		return false, err
+	}
+	if len(describeOutput.Listeners) == 0 {
+		return false, fmt.Errorf("Listener '%s' does not exist.", listenerArn)
+	}
+	listener := describeOutput.Listeners[0]
+
+	if listener.Protocol != elbv2types.ProtocolEnumHttps && listener.Protocol != elbv2types.ProtocolEnumTls {
+		return false, fmt.Errorf("Listener '%s' uses protocol '%s', which does not support certificates.", listenerArn, listener.Protocol)
+	}
+
+	tagsOutput, err := elbClient.DescribeTags(ctx, &elbv2.DescribeTagsInput{ResourceArns: []string{aws.ToString(listener.LoadBalancerArn)}})
+	if err != nil {
+		return false, err
+	}
+	for _, tagDescription := range tagsOutput.TagDescriptions {
+		for _, tag := range tagDescription.Tags {
+			if aws.ToString(tag.Key) == global.AWS_LOAD_BALANCER_CLUSTER_TAG {
+				return false, fmt.Errorf("Load balancer '%s' is managed by the AWS Load Balancer Controller (cluster '%s'): annotate its Ingress or Service instead.", aws.ToString(listener.LoadBalancerArn), aws.ToString(tag.Value))
+			}
+		}
+	}
+
+	if !additional {
+		for _, certificate := range listener.Certificates {
+			if aws.ToString(certificate.CertificateArn) == certificateArn {
+				return false, nil
+			}
+		}
+		log.Info(fmt.Sprintf("Setting default certificate of listener '%s' to '%s'...", listenerArn, certificateArn))
+		_, err = elbClient.ModifyListener(ctx, &elbv2.ModifyListenerInput{
+			ListenerArn:  aws.String(listenerArn),
+			Certificates: []elbv2types.Certificate{{CertificateArn: aws.String(certificateArn)}},
+		})
+		return err == nil, err
+	}
+
+	// The default certificate is also reported in the listener's certificate list.
+	listenerCertificateArns := []string{}
+	input := &elbv2.DescribeListenerCertificatesInput{ListenerArn: aws.String(listenerArn)}
+	for {
+		certificatesOutput, err := elbClient.DescribeListenerCertificates(ctx, input)
+		if err != nil {
+			return false, err
+		}
+		for _, certificate := range certificatesOutput.Certificates {
+			if !aws.ToBool(certificate.IsDefault) {
+				listenerCertificateArns = append(listenerCertificateArns, aws.ToString(certificate.CertificateArn))
+			}
+		}
+		if certificatesOutput.NextMarker == nil {
+			break
+		}
+		input.Marker = certificatesOutput.NextMarker
+	}
+
+	updated := false
+	if !containsString(listenerCertificateArns, certificateArn) {
+		log.Info(fmt.Sprintf("Adding certificate '%s' to listener '%s'...", certificateArn, listenerArn))
+		_, err = elbClient.AddListenerCertificates(ctx, &elbv2.AddListenerCertificatesInput{
+			ListenerArn:  aws.String(listenerArn),
+			Certificates: []elbv2types.Certificate{{CertificateArn: aws.String(certificateArn)}},
+		})
+		if err != nil {
+			return false, err
+		}
+		updated = true
+	}
+
+	// Remove replaced certificates (only those previously applied by the agent, and only after the new certificate is in place.)
+	replacedCertificates := []elbv2types.Certificate{}
+	for _, previousCertificateArn := range previousCertificateArns {
+		if previousCertificateArn != certificateArn && containsString(listenerCertificateArns, previousCertificateArn) {
+			replacedCertificates = append(replacedCertificates, elbv2types.Certificate{CertificateArn: aws.String(previousCertificateArn)})
+		}
+	}
+	if len(replacedCertificates) > 0 {
+		log.Info(fmt.Sprintf("Removing %d replaced certificate(s) from listener '%s'...", len(replacedCertificates), listenerArn))
+		_, err = elbClient.RemoveListenerCertificates(ctx, &elbv2.RemoveListenerCertificatesInput{
+			ListenerArn:  aws.String(listenerArn),
+			Certificates: replacedCertificates,
+		})
+		if err != nil {
+			return updated, err
+		}
+		updated = true
+	}
+
+	return updated, nil
+}
@@ -0,0 +1,314 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+package controllers
+
+import (
+	"crypto/x509"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// Custom metrics are exposed via the manager's existing metrics endpoint (see --metrics-bind-address.)
+
+const metricsNamespace = "acm_certificate_agent"
+
+// RenewalWindow is the period before expiry within which a certificate is expected to have been renewed. Certificates expiring within this window are reported as nearing expiry. Set before reconcilers are registered with the manager.
+var RenewalWindow = 30 * 24 * time.Hour
+
+var (
+	acmImportsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "acm_imports_total",
+		Help:      "Number of certificates imported (or re-imported) into ACM.",
+	}, []string{"namespace"})
+
+	acmImportFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "acm_import_failures_total",
+		Help:      "Number of failed ACM certificate imports.",
+	}, []string{"namespace"})
+
+	acmTagFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "acm_tag_failures_total",
+		Help:      "Number of failed attempts to tag ACM certificates.",
+	}, []string{"namespace"})
+
+	acmDuplicatesDetectedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "acm_duplicates_detected_total",
+		Help:      "Number of times an existing, identical ACM certificate was found (and re-used) instead of importing a duplicate.",
+	}, []string{"namespace"})
+
+	acmDriftDetectedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "acm_drift_detected_total",
+		Help:      "Number of times an ACM certificate was found to have been changed or deleted out-of-band (and was re-imported.)",
+	}, []string{"namespace"})
+
+	keyMismatchesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "key_mismatches_total",
+		Help:      "Number of times a Secret was found to hold a private key that does not match its certificate.",
+	}, []string{"namespace"})
+
+	certificateParseFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "certificate_parse_failures_total",
+		Help:      "Number of times a Secret was found to hold a certificate that could not be parsed (counted once per change to the Secret's data.)",
+	}, []string{"namespace"})
+
+	acmImportsRefusedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "acm_imports_refused_total",
+		Help:      "Number of certificate imports refused because they would exceed an ACM quota.",
+	}, []string{"namespace", "quota"})
+
+	acmImportsDeferredTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "acm_imports_deferred_total",
+		Help:      "Number of certificate re-imports deferred because the ACM certificate has reached the per-certificate import limit.",
+	}, []string{"namespace"})
+
+	acmQuotaLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "acm_quota_limit",
+		Help:      "Value of each ACM quota on imported certificates, as reported by Service Quotas.",
+	}, []string{"region", "role_arn", "quota"})
+
+	acmQuotaUsage = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "acm_quota_usage",
+		Help:      "Usage of each ACM quota on imported certificates, as at the most recent quota check.",
+	}, []string{"region", "role_arn", "quota"})
+
+	certificatesNearingExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "certificates_nearing_expiry",
+		Help:      "Set to 1 for each managed Secret whose certificate expires within the renewal window (i.e. has not been renewed.)",
+	}, []string{"namespace", "name"})
+
+	certificatesRevoked = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "certificates_revoked",
+		Help:      "Set to 1 for each managed Secret whose certificate has been revoked by its CA (see the 'check-revocation' annotation.)",
+	}, []string{"namespace", "name"})
+
+	revocationCheckFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "revocation_check_failures_total",
+		Help:      "Number of revocation checks for which the revocation status of the certificate could not be determined.",
+	}, []string{"namespace"})
+
+	certificateExpirySeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "certificate_expiry_seconds",
+		Help:      "Expiry time (in seconds since the Unix epoch) of the certificate held in each managed Secret (with an empty arn), and of each of its ACM copies (as at the most recent synchronization.)",
+	}, []string{"namespace", "name", "arn"})
+
+	certificateInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "certificate_info",
+		Help:      "Set to 1 for each managed Secret, labelled with the domain names and serial number of its certificate.",
+	}, []string{"namespace", "name", "domains", "serial_number"})
+
+	acmCertificateInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "acm_certificate_info",
+		Help:      "Set to 1 for each ACM copy of the certificate held in each managed Secret, labelled with its status, renewal eligibility and key algorithm (as described by ACM at the most recent synchronization.)",
+	}, []string{"namespace", "name", "arn", "status", "renewal_eligibility", "key_algorithm"})
+
+	acmCertificateInUseBy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "acm_certificate_in_use_by",
+		Help:      "Number of AWS resources (e.g. load balancers) using each ACM copy of the certificate held in each managed Secret (as described by ACM at the most recent synchronization.)",
+	}, []string{"namespace", "name", "arn"})
+
+	syncDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "sync_duration_seconds",
+		Help:      "Time taken to synchronize a Secret with ACM.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"namespace"})
+
+	auditFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "audit_failures_total",
+		Help:      "Number of audit records of changes to ACM that could not be written to an audit sink.",
+	}, []string{"sink"})
+
+	notificationFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "notification_failures_total",
+		Help:      "Number of certificate lifecycle notifications that could not be published.",
+	}, []string{"target"})
+
+	reconcileRetriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "reconcile_retries_total",
+		Help:      "Number of times reconciliation of an object was retried with backoff (after failing, or while waiting for a dependency.)",
+	}, []string{"controller"})
+
+	objectsParkedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "objects_parked_total",
+		Help:      "Number of times an object was parked (i.e. is not retried until it changes), because its retries were exhausted or it failed permanently.",
+	}, []string{"controller"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		acmImportsTotal,
+		acmImportFailuresTotal,
+		acmTagFailuresTotal,
+		acmDuplicatesDetectedTotal,
+		acmDriftDetectedTotal,
+		keyMismatchesTotal,
+		certificateParseFailuresTotal,
+		acmImportsRefusedTotal,
+		acmImportsDeferredTotal,
+		acmQuotaLimit,
+		acmQuotaUsage,
+		certificatesNearingExpiry,
+		certificatesRevoked,
+		revocationCheckFailuresTotal,
+		certificateExpirySeconds,
+		certificateInfo,
+		acmCertificateInfo,
+		acmCertificateInUseBy,
+		syncDurationSeconds,
+		auditFailuresTotal,
+		notificationFailuresTotal,
+		reconcileRetriesTotal,
+		objectsParkedTotal,
+	)
+}
+
+// Records whether the certificate held in the specified Secret is nearing expiry.
+func recordCertificateExpiry(namespace string, name string, notAfter time.Time) {
+	if time.Until(notAfter) < RenewalWindow {
+		certificatesNearingExpiry.WithLabelValues(namespace, name).Set(1)
+	} else {
+		certificatesNearingExpiry.DeleteLabelValues(namespace, name)
+	}
+}
+
+// Records whether the certificate held in the specified Secret has been revoked.
+func recordCertificateRevocation(namespace string, name string, revoked bool) {
+	if revoked {
+		certificatesRevoked.WithLabelValues(namespace, name).Set(1)
+	} else {
+		certificatesRevoked.DeleteLabelValues(namespace, name)
+	}
+}
+
+// Label values of the per-certificate series recorded for each Secret (keyed by namespace and name), so that series for ACM copies (or certificates) the Secret no longer holds are removed.
+var certificateMetricSeries = struct {
+	sync.Mutex
+	arns    map[string][]string
+	info    map[string][]string
+	acmInfo map[string][][]string
+}{arns: map[string][]string{}, info: map[string][]string{}, acmInfo: map[string][][]string{}}
+
+// Records the expiry of the certificate held in the specified Secret and of its ACM copies (as recorded in its acm-certificates annotation), the certificate's domain names and serial number, and the health of its ACM copies.
+func recordCertificateMetrics(namespace string, name string, certificate *x509.Certificate, records []ACMCertificateRecord) {
+
+	key := namespace + "/" + name
+	domains := strings.Join((&SecretReconciler{}).ExtractCertificateDomains(certificate), ",")
+	serialNumber := (&SecretReconciler{}).FormatX509SerialNumber(certificate.SerialNumber)
+
+	certificateMetricSeries.Lock()
+	defer certificateMetricSeries.Unlock()
+
+	arns := []string{""}
+	certificateExpirySeconds.WithLabelValues(namespace, name, "").Set(float64(certificate.NotAfter.Unix()))
+	for _, record := range records {
+		expires, err := time.Parse(global.ISO_8601_FORMAT, record.Expires)
+		if record.CertificateArn == "" || err != nil || containsString(arns, record.CertificateArn) {
+			continue
+		}
+		arns = append(arns, record.CertificateArn)
+		certificateExpirySeconds.WithLabelValues(namespace, name, record.CertificateArn).Set(float64(expires.Unix()))
+	}
+	for _, previousArn := range certificateMetricSeries.arns[key] {
+		if !containsString(arns, previousArn) {
+			certificateExpirySeconds.DeleteLabelValues(namespace, name, previousArn)
+		}
+	}
+	certificateMetricSeries.arns[key] = arns
+
+	acmInfo := [][]string{}
+	acmArns := []string{}
+	for _, record := range records {
+		if record.CertificateArn == "" || record.Status == "" {
+			continue
+		}
+		labels := []string{record.CertificateArn, record.Status, record.RenewalEligibility, record.KeyAlgorithm}
+		acmInfo = append(acmInfo, labels)
+		acmArns = append(acmArns, record.CertificateArn)
+		acmCertificateInfo.WithLabelValues(append([]string{namespace, name}, labels...)...).Set(1)
+		acmCertificateInUseBy.WithLabelValues(namespace, name, record.CertificateArn).Set(float64(len(record.InUseBy)))
+	}
+	for _, previousLabels := range certificateMetricSeries.acmInfo[key] {
+		if !containsLabelValues(acmInfo, previousLabels) {
+			acmCertificateInfo.DeleteLabelValues(append([]string{namespace, name}, previousLabels...)...)
+		}
+		if !containsString(acmArns, previousLabels[0]) {
+			acmCertificateInUseBy.DeleteLabelValues(namespace, name, previousLabels[0])
+		}
+	}
+	certificateMetricSeries.acmInfo[key] = acmInfo
+
+	if previousInfo, ok := certificateMetricSeries.info[key]; ok && (previousInfo[0] != domains || previousInfo[1] != serialNumber) {
+		certificateInfo.DeleteLabelValues(namespace, name, previousInfo[0], previousInfo[1])
+	}
+	certificateInfo.WithLabelValues(namespace, name, domains, serialNumber).Set(1)
+	certificateMetricSeries.info[key] = []string{domains, serialNumber}
+}
+
+// Removes the per-certificate series of the specified Secret (e.g. once it is deleted, or no longer managed.)
+func forgetCertificateMetrics(namespace string, name string) {
+
+	key := namespace + "/" + name
+
+	certificateMetricSeries.Lock()
+	defer certificateMetricSeries.Unlock()
+
+	certificatesNearingExpiry.DeleteLabelValues(namespace, name)
+	certificatesRevoked.DeleteLabelValues(namespace, name)
+	for _, arn := range certificateMetricSeries.arns[key] {
+		certificateExpirySeconds.DeleteLabelValues(namespace, name, arn)
+	}
+	if info, ok := certificateMetricSeries.info[key]; ok {
+		certificateInfo.DeleteLabelValues(namespace, name, info[0], info[1])
+	}
+	for _, labels := range certificateMetricSeries.acmInfo[key] {
+		acmCertificateInfo.DeleteLabelValues(append([]string{namespace, name}, labels...)...)
+		acmCertificateInUseBy.DeleteLabelValues(namespace, name, labels[0])
+	}
+	delete(certificateMetricSeries.arns, key)
+	delete(certificateMetricSeries.info, key)
+	delete(certificateMetricSeries.acmInfo, key)
+}
+
+// Returns true if the list contains the label values.
+func containsLabelValues(list [][]string, labels []string) bool {
+	for _, candidate := range list {
+		if strings.Join(candidate, "|") == strings.Join(labels, "|") {
+			return true
+		}
+	}
+	return false
+}
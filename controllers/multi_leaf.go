@@ -0,0 +1,349 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// Support for Secrets holding several unrelated leaf certificates (e.g. the SNI bundles of legacy systems, which concatenate the certificate and chain of each host in tls.crt, and their private keys in tls.key.)
+// If enabled by the Secret's multi-leaf annotation, each leaf is imported (with its own chain and private key) as a separate ACM certificate. The first leaf held by the Secret is synchronized as the Secret's certificate, and is described by the usual annotations. The remaining leaves are described by the leaf-certificates annotation.
+
+// LeafCertificateRecord describes an additional leaf certificate of a multi-leaf Secret, and the ACM certificates holding it in each ACM destination. Records for all additional leaves are kept (as JSON) in the Secret's leaf-certificates annotation.
+type LeafCertificateRecord struct {
+	DomainNames     []string               `json:"domainNames"`
+	SerialNumber    string                 `json:"serialNumber"`
+	Expires         string                 `json:"expires"`
+	ACMCertificates []ACMCertificateRecord `json:"acmCertificates"`
+}
+
+// Parses the JSON value of a leaf-certificates annotation. Returns nil if the value is absent or malformed.
+func parseLeafCertificateRecords(value string) []LeafCertificateRecord {
+	records := []LeafCertificateRecord{}
+	if value == "" || json.Unmarshal([]byte(value), &records) != nil {
+		return nil
+	}
+	return records
+}
+
+// Returns the record of the leaf certificate with the same set of domain names, if any. Leaves are identified by their domain names (rather than serial number), so that a renewed leaf replaces the ACM certificates of its predecessor.
+func findLeafCertificateRecord(records []LeafCertificateRecord, domainNames []string) (LeafCertificateRecord, bool) {
+	key := domainNamesKey(domainNames)
+	for _, record := range records {
+		if domainNamesKey(record.DomainNames) == key {
+			return record, true
+		}
+	}
+	return LeafCertificateRecord{}, false
+}
+
+func domainNamesKey(domainNames []string) string {
+	normalized := []string{}
+	for _, domainName := range domainNames {
+		normalized = append(normalized, normalizeDomainName(domainName))
+	}
+	sort.Strings(normalized)
+	return strings.Join(normalized, ",")
+}
+
+// Returns true if the Secret's multi-leaf annotation requests that each of its leaf certificates is imported separately.
+func multiLeafEnabled(secret *corev1.Secret) bool {
+	enabled, _ := strconv.ParseBool(strings.TrimSpace(secret.Annotations[global.AGENT_MULTI_LEAF_ANNOTATION]))
+	return enabled
+}
+
+// Returns the certificates that did not issue any other certificate held by the Secret (ignoring duplicates), in the order in which they are held.
+func leafCertificates(certificates []*CertificateWrapper) []*CertificateWrapper {
+
+	leaves := []*CertificateWrapper{}
+	seen := map[string]bool{}
+	for i, certificate := range certificates {
+		if seen[string(certificate.x509.Raw)] {
+			continue
+		}
+		seen[string(certificate.x509.Raw)] = true
+		isIssuer := false
+		for j, otherCertificate := range certificates {
+			if i != j && !otherCertificate.x509.Equal(certificate.x509) && issuedBy(otherCertificate.x509, certificate.x509) {
+				isIssuer = true
+				break
+			}
+		}
+		if !isIssuer {
+			leaves = append(leaves, certificate)
+		}
+	}
+
+	return leaves
+}
+
+// Returns the leaf certificate, followed by each certificate held by the Secret that lies on a path from the leaf towards a root (i.e. the certificates from which the leaf's chain is built.)
+func leafBundle(leaf *CertificateWrapper, certificates []*CertificateWrapper) []*CertificateWrapper {
+
+	bundle := []*CertificateWrapper{leaf}
+	included := map[string]bool{string(leaf.x509.Raw): true}
+	for i := 0; i < len(bundle); i++ {
+		for _, certificate := range certificates {
+			if !included[string(certificate.x509.Raw)] && issuedBy(bundle[i].x509, certificate.x509) {
+				included[string(certificate.x509.Raw)] = true
+				bundle = append(bundle, certificate)
+			}
+		}
+	}
+
+	return bundle
+}
+
+// ParseLeafCertificates parses each of the leaf certificates held by a multi-leaf Secret, together with its chain and the private key (among those held by the Secret) that belongs to it. Leaves are returned in the order in which they are held. A Secret holding a single leaf is parsed as by ParseCertificateDetails.
+func (r *SecretReconciler) ParseLeafCertificates(secret *corev1.Secret) ([]CertificateDetails, error) {
+
+	certBytes, pkBytes, passphrase, certKey, err := r.ReadCertificateData(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	certificates, err := r.ParsePEMCertificates(certBytes, certKey)
+	if err != nil {
+		return nil, err
+	}
+
+	leaves := leafCertificates(certificates)
+	if len(leaves) <= 1 {
+		certificateDetails, err := r.ParseCertificateDetails(secret)
+		if err != nil {
+			return nil, err
+		}
+		return []CertificateDetails{certificateDetails}, nil
+	}
+
+	privateKeys, err := normalizePrivateKeys(pkBytes, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	output := []CertificateDetails{}
+	used := map[string]bool{}
+	for _, leaf := range leaves {
+
+		bundle := leafBundle(leaf, certificates)
+		for _, certificate := range bundle {
+			used[string(certificate.x509.Raw)] = true
+		}
+
+		chainLeaf, intermediates, root, err := r.BuildCertificateChain(bundle)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid certificate chain for leaf '%s' within '%s': %s", leaf.x509.Subject.CommonName, certKey, err)
+		}
+
+		if err := validateCertificatePublicKey(chainLeaf.x509); err != nil {
+			return nil, err
+		}
+
+		// Each leaf must be held with its own private key (although leaves may share a key.)
+		var privateKey []byte
+		for _, candidate := range privateKeys {
+			if verifyPrivateKeyMatches(candidate, chainLeaf.x509) == nil {
+				privateKey = candidate
+				break
+			}
+		}
+		if privateKey == nil {
+			return nil, &keyMismatchError{commonName: chainLeaf.x509.Subject.CommonName}
+		}
+
+		output = append(output, CertificateDetails{
+			SecretName:    &secret.Name,
+			Namespace:     &secret.Namespace,
+			Certificate:   chainLeaf,
+			Intermediates: intermediates,
+			CA:            root,
+			PrivateKey:    privateKey,
+		})
+	}
+
+	// Verify that every certificate is part of the chain of some leaf.
+	for _, certificate := range certificates {
+		if !used[string(certificate.x509.Raw)] {
+			return nil, fmt.Errorf("Invalid certificate chain within '%s': Certificate '%s' is not part of a valid chain.", certKey, certificate.x509.Subject.CommonName)
+		}
+	}
+
+	// The ARN annotation refers to the first leaf.
+	if certificateArn := secret.Annotations[global.AGENT_CERTIFICATE_ARN_ANNOTATION]; certificateArn != "" {
+		output[0].CertificateArn = &certificateArn
+	}
+
+	return output, nil
+}
+
+// SyncLeafCertificates synchronizes the additional leaf certificates of a multi-leaf Secret (i.e. all but the first) with ACM in each of the target regions, and records their ACM certificates in the Secret's leaf-certificates annotation. The annotation is removed from Secrets that no longer hold additional leaves. Leaves outside their validity period are not imported.
+// Failures are reported against the Secret and retried with backoff. ACM certificates of leaves that are no longer held by the Secret are retained.
+func (r *SecretReconciler) SyncLeafCertificates(ctx context.Context, secret *corev1.Secret, cfg aws.Config, regions []string, isReplica bool, leaves []CertificateDetails) (ctrl.Result, error) {
+
+	log := log.FromContext(ctx)
+
+	previousRecords := parseLeafCertificateRecords(secret.Annotations[global.AGENT_LEAF_CERTIFICATES_ANNOTATION])
+	account := targetAccount(secret)
+	records := []LeafCertificateRecord{}
+
+	for _, leaf := range leaves {
+
+		certificate := leaf.Certificate.x509
+		leafCtx := ctrl.LoggerInto(ctx, log.WithValues("leaf", certificate.Subject.CommonName))
+
+		if time.Now().Before(certificate.NotBefore) || time.Now().After(certificate.NotAfter) {
+			r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonInvalidCertificate, fmt.Sprintf("Leaf certificate '%s' is expired or not yet valid: not imported.", certificate.Subject.CommonName))
+			continue
+		}
+
+		if fetchChainEnabled(secret) {
+			if _, err := r.CompleteCertificateChain(leafCtx, &leaf); err != nil {
+				log.Error(err, "Could not fetch missing intermediates.")
+				r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonChainIncomplete, fmt.Sprintf("Could not fetch missing intermediates of leaf certificate '%s': %s", certificate.Subject.CommonName, err))
+			}
+		}
+
+		record := LeafCertificateRecord{
+			DomainNames:     r.ExtractCertificateDomains(certificate),
+			SerialNumber:    r.FormatX509SerialNumber(certificate.SerialNumber),
+			Expires:         certificate.NotAfter.Format(global.ISO_8601_FORMAT),
+			ACMCertificates: []ACMCertificateRecord{},
+		}
+		previousRecord, _ := findLeafCertificateRecord(previousRecords, record.DomainNames)
+
+		for _, region := range regions {
+
+			regionalCertificateDetails := leaf
+			regionalCertificateDetails.CertificateArn = nil
+			regionalCertificateDetails.CreatedAt = nil
+			lastImportTime := ""
+			for _, acmRecord := range previousRecord.ACMCertificates {
+				if acmRecord.Region == region && acmRecord.CertificateArn != "" && (account == "" || acmRecord.Account == account) {
+					certificateArn := acmRecord.CertificateArn
+					regionalCertificateDetails.CertificateArn = &certificateArn
+					lastImportTime = acmRecord.LastImportTime
+					break
+				}
+			}
+
+			regionalCtx := ctrl.LoggerInto(leafCtx, log.WithValues("leaf", certificate.Subject.CommonName, "region", region))
+			acmClient := r.acmServiceFactory()(cfg, region)
+			imported := false
+
+			if isReplica {
+				found, err := r.VerifyReplicatedCertificate(regionalCtx, acmClient, &regionalCertificateDetails)
+				if err != nil {
+					r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonACMError, fmt.Sprintf("ACM certificate lookup for leaf certificate '%s' failed in region '%s': %s", certificate.Subject.CommonName, region, err))
+					return requeueWithBackoff(err)
+				}
+				if !found {
+					log.Info(fmt.Sprintf("No ACM certificate matching leaf certificate '%s' of the replicated Secret was found in region '%s': will retry.", certificate.Subject.CommonName, region))
+					return requeueWithBackoff(nil)
+				}
+			} else {
+				var err error
+				imported, err = r.SyncCertificateWithACM(regionalCtx, acmClient, r.serviceQuotasService(cfg, region), acmIndexScope(secret.Annotations[global.AGENT_ASSUME_ROLE_ARN_ANNOTATION], region), &regionalCertificateDetails)
+				var delayErr *propagationDelayError
+				if errors.As(err, &delayErr) {
+					log.Info(delayErr.Error())
+					return ctrl.Result{RequeueAfter: acmPropagationRequeueDelay}, nil
+				}
+				var inProgressErr *importInProgressError
+				if errors.As(err, &inProgressErr) {
+					log.Info(inProgressErr.Error())
+					return ctrl.Result{RequeueAfter: importLockRequeueDelay}, nil
+				}
+				var dryRunErr *dryRunError
+				if errors.As(err, &dryRunErr) {
+					r.Recorder.Event(secret, corev1.EventTypeNormal, eventReasonDryRun, fmt.Sprintf("Leaf certificate '%s' would be imported into ACM region '%s' (dry run.)", certificate.Subject.CommonName, region))
+					continue
+				}
+				if err != nil {
+					r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonACMError, fmt.Sprintf("ACM synchronization of leaf certificate '%s' failed in region '%s': %s", certificate.Subject.CommonName, region, err))
+					r.RecordRetrySyncStatus(ctx, secret, global.SYNC_STATE_FAILED, fmt.Sprintf("ACM synchronization of leaf certificate '%s' failed in region '%s'.", certificate.Subject.CommonName, region))
+					r.NotifyImportFailed(regionalCtx, secret, region, err.Error())
+					return requeueWithBackoff(err)
+				}
+			}
+
+			if regionalCertificateDetails.CertificateArn == nil {
+				continue
+			}
+
+			if imported {
+				message := fmt.Sprintf("Leaf certificate '%s' imported into ACM as '%s'.", certificate.Subject.CommonName, *regionalCertificateDetails.CertificateArn)
+				r.Recorder.Event(secret, corev1.EventTypeNormal, eventReasonImported, message)
+				notification := newNotification(NotificationImported, "Secret", secret, message)
+				notification.CertificateArn = *regionalCertificateDetails.CertificateArn
+				notification.Region = region
+				notification.Expires = certificate.NotAfter.UTC().Format(time.RFC3339)
+				notify(regionalCtx, notification)
+				lastImportTime = time.Now().UTC().Format(time.RFC3339)
+			}
+
+			acmRecord := ACMCertificateRecord{
+				Region:         region,
+				CertificateArn: *regionalCertificateDetails.CertificateArn,
+				SerialNumber:   record.SerialNumber,
+				Expires:        record.Expires,
+				LastImportTime: lastImportTime,
+			}
+			if parsedArn, err := arn.Parse(acmRecord.CertificateArn); err == nil {
+				acmRecord.Account = parsedArn.AccountID
+			}
+			record.ACMCertificates = append(record.ACMCertificates, acmRecord)
+		}
+
+		records = append(records, record)
+	}
+
+	value := ""
+	if len(records) > 0 {
+		recordsJSON, err := json.Marshal(records)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		value = string(recordsJSON)
+	}
+	if secret.Annotations[global.AGENT_LEAF_CERTIFICATES_ANNOTATION] == value {
+		return ctrl.Result{}, nil
+	}
+
+	log.Info("Updating Secret leaf certificates annotation...")
+	patch := client.MergeFrom(secret.DeepCopy())
+	if value != "" {
+		setAnnotation(secret, global.AGENT_LEAF_CERTIFICATES_ANNOTATION, value)
+	} else {
+		delete(secret.Annotations, global.AGENT_LEAF_CERTIFICATES_ANNOTATION)
+	}
+	if err := r.Patch(ctx, secret, patch); err != nil {
+		log.Error(err, "Failed to persist leaf certificate ARNs back to Secret.")
+		return requeueWithBackoff(err)
+	}
+
+	return ctrl.Result{}, nil
+}
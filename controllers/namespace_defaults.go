@@ -0,0 +1,108 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	networking "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// Agent annotations which, when set on a Namespace, provide defaults for the Secrets and Ingresses within it (so that a namespace can be enrolled wholesale.) Annotations set on the objects themselves take precedence.
+var namespaceDefaultAnnotations = []string{
+	global.AGENT_ENABLED_ANNOTATION,
+	global.AGENT_REGIONS_ANNOTATION,
+	global.AGENT_ASSUME_ROLE_ARN_ANNOTATION,
+	global.AGENT_TAGS_ANNOTATION,
+	global.AGENT_CERTIFICATE_SOURCE_ANNOTATION,
+	global.AGENT_HOSTED_ZONE_ID_ANNOTATION,
+}
+
+// applyNamespaceDefaults sets each of the namespaceDefaultAnnotations that the object does not carry to the value set on its Namespace (if any.) The object is modified in memory only: defaults are never written back, since objects are always patched relative to a copy taken after defaults are applied. Patches replace the object with the server's copy, which does not carry the defaults, so reconcilers that apply defaults must write through a namespaceDefaultsClient.
+func applyNamespaceDefaults(ctx context.Context, c client.Reader, object client.Object) error {
+
+	if object.GetNamespace() == "" {
+		return nil
+	}
+
+	ns := &corev1.Namespace{}
+	if err := c.Get(ctx, types.NamespacedName{Name: object.GetNamespace()}, ns); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+
+	annotations := object.GetAnnotations()
+	for _, key := range namespaceDefaultAnnotations {
+		value, ok := ns.Annotations[key]
+		if !ok {
+			continue
+		}
+		if _, ok := annotations[key]; ok {
+			continue
+		}
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[key] = value
+	}
+	object.SetAnnotations(annotations)
+
+	return nil
+}
+
+// Predicate passing updates to Namespaces that change the defaults they provide (see namespaceDefaultAnnotations.) The creation and deletion of Namespaces is ignored, since the objects within them are reconciled in their own right.
+var namespaceDefaultsChangedPredicate = predicate.Funcs{
+	CreateFunc:  func(event.CreateEvent) bool { return false },
+	DeleteFunc:  func(event.DeleteEvent) bool { return false },
+	GenericFunc: func(event.GenericEvent) bool { return false },
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		for _, key := range namespaceDefaultAnnotations {
+			oldValue, oldOk := e.ObjectOld.GetAnnotations()[key]
+			newValue, newOk := e.ObjectNew.GetAnnotations()[key]
+			if oldOk != newOk || oldValue != newValue {
+				return true
+			}
+		}
+		return false
+	},
+}
+
+// namespaceDefaultsClient re-applies Namespace defaults (see applyNamespaceDefaults) to the Secrets and Ingresses it patches or updates. Without this, defaults would be lost part way through reconciliation whenever the object is written (e.g. to add the agent's finalizer), and the remainder of the reconciliation (e.g. the choice of AWS account and regions) would see the object's own annotations only.
+type namespaceDefaultsClient struct {
+	client.Client
+}
+
+func (c namespaceDefaultsClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if err := c.Client.Patch(ctx, obj, patch, opts...); err != nil {
+		return err
+	}
+	return c.reapplyNamespaceDefaults(ctx, obj)
+}
+
+func (c namespaceDefaultsClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	if err := c.Client.Update(ctx, obj, opts...); err != nil {
+		return err
+	}
+	return c.reapplyNamespaceDefaults(ctx, obj)
+}
+
+// Only the objects to which defaults are applied are modified, so that other objects are never patched with defaults.
+func (c namespaceDefaultsClient) reapplyNamespaceDefaults(ctx context.Context, obj client.Object) error {
+	switch obj.(type) {
+	case *corev1.Secret, *networking.Ingress:
+		return applyNamespaceDefaults(ctx, c.Client, obj)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// SNSService is the subset of the SNS API used by the agent to publish notifications.
+type SNSService interface {
+	Publish(ctx context.Context, topicArn string, subject string, message string) error
+}
+
+// EventBridgeService is the subset of the EventBridge API used by the agent to publish notifications.
+type EventBridgeService interface {
+	PutEvent(ctx context.Context, eventBusName string, source string, detailType string, detail string) error
+}
+
+// awsSNSService invokes the SNS API directly (see awsHTTPClient), since only Publish is used.
+type awsSNSService struct {
+	client *awsHTTPClient
+	region string
+}
+
+// NewAWSSNSService returns an SNSService backed by the SNS API in the specified region.
+func NewAWSSNSService(cfg aws.Config, region string) SNSService {
+	return &awsSNSService{client: newAWSHTTPClient(cfg, "sns"), region: region}
+}
+
+func (s *awsSNSService) Publish(ctx context.Context, topicArn string, subject string, message string) error {
+	_, err := s.client.postQuery(ctx, s.region, url.Values{
+		"Action":   {"Publish"},
+		"Version":  {"2010-03-31"},
+		"TopicArn": {topicArn},
+		"Subject":  {subject},
+		"Message":  {message},
+	})
+	return err
+}
+
+// awsEventBridgeService invokes the EventBridge API directly (see awsHTTPClient), since only PutEvents is used.
+type awsEventBridgeService struct {
+	client *awsHTTPClient
+	region string
+}
+
+// NewAWSEventBridgeService returns an EventBridgeService backed by the EventBridge API in the specified region.
+func NewAWSEventBridgeService(cfg aws.Config, region string) EventBridgeService {
+	return &awsEventBridgeService{client: newAWSHTTPClient(cfg, "events"), region: region}
+}
+
+func (s *awsEventBridgeService) PutEvent(ctx context.Context, eventBusName string, source string, detailType string, detail string) error {
+
+	responseBody, err := s.client.postJSON(ctx, s.region, "AWSEvents.PutEvents", map[string]interface{}{
+		"Entries": []map[string]interface{}{
+			{"EventBusName": eventBusName, "Source": source, "DetailType": detailType, "Detail": detail},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Entries can fail individually, even though the request succeeds.
+	output := struct {
+		FailedEntryCount int
+		Entries          []struct {
+			ErrorCode    string
+			ErrorMessage string
+		}
+	}{}
+	if err := json.Unmarshal(responseBody, &output); err != nil {
+		return err
+	}
+	if output.FailedEntryCount > 0 {
+		for _, entry := range output.Entries {
+			if entry.ErrorCode != "" {
+				return &awsAPIError{Service: "events", Code: entry.ErrorCode, Message: entry.ErrorMessage}
+			}
+		}
+		return fmt.Errorf("EventBridge rejected the event.")
+	}
+
+	return nil
+}
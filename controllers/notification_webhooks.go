@@ -0,0 +1,157 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"text/template"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// Default payload of webhook notifications, which is compatible with Slack incoming webhooks (and Microsoft Teams and Mattermost, which accept the same 'text' field.)
+const defaultNotificationWebhookTemplate = `{"text": {{ printf "*%s*: %s ` + "`%s/%s`" + `%s. %s" .Title .Kind .Namespace .Name (cluster .ClusterName) .Message | json }}}`
+
+// Types of notification sent to Namespace webhooks: those on which application teams must act.
+var webhookNotificationTypes = []string{NotificationImportFailed, NotificationNearingExpiry}
+
+// Reader used to retrieve the Namespace webhook annotations (typically the manager's cached client.) If nil, webhook notifications are disabled. Set before reconcilers are registered with the manager.
+var NotificationReader client.Reader
+
+var notificationHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// notificationWebhook is a webhook to which notifications concerning objects in a Namespace are posted.
+type notificationWebhook struct {
+	url      string
+	template *template.Template
+}
+
+// Functions available to webhook payload templates.
+var notificationTemplateFuncs = template.FuncMap{
+	// Encodes the value as JSON (e.g. a quoted and escaped string.)
+	"json": func(value interface{}) (string, error) {
+		output, err := json.Marshal(value)
+		return string(output), err
+	},
+	// Returns " in cluster '{name}'" if the cluster name is set.
+	"cluster": func(name string) string {
+		if name == "" {
+			return ""
+		}
+		return fmt.Sprintf(" in cluster '%s'", name)
+	},
+}
+
+// Parses a webhook payload template. Templates are evaluated against the notification (see Notification), with an additional 'Title' field describing the event.
+func parseNotificationTemplate(value string) (*template.Template, error) {
+	return template.New("notification").Funcs(notificationTemplateFuncs).Parse(value)
+}
+
+// ValidateNotificationWebhookURL returns an error if the value is not an HTTP(S) URL. Empty URLs are permitted (these disable webhook notifications.)
+func ValidateNotificationWebhookURL(value string) error {
+	if value == "" {
+		return nil
+	}
+	if parsedUrl, err := url.Parse(value); err != nil || (parsedUrl.Scheme != "https" && parsedUrl.Scheme != "http") || parsedUrl.Host == "" {
+		return fmt.Errorf("'%s' is not a valid HTTP(S) URL.", value)
+	}
+	return nil
+}
+
+// ValidateNotificationTemplate returns an error if the value is not a valid webhook payload template (see parseNotificationTemplate.)
+func ValidateNotificationTemplate(value string) error {
+	if _, err := parseNotificationTemplate(value); err != nil {
+		return fmt.Errorf("Template could not be parsed: %w", err)
+	}
+	return nil
+}
+
+// Returns the webhook to which notifications concerning objects in the namespace are posted, as set by the Namespace's webhook annotations, or nil if there is none.
+func namespaceNotificationWebhook(ctx context.Context, namespace string) (*notificationWebhook, error) {
+
+	if NotificationReader == nil || namespace == "" {
+		return nil, nil
+	}
+
+	ns := &corev1.Namespace{}
+	if err := NotificationReader.Get(ctx, types.NamespacedName{Name: namespace}, ns); err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+
+	webhookUrl := ns.Annotations[global.AGENT_NOTIFICATION_WEBHOOK_ANNOTATION]
+	if webhookUrl == "" {
+		return nil, nil
+	}
+	if err := ValidateNotificationWebhookURL(webhookUrl); err != nil {
+		return nil, fmt.Errorf("Namespace '%s' annotation '%s' is not a valid HTTP(S) URL.", namespace, global.AGENT_NOTIFICATION_WEBHOOK_ANNOTATION)
+	}
+
+	templateValue := defaultNotificationWebhookTemplate
+	if value, ok := ns.Annotations[global.AGENT_NOTIFICATION_TEMPLATE_ANNOTATION]; ok && value != "" {
+		templateValue = value
+	}
+	payloadTemplate, err := parseNotificationTemplate(templateValue)
+	if err != nil {
+		return nil, fmt.Errorf("Namespace '%s' annotation '%s' is not a valid template: %w", namespace, global.AGENT_NOTIFICATION_TEMPLATE_ANNOTATION, err)
+	}
+
+	return &notificationWebhook{url: webhookUrl, template: payloadTemplate}, nil
+}
+
+// Posts the notification to the webhook, rendered using its payload template.
+func (w *notificationWebhook) post(ctx context.Context, notification Notification) error {
+
+	data := struct {
+		Notification
+		Title string
+	}{Notification: notification, Title: notificationTitles[notification.Type]}
+
+	payload := &bytes.Buffer{}
+	if err := w.template.Execute(payload, data); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := notificationHTTPClient.Do(req)
+	if err != nil {
+		// Webhook URLs typically embed a secret token, so are omitted from errors (which are logged.)
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return fmt.Errorf("Webhook request failed: %w", urlErr.Err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("Webhook returned status '%s': %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	return nil
+}
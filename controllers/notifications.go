@@ -0,0 +1,229 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// Certificate lifecycle events for which notifications are published.
+const (
+	NotificationImported      = "CertificateImported"
+	NotificationImportFailed  = "CertificateImportFailed"
+	NotificationNearingExpiry = "CertificateNearingExpiry"
+)
+
+// Titles of notification types, used as the SNS message subject and EventBridge detail type.
+var notificationTitles = map[string]string{
+	NotificationImported:      "Certificate imported into ACM",
+	NotificationImportFailed:  "Certificate import into ACM failed",
+	NotificationNearingExpiry: "Certificate nearing expiry without renewal",
+}
+
+const (
+	// Interval within which repeated notifications of the same event for the same object (e.g. a failing import being retried, or the daily expiry check) are suppressed.
+	notificationRepeatInterval = 24 * time.Hour
+)
+
+// SNS topic to which notifications are published, unless set by the ACMAgentConfig (see notificationTopicArn.) Set before reconcilers are registered with the manager.
+var NotificationTopicArn = ""
+
+// EventBridge event bus (name or ARN) to which notifications are published, unless set by the ACMAgentConfig (see notificationEventBus.) Set before reconcilers are registered with the manager.
+var NotificationEventBus = ""
+
+// Types of notification that are published (e.g. NotificationImportFailed.) If empty, all types are published. Set before reconcilers are registered with the manager.
+var NotificationTypes = []string{}
+
+// Notification describes a certificate lifecycle event, published as JSON to the configured SNS topic and/or EventBridge event bus.
+type Notification struct {
+	Type           string `json:"type"`
+	Time           string `json:"time"`
+	Agent          string `json:"agent"`
+	ClusterName    string `json:"clusterName,omitempty"`
+	Kind           string `json:"kind"`
+	Namespace      string `json:"namespace,omitempty"`
+	Name           string `json:"name"`
+	CertificateArn string `json:"certificateArn,omitempty"`
+	Region         string `json:"region,omitempty"`
+	Expires        string `json:"expires,omitempty"`
+	Message        string `json:"message"`
+}
+
+// Returns a notification of the specified type concerning the object.
+func newNotification(notificationType string, kind string, object client.Object, message string) Notification {
+	return Notification{
+		Type:      notificationType,
+		Kind:      kind,
+		Namespace: object.GetNamespace(),
+		Name:      object.GetName(),
+		Message:   message,
+	}
+}
+
+// Time at which each notification was last published, keyed by type, object and region (see notificationKey.)
+var notificationHistory = struct {
+	mutex sync.Mutex
+	sent  map[string]time.Time
+}{sent: map[string]time.Time{}}
+
+func notificationKey(notificationType string, notification Notification) string {
+	return strings.Join([]string{notificationType, notification.Kind, notification.Namespace, notification.Name, notification.Region}, "|")
+}
+
+// Returns true if the notification should be published, i.e. the same event has not been published for the object within notificationRepeatInterval. A successful import re-enables notification of subsequent failures.
+func shouldPublishNotification(notification Notification) bool {
+
+	notificationHistory.mutex.Lock()
+	defer notificationHistory.mutex.Unlock()
+
+	now := time.Now()
+	for key, sent := range notificationHistory.sent {
+		if now.Sub(sent) > notificationRepeatInterval {
+			delete(notificationHistory.sent, key)
+		}
+	}
+
+	if notification.Type == NotificationImported {
+		delete(notificationHistory.sent, notificationKey(NotificationImportFailed, notification))
+		return true
+	}
+
+	key := notificationKey(notification.Type, notification)
+	if _, ok := notificationHistory.sent[key]; ok {
+		return false
+	}
+	notificationHistory.sent[key] = now
+
+	return true
+}
+
+// AWS configuration (the agent's own identity) used to publish notifications, loaded on first use.
+var notificationAWSConfig struct {
+	mutex  sync.Mutex
+	cfg    aws.Config
+	loaded bool
+}
+
+func loadNotificationAWSConfig(ctx context.Context) (aws.Config, error) {
+
+	notificationAWSConfig.mutex.Lock()
+	defer notificationAWSConfig.mutex.Unlock()
+
+	if !notificationAWSConfig.loaded {
+		cfg, err := loadDefaultAWSConfig(ctx)
+		if err != nil {
+			return cfg, err
+		}
+		notificationAWSConfig.cfg = cfg
+		notificationAWSConfig.loaded = true
+	}
+
+	return notificationAWSConfig.cfg, nil
+}
+
+// Publishes a notification to the SNS topic and/or EventBridge event bus configured using the ACMAgentConfig or environment (if any), and to any webhook set by the object's Namespace. Failures are logged (and counted), but do not fail reconciliation.
+func notify(ctx context.Context, notification Notification) {
+
+	log := log.FromContext(ctx)
+
+	topicArn := notificationTopicArn()
+	eventBus := notificationEventBus()
+	var webhook *notificationWebhook
+	if containsString(webhookNotificationTypes, notification.Type) {
+		var err error
+		if webhook, err = namespaceNotificationWebhook(ctx, notification.Namespace); err != nil {
+			log.Error(err, "Unable to retrieve Namespace notification webhook.")
+			notificationFailuresTotal.WithLabelValues("webhook").Inc()
+		}
+	}
+	if topicArn == "" && eventBus == "" && webhook == nil {
+		return
+	}
+	if len(NotificationTypes) > 0 && !containsString(NotificationTypes, notification.Type) {
+		return
+	}
+	if !shouldPublishNotification(notification) {
+		return
+	}
+
+	notification.Time = time.Now().UTC().Format(time.RFC3339)
+	notification.Agent = global.PACKAGE_NAME
+	notification.ClusterName = ClusterName
+	title := notificationTitles[notification.Type]
+
+	if webhook != nil {
+		if err := webhook.post(ctx, notification); err != nil {
+			log.Error(err, fmt.Sprintf("Failed to post notification to the webhook of Namespace '%s'.", notification.Namespace))
+			notificationFailuresTotal.WithLabelValues("webhook").Inc()
+		}
+	}
+
+	if topicArn == "" && eventBus == "" {
+		return
+	}
+
+	message, err := json.Marshal(notification)
+	if err != nil {
+		log.Error(err, "Failed to encode notification.")
+		return
+	}
+
+	cfg, err := loadNotificationAWSConfig(ctx)
+	if err != nil {
+		log.Error(err, "Failed to load AWS configuration: notification not published.")
+		if topicArn != "" {
+			notificationFailuresTotal.WithLabelValues("sns").Inc()
+		}
+		if eventBus != "" {
+			notificationFailuresTotal.WithLabelValues("eventbridge").Inc()
+		}
+		return
+	}
+
+	if topicArn != "" {
+		region := cfg.Region
+		if parsedArn, err := arn.Parse(topicArn); err == nil {
+			region = parsedArn.Region
+		}
+		// SNS subjects are limited to 100 characters.
+		subject := fmt.Sprintf("%s: %s/%s", title, notification.Namespace, notification.Name)
+		if len(subject) > 100 {
+			subject = subject[:97] + "..."
+		}
+		if err := NewAWSSNSService(cfg, region).Publish(ctx, topicArn, subject, string(message)); err != nil {
+			log.Error(err, fmt.Sprintf("Failed to publish notification to SNS topic '%s'.", topicArn))
+			notificationFailuresTotal.WithLabelValues("sns").Inc()
+		}
+	}
+
+	if eventBus != "" {
+		region := cfg.Region
+		if parsedArn, err := arn.Parse(eventBus); err == nil {
+			region = parsedArn.Region
+		}
+		if err := NewAWSEventBridgeService(cfg, region).PutEvent(ctx, eventBus, global.FULL_NAME, title, string(message)); err != nil {
+			log.Error(err, fmt.Sprintf("Failed to publish notification to EventBridge event bus '%s'.", eventBus))
+			notificationFailuresTotal.WithLabelValues("eventbridge").Inc()
+		}
+	}
+}
@@ -0,0 +1,123 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// ParseFailure records that the certificate held in a Secret could not be parsed. It is recorded (as JSON) in the Secret's parse-failure annotation, and is not re-evaluated until the Secret's data (or the annotations selecting its data keys) change.
+type ParseFailure struct {
+	Error    string `json:"error"`
+	DataHash string `json:"dataHash"`
+	Since    string `json:"since"`
+}
+
+// Annotations that determine how the Secret's data is parsed.
+var dataKeyAnnotations = []string{
+	global.AGENT_CERT_KEY_ANNOTATION,
+	global.AGENT_KEY_KEY_ANNOTATION,
+	global.AGENT_CHAIN_KEY_ANNOTATION,
+	global.AGENT_PKCS12_KEY_ANNOTATION,
+	global.AGENT_PKCS12_PASSWORD_KEY_ANNOTATION,
+	global.AGENT_KEY_PASSWORD_KEY_ANNOTATION,
+}
+
+// Returns a hash of the Secret's data and data key annotations, which changes whenever the certificate would be parsed differently.
+func secretDataHash(secret *corev1.Secret) string {
+
+	keys := []string{}
+	for key := range secret.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	hash := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(hash, "%s=%d:", key, len(secret.Data[key]))
+		hash.Write(secret.Data[key])
+	}
+	for _, annotation := range dataKeyAnnotations {
+		fmt.Fprintf(hash, "|%s=%s", annotation, secret.Annotations[annotation])
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// GetParseFailure returns the parse failure recorded against the Secret, if any.
+func (r *SecretReconciler) GetParseFailure(secret *corev1.Secret) (ParseFailure, bool) {
+	parseFailure := ParseFailure{}
+	value, ok := secret.Annotations[global.AGENT_PARSE_FAILURE_ANNOTATION]
+	if !ok || json.Unmarshal([]byte(value), &parseFailure) != nil {
+		return ParseFailure{}, false
+	}
+	return parseFailure, true
+}
+
+// HasUnchangedParseFailure returns true if a parse failure has been recorded against the Secret's current data, so that parsing need not be re-attempted.
+func (r *SecretReconciler) HasUnchangedParseFailure(secret *corev1.Secret) bool {
+	parseFailure, ok := r.GetParseFailure(secret)
+	return ok && parseFailure.DataHash == secretDataHash(secret)
+}
+
+// RecordParseFailure records that the Secret's certificate could not be parsed, in the Secret's parse-failure and sync-status annotations, a warning Event and metric, and an import failure notification.
+func (r *SecretReconciler) RecordParseFailure(ctx context.Context, secret *corev1.Secret, err error) {
+
+	log := log.FromContext(ctx)
+
+	message := fmt.Sprintf("Could not parse certificate: %s", err)
+	certificateParseFailuresTotal.WithLabelValues(secret.Namespace).Inc()
+	r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonParseFailed, fmt.Sprintf("%s. The certificate will not be synchronized until the Secret changes.", message))
+	r.NotifyImportFailed(ctx, secret, "", message)
+
+	value, marshalErr := json.Marshal(ParseFailure{
+		Error:    err.Error(),
+		DataHash: secretDataHash(secret),
+		Since:    time.Now().UTC().Format(time.RFC3339),
+	})
+	if marshalErr != nil {
+		return
+	}
+
+	patch := client.MergeFrom(secret.DeepCopy())
+	setAnnotation(secret, global.AGENT_PARSE_FAILURE_ANNOTATION, string(value))
+	if err := r.Patch(ctx, secret, patch); err != nil {
+		log.Error(err, "Failed to record parse failure on Secret.")
+	}
+
+	r.RecordSyncStatus(ctx, secret, global.SYNC_STATE_FAILED, message)
+}
+
+// ClearParseFailure removes any parse failure recorded against the Secret, once its certificate has been parsed successfully.
+func (r *SecretReconciler) ClearParseFailure(ctx context.Context, secret *corev1.Secret) {
+
+	if _, ok := secret.Annotations[global.AGENT_PARSE_FAILURE_ANNOTATION]; !ok {
+		return
+	}
+
+	patch := client.MergeFrom(secret.DeepCopy())
+	delete(secret.Annotations, global.AGENT_PARSE_FAILURE_ANNOTATION)
+	if err := r.Patch(ctx, secret, patch); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to remove parse failure from Secret.")
+	}
+}
@@ -0,0 +1,120 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// AWS partitions (see https://docs.aws.amazon.com/general/latest/gr/aws-arns-and-namespaces.html.)
+const (
+	partitionAWS      = "aws"
+	partitionAWSChina = "aws-cn"
+	partitionAWSGov   = "aws-us-gov"
+	partitionAWSISO   = "aws-iso"
+	partitionAWSISOB  = "aws-iso-b"
+)
+
+// Region prefixes of the partitions other than 'aws', longest first.
+var partitionRegionPrefixes = []struct {
+	prefix    string
+	partition string
+}{
+	{"us-isob-", partitionAWSISOB},
+	{"us-iso-", partitionAWSISO},
+	{"us-gov-", partitionAWSGov},
+	{"cn-", partitionAWSChina},
+}
+
+// DNS suffixes of AWS API endpoints, by partition.
+var partitionDNSSuffixes = map[string]string{
+	partitionAWS:      "amazonaws.com",
+	partitionAWSChina: "amazonaws.com.cn",
+	partitionAWSGov:   "amazonaws.com",
+	partitionAWSISO:   "c2s.ic.gov",
+	partitionAWSISOB:  "sc2s.sgov.gov",
+}
+
+// AWS partition in which the agent runs (e.g. 'aws-us-gov'.) If empty, the partition is derived from the region. Set before reconcilers are registered with the manager.
+var AWSPartition = ""
+
+// Returns true if the partition is one of those known to the agent.
+func IsKnownPartition(partition string) bool {
+	_, ok := partitionDNSSuffixes[partition]
+	return ok
+}
+
+// Returns the partition to which the region belongs, as determined by its prefix (e.g. 'cn-north-1' belongs to 'aws-cn'.)
+func regionPartition(region string) string {
+	for _, entry := range partitionRegionPrefixes {
+		if strings.HasPrefix(region, entry.prefix) {
+			return entry.partition
+		}
+	}
+	return partitionAWS
+}
+
+// Returns the partition in which the agent operates: AWSPartition if set, otherwise the partition of the agent's region.
+func agentPartition(region string) string {
+	if AWSPartition != "" {
+		return AWSPartition
+	}
+	return regionPartition(region)
+}
+
+// Returns the DNS suffix of AWS API endpoints in the region.
+func partitionDNSSuffix(region string) string {
+	if suffix, ok := partitionDNSSuffixes[regionPartition(region)]; ok {
+		return suffix
+	}
+	return partitionDNSSuffixes[partitionAWS]
+}
+
+// Returns the region from which CloudFront accepts ACM certificates in the partition, or an empty string if CloudFront does not use ACM certificates there (e.g. in aws-cn and aws-us-gov.)
+func cloudFrontRegion(partition string) string {
+	if partition == partitionAWS {
+		return global.CLOUDFRONT_REGION
+	}
+	return ""
+}
+
+// Returns an error if the ARN belongs to a partition other than that in which the agent operates (see agentPartition.) If neither AWSPartition nor the agent's region is known, ARNs are not checked.
+func checkARNPartition(parsedArn arn.ARN, region string) error {
+	if AWSPartition == "" && region == "" {
+		return nil
+	}
+	if partition := agentPartition(region); parsedArn.Partition != partition {
+		return fmt.Errorf("ARN '%s' belongs to AWS partition '%s', but the agent is running in partition '%s'.", parsedArn.String(), parsedArn.Partition, partition)
+	}
+	return nil
+}
+
+// Returns the regions in the list that belong to the agent's partition, and those that do not. If neither AWSPartition nor the agent's region is known, all regions are included.
+func partitionRegions(regions []string, region string) ([]string, []string) {
+	if AWSPartition == "" && region == "" {
+		return regions, []string{}
+	}
+	partition := agentPartition(region)
+	included, excluded := []string{}, []string{}
+	for _, candidate := range regions {
+		if regionPartition(candidate) == partition {
+			included = append(included, candidate)
+		} else {
+			excluded = append(excluded, candidate)
+		}
+	}
+	return included, excluded
+}
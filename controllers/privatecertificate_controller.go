@@ -0,0 +1,400 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/acmpca"
+	acmpcatypes "github.com/aws/aws-sdk-go-v2/service/acmpca/types"
+	corev1 "k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"Validitron/k8s-acm-certificate-agent/api/v1alpha1"
+)
+
+const (
+	// Maximum time to wait for AWS Private CA to issue a certificate once requested.
+	privateCertificateIssueTimeout = 2 * time.Minute
+)
+
+// PrivateCertificateReconciler issues certificates from AWS Private CA (ACM PCA) on behalf of PrivateCertificates, writing them into TLS Secrets and renewing them before they expire.
+// The private key is generated by the agent and never leaves the cluster: only a certificate signing request is sent to AWS.
+type PrivateCertificateReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// Maximum number of objects reconciled in parallel (default 1.)
+	MaxConcurrentReconciles int
+
+	// Delay before the first retry of an object whose reconciliation fails (doubling on each subsequent failure.) Defaults to 1 second.
+	RequeueDelay time.Duration
+
+	// Retries of failed objects, parking those that exceed MaxRetries. Set by SetupWithManager.
+	retries *retryLimiter
+}
+
+func (r *PrivateCertificateReconciler) SetupWithManager(mgr ctrl.Manager) error {
+
+	r.retries = newRetryLimiter("privatecertificate", r.RequeueDelay)
+
+	// Tells the controller which object type this reconciler will handle. Changes to (or deletion of) owned Secrets also trigger reconciliation.
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("privatecertificate").
+		For(&v1alpha1.PrivateCertificate{}).
+		Owns(&corev1.Secret{}).
+		WithOptions(controller.Options{RateLimiter: r.retries.rateLimiter, MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
+		WithLogConstructor(buildLogConstructor(mgr, "privatecertificate-reconciler", v1alpha1.GroupVersion.Group, "PrivateCertificate")). // When multiple controllers running with a single manager, the log auto-constructor does not work. Therefore we must do manually.
+		Complete(r)
+}
+
+func (r *PrivateCertificateReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+
+	log := log.FromContext(ctx)
+
+	privateCertificate := &v1alpha1.PrivateCertificate{}
+	if err := r.Get(ctx, req.NamespacedName, privateCertificate); err != nil {
+		if !k8serr.IsNotFound(err) {
+			log.Error(err, "Unable to retrieve PrivateCertificate.")
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	log.V(1).Info(fmt.Sprintf("Processing PrivateCertificate %s...", req.NamespacedName))
+
+	// Object is marked for deletion - nothing to do (the Secret is garbage collected by K8s; issued certificates simply expire.)
+	if !privateCertificate.ObjectMeta.DeletionTimestamp.IsZero() {
+		log.Info("PrivateCertificate is marked for deletion: nothing to do.")
+		return ctrl.Result{}, nil
+	}
+
+	// Objects whose retries have been exhausted are not reconciled again until they change.
+	if r.retries.Parked(req, privateCertificate.ResourceVersion) {
+		log.Info("PrivateCertificate is parked (retries exhausted): nothing to do.")
+		return ctrl.Result{}, nil
+	}
+	exhausted := r.retries.Exhausted(req)
+
+	var result ctrl.Result
+	var issueErr error
+	if exhausted {
+		log.Info(retriesExhaustedMessage())
+		r.Recorder.Event(privateCertificate, corev1.EventTypeWarning, eventReasonRetriesExhausted, retriesExhaustedMessage())
+		r.SetCondition(privateCertificate, v1alpha1.ConditionIssued, metav1.ConditionFalse, eventReasonRetriesExhausted, retriesExhaustedMessage())
+	} else {
+		result, issueErr = r.IssueCertificate(ctx, privateCertificate)
+	}
+
+	privateCertificate.Status.ObservedGeneration = privateCertificate.Generation
+	if err := r.Status().Update(ctx, privateCertificate); err != nil {
+		log.Error(err, "Failed to update PrivateCertificate status.")
+		return requeueWithBackoff(err)
+	}
+
+	// Read after the status is updated, so that updating it does not end the parking.
+	if exhausted {
+		r.retries.Park(req, privateCertificate.ResourceVersion)
+	}
+
+	return result, issueErr
+}
+
+// IssueCertificate ensures that the PrivateCertificate's Secret holds a current certificate from the specified certificate authority, issuing a new certificate if required, and recording the outcome in the status of the PrivateCertificate (which is not persisted.)
+func (r *PrivateCertificateReconciler) IssueCertificate(ctx context.Context, privateCertificate *v1alpha1.PrivateCertificate) (ctrl.Result, error) {
+
+	log := log.FromContext(ctx)
+
+	secret := &corev1.Secret{}
+	if err := r.Get(ctx, k8stypes.NamespacedName{Namespace: privateCertificate.Namespace, Name: privateCertificate.Spec.SecretName}, secret); err != nil {
+		if !k8serr.IsNotFound(err) {
+			log.Error(err, "Unable to retrieve Secret.")
+			return ctrl.Result{}, err
+		}
+		secret = nil
+	}
+
+	if secret != nil && !metav1.IsControlledBy(secret, privateCertificate) {
+		r.SetCondition(privateCertificate, v1alpha1.ConditionIssued, metav1.ConditionFalse, "SecretConflict", fmt.Sprintf("Secret '%s' already exists and is not owned by this PrivateCertificate.", privateCertificate.Spec.SecretName))
+		return ctrl.Result{}, nil
+	}
+
+	// Otherwise every certificate would be due for renewal as soon as it was issued.
+	if privateCertificate.Spec.RenewBeforeDays >= privateCertificate.Spec.ValidityDays {
+		r.SetCondition(privateCertificate, v1alpha1.ConditionIssued, metav1.ConditionFalse, "InvalidSpec", "'renewBeforeDays' must be less than 'validityDays'.")
+		return ctrl.Result{}, nil
+	}
+
+	renewBefore := time.Duration(privateCertificate.Spec.RenewBeforeDays) * 24 * time.Hour
+
+	// Re-use the existing certificate if it is still current.
+	if secret != nil {
+		reason := r.RenewalReason(privateCertificate, secret, renewBefore)
+		if reason == "" {
+			certificateDetails, _ := (&SecretReconciler{}).ParseCertificateDetails(secret)
+			r.SetCertificateStatus(privateCertificate, certificateDetails.Certificate.x509, renewBefore)
+			r.SetCondition(privateCertificate, v1alpha1.ConditionIssued, metav1.ConditionTrue, "Issued", fmt.Sprintf("Certificate is valid until %s.", certificateDetails.Certificate.x509.NotAfter.Format(time.RFC3339)))
+			return ctrl.Result{RequeueAfter: time.Until(privateCertificate.Status.RenewalTime.Time)}, nil
+		}
+		log.Info(fmt.Sprintf("Issuing replacement certificate: %s", reason))
+	}
+
+	caArn, err := arn.Parse(privateCertificate.Spec.CertificateAuthorityArn)
+	if err != nil {
+		r.SetCondition(privateCertificate, v1alpha1.ConditionIssued, metav1.ConditionFalse, "InvalidCertificateAuthority", fmt.Sprintf("'%s' is not a valid certificate authority ARN.", privateCertificate.Spec.CertificateAuthorityArn))
+		return ctrl.Result{}, nil
+	}
+
+	cfg, err := loadAWSConfig(ctx, privateCertificate.Spec.RoleArn)
+	if err != nil {
+		log.Error(err, "Failed to load AWS configuration.")
+		r.SetCondition(privateCertificate, v1alpha1.ConditionIssued, metav1.ConditionFalse, "AWSConfigurationError", err.Error())
+		return ctrl.Result{}, err
+	}
+	if err := checkARNPartition(caArn, cfg.Region); err != nil {
+		r.SetCondition(privateCertificate, v1alpha1.ConditionIssued, metav1.ConditionFalse, "InvalidCertificateAuthority", err.Error())
+		return ctrl.Result{}, nil
+	}
+
+	region := privateCertificate.Spec.Region
+	if region == "" {
+		region = caArn.Region
+	}
+	pcaCfg := cfg.Copy()
+	pcaCfg.Region = region
+	pcaClient := acmpca.NewFromConfig(pcaCfg)
+
+	privateKey, privateKeyPEM, signingAlgorithm, err := r.GeneratePrivateKey(privateCertificate.Spec.KeyAlgorithm)
+	if err != nil {
+		log.Error(err, "Failed to generate private key.")
+		return ctrl.Result{}, err
+	}
+
+	commonName := privateCertificate.Spec.CommonName
+	if commonName == "" {
+		commonName = privateCertificate.Spec.DNSNames[0]
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: commonName},
+		DNSNames: privateCertificate.Spec.DNSNames,
+	}, privateKey)
+	if err != nil {
+		log.Error(err, "Failed to create certificate signing request.")
+		return ctrl.Result{}, err
+	}
+
+	log.Info(fmt.Sprintf("Requesting certificate for '%s' from AWS Private CA '%s'...", strings.Join(privateCertificate.Spec.DNSNames, "', '"), privateCertificate.Spec.CertificateAuthorityArn))
+	issueOutput, err := pcaClient.IssueCertificate(ctx, &acmpca.IssueCertificateInput{
+		CertificateAuthorityArn: aws.String(privateCertificate.Spec.CertificateAuthorityArn),
+		Csr:                     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}),
+		SigningAlgorithm:        signingAlgorithm,
+		Validity: &acmpcatypes.Validity{
+			Type:  acmpcatypes.ValidityPeriodTypeDays,
+			Value: aws.Int64(privateCertificate.Spec.ValidityDays),
+		},
+	})
+	if err != nil {
+		log.Error(err, "AWS Private CA certificate request failed.")
+		r.SetCondition(privateCertificate, v1alpha1.ConditionIssued, metav1.ConditionFalse, "RequestFailed", err.Error())
+		return requeueWithBackoff(err)
+	}
+
+	// Issuance is asynchronous, but typically completes within seconds. The private key is held only in memory, so a request that times out is abandoned and retried.
+	getOutput, err := acmpca.NewCertificateIssuedWaiter(pcaClient).WaitForOutput(ctx, &acmpca.GetCertificateInput{
+		CertificateArn:          issueOutput.CertificateArn,
+		CertificateAuthorityArn: aws.String(privateCertificate.Spec.CertificateAuthorityArn),
+	}, privateCertificateIssueTimeout)
+	if err != nil {
+		log.Error(err, "AWS Private CA did not issue certificate.")
+		r.SetCondition(privateCertificate, v1alpha1.ConditionIssued, metav1.ConditionFalse, "IssueFailed", err.Error())
+		return requeueWithBackoff(err)
+	}
+
+	chainPEM := strings.TrimSpace(aws.ToString(getOutput.CertificateChain))
+	certificatePEM := strings.TrimSpace(aws.ToString(getOutput.Certificate)) + "\n"
+	if chainPEM != "" {
+		certificatePEM += chainPEM + "\n"
+	}
+
+	if secret == nil {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: privateCertificate.Namespace,
+				Name:      privateCertificate.Spec.SecretName,
+			},
+			Type: corev1.SecretTypeTLS,
+		}
+		if err := ctrl.SetControllerReference(privateCertificate, secret, r.Scheme); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	secret.Data = map[string][]byte{
+		corev1.TLSCertKey:       []byte(certificatePEM),
+		corev1.TLSPrivateKeyKey: privateKeyPEM,
+	}
+	if chainPEM != "" {
+		secret.Data["ca.crt"] = []byte(chainPEM + "\n")
+	}
+
+	// Annotations added to the Secret by users (e.g. to enable ACM import) are preserved.
+	if secret.ResourceVersion == "" {
+		log.Info(fmt.Sprintf("Creating Secret '%s'...", namespacedName(secret.ObjectMeta)))
+		err = r.Create(ctx, secret)
+	} else {
+		log.Info(fmt.Sprintf("Updating Secret '%s'...", namespacedName(secret.ObjectMeta)))
+		err = r.Update(ctx, secret)
+	}
+	if err != nil {
+		log.Error(err, "Failed to write Secret.")
+		r.SetCondition(privateCertificate, v1alpha1.ConditionIssued, metav1.ConditionFalse, "SecretWriteFailed", err.Error())
+		return requeueWithBackoff(err)
+	}
+
+	certificateDetails, err := (&SecretReconciler{}).ParseCertificateDetails(secret)
+	if err != nil {
+		log.Error(err, "Could not parse issued certificate.")
+		r.SetCondition(privateCertificate, v1alpha1.ConditionIssued, metav1.ConditionFalse, "InvalidCertificate", err.Error())
+		return ctrl.Result{}, nil
+	}
+
+	privateCertificate.Status.CertificateArn = aws.ToString(issueOutput.CertificateArn)
+	privateCertificate.Status.CertificateAuthorityArn = privateCertificate.Spec.CertificateAuthorityArn
+	r.SetCertificateStatus(privateCertificate, certificateDetails.Certificate.x509, renewBefore)
+	if meta.IsStatusConditionTrue(privateCertificate.Status.Conditions, v1alpha1.ConditionIssued) {
+		// Renewals do not change the condition, so would otherwise go unrecorded.
+		r.Recorder.Event(privateCertificate, corev1.EventTypeNormal, eventReasonIssued, fmt.Sprintf("Certificate '%s' issued by AWS Private CA.", privateCertificate.Status.CertificateArn))
+	}
+	r.SetCondition(privateCertificate, v1alpha1.ConditionIssued, metav1.ConditionTrue, "Issued", fmt.Sprintf("Certificate is valid until %s.", certificateDetails.Certificate.x509.NotAfter.Format(time.RFC3339)))
+
+	return ctrl.Result{RequeueAfter: time.Until(privateCertificate.Status.RenewalTime.Time)}, nil
+}
+
+// RenewalReason returns the reason why the certificate held in the Secret must be replaced, or an empty string if it is still current.
+func (r *PrivateCertificateReconciler) RenewalReason(privateCertificate *v1alpha1.PrivateCertificate, secret *corev1.Secret, renewBefore time.Duration) string {
+
+	certificateDetails, err := (&SecretReconciler{}).ParseCertificateDetails(secret)
+	if err != nil {
+		return fmt.Sprintf("secret does not contain a valid certificate (%s.)", strings.TrimSuffix(err.Error(), "."))
+	}
+	certificate := certificateDetails.Certificate.x509
+
+	if privateCertificate.Status.CertificateAuthorityArn != privateCertificate.Spec.CertificateAuthorityArn {
+		return "certificate authority has changed."
+	}
+
+	dnsNames := append([]string{}, certificate.DNSNames...)
+	requestedDNSNames := append([]string{}, privateCertificate.Spec.DNSNames...)
+	sort.Strings(dnsNames)
+	sort.Strings(requestedDNSNames)
+	if strings.Join(dnsNames, ",") != strings.Join(requestedDNSNames, ",") {
+		return "DNS names have changed."
+	}
+
+	if privateCertificate.Spec.CommonName != "" && certificate.Subject.CommonName != privateCertificate.Spec.CommonName {
+		return "common name has changed."
+	}
+
+	keyAlgorithm, _ := acmKeyAlgorithm(certificate.PublicKey)
+	if privateCertificate.Spec.KeyAlgorithm != "" && keyAlgorithm != privateCertificate.Spec.KeyAlgorithm {
+		return "key algorithm has changed."
+	}
+
+	if time.Now().After(certificate.NotAfter.Add(-renewBefore)) {
+		return fmt.Sprintf("certificate expires at %s.", certificate.NotAfter.Format(time.RFC3339))
+	}
+
+	return ""
+}
+
+// GeneratePrivateKey generates a private key using the specified algorithm, returning the key, its PEM encoding, and the corresponding AWS Private CA signing algorithm.
+func (r *PrivateCertificateReconciler) GeneratePrivateKey(keyAlgorithm string) (crypto.Signer, []byte, acmpcatypes.SigningAlgorithm, error) {
+
+	if keyAlgorithm == v1alpha1.KeyAlgorithmRSA2048 {
+		privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		privateKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+		return privateKey, privateKeyPEM, acmpcatypes.SigningAlgorithmSha256withrsa, nil
+	}
+
+	curve, signingAlgorithm := elliptic.P256(), acmpcatypes.SigningAlgorithmSha256withecdsa
+	if keyAlgorithm == v1alpha1.KeyAlgorithmECSecp384r1 {
+		curve, signingAlgorithm = elliptic.P384(), acmpcatypes.SigningAlgorithmSha384withecdsa
+	}
+
+	privateKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	privateKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})
+	return privateKey, privateKeyPEM, signingAlgorithm, nil
+}
+
+// SetCertificateStatus records the serial number, expiry date and renewal time of the certificate in the status of the PrivateCertificate.
+func (r *PrivateCertificateReconciler) SetCertificateStatus(privateCertificate *v1alpha1.PrivateCertificate, certificate *x509.Certificate, renewBefore time.Duration) {
+
+	expiryDate := metav1.NewTime(certificate.NotAfter)
+	renewalTime := metav1.NewTime(certificate.NotAfter.Add(-renewBefore))
+
+	privateCertificate.Status.SerialNumber = (&SecretReconciler{}).FormatX509SerialNumber(certificate.SerialNumber)
+	privateCertificate.Status.ExpiryDate = &expiryDate
+	privateCertificate.Status.RenewalTime = &renewalTime
+}
+
+// SetCondition sets the specified condition in the status of the PrivateCertificate, recording an Event if it has changed.
+func (r *PrivateCertificateReconciler) SetCondition(privateCertificate *v1alpha1.PrivateCertificate, conditionType string, status metav1.ConditionStatus, reason string, message string) {
+
+	// Record an Event whenever a condition changes.
+	existing := meta.FindStatusCondition(privateCertificate.Status.Conditions, conditionType)
+	if existing == nil || existing.Status != status || existing.Reason != reason {
+		eventType := corev1.EventTypeNormal
+		if status == metav1.ConditionFalse {
+			eventType = corev1.EventTypeWarning
+		}
+		r.Recorder.Event(privateCertificate, eventType, reason, message)
+	}
+
+	meta.SetStatusCondition(&privateCertificate.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: privateCertificate.Generation,
+	})
+}
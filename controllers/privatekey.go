@@ -0,0 +1,217 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/youmark/pkcs8"
+)
+
+// Normalization of private keys into the forms accepted by ACM import.
+// The agent accepts unencrypted PEM-encoded RSA keys (1024-4096 bits) and ECDSA keys on the P-256 (prime256v1) and P-384 (secp384r1) curves. ACM also imports P-521 keys, but the services integrated with ACM (e.g. load balancers) do not accept them. Keys are re-encoded as PKCS#1 (RSA) or SEC1 (ECDSA), regardless of how they are stored in the Secret.
+
+// unsupportedKeyError is returned when a private key (or the public key of a leaf certificate) is valid, but of a type or size that the agent does not import (e.g. Ed25519, or ECDSA on the P-224 or P-521 curves.)
+type unsupportedKeyError struct {
+	description string
+	commonName  string // Set if the unsupported key is the public key of a certificate.
+}
+
+func (e *unsupportedKeyError) Error() string {
+	if e.commonName != "" {
+		return fmt.Sprintf("Public key type %s of certificate '%s' is not supported by ACM (use RSA 1024-4096 or ECDSA P-256/P-384.)", e.description, e.commonName)
+	}
+	return fmt.Sprintf("Private key type %s is not supported by ACM (use RSA 1024-4096 or ECDSA P-256/P-384.)", e.description)
+}
+
+// keyMismatchError is returned when a private key does not correspond to the public key of the certificate it is held with.
+type keyMismatchError struct {
+	commonName string
+}
+
+func (e *keyMismatchError) Error() string {
+	return fmt.Sprintf("Private key does not match the public key of certificate '%s'.", e.commonName)
+}
+
+// normalizePrivateKey decodes a PEM-encoded private key in PKCS#1, SEC1 or PKCS#8 format, decrypting it with the passphrase if it is encrypted (PKCS#8 'ENCRYPTED PRIVATE KEY' or legacy 'Proc-Type: 4,ENCRYPTED' PEM), and re-encodes it in the unencrypted form accepted by ACM.
+func normalizePrivateKey(pemBytes []byte, passphrase []byte) ([]byte, error) {
+
+	// Skip non-key blocks (e.g. 'EC PARAMETERS', which OpenSSL writes before SEC1 keys.)
+	var block *pem.Block
+	rest := pemBytes
+	for {
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil, errors.New("Could not decode private key.")
+		}
+		if block.Type == "RSA PRIVATE KEY" || block.Type == "EC PRIVATE KEY" || block.Type == "PRIVATE KEY" || block.Type == "ENCRYPTED PRIVATE KEY" {
+			break
+		}
+	}
+
+	der := block.Bytes
+	//lint:ignore SA1019 Legacy PEM encryption is insecure, but is still produced by 'openssl rsa -des3' and similar, so must be read.
+	if x509.IsEncryptedPEMBlock(block) {
+		if len(passphrase) == 0 {
+			return nil, errors.New("Private key is encrypted, but no passphrase was provided.")
+		}
+		var err error
+		//lint:ignore SA1019 Legacy PEM encryption (see above.)
+		der, err = x509.DecryptPEMBlock(block, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("Could not decrypt private key: %s", err)
+		}
+	}
+
+	var privateKey interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		privateKey, err = x509.ParsePKCS1PrivateKey(der)
+	case "EC PRIVATE KEY":
+		privateKey, err = x509.ParseECPrivateKey(der)
+	case "PRIVATE KEY":
+		privateKey, err = x509.ParsePKCS8PrivateKey(der)
+	case "ENCRYPTED PRIVATE KEY":
+		if len(passphrase) == 0 {
+			return nil, errors.New("Private key is encrypted, but no passphrase was provided.")
+		}
+		privateKey, err = pkcs8.ParsePKCS8PrivateKey(der, passphrase)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse private key (%s): %s", block.Type, err)
+	}
+
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, &unsupportedKeyError{description: fmt.Sprintf("%T", privateKey)}
+	}
+	if _, err := acmKeyAlgorithm(signer.Public()); err != nil {
+		return nil, err
+	}
+
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), nil
+	case *ecdsa.PrivateKey:
+		sec1, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("Could not encode private key: %s", err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1}), nil
+	default:
+		return nil, &unsupportedKeyError{description: fmt.Sprintf("%T", privateKey)}
+	}
+}
+
+// acmKeyAlgorithm returns the name by which ACM identifies the algorithm of the public key (e.g. 'RSA_2048' or 'EC_prime256v1'), or an unsupportedKeyError if ACM does not accept keys of its type or size.
+func acmKeyAlgorithm(publicKey crypto.PublicKey) (string, error) {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		bits := key.N.BitLen()
+		if bits < 1024 || bits > 4096 {
+			return "", &unsupportedKeyError{description: fmt.Sprintf("RSA-%d", bits)}
+		}
+		return fmt.Sprintf("RSA_%d", bits), nil
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return "EC_prime256v1", nil
+		case elliptic.P384():
+			return "EC_secp384r1", nil
+		}
+		return "", &unsupportedKeyError{description: fmt.Sprintf("ECDSA %s", key.Curve.Params().Name)}
+	case ed25519.PublicKey:
+		return "", &unsupportedKeyError{description: "Ed25519"}
+	default:
+		return "", &unsupportedKeyError{description: fmt.Sprintf("%T", publicKey)}
+	}
+}
+
+// validateCertificatePublicKey returns an unsupportedKeyError if ACM does not accept the public key of the leaf certificate (e.g. a certificate issued for an ECDSA key on the P-224 curve.)
+func validateCertificatePublicKey(certificate *x509.Certificate) error {
+	if _, err := acmKeyAlgorithm(certificate.PublicKey); err != nil {
+		var unsupportedKeyErr *unsupportedKeyError
+		if errors.As(err, &unsupportedKeyErr) {
+			unsupportedKeyErr.commonName = certificate.Subject.CommonName
+		}
+		return err
+	}
+	return nil
+}
+
+// normalizePrivateKeys normalizes each of the PEM-encoded private keys held together (e.g. the keys of a multi-leaf Secret), as normalizePrivateKey.
+func normalizePrivateKeys(pemBytes []byte, passphrase []byte) ([][]byte, error) {
+
+	keys := [][]byte{}
+	rest := pemBytes
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "RSA PRIVATE KEY" && block.Type != "EC PRIVATE KEY" && block.Type != "PRIVATE KEY" && block.Type != "ENCRYPTED PRIVATE KEY" {
+			continue
+		}
+		key, err := normalizePrivateKey(pem.EncodeToMemory(block), passphrase)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("Could not decode private key.")
+	}
+	return keys, nil
+}
+
+// verifyPrivateKeyMatches returns a keyMismatchError unless the normalized (PKCS#1 or SEC1) PEM-encoded private key corresponds to the public key of the certificate.
+func verifyPrivateKeyMatches(pemBytes []byte, certificate *x509.Certificate) error {
+
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return errors.New("Could not decode private key.")
+	}
+
+	var publicKey interface{ Equal(crypto.PublicKey) bool }
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("Could not parse private key (%s): %s", block.Type, err)
+		}
+		publicKey = &key.PublicKey
+	case "EC PRIVATE KEY":
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("Could not parse private key (%s): %s", block.Type, err)
+		}
+		publicKey = &key.PublicKey
+	default:
+		return fmt.Errorf("Unexpected private key type '%s'.", block.Type)
+	}
+
+	if !publicKey.Equal(certificate.PublicKey) {
+		return &keyMismatchError{commonName: certificate.Subject.CommonName}
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+package controllers
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Keys of each type, with the ACM key algorithm of each (or empty, if ACM does not accept it.)
+func testKeyTypes(t *testing.T) []struct {
+	name         string
+	key          crypto.Signer
+	keyAlgorithm string
+} {
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key: %s", err)
+	}
+	return []struct {
+		name         string
+		key          crypto.Signer
+		keyAlgorithm string
+	}{
+		{"ECDSA P-256", newTestECKey(t, elliptic.P256()), "EC_prime256v1"},
+		{"ECDSA P-384", newTestECKey(t, elliptic.P384()), "EC_secp384r1"},
+		{"ECDSA P-224", newTestECKey(t, elliptic.P224()), ""},
+		{"ECDSA P-521", newTestECKey(t, elliptic.P521()), ""},
+		{"Ed25519", ed25519Key, ""},
+	}
+}
+
+func TestACMKeyAlgorithm(t *testing.T) {
+	for _, test := range testKeyTypes(t) {
+		t.Run(test.name, func(t *testing.T) {
+
+			keyAlgorithm, err := acmKeyAlgorithm(test.key.Public())
+			if test.keyAlgorithm == "" {
+				var unsupportedKeyErr *unsupportedKeyError
+				if !errors.As(err, &unsupportedKeyErr) {
+					t.Fatalf("Expected an unsupportedKeyError, found key algorithm '%s' (error %v).", keyAlgorithm, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Key was not accepted: %s", err)
+			}
+			if keyAlgorithm != test.keyAlgorithm {
+				t.Errorf("Key algorithm is '%s', expected '%s'.", keyAlgorithm, test.keyAlgorithm)
+			}
+		})
+	}
+}
+
+func TestValidateCertificatePublicKey(t *testing.T) {
+	root := newTestRoot(t, "Test Root")
+	for _, test := range testKeyTypes(t) {
+		t.Run(test.name, func(t *testing.T) {
+
+			leaf := root.issueLeaf(t, test.key, "www.example.test")
+
+			err := validateCertificatePublicKey(leaf.x509)
+			if test.keyAlgorithm != "" {
+				if err != nil {
+					t.Errorf("Certificate was not accepted: %s", err)
+				}
+				return
+			}
+			var unsupportedKeyErr *unsupportedKeyError
+			if !errors.As(err, &unsupportedKeyErr) {
+				t.Fatalf("Expected an unsupportedKeyError, found %v.", err)
+			}
+			if unsupportedKeyErr.commonName != "www.example.test" {
+				t.Errorf("Error names certificate '%s', expected 'www.example.test'.", unsupportedKeyErr.commonName)
+			}
+		})
+	}
+}
+
+func TestNormalizePrivateKey(t *testing.T) {
+	for _, test := range testKeyTypes(t) {
+		t.Run(test.name, func(t *testing.T) {
+
+			normalized, err := normalizePrivateKey([]byte(testKeyPEM(t, test.key)), nil)
+			if test.keyAlgorithm == "" {
+				var unsupportedKeyErr *unsupportedKeyError
+				if !errors.As(err, &unsupportedKeyErr) {
+					t.Fatalf("Expected an unsupportedKeyError, found %v.", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Could not normalize key: %s", err)
+			}
+
+			// PKCS#8 ECDSA keys are re-encoded as SEC1.
+			block, _ := pem.Decode(normalized)
+			if block == nil || block.Type != "EC PRIVATE KEY" {
+				t.Fatalf("Normalized key is not an 'EC PRIVATE KEY': %s", normalized)
+			}
+			leaf := newTestRoot(t, "Test Root").issueLeaf(t, test.key, "www.example.test")
+			if err := verifyPrivateKeyMatches(normalized, leaf.x509); err != nil {
+				t.Errorf("Normalized key does not match its certificate: %s", err)
+			}
+		})
+	}
+}
+
+// The serial number and domain names of ECDSA certificates are extracted as those of RSA certificates.
+func TestParseCertificateDetailsOfECCertificates(t *testing.T) {
+
+	root := newTestRoot(t, "Test Root")
+	intermediate := root.issueIntermediate(t, "Test Intermediate")
+
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384()} {
+		t.Run(curve.Params().Name, func(t *testing.T) {
+
+			key := newTestECKey(t, curve)
+			leaf := issueTestCertificate(t, intermediate, key, &x509.Certificate{
+				SerialNumber: big.NewInt(0x0a1b2c3d),
+				Subject:      pkix.Name{CommonName: "www.example.test"},
+				DNSNames:     []string{"www.example.test", "example.test"},
+			})
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "tls"},
+				Type:       corev1.SecretTypeTLS,
+				Data: map[string][]byte{
+					corev1.TLSCertKey:       []byte(testBundle(leaf, intermediate)),
+					corev1.TLSPrivateKeyKey: []byte(testKeyPEM(t, key)),
+				},
+			}
+
+			r := &SecretReconciler{}
+			details, err := r.ParseCertificateDetails(secret)
+			if err != nil {
+				t.Fatalf("Could not parse certificate details: %s", err)
+			}
+
+			if serialNumber := r.FormatX509SerialNumber(details.Certificate.x509.SerialNumber); serialNumber != "0a:1b:2c:3d" {
+				t.Errorf("Serial number is '%s', expected '0a:1b:2c:3d'.", serialNumber)
+			}
+			if domainNames := certificateDomainNames(details.Certificate.x509); !sameDomainNames(domainNames, []string{"www.example.test", "example.test"}) {
+				t.Errorf("Domain names are '%s', expected 'www.example.test,example.test'.", strings.Join(domainNames, ","))
+			}
+			if len(details.Intermediates) != 1 || !details.Intermediates[0].x509.Equal(intermediate.x509) {
+				t.Errorf("Found %d intermediate(s), expected the intermediate certificate.", len(details.Intermediates))
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/servicequotas"
+	sqtypes "github.com/aws/aws-sdk-go-v2/service/servicequotas/types"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// Pre-flight checks of the ACM quotas on imported certificates, so that imports which would exceed them are refused (with a clear explanation) rather than being throttled by ACM.
+
+const (
+	// Service code of ACM within Service Quotas.
+	acmServiceCode = "acm"
+
+	// How long ACM quota values are trusted before they are refreshed.
+	acmQuotaTTL = time.Hour
+)
+
+// ACM quotas checked before importing certificates, identified by their name within Service Quotas. The key is used to label quota metrics.
+const (
+	quotaImportedCertificates = "imported_certificates"
+	quotaImportsPerYear       = "imports_per_year"
+)
+
+var acmQuotaNames = map[string]string{
+	quotaImportedCertificates: "Imported certificates",
+	quotaImportsPerYear:       "Imported certificates in last 365 days",
+}
+
+// Default ACM quotas, used if a quota is not reported by Service Quotas. See https://docs.aws.amazon.com/acm/latest/userguide/acm-limits.html
+var acmDefaultQuotas = map[string]float64{
+	quotaImportedCertificates: 2500,
+	quotaImportsPerYear:       5000,
+}
+
+// ServiceQuotasService is the subset of the Service Quotas API used by the agent. It is satisfied by the AWS SDK Service Quotas client (*servicequotas.Client.)
+type ServiceQuotasService interface {
+	ListServiceQuotas(ctx context.Context, params *servicequotas.ListServiceQuotasInput, optFns ...func(*servicequotas.Options)) (*servicequotas.ListServiceQuotasOutput, error)
+	ListRequestedServiceQuotaChangeHistoryByQuota(ctx context.Context, params *servicequotas.ListRequestedServiceQuotaChangeHistoryByQuotaInput, optFns ...func(*servicequotas.Options)) (*servicequotas.ListRequestedServiceQuotaChangeHistoryByQuotaOutput, error)
+	RequestServiceQuotaIncrease(ctx context.Context, params *servicequotas.RequestServiceQuotaIncreaseInput, optFns ...func(*servicequotas.Options)) (*servicequotas.RequestServiceQuotaIncreaseOutput, error)
+}
+
+var _ ServiceQuotasService = (*servicequotas.Client)(nil)
+
+// ServiceQuotasServiceFactory returns the ServiceQuotasService for the specified region, using the supplied AWS configuration (which carries the credentials of any assumed IAM role.)
+type ServiceQuotasServiceFactory func(cfg aws.Config, region string) ServiceQuotasService
+
+// NewAWSServiceQuotasService returns a ServiceQuotasService backed by the Service Quotas API in the specified region. This is the default ServiceQuotasServiceFactory.
+func NewAWSServiceQuotasService(cfg aws.Config, region string) ServiceQuotasService {
+	regionalCfg := cfg.Copy()
+	regionalCfg.Region = region
+	return servicequotas.NewFromConfig(regionalCfg)
+}
+
+// An ACM quota, as applied to an AWS account/region.
+type acmQuota struct {
+	Key   string // One of quotaImportedCertificates, quotaImportsPerYear.
+	Code  string // Empty if the quota was not reported by Service Quotas (in which case Value is the default.)
+	Value float64
+}
+
+// Cached ACM quotas for a single AWS account/region combination.
+type acmQuotaScope struct {
+	quotas    map[string]acmQuota
+	fetchedAt time.Time
+}
+
+// acmQuotaCache holds the ACM quotas of each AWS account/region (see acmIndexScope), so that Service Quotas is not queried on every import.
+type acmQuotaCache struct {
+	mutex  sync.Mutex
+	scopes map[string]*acmQuotaScope
+}
+
+var acmQuotas = &acmQuotaCache{scopes: map[string]*acmQuotaScope{}}
+
+// Get returns the ACM quotas for the scope, refreshing them from Service Quotas if they are older than acmQuotaTTL.
+func (c *acmQuotaCache) Get(ctx context.Context, quotaClient ServiceQuotasService, scope string) (map[string]acmQuota, error) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if scopeQuotas, ok := c.scopes[scope]; ok && time.Since(scopeQuotas.fetchedAt) < acmQuotaTTL {
+		return scopeQuotas.quotas, nil
+	}
+
+	log.FromContext(ctx).Info("Retrieving ACM quotas...")
+
+	quotas := map[string]acmQuota{}
+	for key, value := range acmDefaultQuotas {
+		quotas[key] = acmQuota{Key: key, Value: value}
+	}
+
+	paginator := servicequotas.NewListServiceQuotasPaginator(quotaClient, &servicequotas.ListServiceQuotasInput{ServiceCode: aws.String(acmServiceCode)})
+	for paginator.HasMorePages() {
+		listOutput, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, serviceQuota := range listOutput.Quotas {
+			for key, name := range acmQuotaNames {
+				if serviceQuota.Value != nil && strings.EqualFold(strings.TrimSpace(aws.ToString(serviceQuota.QuotaName)), name) {
+					quotas[key] = acmQuota{Key: key, Code: aws.ToString(serviceQuota.QuotaCode), Value: *serviceQuota.Value}
+				}
+			}
+		}
+	}
+
+	c.scopes[scope] = &acmQuotaScope{quotas: quotas, fetchedAt: time.Now()}
+
+	return quotas, nil
+}
+
+// quotaExceededError indicates that importing a certificate would exceed an ACM quota. Retrying will not help until certificates are removed from ACM or the quota is increased.
+type quotaExceededError struct {
+	quota acmQuota
+	usage int
+}
+
+func (e *quotaExceededError) Error() string {
+	return fmt.Sprintf("Certificate import refused: %d of %d '%s' (ACM quota) have been used.", e.usage, int(e.quota.Value), acmQuotaNames[e.quota.Key])
+}
+
+// CheckImportQuotas returns a quotaExceededError if importing a certificate into the ACM account/region identified by indexScope would exceed its quotas, and records the quotas and their usage as metrics.
+// Re-imports (of existing ACM certificates) do not count towards the quota on the number of imported certificates. Usage is derived from the ACM certificate index, which describes each listed certificate the first time it is checked.
+func (r *SecretReconciler) CheckImportQuotas(ctx context.Context, acmClient ACMService, quotaClient ServiceQuotasService, indexScope string, reimport bool) error {
+
+	quotas, err := acmQuotas.Get(ctx, quotaClient, indexScope)
+	if err != nil {
+		return fmt.Errorf("Could not retrieve ACM quotas: %s", err)
+	}
+
+	importedCertificates, importsInLastYear, err := acmIndex.ImportUsage(ctx, acmClient, indexScope)
+	if err != nil {
+		return fmt.Errorf("Could not determine ACM quota usage: %s", err)
+	}
+
+	usage := map[string]int{
+		quotaImportedCertificates: importedCertificates,
+		quotaImportsPerYear:       importsInLastYear,
+	}
+	roleArn, region := splitACMIndexScope(indexScope)
+	for key, quota := range quotas {
+		acmQuotaLimit.WithLabelValues(region, roleArn, key).Set(quota.Value)
+		acmQuotaUsage.WithLabelValues(region, roleArn, key).Set(float64(usage[key]))
+	}
+
+	for _, key := range []string{quotaImportedCertificates, quotaImportsPerYear} {
+		if key == quotaImportedCertificates && reimport {
+			continue
+		}
+		if float64(usage[key]+1) > quotas[key].Value {
+			return &quotaExceededError{quota: quotas[key], usage: usage[key]}
+		}
+	}
+
+	return nil
+}
+
+// Returns true if the Secret requests an increase to ACM quotas which would otherwise prevent its certificate from being imported.
+func quotaIncreaseRequested(secret *corev1.Secret) bool {
+	requested, _ := strconv.ParseBool(secret.Annotations[global.AGENT_REQUEST_QUOTA_INCREASE_ANNOTATION])
+	return requested
+}
+
+// RequestQuotaIncrease requests that the exceeded ACM quota is doubled, unless an increase has already been requested and is still open. Returns true if a new request was made.
+func (r *SecretReconciler) RequestQuotaIncrease(ctx context.Context, quotaClient ServiceQuotasService, quotaErr *quotaExceededError) (bool, error) {
+
+	log := log.FromContext(ctx)
+
+	if quotaErr.quota.Code == "" {
+		return false, fmt.Errorf("ACM quota '%s' is not reported by Service Quotas and cannot be increased.", acmQuotaNames[quotaErr.quota.Key])
+	}
+
+	historyOutput, err := quotaClient.ListRequestedServiceQuotaChangeHistoryByQuota(ctx, &servicequotas.ListRequestedServiceQuotaChangeHistoryByQuotaInput{
+		ServiceCode: aws.String(acmServiceCode),
+		QuotaCode:   aws.String(quotaErr.quota.Code),
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, requestedChange := range historyOutput.RequestedQuotas {
+		if requestedChange.Status == sqtypes.RequestStatusPending || requestedChange.Status == sqtypes.RequestStatusCaseOpened {
+			log.Info(fmt.Sprintf("An increase to ACM quota '%s' has already been requested: skipping.", acmQuotaNames[quotaErr.quota.Key]))
+			return false, nil
+		}
+	}
+
+	desiredValue := math.Max(quotaErr.quota.Value*2, float64(quotaErr.usage+1))
+
+	log.Info(fmt.Sprintf("Requesting increase to ACM quota '%s' from %d to %d...", acmQuotaNames[quotaErr.quota.Key], int(quotaErr.quota.Value), int(desiredValue)))
+	_, err = quotaClient.RequestServiceQuotaIncrease(ctx, &servicequotas.RequestServiceQuotaIncreaseInput{
+		ServiceCode:  aws.String(acmServiceCode),
+		QuotaCode:    aws.String(quotaErr.quota.Code),
+		DesiredValue: aws.Float64(desiredValue),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,320 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// Checking that a certificate has not been revoked by its CA before it is imported into ACM, by querying the OCSP responders named in its Authority Information Access (AIA) extension and, failing that, the CRLs named in its CRL Distribution Points extension.
+
+const (
+	// How long revocation statuses (and CRLs) are cached when their responder does not say when they will next be updated.
+	revocationCacheTTL = time.Hour
+	// Maximum time for which revocation statuses (and CRLs) are cached, whatever their next update.
+	revocationMaxCacheTTL = 24 * time.Hour
+	// Maximum size of an OCSP response.
+	ocspMaxResponseBytes = 1 << 20
+	// Maximum size of a CRL.
+	crlMaxResponseBytes = 10 << 20
+)
+
+var revocationHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// OCSP responses, keyed by responder URL and certificate fingerprint, and CRLs, keyed by URL. Shared by all reconcilers, since Secrets are re-checked on every reconcile and many certificates are issued by the same CA.
+var revocationCache = &revocationStatusCache{
+	ocspEntries: map[string]ocspCacheEntry{},
+	crlEntries:  map[string]crlCacheEntry{},
+}
+
+type revocationStatusCache struct {
+	mutex       sync.Mutex
+	ocspEntries map[string]ocspCacheEntry
+	crlEntries  map[string]crlCacheEntry
+}
+
+type ocspCacheEntry struct {
+	response *ocsp.Response
+	expires  time.Time
+}
+
+type crlCacheEntry struct {
+	revoked map[string]pkix.RevokedCertificate // Keyed by serial number (in decimal.)
+	expires time.Time
+}
+
+// Names of the revocation reasons defined by RFC 5280.
+var revocationReasons = map[int]string{
+	ocsp.Unspecified:          "unspecified",
+	ocsp.KeyCompromise:        "keyCompromise",
+	ocsp.CACompromise:         "cACompromise",
+	ocsp.AffiliationChanged:   "affiliationChanged",
+	ocsp.Superseded:           "superseded",
+	ocsp.CessationOfOperation: "cessationOfOperation",
+	ocsp.CertificateHold:      "certificateHold",
+	ocsp.RemoveFromCRL:        "removeFromCRL",
+	ocsp.PrivilegeWithdrawn:   "privilegeWithdrawn",
+	ocsp.AACompromise:         "aACompromise",
+}
+
+// revokedCertificateError is returned when a certificate has been revoked by its CA, so that importing it will not help until the Secret holds a new certificate.
+type revokedCertificateError struct {
+	source    string // 'OCSP' or 'CRL'.
+	revokedAt time.Time
+	reason    int
+}
+
+func (e *revokedCertificateError) Error() string {
+	reason, ok := revocationReasons[e.reason]
+	if !ok {
+		reason = strconv.Itoa(e.reason)
+	}
+	return fmt.Sprintf("Certificate was revoked at %s (reason '%s', reported by %s.)", e.revokedAt.UTC().Format(time.RFC3339), reason, e.source)
+}
+
+// Returns true if the Secret is annotated to enable revocation checks.
+func checkRevocationEnabled(secret *corev1.Secret) bool {
+	enabled, _ := strconv.ParseBool(secret.Annotations[global.AGENT_CHECK_REVOCATION_ANNOTATION])
+	return enabled
+}
+
+// CheckCertificateRevocation returns a revokedCertificateError if the certificate has been revoked by its CA. Its OCSP responders are queried first, then its CRLs, until one of them reports its status. Certificates which name neither (e.g. those issued by most private CAs) are not checked.
+// Any other error means that the revocation status of the certificate could not be determined (e.g. its issuer could not be found, or its responders could not be reached.)
+func (r *SecretReconciler) CheckCertificateRevocation(ctx context.Context, certificateDetails *CertificateDetails) error {
+
+	log := log.FromContext(ctx)
+
+	certificate := certificateDetails.Certificate.x509
+	ocspURLs := httpURLs(certificate.OCSPServer)
+	crlURLs := httpURLs(certificate.CRLDistributionPoints)
+	if len(ocspURLs) == 0 && len(crlURLs) == 0 {
+		log.Info("Certificate names no OCSP responder or CRL: skipping revocation check.")
+		return nil
+	}
+
+	issuer, err := revocationIssuer(ctx, certificateDetails)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, url := range ocspURLs {
+		response, err := revocationCache.getOCSPResponse(ctx, url, certificate, issuer)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		switch response.Status {
+		case ocsp.Good:
+			return nil
+		case ocsp.Revoked:
+			return &revokedCertificateError{source: "OCSP", revokedAt: response.RevokedAt, reason: response.RevocationReason}
+		}
+		lastErr = fmt.Errorf("OCSP responder '%s' does not know the certificate.", url)
+	}
+
+	for _, url := range crlURLs {
+		revoked, err := revocationCache.getCRL(ctx, url, issuer)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		entry, ok := revoked[certificate.SerialNumber.String()]
+		if !ok {
+			return nil
+		}
+		return &revokedCertificateError{source: "CRL", revokedAt: entry.RevocationTime, reason: crlEntryReason(entry)}
+	}
+
+	return lastErr
+}
+
+// Returns the certificate that issued the Secret's certificate: the first intermediate of its chain (or its root, if it has no intermediates) if it was issued by them, otherwise the certificate fetched from its AIA 'CA Issuers' URLs.
+func revocationIssuer(ctx context.Context, certificateDetails *CertificateDetails) (*x509.Certificate, error) {
+
+	certificate := certificateDetails.Certificate.x509
+
+	candidates := []*CertificateWrapper{}
+	if len(certificateDetails.Intermediates) > 0 {
+		candidates = append(candidates, certificateDetails.Intermediates[0])
+	}
+	if certificateDetails.CA != nil {
+		candidates = append(candidates, certificateDetails.CA)
+	}
+	for _, candidate := range candidates {
+		if candidate.x509 != nil && certificate.CheckSignatureFrom(candidate.x509) == nil {
+			return candidate.x509, nil
+		}
+	}
+
+	issuer, err := fetchIssuingCertificate(ctx, certificate)
+	if err != nil {
+		return nil, fmt.Errorf("Could not find the certificate's issuer: %s", err)
+	}
+	return issuer, nil
+}
+
+// Returns the OCSP response for the certificate from the responder at the URL, from the cache if possible. Responses are cached until their next update (but for no more than revocationMaxCacheTTL.)
+func (c *revocationStatusCache) getOCSPResponse(ctx context.Context, url string, certificate *x509.Certificate, issuer *x509.Certificate) (*ocsp.Response, error) {
+
+	fingerprint := certificateFingerprint(certificate)
+	key := url + "|" + hex.EncodeToString(fingerprint[:])
+
+	c.mutex.Lock()
+	entry, ok := c.ocspEntries[key]
+	c.mutex.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.response, nil
+	}
+
+	ocspRequest, err := ocsp.CreateRequest(certificate, issuer, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create OCSP request: %s", err)
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(ocspRequest))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/ocsp-request")
+	request.Header.Set("Accept", "application/ocsp-response")
+
+	body, err := fetchRevocationData(request, ocspMaxResponseBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Could not query OCSP responder '%s': %s", url, err)
+	}
+	response, err := ocsp.ParseResponseForCert(body, certificate, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse response from OCSP responder '%s': %s", url, err)
+	}
+
+	c.mutex.Lock()
+	c.ocspEntries[key] = ocspCacheEntry{response: response, expires: revocationCacheExpiry(response.NextUpdate)}
+	c.mutex.Unlock()
+
+	return response, nil
+}
+
+// Returns the entries of the CRL at the URL (which must be signed by the issuer), from the cache if possible. CRLs are cached until their next update (but for no more than revocationMaxCacheTTL.)
+func (c *revocationStatusCache) getCRL(ctx context.Context, url string, issuer *x509.Certificate) (map[string]pkix.RevokedCertificate, error) {
+
+	c.mutex.Lock()
+	entry, ok := c.crlEntries[url]
+	c.mutex.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.revoked, nil
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	body, err := fetchRevocationData(request, crlMaxResponseBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Could not fetch CRL from '%s': %s", url, err)
+	}
+
+	crl, err := x509.ParseCRL(body)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse CRL from '%s': %s", url, err)
+	}
+	if err := issuer.CheckCRLSignature(crl); err != nil {
+		return nil, fmt.Errorf("CRL fetched from '%s' was not signed by '%s'.", url, issuer.Subject.CommonName)
+	}
+
+	revoked := map[string]pkix.RevokedCertificate{}
+	for _, revokedCertificate := range crl.TBSCertList.RevokedCertificates {
+		revoked[revokedCertificate.SerialNumber.String()] = revokedCertificate
+	}
+
+	c.mutex.Lock()
+	c.crlEntries[url] = crlCacheEntry{revoked: revoked, expires: revocationCacheExpiry(crl.TBSCertList.NextUpdate)}
+	c.mutex.Unlock()
+
+	return revoked, nil
+}
+
+// Sends the request, returning the body of the response (which must not exceed maxBytes.)
+func fetchRevocationData(request *http.Request, maxBytes int64) ([]byte, error) {
+
+	response, err := revocationHTTPClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d.", response.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > maxBytes {
+		return nil, errors.New("response too large.")
+	}
+
+	return body, nil
+}
+
+// Returns the time until which a revocation status, next updated at the specified time (or zero if unknown), is cached.
+func revocationCacheExpiry(nextUpdate time.Time) time.Time {
+	now := time.Now()
+	if nextUpdate.IsZero() || nextUpdate.Before(now) {
+		return now.Add(revocationCacheTTL)
+	}
+	if nextUpdate.After(now.Add(revocationMaxCacheTTL)) {
+		return now.Add(revocationMaxCacheTTL)
+	}
+	return nextUpdate
+}
+
+// Object identifier of the CRL entry extension holding the reason for revocation (RFC 5280, section 5.3.1.)
+var crlReasonCodeOID = []int{2, 5, 29, 21}
+
+// Returns the reason for revocation recorded in the CRL entry, or 'unspecified' if none is recorded.
+func crlEntryReason(entry pkix.RevokedCertificate) int {
+	for _, extension := range entry.Extensions {
+		// The reason is a DER-encoded ENUMERATED: tag 0x0a, length 1, value.
+		if extension.Id.Equal(crlReasonCodeOID) && len(extension.Value) == 3 && extension.Value[0] == 0x0a && extension.Value[1] == 1 {
+			return int(extension.Value[2])
+		}
+	}
+	return ocsp.Unspecified
+}
+
+// Returns the HTTP(S) URLs in the list.
+func httpURLs(urls []string) []string {
+	filtered := []string{}
+	for _, url := range urls {
+		if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+			filtered = append(filtered, url)
+		}
+	}
+	return filtered
+}
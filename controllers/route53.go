@@ -0,0 +1,146 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	acmtypes "github.com/aws/aws-sdk-go-v2/service/acm/types"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	route53types "github.com/aws/aws-sdk-go-v2/service/route53/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"Validitron/k8s-acm-certificate-agent/api/v1alpha1"
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+const (
+	// TTL (seconds) applied to DNS validation records published by the agent.
+	validationRecordTTL = 300
+)
+
+// Creates (or updates) the DNS validation records for an ACM certificate in the specified Route53 hosted zone.
+func upsertValidationRecords(ctx context.Context, cfg aws.Config, hostedZoneID string, records []v1alpha1.DNSValidationRecord) error {
+
+	if len(records) == 0 {
+		return nil
+	}
+
+	changes := []route53types.Change{}
+	for _, record := range records {
+		changes = append(changes, route53types.Change{
+			Action: route53types.ChangeActionUpsert,
+			ResourceRecordSet: &route53types.ResourceRecordSet{
+				Name:            aws.String(record.Name),
+				Type:            route53types.RRType(record.Type),
+				TTL:             aws.Int64(validationRecordTTL),
+				ResourceRecords: []route53types.ResourceRecord{{Value: aws.String(record.Value)}},
+			},
+		})
+	}
+
+	log.FromContext(ctx).Info(fmt.Sprintf("Publishing %d DNS validation record(s) to Route53 hosted zone '%s'...", len(changes), hostedZoneID))
+
+	// Route53 is a global service, so the configured region is irrelevant.
+	route53Client := route53.NewFromConfig(cfg)
+	_, err := route53Client.ChangeResourceRecordSets(ctx, &route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(hostedZoneID),
+		ChangeBatch: &route53types.ChangeBatch{
+			Comment: aws.String(fmt.Sprintf("ACM DNS validation records managed by %s.", global.PACKAGE_NAME)),
+			Changes: changes,
+		},
+	})
+
+	return err
+}
+
+// Returns the (unique) DNS validation records reported by ACM for the certificate.
+func extractValidationRecords(acmCertificate *acmtypes.CertificateDetail) []v1alpha1.DNSValidationRecord {
+
+	output := []v1alpha1.DNSValidationRecord{}
+	recordNames := []string{}
+	for _, domainValidation := range acmCertificate.DomainValidationOptions {
+		if domainValidation.ResourceRecord == nil || domainValidation.ResourceRecord.Name == nil || domainValidation.ResourceRecord.Value == nil {
+			continue
+		}
+		// Wildcard and apex domains share a validation record.
+		if containsString(recordNames, *domainValidation.ResourceRecord.Name) {
+			continue
+		}
+		recordNames = append(recordNames, *domainValidation.ResourceRecord.Name)
+		output = append(output, v1alpha1.DNSValidationRecord{
+			DomainName:       aws.ToString(domainValidation.DomainName),
+			Name:             *domainValidation.ResourceRecord.Name,
+			Type:             string(domainValidation.ResourceRecord.Type),
+			Value:            *domainValidation.ResourceRecord.Value,
+			ValidationStatus: string(domainValidation.ValidationStatus),
+		})
+	}
+
+	return output
+}
+
+// Returns the Route53 hosted zones selected for an ACMCertificateRequest, from its spec and its hosted zone annotation (comma-separated.)
+func selectedHostedZoneIDs(certificateRequest *v1alpha1.ACMCertificateRequest) []string {
+
+	candidates := []string{certificateRequest.Spec.HostedZoneID}
+	candidates = append(candidates, strings.Split(certificateRequest.Annotations[global.AGENT_HOSTED_ZONE_ID_ANNOTATION], ",")...)
+
+	output := []string{}
+	for _, hostedZoneID := range trimSpaceFromSliceElements(candidates) {
+		hostedZoneID = strings.TrimPrefix(hostedZoneID, "/hostedzone/")
+		if hostedZoneID != "" && !containsString(output, hostedZoneID) {
+			output = append(output, hostedZoneID)
+		}
+	}
+
+	return output
+}
+
+// Assigns each validation record to the selected hosted zone whose domain most closely encloses the record name. Returns the names of any records that could not be assigned.
+func assignHostedZones(ctx context.Context, cfg aws.Config, hostedZoneIDs []string, records []v1alpha1.DNSValidationRecord) ([]string, error) {
+
+	route53Client := route53.NewFromConfig(cfg)
+
+	hostedZoneNames := map[string]string{}
+	for _, hostedZoneID := range hostedZoneIDs {
+		output, err := route53Client.GetHostedZone(ctx, &route53.GetHostedZoneInput{Id: aws.String(hostedZoneID)})
+		if err != nil {
+			return nil, err
+		}
+		hostedZoneNames[hostedZoneID] = normalizeDNSName(aws.ToString(output.HostedZone.Name))
+	}
+
+	unassigned := []string{}
+	for i := range records {
+		recordName := normalizeDNSName(records[i].Name)
+		bestMatch := ""
+		for hostedZoneID, hostedZoneName := range hostedZoneNames {
+			if (recordName == hostedZoneName || strings.HasSuffix(recordName, "."+hostedZoneName)) && len(hostedZoneName) > len(hostedZoneNames[bestMatch]) {
+				bestMatch = hostedZoneID
+			}
+		}
+		records[i].HostedZoneID = bestMatch
+		if bestMatch == "" {
+			unassigned = append(unassigned, records[i].Name)
+		}
+	}
+
+	return unassigned, nil
+}
+
+// Lower-cases a DNS name and removes any trailing dot.
+func normalizeDNSName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
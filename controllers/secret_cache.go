@@ -0,0 +1,65 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+package controllers
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+)
+
+// Annotation recorded by 'kubectl apply', holding a copy of the applied object (including the data of Secrets.)
+const lastAppliedConfigurationAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// SecretCacheOptions returns the options of the manager's cache, which limit the memory used to cache Secrets (since every Secret in the cluster is otherwise held in the cache, including large Secrets such as Docker configs.)
+// The managed fields of all Secrets, and the data of Secrets which do not hold certificates (see isCertificateSecret), are not cached. If tlsSecretsOnly is true, only Secrets of type 'kubernetes.io/tls' are cached at all: Secrets of other types which are declared to hold a certificate, or name the data key holding it, are then ignored. If annotationCompat is true, version 1 agent annotations are cached under their current keys (see transformUpgradeAnnotations.)
+func SecretCacheOptions(tlsSecretsOnly bool, annotationCompat bool) cache.Options {
+
+	options := cache.Options{
+		TransformByObject: cache.TransformByObject{
+			&corev1.Secret{}: transformCachedSecret,
+		},
+	}
+
+	// The transform of Secrets replaces the default transform, so must also upgrade annotations.
+	if annotationCompat {
+		options.DefaultTransform = transformUpgradeAnnotations
+		options.TransformByObject[&corev1.Secret{}] = func(obj interface{}) (interface{}, error) {
+			obj, _ = transformUpgradeAnnotations(obj)
+			return transformCachedSecret(obj)
+		}
+	}
+
+	if tlsSecretsOnly {
+		options.SelectorsByObject = cache.SelectorsByObject{
+			&corev1.Secret{}: {Field: fields.OneTermEqualSelector(secretTypeField, string(corev1.SecretTypeTLS))},
+		}
+	}
+
+	return options
+}
+
+// Strips the fields of a Secret that the agent does not use before it is cached. Secrets which do not hold certificates (and do not hold the agent's finalizer) are cached without their data, and without the copy of their data recorded by 'kubectl apply'.
+func transformCachedSecret(obj interface{}) (interface{}, error) {
+
+	secret, ok := obj.(*corev1.Secret)
+	if !ok {
+		return obj, nil
+	}
+
+	secret.ManagedFields = nil
+
+	if !isCertificateSecret(secret) && !containsString(secret.Finalizers, secretFinalizerID) {
+		secret.Data = nil
+		secret.StringData = nil
+		delete(secret.Annotations, lastAppliedConfigurationAnnotation)
+	}
+
+	return secret, nil
+}
@@ -0,0 +1,73 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+func TestIsCertificateSecret(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		secretType  corev1.SecretType
+		annotations map[string]string
+		expected    bool
+	}{
+		{"TLS", corev1.SecretTypeTLS, nil, true},
+		{"Opaque", corev1.SecretTypeOpaque, nil, false},
+		{"Opaque declared to hold a certificate", corev1.SecretTypeOpaque, map[string]string{global.AGENT_CERTIFICATE_SECRET_ANNOTATION: "true"}, true},
+		{"Opaque declared not to hold a certificate", corev1.SecretTypeOpaque, map[string]string{global.AGENT_CERTIFICATE_SECRET_ANNOTATION: "false"}, false},
+		{"Opaque with invalid declaration", corev1.SecretTypeOpaque, map[string]string{global.AGENT_CERTIFICATE_SECRET_ANNOTATION: "yes"}, false},
+		{"Opaque with cert-key", corev1.SecretTypeOpaque, map[string]string{global.AGENT_CERT_KEY_ANNOTATION: "certificate.pem"}, true},
+		{"Opaque with pkcs12-key", corev1.SecretTypeOpaque, map[string]string{global.AGENT_PKCS12_KEY_ANNOTATION: "keystore.p12"}, true},
+		{"Docker config", corev1.SecretTypeDockerConfigJson, map[string]string{global.AGENT_ENABLED_ANNOTATION: "true"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Annotations: test.annotations}, Type: test.secretType}
+			if actual := isCertificateSecret(secret); actual != test.expected {
+				t.Errorf("isCertificateSecret is %t, expected %t.", actual, test.expected)
+			}
+		})
+	}
+}
+
+// The data of Opaque Secrets is only cached if they hold a certificate.
+func TestTransformCachedSecret(t *testing.T) {
+
+	for _, declared := range []string{"true", "false"} {
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "tls", Annotations: map[string]string{
+				global.AGENT_CERTIFICATE_SECRET_ANNOTATION: declared,
+				lastAppliedConfigurationAnnotation:         "{}",
+			}},
+			Type: corev1.SecretTypeOpaque,
+			Data: map[string][]byte{corev1.TLSCertKey: []byte("certificate"), corev1.TLSPrivateKeyKey: []byte("key")},
+		}
+
+		obj, err := transformCachedSecret(secret)
+		if err != nil {
+			t.Fatalf("Could not transform Secret: %s", err)
+		}
+		cached := obj.(*corev1.Secret)
+		if kept := len(cached.Data) == 2; kept != (declared == "true") {
+			t.Errorf("Secret with '%s' annotation '%s' was cached with %d data item(s).", global.AGENT_CERTIFICATE_SECRET_ANNOTATION, declared, len(cached.Data))
+		}
+		if _, kept := cached.Annotations[lastAppliedConfigurationAnnotation]; kept != (declared == "true") {
+			t.Errorf("Secret with '%s' annotation '%s' was cached with last-applied-configuration annotation %t.", global.AGENT_CERTIFICATE_SECRET_ANNOTATION, declared, kept)
+		}
+	}
+}
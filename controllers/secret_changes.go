@@ -0,0 +1,222 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// Annotations written by the agent to record the outcome of synchronization (rather than to configure it), which are therefore excluded from secretInputHash.
+var bookkeepingAnnotations = []string{
+	global.AGENT_CERTIFICATE_ARN_ANNOTATION,
+	global.AGENT_CERTIFICATE_DOMAIN_NAMES_ANNOTATION,
+	global.AGENT_CERTIFICATE_SERIAL_NUMBER_ANNOTATION,
+	global.AGENT_CERTIFICATE_EXPIRY_DATE_ANNOTATION,
+	global.AGENT_SYNC_STATUS_ANNOTATION,
+	global.AGENT_RETRY_COUNT_ANNOTATION,
+	global.AGENT_ACM_CERTIFICATES_ANNOTATION,
+	global.AGENT_CLOUDFRONT_CERTIFICATE_ARN_ANNOTATION,
+	global.AGENT_LISTENER_CERTIFICATE_ARNS_ANNOTATION,
+	global.AGENT_PARSE_FAILURE_ANNOTATION,
+	global.AGENT_DATA_HASH_ANNOTATION,
+	global.AGENT_CERTIFICATE_HASH_ANNOTATION,
+	global.AGENT_CONFIG_HASH_ANNOTATION,
+	global.AGENT_LEAF_CERTIFICATES_ANNOTATION,
+}
+
+// Returns true if the annotation configures the agent's handling of the Secret (i.e. is one of the agent's annotations, but not one of its bookkeeping annotations.)
+func isInputAnnotation(key string) bool {
+	if !strings.HasPrefix(key, global.ANNOTATION_PREFIX+"/") || strings.HasPrefix(key, global.AGENT_CERTIFICATE_ARN_ANNOTATION+".") {
+		return false
+	}
+	return !containsString(bookkeepingAnnotations, key)
+}
+
+// Returns a hash of everything that determines how the Secret is synchronized: its data, labels (see SecretReconciler.Selector) and the agent's annotations, excluding those recording the outcome of synchronization. The hash of a synchronized Secret is recorded in its data-hash annotation.
+func secretInputHash(secret *corev1.Secret) string {
+
+	hash := sha256.New()
+
+	writeSorted := func(section string, values map[string][]byte) {
+		keys := []string{}
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(hash, "%s|%s=%d:", section, key, len(values[key]))
+			hash.Write(values[key])
+		}
+	}
+
+	fmt.Fprintf(hash, "type=%s:", secret.Type)
+	writeSorted("data", secret.Data)
+	labels := map[string][]byte{}
+	for key, value := range secret.Labels {
+		labels[key] = []byte(value)
+	}
+	writeSorted("label", labels)
+	annotations := map[string][]byte{}
+	for key, value := range secret.Annotations {
+		if isInputAnnotation(key) {
+			annotations[key] = []byte(value)
+		}
+	}
+	writeSorted("annotation", annotations)
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Predicate passing updates to Secrets that may change the outcome of synchronization: those changing the Secret's data, labels or agent annotations since it was last synchronized (see secretInputHash), and deletion. Updates to other metadata (e.g. the agent's own bookkeeping annotations, or annotations of other tools) are skipped once the Secret has been synchronized. Periodic resyncs are always passed, so that drift in ACM is still corrected.
+// Updates changing only the retry-count annotation are always skipped, since the agent records each retry of a failing Secret (which would otherwise be retried at once, rather than with backoff.)
+var secretInputChangedPredicate = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+
+		secret, ok := e.ObjectNew.(*corev1.Secret)
+		if !ok {
+			return true
+		}
+
+		if e.ObjectOld.GetResourceVersion() == secret.ResourceVersion || !secret.DeletionTimestamp.IsZero() {
+			return true
+		}
+		if oldSecret, ok := e.ObjectOld.(*corev1.Secret); ok && onlyRetryCountChanged(oldSecret, secret) {
+			return false
+		}
+
+		// Secrets not yet synchronized have no recorded hash, so all their updates are passed.
+		return secret.Annotations[global.AGENT_DATA_HASH_ANNOTATION] != secretInputHash(secret)
+	},
+}
+
+// Returns true if the Secret differs from its previous version only in its retry-count annotation (and resource version.)
+func onlyRetryCountChanged(oldSecret *corev1.Secret, newSecret *corev1.Secret) bool {
+
+	if oldSecret.Annotations[global.AGENT_RETRY_COUNT_ANNOTATION] == newSecret.Annotations[global.AGENT_RETRY_COUNT_ANNOTATION] {
+		return false
+	}
+
+	oldCopy, newCopy := oldSecret.DeepCopy(), newSecret.DeepCopy()
+	for _, version := range []*corev1.Secret{oldCopy, newCopy} {
+		delete(version.Annotations, global.AGENT_RETRY_COUNT_ANNOTATION)
+		version.ResourceVersion = ""
+		version.ManagedFields = nil
+	}
+
+	return equality.Semantic.DeepEqual(oldCopy, newCopy)
+}
+
+// Returns the SHA-256 hash (in hex) of the Secret's certificate data: the data item holding its certificate (by default 'tls.crt', or its PKCS#12 bundle) and, if held separately, its intermediate chain. The hash of a synchronized Secret is recorded in its certificate-hash annotation.
+func certificateDataHash(secret *corev1.Secret) string {
+
+	certKey, _, chainKey := (&SecretReconciler{}).GetDataKeys(secret)
+	if pkcs12Key := strings.TrimSpace(secret.Annotations[global.AGENT_PKCS12_KEY_ANNOTATION]); pkcs12Key != "" {
+		certKey, chainKey = pkcs12Key, ""
+	}
+
+	hash := sha256.New()
+	hash.Write(secret.Data[certKey])
+	if chainKey != "" {
+		fmt.Fprintf(hash, "|%s:", chainKey)
+		hash.Write(secret.Data[chainKey])
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Interval between periodic resyncs (by default, that of controller-runtime.) Synchronized Secrets are re-verified against ACM if they have not been verified for half this interval, so that every resync re-verifies them (whatever its jitter.) Set by main.
+var ResyncInterval = 10 * time.Hour
+
+// Synchronized Secrets most recently verified against ACM by this process, keyed by namespaced name.
+var verifiedSecrets = &verifiedSecretCache{entries: map[types.NamespacedName]verifiedSecret{}}
+
+// verifiedSecretCache allows steady-state reconciles of synchronized Secrets (e.g. when the agent restarts, or when a Secret's certificate enters its renewal window) to make no AWS calls if neither the Secret's certificate (see certificateDataHash) nor anything else determining how it is synchronized has changed. Such Secrets are still re-verified against ACM at every periodic resync, so that drift in ACM is corrected.
+type verifiedSecretCache struct {
+	mutex   sync.Mutex
+	entries map[types.NamespacedName]verifiedSecret
+}
+
+type verifiedSecret struct {
+	key        string // See steadyStateKey.
+	verifiedAt time.Time
+}
+
+// Returns a hash of the Secret's inputs (including defaults taken from its Namespace, which its data-hash annotation excludes) and of the agent's configuration: its runtime configuration (see currentAgentConfig) and its settings (see agentSettings.) The key of a synchronized Secret is recorded in its config-hash annotation. It must be taken once Namespace defaults have been applied, and before the Secret is patched (which discards them.)
+func steadyStateKey(secret *corev1.Secret) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s|%+v|%s", secretInputHash(secret), currentAgentConfig(), agentSettings())))
+	return hex.EncodeToString(hash[:])
+}
+
+// Returns the settings of the agent process (set from its flags and environment) that determine how Secrets are synchronized: its default region and role, the AWS partition and endpoint, the tags applied to ACM certificates and the name of its cluster. These can only change when the agent is restarted.
+func agentSettings() string {
+	return fmt.Sprintf("region=%s,%s,%s|role=%s|partition=%s|endpoint=%s,%s|tags=%+v,%+v|cluster=%s",
+		AWSOverrides.Region, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"),
+		os.Getenv("AWS_ROLE_ARN"),
+		AWSPartition,
+		AWSOverrides.Endpoint, ACMEndpoint,
+		TagTemplates, OwnerTag,
+		ClusterName)
+}
+
+// Verified records that the Secret has been fully synchronized with ACM, with the inputs and configuration identified by the key (see steadyStateKey.)
+func (c *verifiedSecretCache) Verified(name types.NamespacedName, key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries[name] = verifiedSecret{key: key, verifiedAt: time.Now()}
+}
+
+// Forget discards the record of the Secret's verification (e.g. once it has been deleted.)
+func (c *verifiedSecretCache) Forget(name types.NamespacedName) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.entries, name)
+}
+
+// Unchanged returns true if the Secret is synchronized with its current certificate and annotations, so that AWS need not be called: its certificate-hash and data-hash annotations match its data and annotations (inputHash being taken before Namespace defaults were applied), its sync status is 'Synced', and it has been verified against ACM recently, with the same inputs and agent configuration (key, see steadyStateKey.)
+// Secrets not yet verified by this process (e.g. after a restart) are trusted on the strength of their annotations, and re-verified at the next resync, but only if their config-hash annotation shows that they were synchronized with the current key (so that Secrets are verified again if, for example, the agent's default region or tags changed while it was restarted.) Multi-leaf Secrets are never trusted, since their annotations do not show whether every leaf has been synchronized.
+func (c *verifiedSecretCache) Unchanged(secret *corev1.Secret, inputHash string, key string) bool {
+
+	if secret.Annotations[global.AGENT_DATA_HASH_ANNOTATION] != inputHash || secret.Annotations[global.AGENT_CERTIFICATE_HASH_ANNOTATION] != certificateDataHash(secret) {
+		return false
+	}
+	if syncStatus, ok := (&SecretReconciler{}).GetSyncStatus(secret); !ok || syncStatus.State != global.SYNC_STATE_SYNCED {
+		return false
+	}
+
+	name := types.NamespacedName{Namespace: secret.Namespace, Name: secret.Name}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[name]
+	if !ok {
+		if multiLeafEnabled(secret) || secret.Annotations[global.AGENT_CONFIG_HASH_ANNOTATION] != key {
+			return false
+		}
+		c.entries[name] = verifiedSecret{key: key, verifiedAt: time.Now()}
+		return true
+	}
+
+	return entry.key == key && time.Since(entry.verifiedAt) < ResyncInterval/2
+}
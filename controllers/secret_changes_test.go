@@ -0,0 +1,96 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// Returns a Secret annotated as synchronized, with the steady-state key it was synchronized with.
+func newTestSynchronizedSecret(t *testing.T) (*corev1.Secret, string) {
+	t.Helper()
+
+	key := newTestKey(t)
+	leaf := newTestRoot(t, "Test Root").issueLeaf(t, key, "www.example.test")
+	syncStatus, err := json.Marshal(SyncStatus{State: global.SYNC_STATE_SYNCED})
+	if err != nil {
+		t.Fatalf("Could not encode sync status: %s", err)
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "tls", Annotations: map[string]string{
+			global.AGENT_ENABLED_ANNOTATION:     "true",
+			global.AGENT_SYNC_STATUS_ANNOTATION: string(syncStatus),
+		}},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       []byte(testBundle(leaf)),
+			corev1.TLSPrivateKeyKey: []byte(testKeyPEM(t, key)),
+		},
+	}
+	stateKey := steadyStateKey(secret)
+	secret.Annotations[global.AGENT_DATA_HASH_ANNOTATION] = secretInputHash(secret)
+	secret.Annotations[global.AGENT_CERTIFICATE_HASH_ANNOTATION] = certificateDataHash(secret)
+	secret.Annotations[global.AGENT_CONFIG_HASH_ANNOTATION] = stateKey
+
+	return secret, stateKey
+}
+
+// Secrets first seen by the agent (e.g. after a restart) are only trusted if they were synchronized with the current agent configuration.
+func TestVerifiedSecretCacheFirstSeen(t *testing.T) {
+
+	secret, stateKey := newTestSynchronizedSecret(t)
+	inputHash := secretInputHash(secret)
+
+	cache := &verifiedSecretCache{entries: map[types.NamespacedName]verifiedSecret{}}
+	if !cache.Unchanged(secret, inputHash, stateKey) {
+		t.Errorf("Secret synchronized with the current configuration was not trusted.")
+	}
+
+	// The agent's tags changed while it was restarted.
+	previousTagTemplates := TagTemplates
+	defer func() { TagTemplates = previousTagTemplates }()
+	TagTemplates = append([]TagTemplate{{Key: "team", Value: "platform"}}, previousTagTemplates...)
+
+	cache = &verifiedSecretCache{entries: map[types.NamespacedName]verifiedSecret{}}
+	if cache.Unchanged(secret, inputHash, steadyStateKey(secret)) {
+		t.Errorf("Secret synchronized with a previous configuration was trusted.")
+	}
+
+	// Secrets synchronized before the config-hash annotation was recorded are verified once.
+	delete(secret.Annotations, global.AGENT_CONFIG_HASH_ANNOTATION)
+	cache = &verifiedSecretCache{entries: map[types.NamespacedName]verifiedSecret{}}
+	if cache.Unchanged(secret, inputHash, stateKey) {
+		t.Errorf("Secret without a config-hash annotation was trusted.")
+	}
+}
+
+// Secrets verified by this process are trusted until their key changes.
+func TestVerifiedSecretCacheVerified(t *testing.T) {
+
+	secret, stateKey := newTestSynchronizedSecret(t)
+	inputHash := secretInputHash(secret)
+	delete(secret.Annotations, global.AGENT_CONFIG_HASH_ANNOTATION)
+
+	cache := &verifiedSecretCache{entries: map[types.NamespacedName]verifiedSecret{}}
+	cache.Verified(types.NamespacedName{Namespace: secret.Namespace, Name: secret.Name}, stateKey)
+	if !cache.Unchanged(secret, inputHash, stateKey) {
+		t.Errorf("Verified Secret was not trusted.")
+	}
+	if cache.Unchanged(secret, inputHash, "changed") {
+		t.Errorf("Verified Secret was trusted with a different key.")
+	}
+}
@@ -11,9 +11,12 @@ Copyright Kit Huckvale 2022.
 package controllers
 
 import (
+	"bytes"
 	"context"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
@@ -24,25 +27,75 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
 	"github.com/aws/aws-sdk-go-v2/service/acm"
 	"github.com/aws/aws-sdk-go-v2/service/acm/types"
 	"github.com/google/uuid"
 	corev1 "k8s.io/api/core/v1"
 	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	ctrlbuilder "sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"software.sslmate.com/src/go-pkcs12"
 
+	"Validitron/k8s-acm-certificate-agent/api/v1alpha1"
 	"Validitron/k8s-acm-certificate-agent/global"
 )
 
+const (
+	// Interval at which Secrets holding certificates within the renewal window are re-evaluated until they are rotated.
+	renewalWindowCheckInterval = 24 * time.Hour
+)
+
+// ClusterName identifies the cluster in which the agent is running. If set, it is recorded in the ACM tags and source cluster annotation of imported certificates, so that Secrets replicated into other clusters re-use the existing ACM certificate. Set before reconcilers are registered with the manager.
+var ClusterName = ""
+
 // SecretReconciler uploads and synchronizes SSL certificates contained in K8S Secrets with ACM.
 type SecretReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+
+	Recorder record.EventRecorder
+
+	// If true, ACM certificates are deleted alongside Secrets annotated with a 'Delete' delete-policy.
+	EnableCertificateDeletion bool
+
+	// Maximum time for which the agent's finalizer delays deletion of a Secret while its ACM certificates are cleaned up (see FinalizeSecret.) Defaults to 5 minutes.
+	FinalizerTimeout time.Duration
+
+	// Maximum number of objects reconciled in parallel (default 1.)
+	MaxConcurrentReconciles int
+
+	// Delay before the first retry of an object whose reconciliation fails (doubling on each subsequent failure.) Defaults to 1 second.
+	RequeueDelay time.Duration
+
+	// Retries of failed objects, parking those that exceed MaxRetries. Set by SetupWithManager.
+	retries *retryLimiter
+
+	// Creates the ACMService used to synchronize certificates with a region (default NewAWSACMService.) Replace with e.g. FakeACMService for testing, or to target an alternate certificate store.
+	ACMServiceFactory ACMServiceFactory
+
+	// If true, imports which would exceed the ACM quotas on imported certificates are refused (see CheckImportQuotas.)
+	EnableQuotaChecks bool
+
+	// Creates the ServiceQuotasService used to check ACM quotas in a region (default NewAWSServiceQuotasService.)
+	ServiceQuotasServiceFactory ServiceQuotasServiceFactory
+
+	// If true, all Secrets are re-evaluated when the ACMAgentConfig changes.
+	EnableAgentConfig bool
+
+	// Secrets whose labels match this selector are synchronized with ACM without the 'enabled' annotation (unless it is set to 'false'.) Nil if Secrets are enabled by annotation only.
+	Selector labels.Selector
 }
 
 type CertificateDetails struct {
@@ -50,10 +103,15 @@ type CertificateDetails struct {
 	Namespace      *string
 	Certificate    *CertificateWrapper
 	Intermediates  []*CertificateWrapper
-	CA             *CertificateWrapper
+	CA             *CertificateWrapper // Root certificate, if included with the certificate. Used for local verification only (never imported into ACM.)
 	PrivateKey     []byte
 	CertificateArn *string
 	CreatedAt      *string
+	ImportCount    int                      // Number of imports of the ACM certificate by the agent within the past 365 days (including any just made), if it was imported.
+	Tags           []TagTemplate            // Tags requested by the Secret's tags annotation, applied in addition to the configured tags.
+	ACMCertificate *types.CertificateDetail // ACM's description of the certificate with CertificateArn, if it was described during synchronization (and has not since been re-imported.)
+
+	BundleReordered bool // Whether the certificates held by the Secret were out of order (or duplicated), so that the chain imported into ACM is not their order as held.
 }
 
 type CertificateWrapper struct {
@@ -62,31 +120,159 @@ type CertificateWrapper struct {
 }
 
 type SecretAnnotations struct {
-	CertificateArn string
-	SerialNumber   string
-	ExpiryDate     string
-	DomainNames    string
+	SourceCluster            string
+	CertificateArn           string
+	SerialNumber             string
+	ExpiryDate               string
+	DomainNames              string
+	RegionalCertificateArns  map[string]string
+	CloudFrontCertificateArn string
+	SyncStatus               string
+	ACMCertificates          string
+	DataHash                 string
+	CertificateHash          string
+	ConfigHash               string
+}
+
+// SyncStatus summarises the outcome of the most recent attempt to synchronize a Secret with ACM. It is recorded (as JSON) in the Secret's sync-status annotation, from which CertificateReconciler derives the status conditions of cert-manager Certificates.
+type SyncStatus struct {
+	State          string `json:"state"`
+	CertificateArn string `json:"certificateArn,omitempty"`
+	LastImportTime string `json:"lastImportTime,omitempty"`
+	Message        string `json:"message,omitempty"`
+}
+
+// ACMCertificateRecord describes the ACM certificate holding the Secret's certificate in one ACM destination (AWS account and region.) Records for all destinations are kept (as JSON) in the Secret's acm-certificates annotation, which (unlike the flat certificate-arn annotations) can describe several destinations.
+type ACMCertificateRecord struct {
+	Account        string `json:"account"`
+	Region         string `json:"region"`
+	CertificateArn string `json:"certificateArn"`
+	SerialNumber   string `json:"serialNumber,omitempty"`
+	Expires        string `json:"expires,omitempty"`
+	LastImportTime string `json:"lastImportTime,omitempty"`
+
+	// Health of the ACM certificate, as described by ACM when the Secret was last synchronized (see SecretReconciler.RecordACMCertificateHealth.)
+	Status             string   `json:"status,omitempty"`
+	RenewalEligibility string   `json:"renewalEligibility,omitempty"`
+	KeyAlgorithm       string   `json:"keyAlgorithm,omitempty"`
+	InUseBy            []string `json:"inUseBy,omitempty"`
+}
+
+// Parses the JSON value of an acm-certificates annotation. Returns nil if the value is absent or malformed.
+func parseACMCertificateRecords(value string) []ACMCertificateRecord {
+	records := []ACMCertificateRecord{}
+	if value == "" || json.Unmarshal([]byte(value), &records) != nil {
+		return nil
+	}
+	return records
+}
+
+// Returns the ID of the AWS account targeted by the Secret (i.e. that of the IAM role it assumes), or an empty string if the agent's own account is targeted.
+func targetAccount(secret *corev1.Secret) string {
+	if parsedArn, err := arn.Parse(effectiveRoleArn(secret.Annotations[global.AGENT_ASSUME_ROLE_ARN_ANNOTATION])); err == nil {
+		return parsedArn.AccountID
+	}
+	return ""
+}
+
+// Returns true if the Secret holds a certificate which the agent can process: either a TLS Secret, or a Secret (e.g. of type Opaque) which is declared to hold a certificate, or names the data key holding its certificate or PKCS#12 bundle.
+func isCertificateSecret(secret *corev1.Secret) bool {
+	declared, _ := strconv.ParseBool(strings.TrimSpace(secret.Annotations[global.AGENT_CERTIFICATE_SECRET_ANNOTATION]))
+	return secret.Type == corev1.SecretTypeTLS || declared ||
+		strings.TrimSpace(secret.Annotations[global.AGENT_CERT_KEY_ANNOTATION]) != "" ||
+		strings.TrimSpace(secret.Annotations[global.AGENT_PKCS12_KEY_ANNOTATION]) != ""
+}
+
+// Returns the configured ACMServiceFactory, defaulting to the ACM API.
+func (r *SecretReconciler) acmServiceFactory() ACMServiceFactory {
+	if r.ACMServiceFactory == nil {
+		return NewAWSACMService
+	}
+	return r.ACMServiceFactory
+}
+
+// Returns the ServiceQuotasService used to check ACM quotas in the region, or nil if quota checks are disabled.
+func (r *SecretReconciler) serviceQuotasService(cfg aws.Config, region string) ServiceQuotasService {
+	if !r.EnableQuotaChecks {
+		return nil
+	}
+	if r.ServiceQuotasServiceFactory == nil {
+		return NewAWSServiceQuotasService(cfg, region)
+	}
+	return r.ServiceQuotasServiceFactory(cfg, region)
 }
 
 func (r *SecretReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.retries = newRetryLimiter("secret", r.RequeueDelay)
+	r.Client = namespaceDefaultsClient{Client: r.Client}
+
 	// Tells the controller which object type this reconciler will handle.
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.Secret{}).
-		WithEventFilter(predicate.NewPredicateFuncs(func(obj client.Object) bool {
+	builder := ctrl.NewControllerManagedBy(mgr).
+		Named("secret").
+		For(&corev1.Secret{}, ctrlbuilder.WithPredicates(predicate.NewPredicateFuncs(func(obj client.Object) bool {
 
-			// Only handle Secrets of type 'kubernetes.io/tls'
+			// Only handle Secrets of type 'kubernetes.io/tls', or that are declared to hold a certificate or name the data key holding it (or that hold the agent's finalizer, which must be removed.)
 			secret, ok := obj.(*corev1.Secret)
 			if ok {
-				ok = (secret.Type == corev1.SecretTypeTLS)
+				ok = isCertificateSecret(secret) || containsString(secret.Finalizers, secretFinalizerID)
 			}
 
 			return ok
 
-		})).
+		}), secretInputChangedPredicate))
+
+	if err := indexSecretsByType(mgr); err != nil {
+		return err
+	}
+
+	// Changes to the defaults set on a Namespace (e.g. enrolling the namespace) trigger reconciliation of the Secrets within it.
+	builder = builder.Watches(&source.Kind{Type: &corev1.Namespace{}}, handler.EnqueueRequestsFromMapFunc(r.FindSecretsForNamespace), ctrlbuilder.WithPredicates(namespaceDefaultsChangedPredicate))
+
+	// Changes to the agent configuration (e.g. target regions, dry run) trigger reconciliation of all Secrets.
+	if r.EnableAgentConfig {
+		builder = builder.Watches(&source.Kind{Type: &v1alpha1.ACMAgentConfig{}}, handler.EnqueueRequestsFromMapFunc(r.FindSecretsForAgentConfig), ctrlbuilder.WithPredicates(predicate.GenerationChangedPredicate{}))
+	}
+
+	return builder.
+		WithOptions(controller.Options{RateLimiter: r.retries.rateLimiter, MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
 		WithLogConstructor(buildLogConstructor(mgr, "secret-reconciler", "(core)", "secret")). // When multiple controllers running with a single manager, the log auto-constructor does not work. Therefore we must do manually.
 		Complete(r)
 }
 
+// FindSecretsForAgentConfig maps the ACMAgentConfig to all Secrets holding certificates.
+func (r *SecretReconciler) FindSecretsForAgentConfig(obj client.Object) []reconcile.Request {
+
+	if obj.GetName() != v1alpha1.ACMAgentConfigName {
+		return nil
+	}
+
+	secrets, err := listTLSSecrets(context.TODO(), r.Client)
+	if err != nil {
+		return nil
+	}
+
+	requests := []reconcile.Request{}
+	for _, secret := range secrets {
+		requests = append(requests, reconcile.Request{NamespacedName: k8stypes.NamespacedName{Namespace: secret.Namespace, Name: secret.Name}})
+	}
+	return requests
+}
+
+// FindSecretsForNamespace maps a Namespace to the Secrets holding certificates within it.
+func (r *SecretReconciler) FindSecretsForNamespace(obj client.Object) []reconcile.Request {
+
+	secrets, err := listTLSSecrets(context.TODO(), r.Client, client.InNamespace(obj.GetName()))
+	if err != nil {
+		return nil
+	}
+
+	requests := []reconcile.Request{}
+	for _, secret := range secrets {
+		requests = append(requests, reconcile.Request{NamespacedName: k8stypes.NamespacedName{Namespace: secret.Namespace, Name: secret.Name}})
+	}
+	return requests
+}
+
 func (r *SecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 
 	log := log.FromContext(ctx)
@@ -95,69 +281,601 @@ func (r *SecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 	if err := r.Get(ctx, req.NamespacedName, secret); err != nil {
 		if !k8serr.IsNotFound(err) {
 			log.Error(err, "Unable to retrieve Secret.")
+		} else {
+			forgetCertificateMetrics(req.Namespace, req.Name)
+			verifiedSecrets.Forget(req.NamespacedName)
 		}
-		return ctrl.Result{RequeueAfter: defaultRequeueLatency}, client.IgnoreNotFound(err)
+		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
-	log.Info(fmt.Sprintf("Processing Secret %s...", req.NamespacedName))
+	log.V(1).Info(fmt.Sprintf("Processing Secret %s...", req.NamespacedName))
 
-	if secret.Type != corev1.SecretTypeTLS {
+	// The recorded input hash excludes defaults taken from the Secret's Namespace, since changes to these are detected by watching Namespaces (see secretInputChangedPredicate.)
+	inputHash := secretInputHash(secret)
+	if err := applyNamespaceDefaults(ctx, r.Client, secret); err != nil {
+		log.Error(err, "Unable to retrieve Namespace.")
+		return ctrl.Result{}, err
+	}
+	stateKey := steadyStateKey(secret)
+
+	// Changes made to ACM are recorded in the audit trail against this object.
+	ctx = withAuditSubject(ctx, "Secret", secret)
+
+	// The agent's finalizer delays deletion until ACM has been cleaned up, even if the Secret is no longer managed.
+	if !secret.ObjectMeta.DeletionTimestamp.IsZero() && containsString(secret.Finalizers, secretFinalizerID) {
+		return r.FinalizeSecret(ctx, secret)
+	}
+
+	if !isCertificateSecret(secret) {
 		log.Info("Secret is not a TLS certificate: aborting.")
-		return ctrl.Result{}, nil
+		return ctrl.Result{}, client.IgnoreNotFound(r.ReconcileFinalizer(ctx, secret, false))
+	}
+
+	if !namespaceSynchronized(secret.Namespace) {
+		log.Info(fmt.Sprintf("Namespace '%s' is excluded by the agent configuration: aborting.", secret.Namespace))
+		forgetCertificateMetrics(secret.Namespace, secret.Name)
+		return ctrl.Result{}, client.IgnoreNotFound(r.ReconcileFinalizer(ctx, secret, false))
 	}
 
-	// Object is marked for deletion - nothing to do (the operator never removes synced ACM certificates.)
+	// Object is marked for deletion, without the agent's finalizer (e.g. it is delayed by another controller's finalizer.) Unless deletion is enabled and requested, there is nothing to do (by default, the operator never removes synced ACM certificates.)
 	if !secret.ObjectMeta.DeletionTimestamp.IsZero() {
-		log.Info("Secret is marked for deletion: nothing to do.")
+
+		if !r.EnableCertificateDeletion || !hasDeletePolicy(secret.Annotations) {
+			log.Info("Secret is marked for deletion: nothing to do.")
+			return ctrl.Result{}, nil
+		}
+
+		if err := r.CleanUpDeletedSecret(ctx, secret); err != nil {
+			return requeueWithBackoff(err)
+		}
 		return ctrl.Result{}, nil
 	}
 
-	// Detect if secret is annotated to enable ACM certificate management.
-	annotationValue, agentEnabled := secret.Annotations[global.AGENT_ENABLED_ANNOTATION]
-	if agentEnabled {
-		agentEnabled, _ = strconv.ParseBool(annotationValue)
+	// Detect if secret is annotated (or labelled) to enable ACM certificate management.
+	if !r.AgentEnabled(secret) {
+		log.Info("Secret is not annotated (or labelled) to use certificate agent: aborting.")
+		forgetCertificateMetrics(secret.Namespace, secret.Name)
+		return ctrl.Result{}, client.IgnoreNotFound(r.ReconcileFinalizer(ctx, secret, false))
+		// NB that if a user manually clears the secret acm-certificate-agent annotations, but the cert-manager certificate still has an 'acm-certificate-agent/enabled' annotation, then eventually the secret will be reconfigured (via certificate_controller) as agent-managed (and decorated with the appropriate annotations.) This happens because operators periodically run even if there are no changes to the target manifests.
 	}
-	if !agentEnabled {
-		log.Info("Secret is not annotated to use certificate agent: aborting.")
+
+	// Secrets whose retries have been exhausted (or which ACM has rejected) are not synchronized again until they change.
+	if r.retries.Parked(req, secret.ResourceVersion) {
+		log.Info("Secret is parked (retries exhausted, or certificate rejected by ACM): nothing to do.")
 		return ctrl.Result{}, nil
-		// NB that if a user manually clears the secret acm-certificate-agent annotations, but the cert-manager certificate still has an 'acm-certificate-agent/enabled' annotation, then eventually the secret will be reconfigured (via certificate_controller) as agent-managed (and decorated with the appropriate annotations.) This happens because operators periodically run even if there are no changes to the target manifests.
+	}
+	if r.retries.Exhausted(req) {
+		log.Info(retriesExhaustedMessage())
+		r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonRetriesExhausted, retriesExhaustedMessage())
+		r.RecordSyncStatus(ctx, secret, global.SYNC_STATE_FAILED, retriesExhaustedMessage())
+		r.retries.Park(req, secret.ResourceVersion) // Read after the sync status is recorded, so that recording it does not end the parking.
+		return ctrl.Result{}, nil
+	}
+
+	// Certificates that could not be parsed are not re-parsed until the Secret's data changes.
+	if r.HasUnchangedParseFailure(secret) {
+		log.V(1).Info("Certificate could not be parsed and the Secret's data is unchanged: nothing to do.")
+		return ctrl.Result{}, nil
+	}
+
+	if err := r.ReconcileFinalizer(ctx, secret, r.NeedsFinalizer(secret)); err != nil {
+		log.Error(err, "Unable to update Secret finalizer.")
+		return requeueWithBackoff(err)
 	}
 
-	// Parse out leaf certificate, intermediates chain and private key from the K8s Secret.
-	certificateDetails, err := r.ParseCertificateDetails(secret)
+	// Parse out leaf certificate, intermediates chain and private key from the K8s Secret. Each leaf of a multi-leaf Secret is parsed separately: the first is synchronized as the Secret's certificate, and the remainder by SyncLeafCertificates.
+	var certificateDetails CertificateDetails
+	var err error
+	additionalLeaves := []CertificateDetails{}
+	if multiLeafEnabled(secret) {
+		var leaves []CertificateDetails
+		if leaves, err = r.ParseLeafCertificates(secret); err == nil {
+			certificateDetails, additionalLeaves = leaves[0], leaves[1:]
+		}
+	} else {
+		certificateDetails, err = r.ParseCertificateDetails(secret)
+	}
+	var unsupportedKeyErr *unsupportedKeyError
+	if errors.As(err, &unsupportedKeyErr) {
+		log.Error(err, "Unsupported private key: aborting.")
+		r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonUnsupportedKey, unsupportedKeyErr.Error())
+		r.RecordSyncStatus(ctx, secret, global.SYNC_STATE_FAILED, unsupportedKeyErr.Error())
+		return ctrl.Result{}, nil
+	}
+	var keyMismatchErr *keyMismatchError
+	if errors.As(err, &keyMismatchErr) {
+		log.Error(err, "Private key does not match certificate: aborting.")
+		keyMismatchesTotal.WithLabelValues(secret.Namespace).Inc()
+		r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonKeyMismatch, keyMismatchErr.Error())
+		r.RecordSyncStatus(ctx, secret, global.SYNC_STATE_FAILED, "Private key does not match certificate.")
+		return ctrl.Result{}, nil
+	}
 	if err != nil {
 		log.Error(err, "Could not parse certificate: aborting.")
+		r.RecordParseFailure(ctx, secret, err)
 		return ctrl.Result{}, nil
 	}
+	r.ClearParseFailure(ctx, secret)
+
+	recordCertificateExpiry(secret.Namespace, secret.Name, certificateDetails.Certificate.x509.NotAfter)
+	recordCertificateMetrics(secret.Namespace, secret.Name, certificateDetails.Certificate.x509, parseACMCertificateRecords(secret.Annotations[global.AGENT_ACM_CERTIFICATES_ANNOTATION]))
 
 	// Check that certificate is in date.
 	if certificateDetails.Certificate.x509.NotBefore.After(time.Now()) {
 		log.Error(err, "Certificate is not yet valid: aborting.")
+		r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonInvalidCertificate, "Certificate is not yet valid.")
+		r.RecordSyncStatus(ctx, secret, global.SYNC_STATE_FAILED, "Certificate is not yet valid.")
 		return ctrl.Result{}, nil
 	}
 	if certificateDetails.Certificate.x509.NotAfter.Before(time.Now()) {
 		log.Error(err, "Certificate has expired: aborting.")
+		r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonInvalidCertificate, "Certificate has expired.")
+		r.RecordSyncStatus(ctx, secret, global.SYNC_STATE_FAILED, "Certificate has expired.")
 		return ctrl.Result{}, nil
 	}
 
+	// Additional ACM tags requested for this Secret (e.g. on its cert-manager Certificate.)
+	if tagsAnnotation := secret.Annotations[global.AGENT_TAGS_ANNOTATION]; tagsAnnotation != "" {
+		certificateDetails.Tags, err = ParseTagTemplates(tagsAnnotation)
+		if err != nil {
+			log.Error(err, "Invalid tags annotation: aborting.")
+			r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonInvalidAnnotation, fmt.Sprintf("Invalid '%s' annotation: %s", global.AGENT_TAGS_ANNOTATION, err))
+			r.RecordSyncStatus(ctx, secret, global.SYNC_STATE_FAILED, fmt.Sprintf("Invalid '%s' annotation.", global.AGENT_TAGS_ANNOTATION))
+			return ctrl.Result{}, nil
+		}
+	}
+	for i := range additionalLeaves {
+		additionalLeaves[i].Tags = certificateDetails.Tags
+	}
+
+	syncStart := time.Now()
+	defer func() {
+		syncDurationSeconds.WithLabelValues(secret.Namespace).Observe(time.Since(syncStart).Seconds())
+	}()
+
+	// If requested, fetch any intermediates missing from the Secret. If this fails, the certificate is imported with the chain it has (and the chain is completed on a later reconcile.)
+	if fetchChainEnabled(secret) {
+		if _, err := r.CompleteCertificateChain(ctx, &certificateDetails); err != nil {
+			log.Error(err, "Could not fetch missing intermediates.")
+			r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonChainIncomplete, fmt.Sprintf("Could not fetch missing intermediates: %s", err))
+		}
+	}
+
+	// If requested, refuse to import a certificate that its CA has revoked (e.g. so that it is not attached to public load balancers.) If its revocation status cannot be determined, the import proceeds (so that an unreachable OCSP responder does not block renewals.)
+	if checkRevocationEnabled(secret) {
+		err := r.CheckCertificateRevocation(ctx, &certificateDetails)
+		var revokedErr *revokedCertificateError
+		if errors.As(err, &revokedErr) {
+			log.Info(fmt.Sprintf("%s Aborting.", revokedErr.Error()))
+			recordCertificateRevocation(secret.Namespace, secret.Name, true)
+			r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonRevoked, revokedErr.Error())
+			r.RecordSyncStatus(ctx, secret, global.SYNC_STATE_REVOKED, revokedErr.Error())
+			return ctrl.Result{}, nil
+		}
+		recordCertificateRevocation(secret.Namespace, secret.Name, false)
+		if err != nil {
+			log.Error(err, "Could not determine revocation status of certificate.")
+			revocationCheckFailuresTotal.WithLabelValues(secret.Namespace).Inc()
+			r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonRevocationCheckFailed, fmt.Sprintf("Could not determine revocation status of certificate: %s", err))
+		}
+	} else {
+		recordCertificateRevocation(secret.Namespace, secret.Name, false)
+	}
+
+	// Steady state: the Secret is synchronized with its current certificate and nothing else has changed, so ACM need not be consulted.
+	if verifiedSecrets.Unchanged(secret, inputHash, stateKey) {
+		log.V(1).Info("Secret is synchronized and unchanged since it was last verified against ACM: nothing to do.")
+		return r.CheckRenewalWindow(ctx, secret, renewalNotAfter(certificateDetails, additionalLeaves)), nil
+	}
+
+	// Refuse certificates that ACM would reject, describing why (rather than reporting ACM's ValidationException), and warn of those that clients may reject.
+	for _, details := range append([]CertificateDetails{certificateDetails}, additionalLeaves...) {
+		warnings, err := r.CheckACMLimits(&details)
+		var limitErr *acmLimitError
+		if errors.As(err, &limitErr) {
+			log.Info(fmt.Sprintf("%s Aborting.", limitErr.Error()))
+			r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonACMLimitExceeded, limitErr.Error())
+			r.RecordSyncStatus(ctx, secret, global.SYNC_STATE_FAILED, limitErr.Error())
+			return ctrl.Result{}, nil
+		}
+		for _, warning := range warnings {
+			log.Info(warning)
+			r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonACMLimitWarning, warning)
+		}
+	}
+
 	// Set up AWS connection.
-	// The AWS go library automatically retrieves region, service account-linked role ARN and web identity token from environment variables. See https://aws.github.io/aws-sdk-go-v2/docs/configuring-sdk/
-	// These will be automatically set for the pod in which the operator is running as long as the K8s service account is configured appropriately, see the project README and optionally https://docs.aws.amazon.com/eks/latest/userguide/specify-service-account-role.html
-	cfg, err := config.LoadDefaultConfig(context.TODO())
+	cfg, err := loadAWSConfig(ctx, secret.Annotations[global.AGENT_ASSUME_ROLE_ARN_ANNOTATION])
+	var credentialsErr *awsCredentialsError
+	if errors.As(err, &credentialsErr) {
+		// Not the Secret's fault (and already logged by CheckAWSCredentials), so re-check once credentials are next checked, rather than failing (and retrying) every Secret.
+		r.RecordSyncStatus(ctx, secret, global.SYNC_STATE_PENDING, "Waiting for the agent's AWS credentials to become available.")
+		return ctrl.Result{RequeueAfter: awsCredentialsCheckInterval}, nil
+	}
 	if err != nil {
 		log.Error(err, "Failed to load AWS configuration.")
+		r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonACMError, fmt.Sprintf("Failed to load AWS configuration: %s", err))
+		r.RecordRetrySyncStatus(ctx, secret, global.SYNC_STATE_FAILED, "Failed to load AWS configuration.")
+		return ctrl.Result{}, err
+	}
+
+	// Determine the ACM region(s) into which the certificate should be imported. Unless the Secret specifies otherwise, this is the region in which the agent is running.
+	regions, hasRegionsAnnotation := r.GetTargetRegions(secret, cfg.Region)
+	// Credentials are only valid within a single partition, so regions of other partitions (e.g. 'us-east-1' for an agent in 'us-gov-west-1') cannot be targeted.
+	regions, excludedRegions := partitionRegions(regions, cfg.Region)
+	if len(excludedRegions) > 0 {
+		message := fmt.Sprintf("Ignoring region(s) '%s' outside AWS partition '%s'.", strings.Join(excludedRegions, ", "), agentPartition(cfg.Region))
+		log.Info(message)
+		r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonPartitionMismatch, message)
+	}
+	if usedForCloudFront(secret) && cloudFrontRegion(agentPartition(cfg.Region)) == "" {
+		log.Info(fmt.Sprintf("CloudFront does not use ACM certificates in AWS partition '%s': ignoring the '%s' annotation.", agentPartition(cfg.Region), global.AGENT_USE_FOR_ANNOTATION))
+	}
+	if len(regions) == 0 {
+		err := errors.New("No target AWS region could be determined.")
+		log.Error(err, fmt.Sprintf("Set the '%s' annotation or configure a default region for the agent: aborting.", global.AGENT_REGIONS_ANNOTATION))
+		r.RecordSyncStatus(ctx, secret, global.SYNC_STATE_FAILED, err.Error())
+		return ctrl.Result{}, nil
+	}
+
+	// Secrets replicated from another cluster (e.g. by kubed or reflector) carry that cluster's annotations. These re-use the ACM certificate imported by the source cluster rather than importing a duplicate.
+	sourceCluster := secret.Annotations[global.AGENT_SOURCE_CLUSTER_ANNOTATION]
+	isReplica := sourceCluster != "" && sourceCluster != ClusterName
+	if isReplica {
+		log.Info(fmt.Sprintf("Secret was replicated from cluster '%s': re-using existing ACM certificate(s).", sourceCluster))
+	}
+
+	annotationSet := SecretAnnotations{
+		SourceCluster:           sourceCluster,
+		SerialNumber:            r.FormatX509SerialNumber(certificateDetails.Certificate.x509.SerialNumber),
+		ExpiryDate:              certificateDetails.Certificate.x509.NotAfter.Format(global.ISO_8601_FORMAT),
+		DomainNames:             strings.Join(r.ExtractCertificateDomains(certificateDetails.Certificate.x509), ", "),
+		RegionalCertificateArns: map[string]string{},
+	}
+	if !isReplica && ClusterName != "" {
+		annotationSet.SourceCluster = ClusterName
+	}
+
+	shouldImportToACM := false
+	previousRecords := parseACMCertificateRecords(secret.Annotations[global.AGENT_ACM_CERTIFICATES_ANNOTATION])
+	records := []ACMCertificateRecord{}
+
+	for _, region := range regions {
+
+		regionalCertificateDetails := certificateDetails
+		regionalCertificateDetails.CertificateArn = r.GetRegionalCertificateArn(secret, region)
+		regionalCertificateDetails.CreatedAt = nil
+		regionalCertificateDetails.ACMCertificate = nil
+
+		regionalCtx := ctrl.LoggerInto(ctx, log.WithValues("region", region))
+		imported := false
+
+		// An ARN belonging to another region or account cannot be found in the ACM region targeted, and would otherwise be re-imported.
+		if regionalCertificateDetails.CertificateArn != nil {
+			if err := checkCertificateArn(*regionalCertificateDetails.CertificateArn, region, targetAccount(secret)); err != nil {
+				log.Info(err.Error())
+				r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonCertificateArnMismatch, err.Error())
+				r.RecordSyncStatus(ctx, secret, global.SYNC_STATE_FAILED, err.Error())
+				return ctrl.Result{}, nil
+			}
+		}
+
+		// If the Secret has already been synchronized with its current certificate, any import that is now required is the result of an out-of-band change in ACM (e.g. the certificate was deleted or re-imported by hand.)
+		previouslySynced := regionalCertificateDetails.CertificateArn != nil && r.AnnotationMatches(secret, global.AGENT_CERTIFICATE_SERIAL_NUMBER_ANNOTATION, annotationSet.SerialNumber)
+		if isReplica {
+			found, err := r.VerifyReplicatedCertificate(regionalCtx, r.acmServiceFactory()(cfg, region), &regionalCertificateDetails)
+			if err != nil {
+				r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonACMError, fmt.Sprintf("ACM certificate lookup failed in region '%s': %s", region, err))
+				r.RecordRetrySyncStatus(ctx, secret, global.SYNC_STATE_FAILED, fmt.Sprintf("ACM certificate lookup failed in region '%s'.", region))
+				return requeueWithBackoff(err)
+			}
+			if !found {
+				// The source cluster has not yet imported this certificate (or its annotations have not yet been replicated.)
+				log.Info(fmt.Sprintf("No ACM certificate matching the replicated Secret was found in region '%s': will retry.", region))
+				r.RecordRetrySyncStatus(ctx, secret, global.SYNC_STATE_PENDING, fmt.Sprintf("Waiting for cluster '%s' to import the certificate into ACM region '%s'.", sourceCluster, region))
+				return requeueWithBackoff(nil)
+			}
+		} else {
+			indexScope := acmIndexScope(secret.Annotations[global.AGENT_ASSUME_ROLE_ARN_ANNOTATION], region)
+			quotaClient := r.serviceQuotasService(cfg, region)
+			imported, err = r.SyncCertificateWithACM(regionalCtx, r.acmServiceFactory()(cfg, region), quotaClient, indexScope, &regionalCertificateDetails)
+			var notOwnedErr *certificateNotOwnedError
+			if errors.As(err, &notOwnedErr) {
+				// Retrying will not help until the ACM certificate is re-tagged or the ARN annotation is changed.
+				r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonNotOwned, notOwnedErr.Error())
+				r.RecordSyncStatus(ctx, secret, global.SYNC_STATE_FAILED, notOwnedErr.Error())
+				r.NotifyImportFailed(regionalCtx, secret, region, notOwnedErr.Error())
+				return ctrl.Result{}, nil
+			}
+			var quotaErr *quotaExceededError
+			if errors.As(err, &quotaErr) {
+				// Retrying will not help until certificates are removed from ACM or the quota is increased, so re-check once quotas are next refreshed.
+				r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonQuotaExceeded, fmt.Sprintf("%s (Region '%s'.)", quotaErr.Error(), region))
+				r.RecordSyncStatus(ctx, secret, global.SYNC_STATE_FAILED, fmt.Sprintf("ACM quota '%s' exceeded in region '%s'.", acmQuotaNames[quotaErr.quota.Key], region))
+				r.NotifyImportFailed(regionalCtx, secret, region, quotaErr.Error())
+				if quotaIncreaseRequested(secret) {
+					if requested, err := r.RequestQuotaIncrease(regionalCtx, quotaClient, quotaErr); err != nil {
+						log.Error(err, "ACM quota increase request failed.")
+						r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonACMError, fmt.Sprintf("ACM quota increase request failed in region '%s': %s", region, err))
+					} else if requested {
+						r.Recorder.Event(secret, corev1.EventTypeNormal, eventReasonQuotaIncreaseRequested, fmt.Sprintf("Increase to ACM quota '%s' requested in region '%s'.", acmQuotaNames[quotaErr.quota.Key], region))
+					}
+				}
+				return ctrl.Result{RequeueAfter: acmQuotaTTL}, nil
+			}
+			var deferredErr *importDeferredError
+			if errors.As(err, &deferredErr) {
+				r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonImportDeferred, deferredErr.Error())
+				r.RecordSyncStatus(ctx, secret, global.SYNC_STATE_PENDING, fmt.Sprintf("Re-import into ACM region '%s' deferred until %s (import limit.)", region, deferredErr.until.UTC().Format(time.RFC3339)))
+				return ctrl.Result{RequeueAfter: time.Until(deferredErr.until)}, nil
+			}
+			var delayErr *propagationDelayError
+			if errors.As(err, &delayErr) {
+				// Transient: ACM has not yet caught up with an import, so re-check shortly (without reporting a failure.)
+				log.Info(delayErr.Error())
+				if imported {
+					r.Recorder.Event(secret, corev1.EventTypeNormal, eventReasonImported, fmt.Sprintf("Certificate imported into ACM as '%s'.", delayErr.certificateArn))
+				}
+				r.RecordSyncStatus(ctx, secret, global.SYNC_STATE_PENDING, fmt.Sprintf("Waiting for ACM certificate in region '%s' to become available.", region))
+				return ctrl.Result{RequeueAfter: acmPropagationRequeueDelay}, nil
+			}
+			var inProgressErr *importInProgressError
+			if errors.As(err, &inProgressErr) {
+				// Transient: another agent process is importing a certificate for the same domain, so re-check once it has finished (when the certificate it imported will be found, rather than imported again.)
+				log.Info(inProgressErr.Error())
+				r.RecordSyncStatus(ctx, secret, global.SYNC_STATE_PENDING, fmt.Sprintf("Waiting for another agent to finish importing a certificate for the same domain into ACM region '%s'.", region))
+				return ctrl.Result{RequeueAfter: importLockRequeueDelay}, nil
+			}
+			var dryRunErr *dryRunError
+			if errors.As(err, &dryRunErr) {
+				// Nothing further to do until the dry run is ended (which re-queues all Secrets.)
+				r.Recorder.Event(secret, corev1.EventTypeNormal, eventReasonDryRun, fmt.Sprintf("Certificate would be imported into ACM region '%s' (dry run.)", region))
+				r.RecordSyncStatus(ctx, secret, global.SYNC_STATE_PENDING, fmt.Sprintf("Import into ACM region '%s' skipped (dry run.)", region))
+				return ctrl.Result{}, nil
+			}
+			var permanentErr *permanentError
+			if errors.As(err, &permanentErr) {
+				// Retrying will not help until the Secret changes (e.g. ACM rejected its certificate as malformed), so park the Secret rather than retrying it with backoff.
+				message := fmt.Sprintf("ACM rejected the certificate in region '%s' (%s): retries are suspended until the Secret changes.", region, permanentErr.code)
+				r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonImportRejected, fmt.Sprintf("ACM rejected the certificate in region '%s': %s", region, err))
+				r.RecordSyncStatus(ctx, secret, global.SYNC_STATE_FAILED, message)
+				r.NotifyImportFailed(regionalCtx, secret, region, err.Error())
+				r.retries.Park(req, secret.ResourceVersion) // Read after the sync status is recorded, so that recording it does not end the parking.
+				return ctrl.Result{}, nil
+			}
+			if err != nil {
+				r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonACMError, fmt.Sprintf("ACM synchronization failed in region '%s': %s", region, err))
+				// Error details (which include AWS request IDs) are omitted, as each change to the sync status triggers reconciliation.
+				r.RecordRetrySyncStatus(ctx, secret, global.SYNC_STATE_FAILED, fmt.Sprintf("ACM synchronization failed in region '%s'.", region))
+				r.NotifyImportFailed(regionalCtx, secret, region, err.Error())
+				return requeueWithBackoff(err)
+			}
+		}
+		shouldImportToACM = shouldImportToACM || imported
+		if imported && previouslySynced {
+			acmDriftDetectedTotal.WithLabelValues(secret.Namespace).Inc()
+			r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonDriftDetected, fmt.Sprintf("ACM certificate in region '%s' no longer matched the Secret and has been re-imported.", region))
+		}
+		if imported {
+			r.Recorder.Event(secret, corev1.EventTypeNormal, eventReasonImported, fmt.Sprintf("Certificate imported into ACM as '%s'.", *regionalCertificateDetails.CertificateArn))
+			notification := newNotification(NotificationImported, "Secret", secret, fmt.Sprintf("Certificate imported into ACM as '%s'.", *regionalCertificateDetails.CertificateArn))
+			notification.CertificateArn = *regionalCertificateDetails.CertificateArn
+			notification.Region = region
+			notification.Expires = certificateDetails.Certificate.x509.NotAfter.UTC().Format(time.RFC3339)
+			notify(regionalCtx, notification)
+			if CertificateImportLimit > 0 && regionalCertificateDetails.ImportCount >= importLimitWarningThreshold() {
+				r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonImportLimitApproaching, fmt.Sprintf("ACM certificate '%s' has been imported %d time(s) in the last 365 days (limit %d): further re-imports are limited to one per day.", *regionalCertificateDetails.CertificateArn, regionalCertificateDetails.ImportCount, CertificateImportLimit))
+			}
+		}
+
+		if regionalCertificateDetails.CertificateArn == nil {
+			err := fmt.Errorf("Certificate ARN update required but no ARN set for region '%s'.", region)
+			log.Error(err, "Failed to persist ACM certificate ARN back to Secret.")
+			return requeueWithBackoff(err)
+		}
+
+		if hasRegionsAnnotation {
+			annotationSet.RegionalCertificateArns[region] = *regionalCertificateDetails.CertificateArn
+		}
+
+		record := ACMCertificateRecord{
+			Region:         region,
+			CertificateArn: *regionalCertificateDetails.CertificateArn,
+			SerialNumber:   annotationSet.SerialNumber,
+			Expires:        annotationSet.ExpiryDate,
+		}
+		if parsedArn, err := arn.Parse(record.CertificateArn); err == nil {
+			record.Account = parsedArn.AccountID
+		}
+		r.RecordACMCertificateHealth(regionalCtx, secret, r.acmServiceFactory()(cfg, region), &regionalCertificateDetails, &record)
+		if imported {
+			record.LastImportTime = time.Now().UTC().Format(time.RFC3339)
+		} else {
+			for _, previousRecord := range previousRecords {
+				if previousRecord.CertificateArn == record.CertificateArn {
+					record.LastImportTime = previousRecord.LastImportTime
+					break
+				}
+			}
+		}
+		records = append(records, record)
+
+		if region == global.CLOUDFRONT_REGION && usedForCloudFront(secret) {
+			annotationSet.CloudFrontCertificateArn = *regionalCertificateDetails.CertificateArn
+		}
+
+		// The primary ARN annotation (consumed by IngressReconciler) always refers to the agent's own region where possible, otherwise to the first listed region.
+		if region == cfg.Region || annotationSet.CertificateArn == "" {
+			annotationSet.CertificateArn = *regionalCertificateDetails.CertificateArn
+		}
+	}
+
+	// Record the time of the most recent import, for reporting in the status of cert-manager Certificates.
+	syncStatus, _ := r.GetSyncStatus(secret)
+	syncStatus.State = global.SYNC_STATE_SYNCED
+	syncStatus.CertificateArn = annotationSet.CertificateArn
+	syncStatus.Message = ""
+	if shouldImportToACM {
+		syncStatus.LastImportTime = time.Now().UTC().Format(time.RFC3339)
+	}
+	syncStatusJSON, err := json.Marshal(syncStatus)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	annotationSet.SyncStatus = string(syncStatusJSON)
+
+	recordsJSON, err := json.Marshal(records)
+	if err != nil {
 		return ctrl.Result{}, err
 	}
+	annotationSet.ACMCertificates = string(recordsJSON)
+	annotationSet.DataHash = inputHash
+	annotationSet.CertificateHash = certificateDataHash(secret)
+	annotationSet.ConfigHash = stateKey
 
-	acmClient := acm.NewFromConfig(cfg)
+	// See if any annotations don't match the values we hold, otherwise no point in updating.
+	shouldUpdateAnnotations := !r.AnnotationMatches(secret, global.AGENT_SOURCE_CLUSTER_ANNOTATION, annotationSet.SourceCluster) ||
+		!r.AnnotationMatches(secret, global.AGENT_CERTIFICATE_ARN_ANNOTATION, annotationSet.CertificateArn) ||
+		!r.AnnotationMatches(secret, global.AGENT_CERTIFICATE_SERIAL_NUMBER_ANNOTATION, annotationSet.SerialNumber) ||
+		!r.AnnotationMatches(secret, global.AGENT_CERTIFICATE_EXPIRY_DATE_ANNOTATION, annotationSet.ExpiryDate) ||
+		!r.AnnotationMatches(secret, global.AGENT_CERTIFICATE_DOMAIN_NAMES_ANNOTATION, annotationSet.DomainNames) ||
+		!r.AnnotationMatches(secret, global.AGENT_SYNC_STATUS_ANNOTATION, annotationSet.SyncStatus) ||
+		!r.AnnotationMatches(secret, global.AGENT_ACM_CERTIFICATES_ANNOTATION, annotationSet.ACMCertificates) ||
+		!r.AnnotationMatches(secret, global.AGENT_CLOUDFRONT_CERTIFICATE_ARN_ANNOTATION, annotationSet.CloudFrontCertificateArn) ||
+		!r.AnnotationMatches(secret, global.AGENT_DATA_HASH_ANNOTATION, annotationSet.DataHash) ||
+		!r.AnnotationMatches(secret, global.AGENT_CERTIFICATE_HASH_ANNOTATION, annotationSet.CertificateHash) ||
+		!r.AnnotationMatches(secret, global.AGENT_CONFIG_HASH_ANNOTATION, annotationSet.ConfigHash) ||
+		!r.AnnotationMatches(secret, global.AGENT_RETRY_COUNT_ANNOTATION, "") ||
+		!r.RegionalAnnotationsMatch(secret, annotationSet.RegionalCertificateArns)
+
+	// Patch annotations if any changes have been detected.
+	if shouldUpdateAnnotations {
+
+		log.Info("Updating Secret annotations...")
+
+		// Patch (rather than update) so that concurrent changes to the Secret made by other controllers (e.g. cert-manager) do not cause conflicts.
+		patch := client.MergeFrom(secret.DeepCopy())
+
+		if previousArn := secret.Annotations[global.AGENT_CERTIFICATE_ARN_ANNOTATION]; previousArn != "" && previousArn != annotationSet.CertificateArn {
+			r.Recorder.Event(secret, corev1.EventTypeNormal, eventReasonCertificateArnChanged, fmt.Sprintf("ACM certificate ARN changed from '%s' to '%s'.", previousArn, annotationSet.CertificateArn))
+		}
+
+		if annotationSet.SourceCluster != "" {
+			setAnnotation(secret, global.AGENT_SOURCE_CLUSTER_ANNOTATION, annotationSet.SourceCluster)
+		}
+		setAnnotation(secret, global.AGENT_CERTIFICATE_ARN_ANNOTATION, annotationSet.CertificateArn)
+		setAnnotation(secret, global.AGENT_CERTIFICATE_SERIAL_NUMBER_ANNOTATION, annotationSet.SerialNumber)
+		setAnnotation(secret, global.AGENT_CERTIFICATE_EXPIRY_DATE_ANNOTATION, annotationSet.ExpiryDate)
+		setAnnotation(secret, global.AGENT_CERTIFICATE_DOMAIN_NAMES_ANNOTATION, annotationSet.DomainNames)
+		setAnnotation(secret, global.AGENT_SYNC_STATUS_ANNOTATION, annotationSet.SyncStatus)
+		setAnnotation(secret, global.AGENT_ACM_CERTIFICATES_ANNOTATION, annotationSet.ACMCertificates)
+		setAnnotation(secret, global.AGENT_DATA_HASH_ANNOTATION, annotationSet.DataHash)
+		setAnnotation(secret, global.AGENT_CERTIFICATE_HASH_ANNOTATION, annotationSet.CertificateHash)
+		setAnnotation(secret, global.AGENT_CONFIG_HASH_ANNOTATION, annotationSet.ConfigHash)
+		delete(secret.Annotations, global.AGENT_RETRY_COUNT_ANNOTATION) // Synchronization has succeeded.
+		if annotationSet.CloudFrontCertificateArn != "" {
+			setAnnotation(secret, global.AGENT_CLOUDFRONT_CERTIFICATE_ARN_ANNOTATION, annotationSet.CloudFrontCertificateArn)
+		} else {
+			delete(secret.Annotations, global.AGENT_CLOUDFRONT_CERTIFICATE_ARN_ANNOTATION)
+		}
+
+		// Replace regional ARN annotations wholesale so that regions which are no longer targeted are cleaned up.
+		for key := range secret.Annotations {
+			if strings.HasPrefix(key, global.AGENT_CERTIFICATE_ARN_ANNOTATION+".") {
+				delete(secret.Annotations, key)
+			}
+		}
+		for region, certificateArn := range annotationSet.RegionalCertificateArns {
+			setAnnotation(secret, regionalCertificateArnAnnotation(region), certificateArn)
+		}
+
+		err = r.Patch(
+			context.TODO(),
+			secret,
+			patch,
+		)
+
+		if err != nil {
+			log.Error(err, "Failed to persist ACM certificate ARN back to Secret.")
+			return requeueWithBackoff(err)
+		}
+	}
+
+	if !shouldImportToACM && !shouldUpdateAnnotations {
+		log.Info("Secret evaluation complete: nothing to do.")
+	}
+
+	recordCertificateMetrics(secret.Namespace, secret.Name, certificateDetails.Certificate.x509, records)
+
+	// Additional leaves of a multi-leaf Secret (if any) are synchronized once the Secret's own certificate is up to date.
+	if result, err := r.SyncLeafCertificates(ctx, secret, cfg, regions, isReplica, additionalLeaves); err != nil || !result.IsZero() {
+		return result, err
+	}
+	verifiedSecrets.Verified(req.NamespacedName, stateKey)
+
+	return r.CheckRenewalWindow(ctx, secret, renewalNotAfter(certificateDetails, additionalLeaves)), nil
+}
+
+// Returns the expiry of the Secret's certificate, or of the first of its additional (valid) leaves to expire, if earlier: renewal is due when this nears.
+func renewalNotAfter(certificateDetails CertificateDetails, additionalLeaves []CertificateDetails) time.Time {
+	notAfter := certificateDetails.Certificate.x509.NotAfter
+	for _, leaf := range additionalLeaves {
+		if leafNotAfter := leaf.Certificate.x509.NotAfter; leafNotAfter.After(time.Now()) && leafNotAfter.Before(notAfter) {
+			notAfter = leafNotAfter
+		}
+	}
+	return notAfter
+}
+
+// CheckRenewalWindow schedules re-evaluation of the Secret once its certificate enters the renewal window. If the certificate is already within the window (i.e. the Secret has not been rotated), a warning Event is recorded and the Secret is re-evaluated periodically until it is rotated or the certificate expires.
+func (r *SecretReconciler) CheckRenewalWindow(ctx context.Context, secret *corev1.Secret, notAfter time.Time) ctrl.Result {
+
+	untilExpiry := time.Until(notAfter)
+	if untilExpiry > RenewalWindow {
+		return ctrl.Result{RequeueAfter: untilExpiry - RenewalWindow}
+	}
+
+	r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonNearingExpiry, fmt.Sprintf("Certificate expires at %s and has not been renewed.", notAfter.UTC().Format(time.RFC3339)))
+	notification := newNotification(NotificationNearingExpiry, "Secret", secret, fmt.Sprintf("Certificate expires at %s and has not been renewed.", notAfter.UTC().Format(time.RFC3339)))
+	notification.CertificateArn = secret.Annotations[global.AGENT_CERTIFICATE_ARN_ANNOTATION]
+	notification.Expires = notAfter.UTC().Format(time.RFC3339)
+	notify(ctx, notification)
+
+	if untilExpiry < renewalWindowCheckInterval {
+		return ctrl.Result{RequeueAfter: untilExpiry}
+	}
+	return ctrl.Result{RequeueAfter: renewalWindowCheckInterval}
+}
+
+// NotifyImportFailed publishes a notification that the Secret's certificate could not be imported into the ACM region (see notify.)
+func (r *SecretReconciler) NotifyImportFailed(ctx context.Context, secret *corev1.Secret, region string, message string) {
+	notification := newNotification(NotificationImportFailed, "Secret", secret, message)
+	notification.CertificateArn = aws.ToString(r.GetRegionalCertificateArn(secret, region))
+	notification.Region = region
+	notify(ctx, notification)
+}
+
+// SyncCertificateWithACM ensures that the certificate is present in the ACM region targeted by acmClient, importing it if necessary.
+// indexScope identifies the account/region targeted by acmClient within the shared ACM certificate index (see acmIndexScope.)
+// If quotaClient is not nil, imports which would exceed ACM quotas are refused with a quotaExceededError (see CheckImportQuotas.)
+// On return, certificateDetails.CertificateArn holds the ARN of the matching ACM certificate.
+func (r *SecretReconciler) SyncCertificateWithACM(ctx context.Context, acmClient ACMService, quotaClient ServiceQuotasService, indexScope string, certificateDetails *CertificateDetails) (bool, error) {
+
+	log := log.FromContext(ctx)
+
+	// Prevent parallel reconciles of Secrets holding the same certificate from importing duplicates (the duplicate check below is only reliable once any concurrent import has completed.)
+	unlock := acmDomainLocks.Lock(indexScope + "|" + normalizeDomainName(acmDomainName(certificateDetails.Certificate.x509)))
+	defer unlock()
 
 	// Evaluate state...
 
 	shouldImportToACM := false
 	shouldSearchExistingCertificates := false
 
-	// If a certificate ARN annotation exists, see if the certificate exists and matches the serial number. If so, abort (imports to ACM are quota limited.)
+	// If a certificate ARN annotation exists, see if the certificate exists and matches (see MatchACMCertificate.) If so, abort (imports to ACM are quota limited.)
 	serialNumber := certificateDetails.Certificate.x509.SerialNumber
+	oldSerial := "" // Serial number of the ACM certificate overwritten by a re-import (recorded in the audit trail.)
+	var lock *importLock
 	if certificateDetails.CertificateArn != nil {
 
 		log.Info("Certificate has existing ARN annotation. Verifying...")
@@ -166,22 +884,51 @@ func (r *SecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 		acmCertificate, err := acmClient.DescribeCertificate(context.TODO(), &input)
 		if err == nil {
 
-			acmCertSerialNumber, ok := new(big.Int).SetString(strings.ReplaceAll(*acmCertificate.Certificate.Serial, ":", ""), 16)
-			// A certificate with the annotated ARN exists, and it matches on serial number, therefore nothing to do.
-			if ok && serialNumber.Cmp(acmCertSerialNumber) == 0 {
+			certificateDetails.ACMCertificate = acmCertificate.Certificate
+			oldSerial = aws.ToString(acmCertificate.Certificate.Serial)
+			matches, getOutput, err := r.MatchACMCertificate(ctx, acmClient, *certificateDetails.CertificateArn, oldSerial, certificateDetails.Certificate.x509)
+			if err != nil {
+				log.Error(err, "ACM certificate body lookup failed.")
+				return false, err
+			}
+
+			// The chain may have been replaced out-of-band even if the certificate matches. (The chain is only returned by GetCertificate.)
+			if matches {
+				if !r.ChainMatches(aws.ToString(getOutput.CertificateChain), certificateDetails.Intermediates) {
+					log.Info("ACM certificate chain does not match Secret.")
+					matches = false
+				}
+			}
+
+			// A recent import may not yet be reflected by ACM, and should not be mistaken for an out-of-band change (which would trigger a further import.)
+			if !matches && acmIndex.RecentlyImported(indexScope, *certificateDetails.CertificateArn, r.FormatX509SerialNumber(serialNumber)) {
+				return false, &propagationDelayError{certificateArn: *certificateDetails.CertificateArn}
+			}
+
+			// A certificate with the annotated ARN exists, and it matches on fingerprint and chain, therefore nothing to do.
+			if matches {
 				log.Info("Certificate already exists in ACM.")
 				// An identical certificate with the annotated ARN exists - no import required.
 				shouldImportToACM = false
 			} else {
-				// A certificate with the annotated ARN exists, but it does not match on serial number. (K8s certificate should always override ACM certificate therefore we import it to ACM without further BL required.)
+				// A certificate with the annotated ARN exists, but it does not match on fingerprint (or chain). (K8s certificate should always override ACM certificate, provided the agent owns the ACM certificate.)
+				if owner := r.GetACMCertificateTag(acmClient, acmCertificate.Certificate.CertificateArn, OwnerTag.Key); owner == nil || *owner != ownerTagValue() {
+					log.Info(fmt.Sprintf("ACM certificate is not tagged '%s=%s': refusing to overwrite.", OwnerTag.Key, ownerTagValue()))
+					return false, &certificateNotOwnedError{certificateArn: *certificateDetails.CertificateArn}
+				}
 				shouldImportToACM = true
 			}
 
-			certificateDetails.CreatedAt = r.GetACMCertificateTag(acmClient, acmCertificate.Certificate.CertificateArn, "tron/createdAt")
+			if tagKey := createdAtTagKey(); tagKey != "" {
+				certificateDetails.CreatedAt = r.GetACMCertificateTag(acmClient, acmCertificate.Certificate.CertificateArn, tagKey)
+			}
 		} else {
-			if strings.Contains(err.Error(), "(ResourceNotFoundException)") {
+			if isACMResourceNotFound(err) && acmIndex.RecentlyImported(indexScope, *certificateDetails.CertificateArn, r.FormatX509SerialNumber(serialNumber)) {
+				return false, &propagationDelayError{certificateArn: *certificateDetails.CertificateArn}
+			} else if isACMResourceNotFound(err) {
 
 				// Certificate does not exist in ACM, therefore reset ARN annotation.
+				acmIndex.Forget(*certificateDetails.CertificateArn)
 				certificateDetails.CertificateArn = nil
 
 				// We should nevertheless check to see if another ACM certificate matches...
@@ -189,7 +936,7 @@ func (r *SecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 
 			} else {
 				log.Error(err, "ACM certificate lookup failed.")
-				return ctrl.Result{RequeueAfter: defaultRequeueLatency}, err
+				return false, err
 			}
 		}
 	} else {
@@ -198,22 +945,47 @@ func (r *SecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 
 	if shouldSearchExistingCertificates {
 
+		// Prevent other agent processes from importing the same certificate while this one searches for (and imports) it (see acquireImportLock.)
+		var err error
+		lock, err = acquireImportLock(ctx, indexScope, acmDomainName(certificateDetails.Certificate.x509))
+		if err != nil {
+			var inProgressErr *importInProgressError
+			if !errors.As(err, &inProgressErr) {
+				log.Error(err, "Failed to acquire import lock.")
+			}
+			return false, err
+		}
+		defer func() {
+			lock.Release(ctx, aws.ToString(certificateDetails.CertificateArn))
+		}()
+
 		// See if any existing ACM certificates are the current certificate. (ACM does not guard against duplicate certificate import, so we must do it manually.)
-		domainName := certificateDetails.Certificate.x509.Subject.CommonName // ACM extracts domain from subject.CN
-		domainMatches, err := r.FindACMCertificatesByDomain(acmClient, domainName)
+		domainMatches, err := r.FindACMCertificatesByDomains(ctx, acmClient, indexScope, certificateDetails.Certificate.x509)
 		if err != nil {
-			log.Error(err, "Failed to enumerate existing ACM certificates.")
-			return ctrl.Result{}, err
+			var delayErr *propagationDelayError
+			if !errors.As(err, &delayErr) {
+				log.Error(err, "Failed to enumerate existing ACM certificates.")
+			}
+			return false, err
 		}
 
 		// Assume we will need to import the certificate, unless we now find a match.
 		shouldImportToACM = true
 
 		for _, acmCertificate := range domainMatches {
-			acmCertSerialNumber, ok := new(big.Int).SetString(strings.ReplaceAll(*acmCertificate.Certificate.Serial, ":", ""), 16)
-			if ok && serialNumber.Cmp(acmCertSerialNumber) == 0 {
-				certificateDetails.CertificateArn = acmCertificate.Certificate.CertificateArn
+			if serialMatches, _ := serialNumberMatches(serialNumber, acmCertificate.Serial); !serialMatches {
+				continue
+			}
+			// Serial numbers may collide across CAs, so confirm the match by fingerprint (falling back to the serial number if the certificate body cannot be retrieved.)
+			matches, _, err := r.MatchACMCertificate(ctx, acmClient, acmCertificate.CertificateArn, acmCertificate.Serial, certificateDetails.Certificate.x509)
+			if err != nil {
+				log.Error(err, "ACM certificate body lookup failed: matching on serial number.")
+				matches = true
+			}
+			if matches {
+				certificateDetails.CertificateArn = aws.String(acmCertificate.CertificateArn)
 				shouldImportToACM = false
+				acmDuplicatesDetectedTotal.WithLabelValues(*certificateDetails.Namespace).Inc()
 				break
 			}
 		}
@@ -226,98 +998,390 @@ func (r *SecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 	// Note that in case of downstream dependencies within AWS, we do not delete old ACM certificates (even if they have expired.)
 	if shouldImportToACM {
 
-		log.Info(fmt.Sprintf("Importing certificate into ACM (Chain: %s)...", r.DescribeCertificateChain(&certificateDetails)))
+		if currentAgentConfig().DryRun {
+			err := &dryRunError{action: "ACM certificate import"}
+			log.Info(err.Error())
+			return false, err
+		}
+
+		// An earlier import of a new certificate may have been interrupted before its ARN was recorded (see acquireImportLock.)
+		if err := lock.CheckInterruptedImport(); err != nil {
+			log.Info(err.Error())
+			return false, err
+		}
+
+		// Limit the number of times the same ACM certificate is re-imported (see CertificateImportLimit.)
+		now := time.Now()
+		importHistory := []time.Time{}
+		if certificateDetails.CertificateArn != nil {
+			importHistory = parseImportHistory(aws.ToString(r.GetACMCertificateTag(acmClient, certificateDetails.CertificateArn, ImportHistoryTagKey)), now)
+			err := checkImportLimit(*certificateDetails.CertificateArn, importHistory, now)
+			if err != nil {
+				log.Info(err.Error())
+				acmImportsDeferredTotal.WithLabelValues(*certificateDetails.Namespace).Inc()
+				return false, err
+			}
+		}
+		importHistory = append(importHistory, now.UTC().Truncate(24*time.Hour))
+
+		// Refuse imports which would exceed ACM quotas, rather than being throttled by ACM. If quotas cannot be checked (e.g. for lack of permission), the import proceeds.
+		if quotaClient != nil {
+			err := r.CheckImportQuotas(ctx, acmClient, quotaClient, indexScope, certificateDetails.CertificateArn != nil)
+			var quotaErr *quotaExceededError
+			if errors.As(err, &quotaErr) {
+				log.Info(quotaErr.Error())
+				acmImportsRefusedTotal.WithLabelValues(*certificateDetails.Namespace, quotaErr.quota.Key).Inc()
+				return false, err
+			}
+			if err != nil {
+				log.Error(err, "ACM quota check failed: importing regardless.")
+			}
+		}
+
+		if certificateDetails.BundleReordered {
+			log.Info("Certificates held by the Secret are not in leaf-first order (or are duplicated): importing the chain in normalized order.")
+		}
+		log.Info(fmt.Sprintf("Importing certificate into ACM (Chain: %s)...", r.DescribeCertificateChain(certificateDetails)))
+		certificateDetails.ACMCertificate = nil
+
+		tags := r.CreateStandardTagArray(certificateDetails.CreatedAt, aws.ToString(certificateDetails.Namespace), aws.ToString(certificateDetails.SecretName), certificateDetails.Tags)
+		tags = append(tags, types.Tag{Key: aws.String(ImportHistoryTagKey), Value: aws.String(formatImportHistory(importHistory))})
 
 		importInput := acm.ImportCertificateInput{
-			Certificate:      []byte(certificateDetails.Certificate.PEM),
-			CertificateChain: []byte(*r.CertificateWrapperArrayToPEM(certificateDetails.Intermediates)),
-			PrivateKey:       certificateDetails.PrivateKey,
+			Certificate: []byte(certificateDetails.Certificate.PEM),
+			PrivateKey:  certificateDetails.PrivateKey,
+		}
+		// The chain is omitted for certificates without intermediates (e.g. those issued directly by a root.)
+		if chainPEM := r.CertificateWrapperArrayToPEM(certificateDetails.Intermediates); chainPEM != nil {
+			importInput.CertificateChain = []byte(*chainPEM)
 		}
 		if certificateDetails.CertificateArn != nil {
 			importInput.CertificateArn = certificateDetails.CertificateArn
+		} else {
+			// Tag on creation, so that tagging policies which require specific tags on import are satisfied.
+			importInput.Tags = tags
+		}
+
+		_, region := splitACMIndexScope(indexScope)
+		auditRecord := AuditRecord{
+			Action:         auditActionImport,
+			CertificateArn: aws.ToString(importInput.CertificateArn),
+			Region:         region,
+			NewSerial:      r.FormatX509SerialNumber(serialNumber),
+		}
+		if importInput.CertificateArn != nil {
+			auditRecord.Action = auditActionReimport
+			auditRecord.OldSerial = oldSerial
 		}
 
+		if importInput.CertificateArn == nil {
+			if err := lock.StartImport(ctx); err != nil {
+				log.Error(err, "Failed to record import in import lock.")
+				return false, err
+			}
+		}
 		importResult, err := acmClient.ImportCertificate(context.TODO(), &importInput)
+		if importInput.CertificateArn == nil {
+			if err != nil {
+				lock.ImportFailed(ctx, err)
+			} else {
+				lock.Imported(ctx, aws.ToString(importResult.CertificateArn))
+			}
+		}
+		if err == nil {
+			auditRecord.CertificateArn = aws.ToString(importResult.CertificateArn)
+			auditRecord.Tags = acmTagMap(importInput.Tags)
+		}
+		recordAudit(ctx, auditRecord, err)
 		if err != nil {
 			log.Error(err, "ACM certificate import failed.")
-			return ctrl.Result{RequeueAfter: defaultRequeueLatency}, err
+			acmImportFailuresTotal.WithLabelValues(*certificateDetails.Namespace).Inc()
+			return false, classifyError(err)
 		}
+		acmImportsTotal.WithLabelValues(*certificateDetails.Namespace).Inc()
 
 		certificateDetails.CertificateArn = importResult.CertificateArn
+		certificateDetails.ImportCount = len(importHistory)
+		acmIndex.Put(indexScope, ACMCertificateSummary{
+			CertificateArn:          *importResult.CertificateArn,
+			DomainName:              acmDomainName(certificateDetails.Certificate.x509),
+			Serial:                  r.FormatX509SerialNumber(serialNumber),
+			SubjectAlternativeNames: certificateDomainNames(certificateDetails.Certificate.x509),
+			Type:                    string(types.CertificateTypeImported),
+			ImportedAt:              time.Now(),
+		})
 
-		// Tag separately because you can only tag on import when creating (not updating) a certificate.
-		tagInput := acm.AddTagsToCertificateInput{
-			CertificateArn: certificateDetails.CertificateArn,
-			Tags:           r.CreateStandardTagArray(certificateDetails.CreatedAt),
+		// Tag separately when re-importing because you can only tag on import when creating (not updating) a certificate.
+		if importInput.CertificateArn != nil && len(tags) > 0 {
+			tagInput := acm.AddTagsToCertificateInput{
+				CertificateArn: certificateDetails.CertificateArn,
+				Tags:           tags,
+			}
+			_, tagError := acmClient.AddTagsToCertificate(context.TODO(), &tagInput)
+			recordAudit(ctx, AuditRecord{Action: auditActionTag, CertificateArn: *certificateDetails.CertificateArn, Region: region, Tags: acmTagMap(tags)}, tagError)
+			if tagError != nil {
+				log.Error(tagError, "ACM certificate tagging failed.")
+				acmTagFailuresTotal.WithLabelValues(*certificateDetails.Namespace).Inc()
+				return true, tagError
+			}
 		}
-		_, tagError := acmClient.AddTagsToCertificate(context.TODO(), &tagInput)
-		if tagError != nil {
-			log.Error(tagError, "ACM certificate tagging failed.")
-			return ctrl.Result{RequeueAfter: defaultRequeueLatency}, tagError
+
+		// Confirm that the import is visible before the ARN is recorded, so that the next reconcile does not find a missing (or stale) certificate.
+		if err := r.VerifyImportedCertificate(ctx, acmClient, *certificateDetails.CertificateArn, serialNumber); err != nil {
+			var delayErr *propagationDelayError
+			if !errors.As(err, &delayErr) {
+				log.Error(err, "ACM certificate verification failed.")
+			}
+			return true, err
 		}
 
 	}
 
-	shouldUpdateAnnotations := false
+	return shouldImportToACM, nil
+}
 
-	// See if any annotations don't match the values we hold, otherwise no point in updating.
-	annotationSet := SecretAnnotations{
-		CertificateArn: *certificateDetails.CertificateArn,
-		SerialNumber:   r.FormatX509SerialNumber(certificateDetails.Certificate.x509.SerialNumber),
-		ExpiryDate:     certificateDetails.Certificate.x509.NotAfter.Format(global.ISO_8601_FORMAT),
-		DomainNames:    strings.Join(r.ExtractCertificateDomains(certificateDetails.Certificate.x509), ", "),
+// VerifyReplicatedCertificate returns true if the ACM certificate recorded in the ARN annotation of a replicated Secret exists in the region targeted by acmClient and matches the Secret's certificate. Replicated Secrets are never imported, since the source cluster owns the ACM certificate.
+func (r *SecretReconciler) VerifyReplicatedCertificate(ctx context.Context, acmClient ACMService, certificateDetails *CertificateDetails) (bool, error) {
+
+	if certificateDetails.CertificateArn == nil {
+		return false, nil
 	}
 
-	shouldUpdateAnnotations = !r.AnnotationMatches(secret, global.AGENT_CERTIFICATE_ARN_ANNOTATION, annotationSet.CertificateArn) ||
-		!r.AnnotationMatches(secret, global.AGENT_CERTIFICATE_SERIAL_NUMBER_ANNOTATION, annotationSet.SerialNumber) ||
-		!r.AnnotationMatches(secret, global.AGENT_CERTIFICATE_EXPIRY_DATE_ANNOTATION, annotationSet.ExpiryDate) ||
-		!r.AnnotationMatches(secret, global.AGENT_CERTIFICATE_DOMAIN_NAMES_ANNOTATION, annotationSet.DomainNames)
+	acmCertificate, err := acmClient.DescribeCertificate(ctx, &acm.DescribeCertificateInput{CertificateArn: certificateDetails.CertificateArn})
+	if err != nil {
+		if isACMResourceNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
 
-	// Patch annotations if any changes have been detected.
-	if shouldUpdateAnnotations {
+	certificateDetails.ACMCertificate = acmCertificate.Certificate
+	matches, _, err := r.MatchACMCertificate(ctx, acmClient, *certificateDetails.CertificateArn, aws.ToString(acmCertificate.Certificate.Serial), certificateDetails.Certificate.x509)
+	return matches, err
+}
 
-		log.Info("Updating Secret annotations...")
+// Returns true if the Secret is enabled for ACM certificate management: either by its 'enabled' annotation or, if it has none, by matching Selector.
+func (r *SecretReconciler) AgentEnabled(secret *corev1.Secret) bool {
+	if annotationValue, ok := secret.Annotations[global.AGENT_ENABLED_ANNOTATION]; ok {
+		enabled, _ := strconv.ParseBool(annotationValue)
+		return enabled
+	}
+	return r.Selector != nil && !r.Selector.Empty() && r.Selector.Matches(labels.Set(secret.Labels))
+}
 
-		if certificateDetails.CertificateArn == nil {
-			err := errors.New("Certificate ARN update required but no ARN set.")
-			log.Error(err, "Failed to persist ACM certificate ARN back to Secret.")
-			return ctrl.Result{RequeueAfter: defaultRequeueLatency}, err
+// GetTargetRegions returns the list of regions into which the Secret's certificate should be imported, and whether this was explicitly set (by annotation, or by the ACMAgentConfig.) Certificates used with CloudFront are also imported into us-east-1 (in the 'aws' partition.)
+func (r *SecretReconciler) GetTargetRegions(secret *corev1.Secret, defaultRegion string) ([]string, bool) {
+
+	regions := []string{}
+	regionsAnnotation, ok := secret.Annotations[global.AGENT_REGIONS_ANNOTATION]
+	hasExplicitRegions := ok && strings.TrimSpace(regionsAnnotation) != ""
+	if hasExplicitRegions {
+		for _, region := range trimSpaceFromSliceElements(strings.Split(regionsAnnotation, ",")) {
+			if region != "" && !containsString(regions, region) {
+				regions = append(regions, region)
+			}
 		}
+	} else if configRegions := currentAgentConfig().Regions; len(configRegions) > 0 {
+		regions = append(regions, configRegions...)
+		hasExplicitRegions = true
+	} else if defaultRegion != "" {
+		regions = append(regions, defaultRegion)
+	}
 
-		secret.Annotations[global.AGENT_CERTIFICATE_ARN_ANNOTATION] = annotationSet.CertificateArn
-		secret.Annotations[global.AGENT_CERTIFICATE_SERIAL_NUMBER_ANNOTATION] = annotationSet.SerialNumber
-		secret.Annotations[global.AGENT_CERTIFICATE_EXPIRY_DATE_ANNOTATION] = annotationSet.ExpiryDate
-		secret.Annotations[global.AGENT_CERTIFICATE_DOMAIN_NAMES_ANNOTATION] = annotationSet.DomainNames
+	// CloudFront only accepts certificates from us-east-1, regardless of the region in which the agent is running.
+	if cloudFrontRegion := cloudFrontRegion(agentPartition(defaultRegion)); usedForCloudFront(secret) && cloudFrontRegion != "" && !containsString(regions, cloudFrontRegion) {
+		regions = append(regions, cloudFrontRegion)
+	}
 
-		err = r.Update(
-			context.TODO(),
-			secret,
-			&client.UpdateOptions{},
-		)
+	return regions, hasExplicitRegions
+}
+
+// Returns true if the Secret's certificate is to be used with CloudFront (see the 'use-for' annotation.)
+func usedForCloudFront(secret *corev1.Secret) bool {
+	return strings.EqualFold(strings.TrimSpace(secret.Annotations[global.AGENT_USE_FOR_ANNOTATION]), global.USE_FOR_CLOUDFRONT)
+}
 
+// GetRegionalCertificateArn returns the ARN previously recorded against the Secret for the specified region, if any.
+func (r *SecretReconciler) GetRegionalCertificateArn(secret *corev1.Secret, region string) *string {
+
+	// Structured records, where present, take precedence. A record is only used if it was made in the account now targeted by the Secret (i.e. the assumed role has not moved to another account.)
+	if records := parseACMCertificateRecords(secret.Annotations[global.AGENT_ACM_CERTIFICATES_ANNOTATION]); records != nil {
+		account := targetAccount(secret)
+		for _, record := range records {
+			if record.Region == region && record.CertificateArn != "" && (account == "" || record.Account == account) {
+				certificateArn := record.CertificateArn
+				return &certificateArn
+			}
+		}
+		return nil
+	}
+
+	certificateArn, ok := secret.Annotations[regionalCertificateArnAnnotation(region)]
+	if ok && certificateArn != "" {
+		return &certificateArn
+	}
+
+	if region == global.CLOUDFRONT_REGION {
+		certificateArn, ok = secret.Annotations[global.AGENT_CLOUDFRONT_CERTIFICATE_ARN_ANNOTATION]
+		if ok && certificateArn != "" {
+			return &certificateArn
+		}
+	}
+
+	// Fall back to the primary ARN annotation provided it refers to the same region (e.g. when a regions annotation is first added to an existing Secret.)
+	certificateArn, ok = secret.Annotations[global.AGENT_CERTIFICATE_ARN_ANNOTATION]
+	if ok && certificateArn != "" {
+		parsedArn, err := arn.Parse(certificateArn)
+		if err == nil && parsedArn.Region == region {
+			return &certificateArn
+		}
+	}
+
+	return nil
+}
+
+// GetDataKeys returns the keys of the Secret data items holding the certificate, private key and (if held separately from the certificate) intermediate chain. Unless overridden by annotation, these are 'tls.crt', 'tls.key' and none respectively.
+func (r *SecretReconciler) GetDataKeys(secret *corev1.Secret) (string, string, string) {
+
+	certKey, keyKey := corev1.TLSCertKey, corev1.TLSPrivateKeyKey
+	if value := strings.TrimSpace(secret.Annotations[global.AGENT_CERT_KEY_ANNOTATION]); value != "" {
+		certKey = value
+	}
+	if value := strings.TrimSpace(secret.Annotations[global.AGENT_KEY_KEY_ANNOTATION]); value != "" {
+		keyKey = value
+	}
+	chainKey := strings.TrimSpace(secret.Annotations[global.AGENT_CHAIN_KEY_ANNOTATION])
+
+	return certKey, keyKey, chainKey
+}
+
+// DecodePKCS12 extracts the certificate (followed by its intermediates and any root) and private key from the PKCS#12 bundle held in the specified data item of the Secret, returning both in PEM format.
+// If the Secret names a password data key, its value (less any trailing newline) is used to decrypt the bundle. Otherwise, the bundle is assumed to have an empty password.
+func (r *SecretReconciler) DecodePKCS12(secret *corev1.Secret, pkcs12Key string) ([]byte, []byte, error) {
+
+	bundle, ok := secret.Data[pkcs12Key]
+	if !ok || len(bundle) == 0 {
+		return nil, nil, fmt.Errorf("'%s' is missing or empty", pkcs12Key)
+	}
+
+	password := ""
+	if passwordKey := strings.TrimSpace(secret.Annotations[global.AGENT_PKCS12_PASSWORD_KEY_ANNOTATION]); passwordKey != "" {
+		passwordBytes, ok := secret.Data[passwordKey]
+		if !ok {
+			return nil, nil, fmt.Errorf("'%s' is missing", passwordKey)
+		}
+		password = strings.TrimRight(string(passwordBytes), "\r\n")
+	}
+
+	privateKey, certificate, caCertificates, err := pkcs12.DecodeChain(bundle, password)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not decode PKCS#12 bundle within '%s': %s", pkcs12Key, err)
+	}
+
+	pkDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not encode private key within '%s': %s", pkcs12Key, err)
+	}
+
+	// Any root is retained here, and is separated from the intermediate chain by ParseCertificateDetails.
+	certBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw})
+	for _, caCertificate := range caCertificates {
+		certBytes = append(certBytes, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCertificate.Raw})...)
+	}
+
+	return certBytes, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkDER}), nil
+}
+
+// ReadCertificateData returns the certificate (followed by any intermediates held separately from it) and private key held by the Secret, in PEM format, together with the passphrase of the private key (if any) and the data key holding the certificate.
+func (r *SecretReconciler) ReadCertificateData(secret *corev1.Secret) ([]byte, []byte, []byte, string, error) {
+
+	certKey, keyKey, chainKey := r.GetDataKeys(secret)
+
+	var certBytes, pkBytes []byte
+	if pkcs12Key := strings.TrimSpace(secret.Annotations[global.AGENT_PKCS12_KEY_ANNOTATION]); pkcs12Key != "" {
+
+		// Certificate, chain and key are extracted from the bundle (and converted to PEM.)
+		var err error
+		certBytes, pkBytes, err = r.DecodePKCS12(secret, pkcs12Key)
 		if err != nil {
-			log.Error(err, "Failed to persist ACM certificate ARN back to Secret.")
-			return ctrl.Result{RequeueAfter: defaultRequeueLatency}, err
+			return nil, nil, nil, "", err
+		}
+		certKey = pkcs12Key
+
+	} else {
+
+		var ok bool
+		certBytes, ok = secret.Data[certKey]
+		if !ok || len(certBytes) == 0 {
+			return nil, nil, nil, "", fmt.Errorf("'%s' is missing or empty", certKey)
+		}
+
+		pkBytes, ok = secret.Data[keyKey]
+		if !ok || len(pkBytes) == 0 {
+			return nil, nil, nil, "", fmt.Errorf("'%s' is missing or empty", keyKey)
+		}
+
+		// Intermediates held separately from the leaf certificate are parsed as if appended to it.
+		if chainKey != "" {
+			chainBytes, ok := secret.Data[chainKey]
+			if !ok {
+				return nil, nil, nil, "", fmt.Errorf("'%s' is missing", chainKey)
+			}
+			certBytes = append(append(append([]byte{}, certBytes...), '\n'), chainBytes...)
 		}
 	}
 
-	if !shouldImportToACM && !shouldUpdateAnnotations {
-		log.Info("Secret evaluation complete: nothing to do.")
+	var passphrase []byte
+	if passwordKey := strings.TrimSpace(secret.Annotations[global.AGENT_KEY_PASSWORD_KEY_ANNOTATION]); passwordKey != "" {
+		passwordBytes, ok := secret.Data[passwordKey]
+		if !ok {
+			return nil, nil, nil, "", fmt.Errorf("'%s' is missing", passwordKey)
+		}
+		passphrase = []byte(strings.TrimRight(string(passwordBytes), "\r\n"))
+	}
+
+	return certBytes, pkBytes, passphrase, certKey, nil
+}
+
+// ParsePEMCertificates parses each of the PEM-encoded certificates held within the specified data item of the Secret.
+func (r *SecretReconciler) ParsePEMCertificates(certBytes []byte, certKey string) ([]*CertificateWrapper, error) {
+
+	regex := regexp.MustCompile(`(?m)` + global.PEM_CERTIFICATE_BEGIN_TAG + `[\w\W]+?` + global.PEM_CERTIFICATE_END_TAG)
+
+	certificates := []*CertificateWrapper{}
+
+	matches := regex.FindAllString(string(certBytes), -1)
+	for i, componentCertificate := range matches {
+		block, _ := pem.Decode([]byte(componentCertificate))
+		if block == nil {
+			return nil, fmt.Errorf("Could not decode certificate at index %d within '%s'.", i, certKey)
+		}
+
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse certificate at index %d within '%s'.", i, certKey)
+		}
+		// Certificates are re-encoded, so that the PEM imported into ACM does not depend on the formatting of the Secret (e.g. line endings or headers.)
+		certificates = append(certificates, &CertificateWrapper{
+			PEM:  strings.TrimSpace(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw}))),
+			x509: certificate,
+		})
 	}
 
-	return ctrl.Result{}, nil
+	return certificates, nil
 }
 
 func (r *SecretReconciler) ParseCertificateDetails(secret *corev1.Secret) (CertificateDetails, error) {
 
-	certBytes, ok := secret.Data["tls.crt"]
-	if !ok || len(certBytes) == 0 {
-		return CertificateDetails{}, errors.New("'tls.crt' is missing or empty")
+	certBytes, pkBytes, passphrase, certKey, err := r.ReadCertificateData(secret)
+	if err != nil {
+		return CertificateDetails{}, err
 	}
 
-	pkBytes, ok := secret.Data["tls.key"]
-	if !ok || len(pkBytes) == 0 {
-		return CertificateDetails{}, errors.New("'tls.key' is missing or empty")
+	// Convert the private key into a form accepted by ACM, decrypting it if necessary.
+	pkBytes, err = normalizePrivateKey(pkBytes, passphrase)
+	if err != nil {
+		return CertificateDetails{}, err
 	}
 
 	// Not currently used.
@@ -342,72 +1406,37 @@ func (r *SecretReconciler) ParseCertificateDetails(secret *corev1.Secret) (Certi
 		}
 	*/
 
-	certString := string(certBytes)
-	regex := regexp.MustCompile(`(?m)` + global.PEM_CERTIFICATE_BEGIN_TAG + `[\w\W]+?` + global.PEM_CERTIFICATE_END_TAG)
-
-	certificates := []*CertificateWrapper{}
-
-	matches := regex.FindAllString(certString, -1)
-	for i, componentCertificate := range matches {
-		block, _ := pem.Decode([]byte(componentCertificate))
-		if block == nil {
-			return CertificateDetails{}, fmt.Errorf("Could not decode certificate at index %d within 'tls.crt'.", i)
-		}
-
-		certificate, err := x509.ParseCertificate(block.Bytes)
-		if err != nil {
-			return CertificateDetails{}, fmt.Errorf("Could not parse certificate at index %d within 'tls.crt'.", i)
-		}
-		certificates = append(certificates, &CertificateWrapper{
-			PEM:  componentCertificate,
-			x509: certificate,
-		})
+	certificates, err := r.ParsePEMCertificates(certBytes, certKey)
+	if err != nil {
+		return CertificateDetails{}, err
 	}
 
-	// Find leaf certificate = the one whose subject is not *also* an issuer of another certificate.
-	var leaf *CertificateWrapper
-	for i, certificate := range certificates {
-		subjectDN := certificate.x509.Subject.String()
-		isIssuer := false
-		for j, otherCertificate := range certificates {
-			if i == j {
-				continue
-			}
-			if otherCertificate.x509.Issuer.String() == subjectDN {
-				isIssuer = true
-				break
-			}
-		}
-		if !isIssuer {
-			leaf = certificate
-			break
+	leaf, intermediates, root, err := r.BuildCertificateChain(certificates)
+	if err != nil {
+		if leaves := leafCertificates(certificates); len(leaves) > 1 && !multiLeafEnabled(secret) {
+			return CertificateDetails{}, fmt.Errorf("'%s' holds %d unrelated leaf certificates: set the '%s' annotation to 'true' to import each as a separate ACM certificate.", certKey, len(leaves), global.AGENT_MULTI_LEAF_ANNOTATION)
 		}
+		return CertificateDetails{}, fmt.Errorf("Invalid certificate chain within '%s': %s", certKey, err)
 	}
 
-	// Construct intermediate chain (leafwards -> rootwards)
-	var intermediates []*CertificateWrapper
-	current := leaf
-	for {
-		issuer := r.FindIssuingCertificate(current, certificates)
-		if issuer == nil {
-			break
-		}
-		intermediates = append(intermediates, issuer)
-		current = issuer
+	// Check that ACM accepts the leaf certificate's key (ECDSA leaf certificates must use one of the curves ACM supports.)
+	if err := validateCertificatePublicKey(leaf.x509); err != nil {
+		return CertificateDetails{}, err
 	}
 
-	// Verify that intermediate chain is complete
-	if len(intermediates) != len(matches)-1 {
-		return CertificateDetails{}, errors.New("One or more certificates not incorporated into intermediate chain.")
+	// Check that the private key belongs to the leaf certificate, since ACM would otherwise reject the import (with a less helpful error.)
+	if err := verifyPrivateKeyMatches(pkBytes, leaf.x509); err != nil {
+		return CertificateDetails{}, err
 	}
 
 	output := &CertificateDetails{
-		SecretName:    &secret.Name,
-		Namespace:     &secret.Namespace,
-		Certificate:   leaf,
-		Intermediates: intermediates,
-		CA:            nil, /*ca*/
-		PrivateKey:    pkBytes,
+		SecretName:      &secret.Name,
+		Namespace:       &secret.Namespace,
+		Certificate:     leaf,
+		Intermediates:   intermediates,
+		CA:              root,
+		PrivateKey:      pkBytes,
+		BundleReordered: !isNormalizedBundle(certificates, leaf, intermediates, root),
 	}
 
 	// Retrieve certificate ARN, if set.
@@ -420,64 +1449,9 @@ func (r *SecretReconciler) ParseCertificateDetails(secret *corev1.Secret) (Certi
 	return *output, nil
 }
 
-func (r *SecretReconciler) FindIssuingCertificate(subjectCertificate *CertificateWrapper, certificatePool []*CertificateWrapper) *CertificateWrapper {
-	issuerDN := subjectCertificate.x509.Issuer.String()
-	for _, candidateCertificate := range certificatePool {
-		if candidateCertificate.x509.Subject.String() == issuerDN {
-			return candidateCertificate
-		}
-	}
-	return nil
-}
-
-func (r *SecretReconciler) FindACMCertificatesByDomain(acmClient *acm.Client, domainName string) ([]*acm.DescribeCertificateOutput, error) {
-
-	var output []*acm.DescribeCertificateOutput
-
-	// AWS API for ACM provides no way (currently @v2.x) to search for certificates by domain, so we must iterate through.
-
-	var nextToken string
-	for {
-		input := acm.ListCertificatesInput{
-			MaxItems: aws.Int32(10),
-		}
-		if nextToken != "" {
-			input.NextToken = aws.String(nextToken)
-		}
-
-		listOutput, err := acmClient.ListCertificates(context.TODO(), &input)
-		if err != nil {
-			return output, err
-		}
-
-		for _, acmCertificateSummary := range listOutput.CertificateSummaryList {
-			if *acmCertificateSummary.DomainName == domainName {
-
-				// Retrieve certificate details
-				describeInput := acm.DescribeCertificateInput{
-					CertificateArn: acmCertificateSummary.CertificateArn,
-				}
-				acmCertificate, err := acmClient.DescribeCertificate(context.TODO(), &describeInput)
-				if err != nil {
-					return output, err
-				}
-
-				output = append(output, acmCertificate)
-			}
-		}
-
-		if listOutput.NextToken != nil {
-			nextToken = *listOutput.NextToken
-		} else {
-			nextToken = ""
-		}
-
-		if nextToken == "" {
-			break
-		}
-	}
-
-	return output, nil
+// FindACMCertificatesByDomains returns the ACM certificates listed under the same domain name as the certificate, and with the same set of domain names (subject CN and subject alternative names), using the shared ACM certificate index.
+func (r *SecretReconciler) FindACMCertificatesByDomains(ctx context.Context, acmClient ACMService, indexScope string, certificate *x509.Certificate) ([]ACMCertificateSummary, error) {
+	return acmIndex.FindByDomains(ctx, acmClient, indexScope, acmDomainName(certificate), certificateDomainNames(certificate))
 }
 
 func (r *SecretReconciler) DescribeCertificateChain(certificateDetails *CertificateDetails) string {
@@ -512,7 +1486,35 @@ func (r *SecretReconciler) CertificateWrapperArrayToPEM(wrapperArray []*Certific
 	return &output
 }
 
-func (r *SecretReconciler) GetACMCertificateTag(acmClient *acm.Client, certificateArn *string, tagKey string) *string {
+// ChainMatches returns true if the PEM-encoded certificate chain held by ACM contains exactly the specified intermediate certificates (in order.)
+func (r *SecretReconciler) ChainMatches(acmChainPEM string, intermediates []*CertificateWrapper) bool {
+
+	chain := [][]byte{}
+	rest := []byte(acmChainPEM)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			chain = append(chain, block.Bytes)
+		}
+	}
+
+	if len(chain) != len(intermediates) {
+		return false
+	}
+	for i, intermediate := range intermediates {
+		if !bytes.Equal(chain[i], intermediate.x509.Raw) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r *SecretReconciler) GetACMCertificateTag(acmClient ACMService, certificateArn *string, tagKey string) *string {
 
 	input := acm.ListTagsForCertificateInput{
 		CertificateArn: certificateArn,
@@ -531,51 +1533,69 @@ func (r *SecretReconciler) GetACMCertificateTag(acmClient *acm.Client, certifica
 	return nil
 }
 
-func (r *SecretReconciler) CreateStandardTagArray(createdAtString *string) []types.Tag {
+// CreateStandardTagArray renders the configured tag templates (see tagTemplates), followed by any additional templates for the object, for a certificate belonging to the specified K8s object. Additional templates replace configured templates with the same key (other than the owner tag.)
+func (r *SecretReconciler) CreateStandardTagArray(createdAtString *string, namespace string, name string, additionalTemplates []TagTemplate) []types.Tag {
 
-	now := aws.String(time.Now().UTC().Format(global.ISO_8601_FORMAT))
+	now := time.Now().UTC().Format(global.ISO_8601_FORMAT) // Why this weird format string? Because: reasons. (https://pkg.go.dev/time)
 
-	createModifiedTag := true
-
-	if createdAtString == nil {
-		createdAtString = now     // Why this weird format string? Because: reasons. (https://pkg.go.dev/time)	}
-		createModifiedTag = false // No previous createdAt timestamp, therefore don't create a 'modifiedAt' tag.
+	variables := map[string]string{
+		tagVariableAgent:         global.PACKAGE_NAME,
+		tagVariableClusterName:   ClusterName,
+		tagVariableCorrelationID: strings.ReplaceAll(base64.StdEncoding.EncodeToString([]byte(uuid.New().String())), "=", ""),
+		tagVariableCreatedAt:     now,
+		tagVariableModifiedAt:    "", // No previous createdAt timestamp, therefore don't create a 'modifiedAt' tag.
+		tagVariableName:          name,
+		tagVariableNamespace:     namespace,
 	}
-
-	output := []types.Tag{
-		{
-			Key:   aws.String("tron/correlationId"),
-			Value: aws.String(strings.ReplaceAll(base64.StdEncoding.EncodeToString([]byte(uuid.New().String())), "=", "")),
-		},
-		{
-			Key:   aws.String("tron/createdBy"),
-			Value: aws.String(global.PACKAGE_NAME),
-		},
-		{
-			Key:   aws.String("tron/createdAt"),
-			Value: createdAtString,
-		},
+	if createdAtString != nil {
+		variables[tagVariableCreatedAt] = *createdAtString
+		variables[tagVariableModifiedAt] = now
 	}
 
-	if createModifiedTag {
+	templates := []TagTemplate{}
+	for _, template := range tagTemplates() {
+		if !containsTagTemplateKey(additionalTemplates, template.Key) {
+			templates = append(templates, template)
+		}
+	}
+	templates = append(templates, additionalTemplates...)
+
+	output := []types.Tag{}
+	hasOwnerTag := false
+	for _, template := range templates {
+		value := template.render(variables)
+		if value == "" {
+			continue
+		}
+		if template.Key == OwnerTag.Key {
+			// The owner tag always takes precedence, since it is used to decide whether certificates may be overwritten.
+			value = ownerTagValue()
+			hasOwnerTag = true
+		}
 		output = append(output, types.Tag{
-			Key:   aws.String("tron/modifiedAt"),
-			Value: now,
+			Key:   aws.String(template.Key),
+			Value: aws.String(value),
+		})
+	}
+	if !hasOwnerTag {
+		output = append(output, types.Tag{
+			Key:   aws.String(OwnerTag.Key),
+			Value: aws.String(ownerTagValue()),
 		})
 	}
 
 	return output
 }
 
+// FormatX509SerialNumber formats the serial number as ACM does (as colon-separated hexadecimal bytes.) Negative serial numbers are formatted in two's complement (see serialNumberBytes.)
 func (r *SecretReconciler) FormatX509SerialNumber(number *big.Int) string {
-	hex := number.Text(16)
-
-	if len(hex)%2 > 0 {
-		hex = "0" + hex
+	digits := hex.EncodeToString(serialNumberBytes(number))
+	if digits == "" {
+		digits = "00"
 	}
 
 	var output string
-	for i, char := range hex {
+	for i, char := range digits {
 		if i > 0 && i%2 == 0 {
 			output = output + ":"
 		}
@@ -594,3 +1614,83 @@ func (r *SecretReconciler) ExtractCertificateDomains(certificate *x509.Certifica
 func (r *SecretReconciler) AnnotationMatches(secret *corev1.Secret, key string, value string) bool {
 	return secret.Annotations[key] == value
 }
+
+func (r *SecretReconciler) RegionalAnnotationsMatch(secret *corev1.Secret, regionalCertificateArns map[string]string) bool {
+
+	count := 0
+	for key := range secret.Annotations {
+		if strings.HasPrefix(key, global.AGENT_CERTIFICATE_ARN_ANNOTATION+".") {
+			count++
+		}
+	}
+	if count != len(regionalCertificateArns) {
+		return false
+	}
+
+	for region, certificateArn := range regionalCertificateArns {
+		if !r.AnnotationMatches(secret, regionalCertificateArnAnnotation(region), certificateArn) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// GetSyncStatus returns the sync status recorded in the Secret's annotations, if any.
+func (r *SecretReconciler) GetSyncStatus(secret *corev1.Secret) (SyncStatus, bool) {
+
+	syncStatus := SyncStatus{}
+	value, ok := secret.Annotations[global.AGENT_SYNC_STATUS_ANNOTATION]
+	if !ok || json.Unmarshal([]byte(value), &syncStatus) != nil {
+		return SyncStatus{}, false
+	}
+
+	return syncStatus, true
+}
+
+// RecordSyncStatus records the outcome of an unsuccessful (or incomplete) synchronization in the Secret's sync-status annotation, retaining the ARN and time of the last successful import, together with the number of consecutive times synchronization has been retried in its retry-count annotation. This is best effort: failures are logged but otherwise ignored.
+// Use RecordRetrySyncStatus if synchronization is to be retried with backoff.
+func (r *SecretReconciler) RecordSyncStatus(ctx context.Context, secret *corev1.Secret, state string, message string) {
+	r.recordSyncStatus(ctx, secret, state, message, false)
+}
+
+// RecordRetrySyncStatus records the outcome of a synchronization that is about to be retried with backoff (see requeueWithBackoff), as RecordSyncStatus. The retry-count annotation includes the retry being requeued, which the rate limiter only counts once the Secret is requeued.
+func (r *SecretReconciler) RecordRetrySyncStatus(ctx context.Context, secret *corev1.Secret, state string, message string) {
+	r.recordSyncStatus(ctx, secret, state, message, true)
+}
+
+func (r *SecretReconciler) recordSyncStatus(ctx context.Context, secret *corev1.Secret, state string, message string, retrying bool) {
+
+	log := log.FromContext(ctx)
+
+	syncStatus, _ := r.GetSyncStatus(secret)
+	syncStatus.State = state
+	syncStatus.Message = message
+
+	value, err := json.Marshal(syncStatus)
+	if err != nil {
+		return
+	}
+	retries := r.retries.NumRequeues(ctrl.Request{NamespacedName: client.ObjectKeyFromObject(secret)})
+	if retrying {
+		retries++
+	}
+	retryCount := ""
+	if retries > 0 {
+		retryCount = strconv.Itoa(retries)
+	}
+	if r.AnnotationMatches(secret, global.AGENT_SYNC_STATUS_ANNOTATION, string(value)) && r.AnnotationMatches(secret, global.AGENT_RETRY_COUNT_ANNOTATION, retryCount) {
+		return
+	}
+
+	patch := client.MergeFrom(secret.DeepCopy())
+	setAnnotation(secret, global.AGENT_SYNC_STATUS_ANNOTATION, string(value))
+	if retryCount != "" {
+		setAnnotation(secret, global.AGENT_RETRY_COUNT_ANNOTATION, retryCount)
+	} else {
+		delete(secret.Annotations, global.AGENT_RETRY_COUNT_ANNOTATION)
+	}
+	if err := r.Patch(ctx, secret, patch); err != nil {
+		log.Error(err, "Failed to record sync status on Secret.")
+	}
+}
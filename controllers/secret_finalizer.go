@@ -0,0 +1,138 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// Finalizer added to managed Secrets whose deletion requires clean-up by the agent (see SecretReconciler.NeedsFinalizer.)
+const secretFinalizerID = global.DOMAIN_NAME + "/" + global.PACKAGE_NAME
+
+const (
+	// Default maximum time for which the agent's finalizer delays deletion of a Secret (see SecretReconciler.FinalizerTimeout.)
+	defaultSecretFinalizerTimeout = 5 * time.Minute
+)
+
+// Returns the configured FinalizerTimeout, defaulting to defaultSecretFinalizerTimeout.
+func (r *SecretReconciler) finalizerTimeout() time.Duration {
+	if r.FinalizerTimeout <= 0 {
+		return defaultSecretFinalizerTimeout
+	}
+	return r.FinalizerTimeout
+}
+
+// NeedsFinalizer returns true if the agent must act when the Secret is deleted: either to delete its ACM certificates (see the delete-policy annotation), or to record their retention in the audit trail. Secrets replicated from another cluster never need a finalizer, since their ACM certificates belong to the source cluster.
+func (r *SecretReconciler) NeedsFinalizer(secret *corev1.Secret) bool {
+	if sourceCluster := secret.Annotations[global.AGENT_SOURCE_CLUSTER_ANNOTATION]; sourceCluster != "" && sourceCluster != ClusterName {
+		return false
+	}
+	return (r.EnableCertificateDeletion && hasDeletePolicy(secret.Annotations)) || len(AuditSinks) > 0
+}
+
+// ReconcileFinalizer adds the agent's finalizer to the Secret if required, or removes it if no longer required (e.g. the Secret's delete policy was changed.)
+func (r *SecretReconciler) ReconcileFinalizer(ctx context.Context, secret *corev1.Secret, required bool) error {
+
+	hasFinalizer := containsString(secret.Finalizers, secretFinalizerID)
+	if hasFinalizer == required {
+		return nil
+	}
+
+	// Patch with an optimistic lock, so that finalizers added or removed concurrently by other controllers are not overwritten.
+	patch := client.MergeFromWithOptions(secret.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	if required {
+		log.FromContext(ctx).Info("Adding finalizer to Secret...")
+		secret.Finalizers = append(secret.Finalizers, secretFinalizerID)
+	} else {
+		log.FromContext(ctx).Info("Removing finalizer from Secret...")
+		secret.Finalizers = removeString(secret.Finalizers, secretFinalizerID)
+	}
+	if err := r.Patch(ctx, secret, patch); err != nil {
+		return fmt.Errorf("Could not update finalizers of Secret: %w", err)
+	}
+
+	return nil
+}
+
+// FinalizeSecret cleans up the ACM certificates of a Secret that is marked for deletion and holds the agent's finalizer, then removes the finalizer. If clean-up fails it is retried, until FinalizerTimeout has elapsed since deletion was requested: the finalizer is then removed regardless, so that deletion (e.g. of the Secret's namespace) is not blocked indefinitely.
+func (r *SecretReconciler) FinalizeSecret(ctx context.Context, secret *corev1.Secret) (ctrl.Result, error) {
+
+	log := log.FromContext(ctx)
+
+	if err := r.CleanUpDeletedSecret(ctx, secret); err != nil {
+		if time.Since(secret.DeletionTimestamp.Time) < r.finalizerTimeout() {
+			return requeueWithBackoff(err)
+		}
+		message := fmt.Sprintf("ACM clean-up did not complete within %s of deletion: releasing Secret.", r.finalizerTimeout())
+		log.Error(err, message)
+		r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonACMError, fmt.Sprintf("%s Last error: %s", message, err))
+	}
+
+	if err := r.ReconcileFinalizer(ctx, secret, false); err != nil {
+		return requeueWithBackoff(client.IgnoreNotFound(err))
+	}
+
+	log.Info("Secret is marked for deletion: clean up complete.")
+	return ctrl.Result{}, nil
+}
+
+// CleanUpDeletedSecret deletes the ACM certificates of a Secret that is marked for deletion, if deletion is enabled and requested. Otherwise, the retention of its ACM certificates is recorded in the audit trail (if any.)
+func (r *SecretReconciler) CleanUpDeletedSecret(ctx context.Context, secret *corev1.Secret) error {
+
+	log := log.FromContext(ctx)
+
+	// ACM certificates of replicated Secrets belong to the source cluster.
+	if sourceCluster := secret.Annotations[global.AGENT_SOURCE_CLUSTER_ANNOTATION]; sourceCluster != "" && sourceCluster != ClusterName {
+		log.Info(fmt.Sprintf("Secret was replicated from cluster '%s': ACM certificates will not be deleted.", sourceCluster))
+		return nil
+	}
+
+	certificateArns := annotatedCertificateArns(secret.Annotations)
+
+	if !r.EnableCertificateDeletion || !hasDeletePolicy(secret.Annotations) {
+		log.Info("Secret is marked for deletion: ACM certificates are retained.")
+		for _, certificateArn := range certificateArns {
+			region := ""
+			if parsedArn, err := arn.Parse(certificateArn); err == nil {
+				region = parsedArn.Region
+			}
+			recordAudit(ctx, AuditRecord{Action: auditActionRetain, CertificateArn: certificateArn, Region: region}, nil)
+		}
+		return nil
+	}
+
+	log.Info("Secret is marked for deletion: removing unused ACM certificates...")
+
+	cfg, err := loadAWSConfig(ctx, secret.Annotations[global.AGENT_ASSUME_ROLE_ARN_ANNOTATION])
+	if err != nil {
+		log.Error(err, "Failed to load AWS configuration.")
+		return err
+	}
+
+	if err := deleteACMCertificates(ctx, r.acmServiceFactory(), cfg, certificateArns); err != nil {
+		log.Error(err, "ACM certificate deletion failed.")
+		r.Recorder.Event(secret, corev1.EventTypeWarning, eventReasonACMError, fmt.Sprintf("ACM certificate deletion failed: %s", err))
+		return err
+	}
+
+	r.Recorder.Event(secret, corev1.EventTypeNormal, eventReasonDeleted, "Unused ACM certificates deleted.")
+	return nil
+}
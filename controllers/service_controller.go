@@ -0,0 +1,173 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// ServiceReconciler injects ACM certificate annotations into Services of type LoadBalancer (NLB/CLB) by finding a matching SSL-containing Secret for the Service's external DNS host name(s).
+type ServiceReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// Maximum number of objects reconciled in parallel (default 1.)
+	MaxConcurrentReconciles int
+
+	// Delay before the first retry of an object whose reconciliation fails (doubling on each subsequent failure.) Defaults to 1 second.
+	RequeueDelay time.Duration
+
+	// Retries of failed objects, parking those that exceed MaxRetries. Set by SetupWithManager.
+	retries *retryLimiter
+}
+
+func (r *ServiceReconciler) SetupWithManager(mgr ctrl.Manager) error {
+
+	r.retries = newRetryLimiter("service", r.RequeueDelay)
+
+	if err := indexSecretsByType(mgr); err != nil {
+		return err
+	}
+
+	// Tells the controller which object type this reconciler will handle.
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("service").
+		For(&corev1.Service{}).
+		WithOptions(controller.Options{RateLimiter: r.retries.rateLimiter, MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
+		WithLogConstructor(buildLogConstructor(mgr, "service-reconciler", "(core)", "service")). // When multiple controllers running with a single manager, the log auto-constructor does not work. Therefore we must do manually.
+		Complete(r)
+}
+
+func (r *ServiceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+
+	log := log.FromContext(ctx)
+
+	service := &corev1.Service{}
+	if err := r.Get(ctx, req.NamespacedName, service); err != nil {
+		if !k8serr.IsNotFound(err) {
+			log.Error(err, "Unable to retrieve Service.")
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	log.V(1).Info(fmt.Sprintf("Processing Service %s...", req.NamespacedName))
+
+	// Object is marked for deletion - nothing to do (the operator never removes synced ACM certificates.)
+	if !service.ObjectMeta.DeletionTimestamp.IsZero() {
+		log.Info("Service is marked for deletion: nothing to do.")
+		return ctrl.Result{}, nil
+	}
+
+	// Detect if Service is annotated to enable ACM certificate management.
+	certificateAgentEnabledAnnotation, certificateAgentEnabled := service.Annotations[global.AGENT_ENABLED_ANNOTATION]
+	if certificateAgentEnabled {
+		certificateAgentEnabled, _ = strconv.ParseBool(certificateAgentEnabledAnnotation)
+	}
+
+	if !certificateAgentEnabled {
+		log.Info(fmt.Sprintf("Service '%s' is not marked as managed.", req.NamespacedName))
+		return ctrl.Result{}, nil
+	}
+
+	// Objects whose retries have been exhausted are not reconciled again until they change.
+	if r.retries.Parked(req, service.ResourceVersion) {
+		log.Info("Service is parked (retries exhausted): nothing to do.")
+		return ctrl.Result{}, nil
+	}
+	if r.retries.Exhausted(req) {
+		log.Info(retriesExhaustedMessage())
+		r.Recorder.Event(service, corev1.EventTypeWarning, eventReasonRetriesExhausted, retriesExhaustedMessage())
+		r.retries.Park(req, service.ResourceVersion)
+		return ctrl.Result{}, nil
+	}
+
+	// Make sure Service is provisioned by a load balancer.
+	if service.Spec.Type != corev1.ServiceTypeLoadBalancer {
+		log.Info(fmt.Sprintf("Service is not of type '%s': aborting.", corev1.ServiceTypeLoadBalancer))
+		return ctrl.Result{}, nil
+	}
+
+	// Host names are taken from the external-dns annotation, which is the conventional way to declare the DNS name(s) of a load balanced Service.
+	hostNamesAnnotation, ok := service.Annotations[global.EXTERNAL_DNS_HOSTNAME_ANNOTATION]
+	if !ok || strings.TrimSpace(hostNamesAnnotation) == "" {
+		log.Info(fmt.Sprintf("Service does not define a '%s' annotation: aborting.", global.EXTERNAL_DNS_HOSTNAME_ANNOTATION))
+		return ctrl.Result{}, nil
+	}
+
+	hostNames := []string{}
+	for _, hostName := range trimSpaceFromSliceElements(strings.Split(hostNamesAnnotation, ",")) {
+		if hostName != "" && !containsString(hostNames, hostName) {
+			hostNames = append(hostNames, hostName)
+		}
+	}
+
+	// Retrieve certificate ARNs for hosts by processing TLS certificates stored as K8S Secrets which have been processed by secret_controller and synced with ACM.
+	secrets, listErr := listTLSSecrets(ctx, r.Client)
+	if listErr != nil {
+		log.Error(listErr, "Could not list Secrets.")
+		return ctrl.Result{}, listErr
+	}
+	var hasUnmatchedHostName bool
+	unmatchedHostNames := []string{}
+	certificateArns := []string{}
+	for _, hostName := range hostNames {
+		certificateArn, err := findCertificateArnForHost(secrets, hostName)
+		if err != nil {
+			// If we can't find an ARN for a given hostname, we can still save the ones we can find - but return an error so reconciliation is re-attempted.
+			hasUnmatchedHostName = true
+			unmatchedHostNames = append(unmatchedHostNames, hostName)
+			continue
+		}
+		if !containsString(certificateArns, certificateArn) {
+			certificateArns = append(certificateArns, certificateArn)
+		}
+	}
+
+	// Update annotation.
+	arnAnnotation := strings.Join(certificateArns, ",")
+	serviceARNAnnotation, serviceHasARNAnnotation := service.Annotations[global.AWS_LOAD_BALANCER_SSL_CERT_ANNOTATION]
+	if len(certificateArns) > 0 && (!serviceHasARNAnnotation || serviceARNAnnotation != arnAnnotation) {
+		log.Info("Adding ACM certificate ARNs to Service...")
+
+		// Certificate ARN annotation for NLB/CLB can hold multiple (comma-separated) ARN values.
+		patch := client.MergeFrom(service.DeepCopy())
+		setAnnotation(service, global.AWS_LOAD_BALANCER_SSL_CERT_ANNOTATION, arnAnnotation)
+		if err := r.Patch(ctx, service, patch); err != nil {
+			log.Error(err, "Failed to persist ACM certificate ARN(s) back to Service.")
+			return ctrl.Result{}, err
+		}
+		r.Recorder.Event(service, corev1.EventTypeNormal, eventReasonDecorated, fmt.Sprintf("ACM certificate ARN(s) set to '%s'.", arnAnnotation))
+	}
+
+	if hasUnmatchedHostName {
+		log.Info("At least one host name was not reconciled with a certificate ARN: will retry.")
+		r.Recorder.Event(service, corev1.EventTypeWarning, eventReasonUnmatchedHosts, fmt.Sprintf("No ACM certificate found for host(s): %s.", strings.Join(unmatchedHostNames, ", ")))
+		return requeueWithBackoff(nil)
+	}
+
+	return ctrl.Result{}, nil
+}
@@ -0,0 +1,195 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	cm "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	corev1 "k8s.io/api/core/v1"
+	networking "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+const (
+	// Path, on the manager's metrics server, at which StatusHandler is served.
+	StatusPath = "/status"
+)
+
+// ObjectStatus summarises the state of an object managed by the agent.
+type ObjectStatus struct {
+	Kind            string   `json:"kind"`
+	Namespace       string   `json:"namespace"`
+	Name            string   `json:"name"`
+	State           string   `json:"state,omitempty"`
+	CertificateArns []string `json:"certificateArns,omitempty"`
+	Expires         string   `json:"expires,omitempty"`
+	LastImportTime  string   `json:"lastImportTime,omitempty"`
+	CertificateHash string   `json:"certificateHash,omitempty"`
+	Message         string   `json:"message,omitempty"`
+}
+
+// StatusHandler serves a summary of the Secrets, cert-manager Certificates and Ingresses managed by the agent (their ACM certificate ARNs, expiry, and the outcome of their most recent synchronization), so that operators can review the agent's state without combining annotations read using kubectl.
+// The summary is JSON by default, or a table if requested with '?format=table'. Objects can be filtered by state (e.g. '?state=Failed'.)
+type StatusHandler struct {
+	// Reader used to list managed objects (typically the manager's cached client.)
+	Client client.Reader
+}
+
+func (h *StatusHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+
+	log := log.FromContext(req.Context()).WithName("status")
+
+	statuses, err := h.ListObjectStatuses(req.Context())
+	if err != nil {
+		log.Error(err, "Unable to list managed objects.")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if state := req.URL.Query().Get("state"); state != "" {
+		filtered := []ObjectStatus{}
+		for _, status := range statuses {
+			if strings.EqualFold(status.State, state) {
+				filtered = append(filtered, status)
+			}
+		}
+		statuses = filtered
+	}
+
+	if req.URL.Query().Get("format") == "table" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(table, "KIND\tNAMESPACE\tNAME\tSTATE\tEXPIRES\tCERTIFICATE ARNS\tMESSAGE")
+		for _, status := range statuses {
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", status.Kind, status.Namespace, status.Name, status.State, status.Expires, strings.Join(status.CertificateArns, ","), status.Message)
+		}
+		table.Flush()
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(statuses); err != nil {
+		log.Error(err, "Unable to write status.")
+	}
+}
+
+// ListObjectStatuses returns the status of each object managed by the agent, ordered by kind, namespace and name. Kinds whose CRDs are not installed (e.g. cert-manager Certificates) are omitted.
+func (h *StatusHandler) ListObjectStatuses(ctx context.Context) ([]ObjectStatus, error) {
+
+	statuses := []ObjectStatus{}
+
+	secrets := &corev1.SecretList{}
+	if err := h.Client.List(ctx, secrets); err != nil {
+		return nil, err
+	}
+	for _, secret := range secrets.Items {
+		if err := applyNamespaceDefaults(ctx, h.Client, &secret); err != nil {
+			return nil, err
+		}
+		syncStatus, synced := (&SecretReconciler{}).GetSyncStatus(&secret)
+		if enabled, _ := strconv.ParseBool(secret.Annotations[global.AGENT_ENABLED_ANNOTATION]); !enabled && !synced {
+			continue
+		}
+		certificateArns := annotatedCertificateArns(secret.Annotations)
+		sort.Strings(certificateArns)
+		statuses = append(statuses, ObjectStatus{
+			Kind:            "Secret",
+			Namespace:       secret.Namespace,
+			Name:            secret.Name,
+			State:           syncStatus.State,
+			CertificateArns: certificateArns,
+			Expires:         secret.Annotations[global.AGENT_CERTIFICATE_EXPIRY_DATE_ANNOTATION],
+			LastImportTime:  syncStatus.LastImportTime,
+			CertificateHash: secret.Annotations[global.AGENT_CERTIFICATE_HASH_ANNOTATION],
+			Message:         syncStatus.Message,
+		})
+	}
+
+	certificates := &cm.CertificateList{}
+	if err := h.Client.List(ctx, certificates); err != nil && !meta.IsNoMatchError(err) {
+		return nil, err
+	}
+	for _, certificate := range certificates.Items {
+		if enabled, _ := strconv.ParseBool(certificate.Annotations[global.AGENT_ENABLED_ANNOTATION]); !enabled {
+			continue
+		}
+		status := ObjectStatus{
+			Kind:      cm.CertificateKind,
+			Namespace: certificate.Namespace,
+			Name:      certificate.Name,
+		}
+		if certificateArn := certificate.Annotations[global.AGENT_CERTIFICATE_ARN_ANNOTATION]; certificateArn != "" {
+			status.CertificateArns = []string{certificateArn}
+		}
+		if certificate.Status.NotAfter != nil {
+			status.Expires = certificate.Status.NotAfter.UTC().Format(global.ISO_8601_FORMAT)
+		}
+		for _, condition := range certificate.Status.Conditions {
+			if condition.Type == certificateConditionACMSynced {
+				status.State = condition.Reason
+				status.Message = condition.Message
+			}
+		}
+		statuses = append(statuses, status)
+	}
+
+	ingresses := &networking.IngressList{}
+	if err := h.Client.List(ctx, ingresses); err != nil {
+		return nil, err
+	}
+	for _, ingress := range ingresses.Items {
+		if err := applyNamespaceDefaults(ctx, h.Client, &ingress); err != nil {
+			return nil, err
+		}
+		if enabled, _ := strconv.ParseBool(ingress.Annotations[global.AGENT_ENABLED_ANNOTATION]); !enabled {
+			continue
+		}
+		status := ObjectStatus{
+			Kind:            "Ingress",
+			Namespace:       ingress.Namespace,
+			Name:            ingress.Name,
+			CertificateArns: splitCertificateArns(ingress.Annotations[global.AGENT_MANAGED_CERTIFICATE_ARNS_ANNOTATION]),
+		}
+		hostCertificates := HostCertificates{}
+		if value, ok := ingress.Annotations[global.AGENT_HOST_CERTIFICATES_ANNOTATION]; ok && json.Unmarshal([]byte(value), &hostCertificates) == nil {
+			status.State = eventReasonDecorated
+			if len(hostCertificates.Unmatched) > 0 {
+				status.State = eventReasonUnmatchedHosts
+				status.Message = fmt.Sprintf("No ACM certificate found for host(s): %s.", strings.Join(hostCertificates.Unmatched, ", "))
+			}
+		}
+		statuses = append(statuses, status)
+	}
+
+	sort.SliceStable(statuses, func(i, j int) bool {
+		if statuses[i].Kind != statuses[j].Kind {
+			return statuses[i].Kind < statuses[j].Kind
+		}
+		if statuses[i].Namespace != statuses[j].Namespace {
+			return statuses[i].Namespace < statuses[j].Namespace
+		}
+		return statuses[i].Name < statuses[j].Name
+	})
+
+	return statuses, nil
+}
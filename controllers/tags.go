@@ -0,0 +1,161 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// TagTemplate is an ACM tag whose value may reference variables (e.g. '{namespace}') that are substituted when the tag is applied.
+type TagTemplate struct {
+	Key   string
+	Value string
+}
+
+const (
+	tagVariableAgent         = "agent"
+	tagVariableClusterName   = "clusterName"
+	tagVariableCorrelationID = "correlationId"
+	tagVariableCreatedAt     = "createdAt"
+	tagVariableModifiedAt    = "modifiedAt"
+	tagVariableName          = "name"
+	tagVariableNamespace     = "namespace"
+)
+
+var tagVariablePattern = regexp.MustCompile(`\{([A-Za-z]+)\}`)
+
+// TagTemplates is the set of tags applied to ACM certificates imported or requested by the agent. Tags whose value is empty once variables have been substituted are omitted. Set before reconcilers are registered with the manager.
+var TagTemplates = []TagTemplate{
+	{Key: "tron/correlationId", Value: "{" + tagVariableCorrelationID + "}"},
+	{Key: "tron/createdBy", Value: "{" + tagVariableAgent + "}"},
+	{Key: "tron/createdAt", Value: "{" + tagVariableCreatedAt + "}"},
+	{Key: "tron/modifiedAt", Value: "{" + tagVariableModifiedAt + "}"},
+	{Key: "tron/clusterName", Value: "{" + tagVariableClusterName + "}"},
+}
+
+// OwnerTag identifies ACM certificates that were created by the agent (and may therefore be overwritten by it.) It is always applied, even if absent from TagTemplates. Its value may reference the {agent} and {clusterName} variables. Set before reconcilers are registered with the manager.
+var OwnerTag = TagTemplate{Key: "tron/createdBy", Value: "{" + tagVariableAgent + "}"}
+
+// Returned when an ACM certificate that would be overwritten does not carry the agent's owner tag.
+type certificateNotOwnedError struct {
+	certificateArn string
+}
+
+func (e *certificateNotOwnedError) Error() string {
+	return fmt.Sprintf("ACM certificate '%s' is not tagged '%s=%s' and may be owned by another tool: refusing to overwrite.", e.certificateArn, OwnerTag.Key, ownerTagValue())
+}
+
+// ParseOwnerTag parses a 'key=value' owner tag.
+func ParseOwnerTag(value string) (TagTemplate, error) {
+
+	templates, err := ParseTagTemplates(value)
+	if err != nil {
+		return TagTemplate{}, err
+	}
+	if len(templates) != 1 {
+		return TagTemplate{}, fmt.Errorf("'%s' is not a valid owner tag: expected a single 'key=value'.", value)
+	}
+	for _, match := range tagVariablePattern.FindAllStringSubmatch(templates[0].Value, -1) {
+		if match[1] != tagVariableAgent && match[1] != tagVariableClusterName {
+			return TagTemplate{}, fmt.Errorf("Owner tag may only reference the {%s} and {%s} variables.", tagVariableAgent, tagVariableClusterName)
+		}
+	}
+
+	return templates[0], nil
+}
+
+// Returns the value of the owner tag expected on ACM certificates created by the agent.
+func ownerTagValue() string {
+	return OwnerTag.render(map[string]string{
+		tagVariableAgent:       global.PACKAGE_NAME,
+		tagVariableClusterName: ClusterName,
+	})
+}
+
+// ParseTagTemplates parses a comma-separated list of 'key=value' tag templates.
+func ParseTagTemplates(value string) ([]TagTemplate, error) {
+
+	output := []TagTemplate{}
+	for _, entry := range trimSpaceFromSliceElements(strings.Split(value, ",")) {
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("'%s' is not a valid tag: expected 'key=value'.", entry)
+		}
+		template, err := newTagTemplate(parts[0], parts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		output = append(output, template)
+	}
+
+	return output, nil
+}
+
+// Returns a tag template with the specified key and value, checking that the key is valid and that the value only references known variables.
+func newTagTemplate(key string, value string) (TagTemplate, error) {
+
+	template := TagTemplate{Key: strings.TrimSpace(key), Value: strings.TrimSpace(value)}
+
+	if template.Key == "" {
+		return TagTemplate{}, fmt.Errorf("Tag key must not be empty.")
+	}
+	if len(template.Key) > 128 {
+		return TagTemplate{}, fmt.Errorf("Tag key '%s' exceeds 128 characters.", template.Key)
+	}
+	for _, match := range tagVariablePattern.FindAllStringSubmatch(template.Value, -1) {
+		switch match[1] {
+		case tagVariableAgent, tagVariableClusterName, tagVariableCorrelationID, tagVariableCreatedAt, tagVariableModifiedAt, tagVariableName, tagVariableNamespace:
+		default:
+			return TagTemplate{}, fmt.Errorf("Tag '%s' references unknown variable '%s'.", template.Key, match[0])
+		}
+	}
+
+	return template, nil
+}
+
+// Returns the key of the tag that records when the agent first created the ACM certificate (if any), so that it can be preserved when the certificate is re-imported.
+func createdAtTagKey() string {
+	for _, template := range tagTemplates() {
+		if template.Value == "{"+tagVariableCreatedAt+"}" {
+			return template.Key
+		}
+	}
+	return ""
+}
+
+// Returns true if the slice contains a tag template with the specified key.
+func containsTagTemplateKey(templates []TagTemplate, key string) bool {
+	for _, template := range templates {
+		if template.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Substitutes variables in the tag template value. Unknown variables are left unchanged.
+func (t TagTemplate) render(variables map[string]string) string {
+	return tagVariablePattern.ReplaceAllStringFunc(t.Value, func(match string) string {
+		if value, ok := variables[match[1:len(match)-1]]; ok {
+			return value
+		}
+		return match
+	})
+}
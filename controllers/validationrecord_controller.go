@@ -0,0 +1,244 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+	"github.com/aws/aws-sdk-go-v2/service/acm/types"
+	corev1 "k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"Validitron/k8s-acm-certificate-agent/api/v1alpha1"
+)
+
+// ValidationRecordReconciler publishes the DNS validation records of ACM certificates awaiting validation to the Route53 hosted zones selected for each ACMCertificateRequest, and reports validation progress in its status.
+type ValidationRecordReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// Maximum number of objects reconciled in parallel (default 1.)
+	MaxConcurrentReconciles int
+
+	// Delay before the first retry of an object whose reconciliation fails (doubling on each subsequent failure.) Defaults to 1 second.
+	RequeueDelay time.Duration
+
+	// Retries of failed objects, parking those that exceed MaxRetries. Set by SetupWithManager.
+	retries *retryLimiter
+}
+
+func (r *ValidationRecordReconciler) SetupWithManager(mgr ctrl.Manager) error {
+
+	r.retries = newRetryLimiter("validationrecord", r.RequeueDelay)
+
+	// Tells the controller which object type this reconciler will handle. (ACMCertificateRequests are also handled by ACMCertificateRequestReconciler, so the controller must be explicitly named.)
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("validationrecord").
+		For(&v1alpha1.ACMCertificateRequest{}).
+		WithOptions(controller.Options{RateLimiter: r.retries.rateLimiter, MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
+		WithLogConstructor(buildLogConstructor(mgr, "validationrecord-reconciler", v1alpha1.GroupVersion.Group, "ACMCertificateRequest")). // When multiple controllers running with a single manager, the log auto-constructor does not work. Therefore we must do manually.
+		Complete(r)
+}
+
+func (r *ValidationRecordReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+
+	log := log.FromContext(ctx)
+
+	certificateRequest := &v1alpha1.ACMCertificateRequest{}
+	if err := r.Get(ctx, req.NamespacedName, certificateRequest); err != nil {
+		if !k8serr.IsNotFound(err) {
+			log.Error(err, "Unable to retrieve ACMCertificateRequest.")
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	// Nothing to do until a certificate has been requested (the resulting status update will trigger reconciliation.)
+	if !certificateRequest.ObjectMeta.DeletionTimestamp.IsZero() || certificateRequest.Status.CertificateArn == "" {
+		return ctrl.Result{}, nil
+	}
+
+	log.V(1).Info(fmt.Sprintf("Processing validation records for ACMCertificateRequest %s...", req.NamespacedName))
+
+	// Objects whose retries have been exhausted are not reconciled again until they change.
+	if r.retries.Parked(req, certificateRequest.ResourceVersion) {
+		log.Info("ACMCertificateRequest is parked (retries exhausted): nothing to do.")
+		return ctrl.Result{}, nil
+	}
+	if r.retries.Exhausted(req) {
+		log.Info(retriesExhaustedMessage())
+		r.Recorder.Event(certificateRequest, corev1.EventTypeWarning, eventReasonRetriesExhausted, retriesExhaustedMessage())
+		r.retries.Park(req, certificateRequest.ResourceVersion)
+		return ctrl.Result{}, nil
+	}
+
+	original := certificateRequest.Status.DeepCopy()
+	result, validationErr := r.ValidateCertificate(ctx, certificateRequest)
+
+	if !reflect.DeepEqual(original, &certificateRequest.Status) {
+		if err := r.Status().Update(ctx, certificateRequest); err != nil {
+			log.Error(err, "Failed to update ACMCertificateRequest status.")
+			return requeueWithBackoff(err)
+		}
+	}
+
+	return result, validationErr
+}
+
+// ValidateCertificate publishes the DNS validation records for the certificate referenced by the ACMCertificateRequest (if it is awaiting validation), recording progress in the status of the ACMCertificateRequest (which is not persisted.)
+func (r *ValidationRecordReconciler) ValidateCertificate(ctx context.Context, certificateRequest *v1alpha1.ACMCertificateRequest) (ctrl.Result, error) {
+
+	log := log.FromContext(ctx)
+
+	// Condition handling is shared with ACMCertificateRequestReconciler.
+	requestReconciler := &ACMCertificateRequestReconciler{Recorder: r.Recorder}
+
+	cfg, err := loadAWSConfig(ctx, certificateRequest.Spec.RoleArn)
+	if err != nil {
+		log.Error(err, "Failed to load AWS configuration.")
+		return ctrl.Result{}, err
+	}
+
+	region := certificateRequest.Spec.Region
+	if region == "" {
+		region = cfg.Region
+	}
+	acmClient := NewAWSACMService(cfg, region)
+
+	describeOutput, err := acmClient.DescribeCertificate(ctx, &acm.DescribeCertificateInput{CertificateArn: aws.String(certificateRequest.Status.CertificateArn)})
+	if err != nil {
+		if isACMResourceNotFound(err) {
+			// ACMCertificateRequestReconciler will request a replacement.
+			return ctrl.Result{}, nil
+		}
+		log.Error(err, "ACM certificate lookup failed.")
+		return requeueWithBackoff(err)
+	}
+
+	records := extractValidationRecords(describeOutput.Certificate)
+
+	// Retain the hosted zone assignments made when records were published.
+	for i := range records {
+		for _, existing := range certificateRequest.Status.ValidationRecords {
+			if existing.Name == records[i].Name {
+				records[i].HostedZoneID = existing.HostedZoneID
+			}
+		}
+	}
+
+	if describeOutput.Certificate.Status != types.CertificateStatusPendingValidation {
+		certificateRequest.Status.ValidationRecords = records
+		if describeOutput.Certificate.Status == types.CertificateStatusIssued {
+			requestReconciler.SetCondition(certificateRequest, v1alpha1.ConditionValidated, metav1.ConditionTrue, "Validated", "All domain names have been validated.")
+		}
+		return ctrl.Result{}, nil
+	}
+
+	if len(records) == 0 {
+		log.Info("ACM has not yet provided DNS validation records: will retry.")
+		return requeueWithBackoff(nil)
+	}
+
+	r.SetValidationProgress(requestReconciler, certificateRequest, records)
+
+	hostedZoneIDs := selectedHostedZoneIDs(certificateRequest)
+	if len(hostedZoneIDs) == 0 {
+		certificateRequest.Status.ValidationRecords = records
+		requestReconciler.SetCondition(certificateRequest, v1alpha1.ConditionValidationRecordsPublished, metav1.ConditionFalse, "NoHostedZone", "No Route53 hosted zone specified: DNS validation records listed in status must be created manually.")
+		return requeueWithBackoff(nil)
+	}
+
+	// Publish records only when they change (ACM re-uses validation records for the lifetime of the certificate.)
+	if !meta.IsStatusConditionTrue(certificateRequest.Status.Conditions, v1alpha1.ConditionValidationRecordsPublished) || !r.RecordsMatch(certificateRequest.Status.ValidationRecords, records) || meta.FindStatusCondition(certificateRequest.Status.Conditions, v1alpha1.ConditionValidationRecordsPublished).ObservedGeneration != certificateRequest.Generation {
+
+		unassigned, err := assignHostedZones(ctx, cfg, hostedZoneIDs, records)
+		if err != nil {
+			log.Error(err, "Failed to retrieve Route53 hosted zones.")
+			requestReconciler.SetCondition(certificateRequest, v1alpha1.ConditionValidationRecordsPublished, metav1.ConditionFalse, "PublishFailed", err.Error())
+			return requeueWithBackoff(err)
+		}
+
+		recordsByZone := map[string][]v1alpha1.DNSValidationRecord{}
+		for _, record := range records {
+			if record.HostedZoneID != "" {
+				recordsByZone[record.HostedZoneID] = append(recordsByZone[record.HostedZoneID], record)
+			}
+		}
+		for hostedZoneID, zoneRecords := range recordsByZone {
+			if err := upsertValidationRecords(ctx, cfg, hostedZoneID, zoneRecords); err != nil {
+				log.Error(err, "Failed to publish DNS validation records.")
+				requestReconciler.SetCondition(certificateRequest, v1alpha1.ConditionValidationRecordsPublished, metav1.ConditionFalse, "PublishFailed", err.Error())
+				return requeueWithBackoff(err)
+			}
+		}
+
+		certificateRequest.Status.ValidationRecords = records
+		if len(unassigned) > 0 {
+			requestReconciler.SetCondition(certificateRequest, v1alpha1.ConditionValidationRecordsPublished, metav1.ConditionFalse, "NoMatchingHostedZone", fmt.Sprintf("No selected Route53 hosted zone encloses record(s): %s.", strings.Join(unassigned, ", ")))
+		} else {
+			requestReconciler.SetCondition(certificateRequest, v1alpha1.ConditionValidationRecordsPublished, metav1.ConditionTrue, "Published", fmt.Sprintf("DNS validation records published to Route53 hosted zone(s) '%s'.", strings.Join(hostedZoneIDs, "', '")))
+		}
+	} else {
+		certificateRequest.Status.ValidationRecords = records
+	}
+
+	// Poll until ACM has validated the certificate.
+	return requeueWithBackoff(nil)
+}
+
+// SetValidationProgress sets the Validated condition according to the validation status reported by ACM for each record.
+func (r *ValidationRecordReconciler) SetValidationProgress(requestReconciler *ACMCertificateRequestReconciler, certificateRequest *v1alpha1.ACMCertificateRequest, records []v1alpha1.DNSValidationRecord) {
+
+	pending := 0
+	for _, record := range records {
+		if record.ValidationStatus == string(types.DomainStatusFailed) {
+			requestReconciler.SetCondition(certificateRequest, v1alpha1.ConditionValidated, metav1.ConditionFalse, "ValidationFailed", fmt.Sprintf("ACM failed to validate domain '%s'.", record.DomainName))
+			return
+		}
+		if record.ValidationStatus != string(types.DomainStatusSuccess) {
+			pending++
+		}
+	}
+
+	if pending > 0 {
+		requestReconciler.SetCondition(certificateRequest, v1alpha1.ConditionValidated, metav1.ConditionFalse, "PendingValidation", fmt.Sprintf("%d of %d validation record(s) awaiting validation.", pending, len(records)))
+	} else {
+		requestReconciler.SetCondition(certificateRequest, v1alpha1.ConditionValidated, metav1.ConditionTrue, "Validated", "All domain names have been validated.")
+	}
+}
+
+// RecordsMatch returns true if both sets of validation records have the same names and values.
+func (r *ValidationRecordReconciler) RecordsMatch(existing []v1alpha1.DNSValidationRecord, records []v1alpha1.DNSValidationRecord) bool {
+
+	if len(existing) != len(records) {
+		return false
+	}
+	for i := range records {
+		if existing[i].Name != records[i].Name || existing[i].Value != records[i].Value {
+			return false
+		}
+	}
+	return true
+}
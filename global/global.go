@@ -9,21 +9,119 @@ const (
 	DOMAIN_NAME  string = "validitron.io"
 	FULL_NAME    string = PACKAGE_NAME + "." + DOMAIN_NAME
 
-	AGENT_ENABLED_ANNOTATION                   string = FULL_NAME + "/enabled"
-	AGENT_INHERITS_FROM_ANNOTATION             string = FULL_NAME + "/inherits-from"
-	AGENT_CERTIFICATE_ARN_ANNOTATION           string = FULL_NAME + "/certificate-arn"
-	AGENT_CERTIFICATE_DOMAIN_NAMES_ANNOTATION  string = FULL_NAME + "/domains"
-	AGENT_CERTIFICATE_SERIAL_NUMBER_ANNOTATION string = FULL_NAME + "/serial-number"
-	AGENT_CERTIFICATE_EXPIRY_DATE_ANNOTATION   string = FULL_NAME + "/expires"
+	// Agent annotation keys are prefixed with the version of their schema, so that the meaning of an annotation can change without stranding objects annotated by earlier versions of the agent. Version 1 annotations (prefixed with FULL_NAME alone) are upgraded in place (see controllers.AnnotationMigrator.)
+	ANNOTATION_VERSION   string = "v2"
+	ANNOTATION_PREFIX    string = ANNOTATION_VERSION + "." + FULL_NAME
+	V1_ANNOTATION_PREFIX string = FULL_NAME
 
-	ALB_INGRESS_CLASS_ANNOTATION           string = "kubernetes.io/ingress.class"
-	ALB_INGRESS_LISTEN_PORTS_ANNOTATION    string = "alb.ingress.kubernetes.io/listen-ports"
-	ALB_INGRESS_CERTIFICATE_ARN_ANNOTATION string = "alb.ingress.kubernetes.io/certificate-arn"
+	AGENT_ENABLED_ANNOTATION                    string = ANNOTATION_PREFIX + "/enabled"
+	AGENT_INHERITS_FROM_ANNOTATION              string = ANNOTATION_PREFIX + "/inherits-from"
+	AGENT_CERTIFICATE_ARN_ANNOTATION            string = ANNOTATION_PREFIX + "/certificate-arn"
+	AGENT_CERTIFICATE_DOMAIN_NAMES_ANNOTATION   string = ANNOTATION_PREFIX + "/domains"
+	AGENT_CERTIFICATE_SERIAL_NUMBER_ANNOTATION  string = ANNOTATION_PREFIX + "/serial-number"
+	AGENT_CERTIFICATE_EXPIRY_DATE_ANNOTATION    string = ANNOTATION_PREFIX + "/expires"
+	AGENT_REGIONS_ANNOTATION                    string = ANNOTATION_PREFIX + "/regions"
+	AGENT_ASSUME_ROLE_ARN_ANNOTATION            string = ANNOTATION_PREFIX + "/assume-role-arn"
+	AGENT_DELETE_POLICY_ANNOTATION              string = ANNOTATION_PREFIX + "/delete-policy"
+	AGENT_REQUEST_CERTIFICATE_ANNOTATION        string = ANNOTATION_PREFIX + "/request-certificate"
+	AGENT_HOSTED_ZONE_ID_ANNOTATION             string = ANNOTATION_PREFIX + "/hosted-zone-id"
+	AGENT_CERTIFICATE_SOURCE_ANNOTATION         string = ANNOTATION_PREFIX + "/certificate-source"
+	AGENT_SOURCE_CLUSTER_ANNOTATION             string = ANNOTATION_PREFIX + "/source-cluster"
+	AGENT_SYNC_STATUS_ANNOTATION                string = ANNOTATION_PREFIX + "/sync-status"
+	AGENT_RETRY_COUNT_ANNOTATION                string = ANNOTATION_PREFIX + "/retry-count"
+	AGENT_ACM_CERTIFICATES_ANNOTATION           string = ANNOTATION_PREFIX + "/acm-certificates"
+	AGENT_CERTIFICATE_SECRET_ANNOTATION         string = ANNOTATION_PREFIX + "/certificate-secret"
+	AGENT_CERT_KEY_ANNOTATION                   string = ANNOTATION_PREFIX + "/cert-key"
+	AGENT_KEY_KEY_ANNOTATION                    string = ANNOTATION_PREFIX + "/key-key"
+	AGENT_CHAIN_KEY_ANNOTATION                  string = ANNOTATION_PREFIX + "/chain-key"
+	AGENT_PKCS12_KEY_ANNOTATION                 string = ANNOTATION_PREFIX + "/pkcs12-key"
+	AGENT_PKCS12_PASSWORD_KEY_ANNOTATION        string = ANNOTATION_PREFIX + "/pkcs12-password-key"
+	AGENT_KEY_PASSWORD_KEY_ANNOTATION           string = ANNOTATION_PREFIX + "/key-password-key"
+	AGENT_FETCH_CHAIN_ANNOTATION                string = ANNOTATION_PREFIX + "/fetch-chain"
+	AGENT_CHECK_REVOCATION_ANNOTATION           string = ANNOTATION_PREFIX + "/check-revocation"
+	AGENT_SECRET_NAMESPACES_ANNOTATION          string = ANNOTATION_PREFIX + "/secret-namespaces"
+	AGENT_SECRET_SELECTOR_ANNOTATION            string = ANNOTATION_PREFIX + "/secret-selector"
+	AGENT_CERTIFICATE_ARN_POLICY_ANNOTATION     string = ANNOTATION_PREFIX + "/certificate-arn-policy"
+	AGENT_MANAGED_CERTIFICATE_ARNS_ANNOTATION   string = ANNOTATION_PREFIX + "/managed-certificate-arns"
+	AGENT_HOST_CERTIFICATES_ANNOTATION          string = ANNOTATION_PREFIX + "/host-certificates"
+	AGENT_SSL_REDIRECT_ANNOTATION               string = ANNOTATION_PREFIX + "/ssl-redirect"
+	AGENT_MANAGED_SSL_REDIRECT_ANNOTATION       string = ANNOTATION_PREFIX + "/managed-ssl-redirect"
+	AGENT_CERTIFICATE_SELECTION_ANNOTATION      string = ANNOTATION_PREFIX + "/certificate-selection"
+	AGENT_REQUEST_QUOTA_INCREASE_ANNOTATION     string = ANNOTATION_PREFIX + "/request-quota-increase"
+	AGENT_USE_FOR_ANNOTATION                    string = ANNOTATION_PREFIX + "/use-for"
+	AGENT_CLOUDFRONT_CERTIFICATE_ARN_ANNOTATION string = ANNOTATION_PREFIX + "/cloudfront-certificate-arn"
+	AGENT_LISTENER_ARNS_ANNOTATION              string = ANNOTATION_PREFIX + "/listener-arns"
+	AGENT_LISTENER_CERTIFICATE_ANNOTATION       string = ANNOTATION_PREFIX + "/listener-certificate"
+	AGENT_LISTENER_CERTIFICATE_ARNS_ANNOTATION  string = ANNOTATION_PREFIX + "/listener-certificate-arns"
+	AGENT_TAGS_ANNOTATION                       string = ANNOTATION_PREFIX + "/tags"
+	AGENT_ISSUER_ANNOTATION                     string = ANNOTATION_PREFIX + "/issuer"
+	AGENT_CLUSTER_ISSUER_ANNOTATION             string = ANNOTATION_PREFIX + "/cluster-issuer"
+	AGENT_NOTIFICATION_WEBHOOK_ANNOTATION       string = ANNOTATION_PREFIX + "/notification-webhook"
+	AGENT_NOTIFICATION_TEMPLATE_ANNOTATION      string = ANNOTATION_PREFIX + "/notification-template"
+	AGENT_PARSE_FAILURE_ANNOTATION              string = ANNOTATION_PREFIX + "/parse-failure"
+	AGENT_DATA_HASH_ANNOTATION                  string = ANNOTATION_PREFIX + "/data-hash"
+	AGENT_CERTIFICATE_HASH_ANNOTATION           string = ANNOTATION_PREFIX + "/certificate-hash"
+	AGENT_CONFIG_HASH_ANNOTATION                string = ANNOTATION_PREFIX + "/config-hash"
+	AGENT_MULTI_LEAF_ANNOTATION                 string = ANNOTATION_PREFIX + "/multi-leaf"
+	AGENT_LEAF_CERTIFICATES_ANNOTATION          string = ANNOTATION_PREFIX + "/leaf-certificates"
+	AGENT_DOMAIN_MATCHING_ANNOTATION            string = ANNOTATION_PREFIX + "/domain-matching"
+	AGENT_DOMAIN_MAPPING_ANNOTATION             string = ANNOTATION_PREFIX + "/domain-mapping"
+
+	ALB_INGRESS_CLASS_ANNOTATION               string = "kubernetes.io/ingress.class"
+	ALB_INGRESS_LISTEN_PORTS_ANNOTATION        string = "alb.ingress.kubernetes.io/listen-ports"
+	ALB_INGRESS_CERTIFICATE_ARN_ANNOTATION     string = "alb.ingress.kubernetes.io/certificate-arn"
+	ALB_INGRESS_SSL_POLICY_ANNOTATION          string = "alb.ingress.kubernetes.io/ssl-policy"
+	ALB_INGRESS_SSL_REDIRECT_ANNOTATION        string = "alb.ingress.kubernetes.io/ssl-redirect"
+	ALB_INGRESS_SSL_REDIRECT_ACTION_ANNOTATION string = "alb.ingress.kubernetes.io/actions.ssl-redirect"
+	ALB_INGRESS_IP_ADDRESS_TYPE_ANNOTATION     string = "alb.ingress.kubernetes.io/ip-address-type"
+	ALB_INGRESS_CLASS                          string = "alb"
+	ALB_INGRESS_CONTROLLER                     string = "ingress.k8s.aws/alb"
+
+	AWS_GATEWAY_CERTIFICATE_ARN_OPTION string = "application-networking.k8s.aws/certificate-arn"
+
+	AWS_LOAD_BALANCER_CLUSTER_TAG string = "elbv2.k8s.aws/cluster" // Tag applied by the AWS Load Balancer Controller to the load balancers it manages.
+
+	AWS_LOAD_BALANCER_SSL_CERT_ANNOTATION string = "service.beta.kubernetes.io/aws-load-balancer-ssl-cert"
+	EXTERNAL_DNS_HOSTNAME_ANNOTATION      string = "external-dns.alpha.kubernetes.io/hostname"
 
 	CERTIFICATE_STATUS_FAILED   string = "Failed"
 	CERTIFICATE_STATUS_EXPIRED  string = "Expired"
 	CERTIFICATE_STATUS_INACTIVE string = "Inactive"
 
+	SYNC_STATE_SYNCED  string = "Synced"
+	SYNC_STATE_FAILED  string = "Failed"
+	SYNC_STATE_PENDING string = "Pending"
+	SYNC_STATE_REVOKED string = "Revoked"
+
+	DELETE_POLICY_DELETE string = "Delete"
+	DELETE_POLICY_RETAIN string = "Retain"
+
+	CERTIFICATE_ARN_POLICY_MERGE   string = "Merge"
+	CERTIFICATE_ARN_POLICY_REPLACE string = "Replace"
+
+	SSL_REDIRECT_POLICY_ANNOTATION string = "Annotation"
+	SSL_REDIRECT_POLICY_ACTIONS    string = "Actions"
+	SSL_REDIRECT_POLICY_NONE       string = "None"
+
+	CERTIFICATE_SOURCE_IMPORTED         string = "Imported"
+	CERTIFICATE_SOURCE_REQUESTED        string = "Requested"
+	CERTIFICATE_SOURCE_PREFER_REQUESTED string = "PreferRequested"
+
+	CERTIFICATE_SELECTION_LATEST_EXPIRY string = "LatestExpiry"
+	CERTIFICATE_SELECTION_MOST_SPECIFIC string = "MostSpecific"
+
+	DOMAIN_MATCHING_EXACT              string = "Exact"
+	DOMAIN_MATCHING_WILDCARD           string = "Wildcard"
+	DOMAIN_MATCHING_WILDCARD_ANY_DEPTH string = "WildcardAnyDepth"
+	DOMAIN_MATCHING_MAPPED             string = "Mapped"
+	DOMAIN_MAPPING_RULES_KEY           string = "rules" // ConfigMap data key holding domain mapping rules.
+
+	USE_FOR_CLOUDFRONT string = "cloudfront"
+	CLOUDFRONT_REGION  string = "us-east-1" // CloudFront only accepts ACM certificates from this region.
+
+	LISTENER_CERTIFICATE_DEFAULT    string = "Default"
+	LISTENER_CERTIFICATE_ADDITIONAL string = "Additional"
+
 	PEM_CERTIFICATE_BEGIN_TAG string = "-----BEGIN CERTIFICATE-----"
 	PEM_CERTIFICATE_END_TAG   string = "-----END CERTIFICATE-----"
 
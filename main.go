@@ -11,22 +11,39 @@ Copyright Kit Huckvale 2022.
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
 	cm "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	uberzap "go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	networking "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	gateway "sigs.k8s.io/gateway-api/apis/v1alpha2"
+	"sigs.k8s.io/yaml"
 
+	"Validitron/k8s-acm-certificate-agent/api/v1alpha1"
 	"Validitron/k8s-acm-certificate-agent/controllers"
+	"Validitron/k8s-acm-certificate-agent/global"
+	"Validitron/k8s-acm-certificate-agent/webhooks"
 )
 
 var (
@@ -36,8 +53,86 @@ var (
 )
 
 const (
-	ENABLE_CERTIFICATE_SYNC   string = "ENABLE_CERTIFICATE_SYNC"
-	ENABLE_INGRESS_DECORATION string = "ENABLE_INGRESS_DECORATION"
+	ENABLE_CERTIFICATE_SYNC            string = "ENABLE_CERTIFICATE_SYNC"
+	ENABLE_INGRESS_DECORATION          string = "ENABLE_INGRESS_DECORATION"
+	ENABLE_CERTIFICATE_DELETION        string = "ENABLE_CERTIFICATE_DELETION"
+	ENABLE_GATEWAY_DECORATION          string = "ENABLE_GATEWAY_DECORATION"
+	ENABLE_SERVICE_DECORATION          string = "ENABLE_SERVICE_DECORATION"
+	ENABLE_ISTIO_DECORATION            string = "ENABLE_ISTIO_DECORATION"
+	ENABLE_ANNOTATION_WEBHOOK          string = "ENABLE_ANNOTATION_WEBHOOK"
+	ENABLE_INGRESS_DEFAULTING_WEBHOOK  string = "ENABLE_INGRESS_DEFAULTING_WEBHOOK"
+	ENABLE_CERTIFICATE_REQUESTS        string = "ENABLE_CERTIFICATE_REQUESTS"
+	ENABLE_CERTIFICATE_PROVISIONING    string = "ENABLE_CERTIFICATE_PROVISIONING"
+	CERTIFICATE_ISSUER                 string = "CERTIFICATE_ISSUER"
+	ENABLE_PRIVATE_CA                  string = "ENABLE_PRIVATE_CA"
+	ENABLE_CERTIFICATE_EXPORT          string = "ENABLE_CERTIFICATE_EXPORT"
+	ENABLE_QUOTA_CHECKS                string = "ENABLE_QUOTA_CHECKS"
+	ENABLE_LISTENER_ROTATION           string = "ENABLE_LISTENER_ROTATION"
+	ENABLE_AGENT_CONFIG                string = "ENABLE_AGENT_CONFIG"
+	ENABLE_SECRET_STATE                string = "ENABLE_SECRET_STATE"
+	MAX_REQUEUE_DELAY                  string = "MAX_REQUEUE_DELAY"
+	REQUEUE_JITTER                     string = "REQUEUE_JITTER"
+	MAX_RETRIES                        string = "MAX_RETRIES"
+	CLUSTER_NAME                       string = "CLUSTER_NAME"
+	ACM_TAGS                           string = "ACM_TAGS"
+	OWNER_TAG                          string = "OWNER_TAG"
+	SECRET_SELECTOR                    string = "SECRET_SELECTOR"
+	INGRESS_DEFAULTING_SELECTOR        string = "INGRESS_DEFAULTING_SELECTOR"
+	INGRESS_DEFAULT_LISTEN_PORTS       string = "INGRESS_DEFAULT_LISTEN_PORTS"
+	INGRESS_DEFAULT_IP_ADDRESS_TYPE    string = "INGRESS_DEFAULT_IP_ADDRESS_TYPE"
+	RENEWAL_WINDOW                     string = "RENEWAL_WINDOW"
+	CERTIFICATE_IMPORT_LIMIT           string = "CERTIFICATE_IMPORT_LIMIT"
+	RESYNC_INTERVAL                    string = "RESYNC_INTERVAL"
+	INGRESS_CLASSES                    string = "INGRESS_CLASSES"
+	INGRESS_CERTIFICATE_ARN_ANNOTATION string = "INGRESS_CERTIFICATE_ARN_ANNOTATION"
+	INGRESS_TLS_HOSTS                  string = "INGRESS_TLS_HOSTS"
+	INGRESS_SSL_POLICY                 string = "INGRESS_SSL_POLICY"
+	INGRESS_SSL_REDIRECT               string = "INGRESS_SSL_REDIRECT"
+	INGRESS_CERTIFICATE_SOURCE         string = "INGRESS_CERTIFICATE_SOURCE"
+	INGRESS_LISTENER_CERTIFICATE_LIMIT string = "INGRESS_LISTENER_CERTIFICATE_LIMIT"
+	LOG_LEVEL                          string = "LOG_LEVEL"
+	LOG_FORMAT                         string = "LOG_FORMAT"
+	LOG_SAMPLING                       string = "LOG_SAMPLING"
+	AUDIT_SINKS                        string = "AUDIT_SINKS"
+	AUDIT_S3_BUCKET                    string = "AUDIT_S3_BUCKET"
+	AUDIT_S3_PREFIX                    string = "AUDIT_S3_PREFIX"
+	AUDIT_LOG_GROUP                    string = "AUDIT_LOG_GROUP"
+	AUDIT_LOG_STREAM                   string = "AUDIT_LOG_STREAM"
+	NOTIFICATION_TOPIC_ARN             string = "NOTIFICATION_TOPIC_ARN"
+	AWS_CREDENTIALS_SECRET             string = "AWS_CREDENTIALS_SECRET"
+	AWS_ENDPOINT                       string = "AWS_ENDPOINT"
+	ACM_ENDPOINT                       string = "ACM_ENDPOINT"
+	ACM_ENDPOINT_INSECURE              string = "ACM_ENDPOINT_INSECURE"
+	AWS_PARTITION                      string = "AWS_PARTITION"
+	SECRET_FINALIZER_TIMEOUT           string = "SECRET_FINALIZER_TIMEOUT"
+	NOTIFICATION_EVENT_BUS             string = "NOTIFICATION_EVENT_BUS"
+	NOTIFICATION_TYPES                 string = "NOTIFICATION_TYPES"
+	CACHE_TLS_SECRETS_ONLY             string = "CACHE_TLS_SECRETS_ONLY"
+	ANNOTATION_COMPAT                  string = "ANNOTATION_COMPAT"
+	LEADER_ELECTION_NAMESPACE          string = "LEADER_ELECTION_NAMESPACE"
+	LEADER_ELECTION_RESOURCE_LOCK      string = "LEADER_ELECTION_RESOURCE_LOCK"
+	LEADER_ELECTION_LEASE_DURATION     string = "LEADER_ELECTION_LEASE_DURATION"
+	LEADER_ELECTION_RENEW_DEADLINE     string = "LEADER_ELECTION_RENEW_DEADLINE"
+	LEADER_ELECTION_RETRY_PERIOD       string = "LEADER_ELECTION_RETRY_PERIOD"
+	CONFIG_FILE                        string = "CONFIG_FILE"
+	AWS_HEALTH_CHECK_INTERVAL          string = "AWS_HEALTH_CHECK_INTERVAL"
+	AWS_HEALTH_CHECK_FAILURE_THRESHOLD string = "AWS_HEALTH_CHECK_FAILURE_THRESHOLD"
+)
+
+// Names of the controllers that can be selected using the --controllers flag.
+const (
+	CONTROLLER_SECRET                  string = "secret"
+	CONTROLLER_CERTIFICATE             string = "certificate"
+	CONTROLLER_ACM_CERTIFICATE_SYNC    string = "acmcertificatesync"
+	CONTROLLER_INGRESS                 string = "ingress"
+	CONTROLLER_ACM_CERTIFICATE_REQUEST string = "acmcertificaterequest"
+	CONTROLLER_PRIVATE_CERTIFICATE     string = "privatecertificate"
+	CONTROLLER_ACM_CERTIFICATE_EXPORT  string = "acmcertificateexport"
+	CONTROLLER_GATEWAY                 string = "gateway"
+	CONTROLLER_SERVICE                 string = "service"
+	CONTROLLER_ISTIO_GATEWAY           string = "istiogateway"
+	CONTROLLER_LISTENER                string = "listener"
+	CONTROLLER_ACM_SECRET_STATE        string = "acmsecretstate"
 )
 
 func init() {
@@ -51,53 +146,407 @@ func init() {
 	//Add scheme for cert-manager API types (Certificate).
 	utilruntime.Must(cm.AddToScheme(scheme))
 
+	// Add scheme for Gateway API types (Gateway, HTTPRoute).
+	utilruntime.Must(gateway.AddToScheme(scheme))
+
+	//Add scheme for agent API types (ACMCertificateSync).
+	utilruntime.Must(v1alpha1.AddToScheme(scheme))
+
 }
 
 func main() {
+
+	// Settings in the config file (if any) are loaded before flags are defined, since the environment variables it sets provide the defaults of flags.
+	configFile, err := loadConfigFile(configFilePath(os.Args[1:]))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	for key, value := range configFile.env {
+		os.Setenv(key, value)
+	}
+
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var clusterName string
+	var acmTags string
+	var ownerTag string
+	var secretSelector string
+	var ingressDefaultingSelector string
+	var ingressDefaultListenPorts string
+	var ingressDefaultIPAddressType string
+	var resyncInterval time.Duration
+	var controllerList string
+	var leaderElectionID string
+	var leaderElectionNamespace string
+	var leaderElectionResourceLock string
+	var leaseDuration time.Duration
+	var awsHealthCheckInterval time.Duration
+	var awsHealthCheckFailureThreshold time.Duration
+	var renewDeadline time.Duration
+	var retryPeriod time.Duration
+	var logLevel string
+	var logFormat string
+	var logSampling bool
+	var awsSettings controllers.AWSSettings
+	var awsCredentialsSecret string
+	var acmEndpoint string
+	var acmEndpointInsecure bool
+	var awsPartition string
+	var cacheTLSSecretsOnly bool
+	var annotationCompat bool
+	workers := map[string]*int{}
+	requeueDelays := map[string]*time.Duration{}
+	logLevels := map[string]*string{}
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&leaderElectionID, "leader-election-id", "d4b9aab7.validitron.io",
+		"Name of the resource used for leader election. Deployments running different sets of controllers must use different IDs.")
+	flag.StringVar(&leaderElectionNamespace, "leader-election-namespace", os.Getenv(LEADER_ELECTION_NAMESPACE),
+		"Namespace in which the leader election resource is created. Defaults to the namespace in which the agent is running.")
+	flag.StringVar(&leaderElectionResourceLock, "leader-election-resource-lock", os.Getenv(LEADER_ELECTION_RESOURCE_LOCK),
+		"Type of resource used for leader election: 'leases', 'configmapsleases' or 'endpointsleases' (the latter two for migration from ConfigMap or Endpoints locks.) Defaults to 'leases'.")
+	defaultLeaseDuration, _ := getDurationEnv(LEADER_ELECTION_LEASE_DURATION)
+	flag.DurationVar(&leaseDuration, "leader-election-lease-duration", defaultLeaseDuration,
+		"Duration for which non-leader candidates wait before acquiring leadership that has not been renewed (i.e. the longest failover time if the leader stops without releasing leadership.) Defaults to 15s.")
+	defaultRenewDeadline, _ := getDurationEnv(LEADER_ELECTION_RENEW_DEADLINE)
+	flag.DurationVar(&renewDeadline, "leader-election-renew-deadline", defaultRenewDeadline,
+		"Duration for which the leader retries renewing leadership before giving it up. Must be less than the lease duration. Defaults to 10s.")
+	defaultRetryPeriod, _ := getDurationEnv(LEADER_ELECTION_RETRY_PERIOD)
+	flag.DurationVar(&retryPeriod, "leader-election-retry-period", defaultRetryPeriod,
+		"Interval between attempts by candidates to acquire (or renew) leadership. Defaults to 2s.")
+	flag.StringVar(&controllerList, "controllers", "",
+		"Comma-separated list of controllers to run ("+strings.Join(allControllers(), ", ")+"). "+
+			"If set, supersedes the ENABLE_CERTIFICATE_SYNC, ENABLE_INGRESS_DECORATION and other ENABLE_* controller toggles.")
+	flag.StringVar(&clusterName, "cluster-name", os.Getenv(CLUSTER_NAME),
+		"Name identifying this cluster, recorded in the ACM tags and annotations of imported certificates. "+
+			"Enables Secrets replicated from other clusters to re-use existing ACM certificates.")
+	flag.StringVar(&acmTags, "acm-tags", os.Getenv(ACM_TAGS),
+		"Comma-separated 'key=value' tags applied to ACM certificates, replacing the default 'tron/*' tags. "+
+			"Values may reference the variables {namespace}, {name}, {clusterName}, {agent}, {correlationId}, {createdAt} and {modifiedAt}.")
+	flag.StringVar(&ownerTag, "owner-tag", os.Getenv(OWNER_TAG),
+		"'key=value' tag identifying ACM certificates owned by the agent. Certificates without this tag are never overwritten. "+
+			"The value may reference the variables {agent} and {clusterName}. Defaults to 'tron/createdBy={agent}'.")
+	flag.StringVar(&secretSelector, "secret-selector", os.Getenv(SECRET_SELECTOR),
+		"Label selector (e.g. 'acm-sync=true') identifying Secrets synchronized with ACM without the 'enabled' annotation. "+
+			"Secrets annotated 'enabled: false' are never synchronized.")
+	flag.StringVar(&ingressDefaultingSelector, "ingress-defaulting-selector", os.Getenv(INGRESS_DEFAULTING_SELECTOR),
+		"Label selector identifying Ingresses annotated 'enabled: true' by the Ingress defaulting webhook when they are created. "+
+			"Matches every Ingress if unset.")
+	flag.StringVar(&ingressDefaultListenPorts, "ingress-default-listen-ports", os.Getenv(INGRESS_DEFAULT_LISTEN_PORTS),
+		"Value of the 'alb.ingress.kubernetes.io/listen-ports' annotation added by the Ingress defaulting webhook to Ingresses without one (e.g. '[{\"HTTPS\":443}]'). "+
+			"The annotation is not added if unset.")
+	flag.StringVar(&ingressDefaultIPAddressType, "ingress-default-ip-address-type", os.Getenv(INGRESS_DEFAULT_IP_ADDRESS_TYPE),
+		"Value of the 'alb.ingress.kubernetes.io/ip-address-type' annotation added by the Ingress defaulting webhook to Ingresses without one ('ipv4', 'dualstack' or 'dualstack-without-public-ipv4'). "+
+			"The annotation is not added if unset.")
+	defaultAWSHealthCheckInterval, _ := getDurationEnv(AWS_HEALTH_CHECK_INTERVAL)
+	flag.DurationVar(&awsHealthCheckInterval, "aws-health-check-interval", defaultAWSHealthCheckInterval,
+		"Interval between checks of AWS connectivity (STS GetCallerIdentity and ACM ListCertificates), whose outcome is reported by the readiness probe. Defaults to 1m.")
+	defaultAWSHealthCheckFailureThreshold, _ := getDurationEnv(AWS_HEALTH_CHECK_FAILURE_THRESHOLD)
+	flag.DurationVar(&awsHealthCheckFailureThreshold, "aws-health-check-failure-threshold", defaultAWSHealthCheckFailureThreshold,
+		"Duration without a successful check of AWS connectivity after which the health (liveness) probe fails, so that the agent is restarted. "+
+			"The health probe does not reflect AWS connectivity if unset.")
+	defaultResyncInterval, _ := getDurationEnv(RESYNC_INTERVAL)
+	flag.DurationVar(&resyncInterval, "resync-interval", defaultResyncInterval,
+		"Interval at which all watched objects (including managed Secrets and Ingresses) are re-reconciled, so that drift in ACM is corrected even if nothing changes in K8s. "+
+			"Defaults to the controller-runtime default (10h) if unset.")
+	for _, name := range allControllers() {
+		workers[name] = flag.Int(name+"-workers", getIntEnv(workersEnv(name), 1),
+			"Number of "+name+" objects reconciled in parallel. Defaults to the value of "+workersEnv(name)+", or 1.")
+		defaultRequeueDelay, _ := getDurationEnv(requeueDelayEnv(name))
+		requeueDelays[name] = flag.Duration(name+"-requeue-delay", defaultRequeueDelay,
+			"Delay before the first retry of a failed "+name+" object (doubling on each subsequent failure). Defaults to the value of "+requeueDelayEnv(name)+", or 1s.")
+		logLevels[name] = flag.String(name+"-log-level", os.Getenv(logLevelEnv(name)),
+			"Log level of the "+name+" controller (see --log-level). Defaults to the value of "+logLevelEnv(name)+", or the agent's log level.")
+	}
+	flag.StringVar(&logLevel, "log-level", os.Getenv(LOG_LEVEL),
+		"Log level: 'debug', 'info', 'error', or an integer verbosity (e.g. '2'). "+
+			"'info' omits per-object progress messages (e.g. 'Processing Secret...'). Defaults to 'debug' for console output and 'info' for JSON output.")
+	flag.StringVar(&logFormat, "log-format", os.Getenv(LOG_FORMAT),
+		"Log output format: 'console' (human-readable, the default) or 'json' (machine-parsable, with stack traces for errors only).")
+	flag.BoolVar(&logSampling, "log-sampling", getBooleanEnv(LOG_SAMPLING),
+		"If true, repeated log messages are sampled (after the first 100 identical messages in a second, only every 100th is logged).")
+	flag.StringVar(&awsSettings.Region, "aws-region", "",
+		"AWS region in which the agent is running (the default region for imports), overriding the default credential chain (e.g. AWS_REGION).")
+	flag.StringVar(&awsSettings.AccessKeyID, "aws-access-key-id", "",
+		"AWS access key ID, overriding the default credential chain. Prefer --aws-credentials-secret, since flags are visible to other processes.")
+	flag.StringVar(&awsSettings.SecretAccessKey, "aws-secret-access-key", "",
+		"AWS secret access key (see --aws-access-key-id).")
+	flag.StringVar(&awsSettings.SessionToken, "aws-session-token", "",
+		"AWS session token, for temporary credentials (see --aws-access-key-id).")
+	flag.StringVar(&awsCredentialsSecret, "aws-credentials-secret", os.Getenv(AWS_CREDENTIALS_SECRET),
+		"Secret ('namespace/name') holding AWS credentials in the keys AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and (optionally) AWS_SESSION_TOKEN and AWS_REGION, overriding the default credential chain. "+
+			"The Secret is re-read every 5 minutes, so that rotated credentials are used.")
+	flag.StringVar(&awsSettings.Endpoint, "aws-endpoint", os.Getenv(AWS_ENDPOINT),
+		"URL of an endpoint serving all AWS APIs (e.g. 'http://localstack:4566'), in place of the standard AWS endpoints.")
+	flag.StringVar(&acmEndpoint, "acm-endpoint", os.Getenv(ACM_ENDPOINT),
+		"URL of the ACM API endpoint (e.g. 'https://localhost:4566' for LocalStack), in place of the standard regional endpoints (and --aws-endpoint).")
+	flag.BoolVar(&acmEndpointInsecure, "acm-endpoint-insecure", getBooleanEnv(ACM_ENDPOINT_INSECURE),
+		"If true, the TLS certificate of the ACM API endpoint is not verified. For testing only.")
+	flag.StringVar(&awsPartition, "aws-partition", os.Getenv(AWS_PARTITION),
+		"AWS partition in which the agent is running ('aws', 'aws-cn', 'aws-us-gov', 'aws-iso' or 'aws-iso-b'). ARNs and regions of other partitions are rejected. "+
+			"Defaults to the partition of the agent's region.")
+	flag.BoolVar(&cacheTLSSecretsOnly, "cache-tls-secrets-only", getBooleanEnv(CACHE_TLS_SECRETS_ONLY),
+		"If true, only Secrets of type 'kubernetes.io/tls' are watched and cached, reducing the agent's memory use on clusters with many other Secrets. "+
+			"Secrets of other types (e.g. Opaque) which name the data key holding their certificate are then ignored.")
+	flag.BoolVar(&annotationCompat, "annotation-compat", getBooleanEnvOrDefault(ANNOTATION_COMPAT, true),
+		"If true, version 1 annotations (prefixed '"+global.V1_ANNOTATION_PREFIX+"/') are honoured, accepted by the annotation webhook and migrated in place to their '"+global.ANNOTATION_PREFIX+"/' keys. "+
+			"If false, version 1 annotations are ignored (and, if added or changed, rejected by the annotation webhook.) Defaults to true.")
+	flag.String("config", os.Getenv(CONFIG_FILE),
+		"YAML file setting the agent's flags (keyed by flag name, without the leading '--') and, under the key 'env', its environment variables (e.g. ENABLE_CERTIFICATE_SYNC.) "+
+			"Settings in the file override environment variables, and are overridden by flags given on the command line.")
 	opts := zap.Options{
 		Development: true,
 	}
 	opts.BindFlags(flag.CommandLine)
 	flag.Parse()
 
+	if err := configFile.applyFlags(flag.CommandLine); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if err := applyLogSettings(&opts, logLevel, logFormat, logSampling); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	// NB that when there are multiple controllers, logging must be further configured so that log entries are correctly annotated with controller details. See the SetupWithManager methods for each controller.
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	// Controllers with their own log level log through a separate logger.
+	for _, name := range allControllers() {
+		if *logLevels[name] == "" {
+			continue
+		}
+		level, err := parseLogLevel(*logLevels[name])
+		if err != nil {
+			setupLog.Error(err, fmt.Sprintf("Invalid log level for controller '%s'.", name))
+			os.Exit(1)
+		}
+		controllers.ControllerLoggers[name] = zap.New(zap.UseFlagOptions(&opts), zap.Level(level))
+	}
+	// Validation records are published by the acmcertificaterequest controller.
+	if controllerLog, ok := controllers.ControllerLoggers[CONTROLLER_ACM_CERTIFICATE_REQUEST]; ok {
+		controllers.ControllerLoggers["validationrecord"] = controllerLog
+	}
+
+	// Periodic resync re-delivers every cached object to its reconciler.
+	var syncPeriod *time.Duration
+	if resyncInterval > 0 {
+		syncPeriod = &resyncInterval
+		controllers.ResyncInterval = resyncInterval
+	}
+
+	// Leader election timings default to those of controller-runtime.
+	if err := validateLeaderElectionTimings(leaseDuration, renewDeadline, retryPeriod); err != nil {
+		setupLog.Error(err, "Invalid leader election settings.")
+		os.Exit(1)
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		//Namespace: // No namespace is defined = cluster-scoped.
-		Scheme:                 scheme,
-		MetricsBindAddress:     metricsAddr,
-		Port:                   9443,
-		HealthProbeBindAddress: probeAddr,
-		LeaderElection:         enableLeaderElection,
-		LeaderElectionID:       "d4b9aab7.validitron.io",
+		Scheme:                     scheme,
+		MetricsBindAddress:         metricsAddr,
+		Port:                       9443,
+		HealthProbeBindAddress:     probeAddr,
+		LeaderElection:             enableLeaderElection,
+		LeaderElectionID:           leaderElectionID,
+		LeaderElectionNamespace:    leaderElectionNamespace,
+		LeaderElectionResourceLock: leaderElectionResourceLock,
+		LeaseDuration:              optionalDuration(leaseDuration),
+		RenewDeadline:              optionalDuration(renewDeadline),
+		RetryPeriod:                optionalDuration(retryPeriod),
+		SyncPeriod:                 syncPeriod,
+		NewCache:                   cache.BuilderWithOptions(controllers.SecretCacheOptions(cacheTLSSecretsOnly, annotationCompat)),
 	})
 	if err != nil {
 		setupLog.Error(err, "Unable to start manager.")
 		os.Exit(1)
 	}
 
-	if getBooleanEnv(ENABLE_CERTIFICATE_SYNC) {
+	// Ceiling for the exponential backoff applied to objects whose reconciliation fails (e.g. due to ACM throttling.)
+	if maxRequeueDelay, ok := getDurationEnv(MAX_REQUEUE_DELAY); ok {
+		controllers.MaxRequeueDelay = maxRequeueDelay
+	}
+
+	// Random extension of per-object requeue delays (as a fraction of the delay), so that objects which fail together are not all retried together.
+	if jitter, err := strconv.ParseFloat(os.Getenv(REQUEUE_JITTER), 64); err == nil && jitter >= 0 {
+		controllers.RequeueJitter = jitter
+	}
+
+	// Number of consecutive failures after which objects are parked until they change (0 for no limit.)
+	if maxRetries, err := strconv.Atoi(os.Getenv(MAX_RETRIES)); err == nil && maxRetries >= 0 {
+		controllers.MaxRetries = maxRetries
+	}
+
+	// Period before expiry within which certificates are expected to have been renewed.
+	if renewalWindow, ok := getDurationEnv(RENEWAL_WINDOW); ok {
+		controllers.RenewalWindow = renewalWindow
+	}
+
+	// Maximum number of times each ACM certificate is imported within any 365-day period (0 for no limit.)
+	if importLimit, err := strconv.Atoi(os.Getenv(CERTIFICATE_IMPORT_LIMIT)); err == nil && importLimit >= 0 {
+		controllers.CertificateImportLimit = importLimit
+	}
 
+	controllers.ClusterName = clusterName
+
+	// Explicit AWS region, credentials and endpoint (e.g. for clusters outside AWS), in place of the default credential chain.
+	if awsCredentialsSecret != "" && awsSettings.AccessKeyID == "" {
+		namespace, name, found := strings.Cut(awsCredentialsSecret, "/")
+		if !found || namespace == "" || name == "" {
+			setupLog.Error(fmt.Errorf("'%s' is not of the form 'namespace/name'.", awsCredentialsSecret), "Invalid AWS credentials Secret.")
+			os.Exit(1)
+		}
+		// The API reader is used since AWS configuration is loaded before the manager's cache is started.
+		awsSettings.CredentialsSecret = &controllers.SecretCredentialsProvider{
+			Reader: mgr.GetAPIReader(),
+			Key:    types.NamespacedName{Namespace: namespace, Name: name},
+		}
+	}
+	if awsSettings.AccessKeyID != "" && awsSettings.SecretAccessKey == "" {
+		setupLog.Error(fmt.Errorf("An AWS secret access key must accompany the access key ID."), "Invalid AWS credentials.")
+		os.Exit(1)
+	}
+	controllers.AWSOverrides = awsSettings
+
+	if awsPartition != "" && !controllers.IsKnownPartition(awsPartition) {
+		setupLog.Error(fmt.Errorf("'%s' is not a known AWS partition.", awsPartition), "Invalid AWS partition.")
+		os.Exit(1)
+	}
+	controllers.AWSPartition = awsPartition
+
+	controllers.ACMEndpoint = acmEndpoint
+	controllers.ACMEndpointInsecure = acmEndpointInsecure
+	if acmEndpointInsecure {
+		setupLog.Info("TLS verification of the ACM endpoint is disabled: this is intended for testing only.")
+	}
+
+	if acmTags != "" {
+		tagTemplates, err := controllers.ParseTagTemplates(acmTags)
+		if err != nil {
+			setupLog.Error(err, "Invalid ACM tag configuration.")
+			os.Exit(1)
+		}
+		controllers.TagTemplates = tagTemplates
+	}
+
+	if ownerTag != "" {
+		parsedOwnerTag, err := controllers.ParseOwnerTag(ownerTag)
+		if err != nil {
+			setupLog.Error(err, "Invalid owner tag configuration.")
+			os.Exit(1)
+		}
+		controllers.OwnerTag = parsedOwnerTag
+	}
+
+	// Sinks to which changes made to ACM are recorded (for compliance audit.)
+	auditSinks, err := controllers.NewAuditSinks(context.Background(), controllers.AuditConfig{
+		Sinks:     getListEnv(AUDIT_SINKS),
+		S3Bucket:  strings.TrimSpace(os.Getenv(AUDIT_S3_BUCKET)),
+		S3Prefix:  strings.TrimSpace(os.Getenv(AUDIT_S3_PREFIX)),
+		LogGroup:  strings.TrimSpace(os.Getenv(AUDIT_LOG_GROUP)),
+		LogStream: strings.TrimSpace(os.Getenv(AUDIT_LOG_STREAM)),
+	}, mgr.GetEventRecorderFor(global.PACKAGE_NAME))
+	if err != nil {
+		setupLog.Error(err, "Invalid audit configuration.")
+		os.Exit(1)
+	}
+	controllers.AuditSinks = auditSinks
+
+	// Destinations of certificate lifecycle notifications (unless set by the ACMAgentConfig.)
+	controllers.NotificationTopicArn = strings.TrimSpace(os.Getenv(NOTIFICATION_TOPIC_ARN))
+	controllers.NotificationEventBus = strings.TrimSpace(os.Getenv(NOTIFICATION_EVENT_BUS))
+	controllers.NotificationReader = mgr.GetClient()
+
+	// Import locks (Leases, in the namespace used for leader election) serialize imports of certificates for the same domain across agent processes. Leases are read directly, rather than from the cache, since the cache may lag another process's lock.
+	importLockNamespace := leaderElectionNamespace
+	if importLockNamespace == "" {
+		if data, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace"); err == nil {
+			importLockNamespace = strings.TrimSpace(string(data))
+		}
+	}
+	if importLockNamespace != "" {
+		importLockClient, err := client.New(mgr.GetConfig(), client.Options{Scheme: mgr.GetScheme(), Mapper: mgr.GetRESTMapper()})
+		if err != nil {
+			setupLog.Error(err, "Unable to create import lock client.")
+			os.Exit(1)
+		}
+		controllers.ImportLockClient = importLockClient
+		controllers.ImportLockNamespace = importLockNamespace
+	} else {
+		setupLog.Info("Agent namespace is unknown: import locks are disabled.")
+	}
+	for _, notificationType := range getListEnv(NOTIFICATION_TYPES) {
+		if notificationType != controllers.NotificationImported && notificationType != controllers.NotificationImportFailed && notificationType != controllers.NotificationNearingExpiry {
+			setupLog.Error(fmt.Errorf("Unknown notification type '%s'. Expected one of: %s, %s, %s.", notificationType, controllers.NotificationImported, controllers.NotificationImportFailed, controllers.NotificationNearingExpiry), "Invalid notification configuration.")
+			os.Exit(1)
+		}
+		controllers.NotificationTypes = append(controllers.NotificationTypes, notificationType)
+	}
+
+	parsedSecretSelector, err := labels.Parse(secretSelector)
+	if err != nil {
+		setupLog.Error(err, "Invalid Secret selector configuration.")
+		os.Exit(1)
+	}
+
+	enabledControllers, err := selectControllers(controllerList)
+	if err != nil {
+		setupLog.Error(err, "Invalid controller selection.")
+		os.Exit(1)
+	}
+	setupLog.Info(fmt.Sprintf("Running controllers: %s.", strings.Join(enabledControllerNames(enabledControllers), ", ")))
+
+	// Runtime configuration (ACMAgentConfig) applies to all controllers, so is enabled independently of controller selection.
+	if getBooleanEnv(ENABLE_AGENT_CONFIG) {
+
+		if err = (&controllers.ACMAgentConfigReconciler{
+			Client:   mgr.GetClient(),
+			Scheme:   mgr.GetScheme(),
+			Recorder: mgr.GetEventRecorderFor(global.PACKAGE_NAME),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "Unable to create ACMAgentConfig reconciler.", "controller", "ACMAgentConfig")
+			os.Exit(1)
+		}
+
+	}
+
+	if enabledControllers[CONTROLLER_SECRET] {
+
+		secretFinalizerTimeout, _ := getDurationEnv(SECRET_FINALIZER_TIMEOUT)
 		if err = (&controllers.SecretReconciler{
-			Client: mgr.GetClient(),
-			Scheme: mgr.GetScheme(),
+			Client:                    mgr.GetClient(),
+			Scheme:                    mgr.GetScheme(),
+			Recorder:                  mgr.GetEventRecorderFor(global.PACKAGE_NAME),
+			EnableCertificateDeletion: getBooleanEnv(ENABLE_CERTIFICATE_DELETION),
+			FinalizerTimeout:          secretFinalizerTimeout,
+			EnableQuotaChecks:         getBooleanEnv(ENABLE_QUOTA_CHECKS),
+			EnableAgentConfig:         getBooleanEnv(ENABLE_AGENT_CONFIG),
+			Selector:                  parsedSecretSelector,
+			MaxConcurrentReconciles:   *workers[CONTROLLER_SECRET],
+			RequeueDelay:              *requeueDelays[CONTROLLER_SECRET],
 		}).SetupWithManager(mgr); err != nil {
 			setupLog.Error(err, "Unable to create Secret reconciler.", "controller", "Secret")
 			os.Exit(1)
 		}
 
+	}
+
+	if enabledControllers[CONTROLLER_CERTIFICATE] {
+
 		if err = (&controllers.CertificateReconciler{
-			Client: mgr.GetClient(),
-			Scheme: mgr.GetScheme(),
+			Client:                    mgr.GetClient(),
+			Scheme:                    mgr.GetScheme(),
+			Recorder:                  mgr.GetEventRecorderFor(global.PACKAGE_NAME),
+			EnableCertificateDeletion: getBooleanEnv(ENABLE_CERTIFICATE_DELETION),
+			MaxConcurrentReconciles:   *workers[CONTROLLER_CERTIFICATE],
+			RequeueDelay:              *requeueDelays[CONTROLLER_CERTIFICATE],
 		}).SetupWithManager(mgr); err != nil {
 			setupLog.Error(err, "Unable to create Certificate reconciler.", "controller", "Certificate")
 			os.Exit(1)
@@ -105,11 +554,58 @@ func main() {
 
 	}
 
-	if getBooleanEnv(ENABLE_INGRESS_DECORATION) {
+	if enabledControllers[CONTROLLER_ACM_CERTIFICATE_SYNC] {
+
+		if err = (&controllers.ACMCertificateSyncReconciler{
+			Client:                  mgr.GetClient(),
+			Scheme:                  mgr.GetScheme(),
+			Recorder:                mgr.GetEventRecorderFor(global.PACKAGE_NAME),
+			EnableQuotaChecks:       getBooleanEnv(ENABLE_QUOTA_CHECKS),
+			MaxConcurrentReconciles: *workers[CONTROLLER_ACM_CERTIFICATE_SYNC],
+			RequeueDelay:            *requeueDelays[CONTROLLER_ACM_CERTIFICATE_SYNC],
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "Unable to create ACMCertificateSync reconciler.", "controller", "ACMCertificateSync")
+			os.Exit(1)
+		}
+
+	}
+
+	if enabledControllers[CONTROLLER_INGRESS] {
+
+		// Issuer of Certificates provisioned for Ingresses without an issuer annotation.
+		var defaultIssuer *cmmeta.ObjectReference
+		if issuer := strings.TrimSpace(os.Getenv(CERTIFICATE_ISSUER)); issuer != "" {
+			defaultIssuer, err = controllers.ParseIssuerReference(issuer)
+			if err != nil {
+				setupLog.Error(err, "Invalid certificate issuer configuration.")
+				os.Exit(1)
+			}
+		}
+
+		certificateSource := strings.TrimSpace(os.Getenv(INGRESS_CERTIFICATE_SOURCE))
+		if certificateSource != "" {
+			if err := controllers.ValidateCertificateSource(certificateSource); err != nil {
+				setupLog.Error(err, "Invalid Ingress certificate source configuration.")
+				os.Exit(1)
+			}
+		}
 
 		if err = (&controllers.IngressReconciler{
-			Client: mgr.GetClient(),
-			Scheme: mgr.GetScheme(),
+			Client:                        mgr.GetClient(),
+			Scheme:                        mgr.GetScheme(),
+			Recorder:                      mgr.GetEventRecorderFor(global.PACKAGE_NAME),
+			EnableCertificateRequests:     getBooleanEnv(ENABLE_CERTIFICATE_REQUESTS),
+			EnableCertificateProvisioning: getBooleanEnv(ENABLE_CERTIFICATE_PROVISIONING),
+			DefaultIssuer:                 defaultIssuer,
+			IngressClasses:                getListEnv(INGRESS_CLASSES),
+			CertificateArnAnnotation:      strings.TrimSpace(os.Getenv(INGRESS_CERTIFICATE_ARN_ANNOTATION)),
+			UseTLSHosts:                   getBooleanEnv(INGRESS_TLS_HOSTS),
+			SSLPolicy:                     strings.TrimSpace(os.Getenv(INGRESS_SSL_POLICY)),
+			SSLRedirect:                   getBooleanEnv(INGRESS_SSL_REDIRECT),
+			CertificateSource:             certificateSource,
+			ListenerCertificateLimit:      getIntEnv(INGRESS_LISTENER_CERTIFICATE_LIMIT, 0),
+			MaxConcurrentReconciles:       *workers[CONTROLLER_INGRESS],
+			RequeueDelay:                  *requeueDelays[CONTROLLER_INGRESS],
 		}).SetupWithManager(mgr); err != nil {
 			setupLog.Error(err, "Unable to create ingress reconciler.", "controller", "Ingress")
 			os.Exit(1)
@@ -117,6 +613,175 @@ func main() {
 
 	}
 
+	if enabledControllers[CONTROLLER_ACM_CERTIFICATE_REQUEST] {
+
+		if err = (&controllers.ACMCertificateRequestReconciler{
+			Client:                    mgr.GetClient(),
+			Scheme:                    mgr.GetScheme(),
+			Recorder:                  mgr.GetEventRecorderFor(global.PACKAGE_NAME),
+			EnableCertificateDeletion: getBooleanEnv(ENABLE_CERTIFICATE_DELETION),
+			MaxConcurrentReconciles:   *workers[CONTROLLER_ACM_CERTIFICATE_REQUEST],
+			RequeueDelay:              *requeueDelays[CONTROLLER_ACM_CERTIFICATE_REQUEST],
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "Unable to create ACMCertificateRequest reconciler.", "controller", "ACMCertificateRequest")
+			os.Exit(1)
+		}
+
+		if err = (&controllers.ValidationRecordReconciler{
+			Client:                  mgr.GetClient(),
+			Scheme:                  mgr.GetScheme(),
+			Recorder:                mgr.GetEventRecorderFor(global.PACKAGE_NAME),
+			MaxConcurrentReconciles: *workers[CONTROLLER_ACM_CERTIFICATE_REQUEST],
+			RequeueDelay:            *requeueDelays[CONTROLLER_ACM_CERTIFICATE_REQUEST],
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "Unable to create validation record reconciler.", "controller", "ValidationRecord")
+			os.Exit(1)
+		}
+
+	}
+
+	if enabledControllers[CONTROLLER_PRIVATE_CERTIFICATE] {
+
+		if err = (&controllers.PrivateCertificateReconciler{
+			Client:                  mgr.GetClient(),
+			Scheme:                  mgr.GetScheme(),
+			Recorder:                mgr.GetEventRecorderFor(global.PACKAGE_NAME),
+			MaxConcurrentReconciles: *workers[CONTROLLER_PRIVATE_CERTIFICATE],
+			RequeueDelay:            *requeueDelays[CONTROLLER_PRIVATE_CERTIFICATE],
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "Unable to create PrivateCertificate reconciler.", "controller", "PrivateCertificate")
+			os.Exit(1)
+		}
+
+	}
+
+	if enabledControllers[CONTROLLER_ACM_CERTIFICATE_EXPORT] {
+
+		if err = (&controllers.ACMCertificateExportReconciler{
+			Client:                  mgr.GetClient(),
+			Scheme:                  mgr.GetScheme(),
+			Recorder:                mgr.GetEventRecorderFor(global.PACKAGE_NAME),
+			MaxConcurrentReconciles: *workers[CONTROLLER_ACM_CERTIFICATE_EXPORT],
+			RequeueDelay:            *requeueDelays[CONTROLLER_ACM_CERTIFICATE_EXPORT],
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "Unable to create ACMCertificateExport reconciler.", "controller", "ACMCertificateExport")
+			os.Exit(1)
+		}
+
+	}
+
+	if enabledControllers[CONTROLLER_GATEWAY] {
+
+		if err = (&controllers.GatewayReconciler{
+			Client:                  mgr.GetClient(),
+			Scheme:                  mgr.GetScheme(),
+			Recorder:                mgr.GetEventRecorderFor(global.PACKAGE_NAME),
+			MaxConcurrentReconciles: *workers[CONTROLLER_GATEWAY],
+			RequeueDelay:            *requeueDelays[CONTROLLER_GATEWAY],
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "Unable to create gateway reconciler.", "controller", "Gateway")
+			os.Exit(1)
+		}
+
+	}
+
+	if enabledControllers[CONTROLLER_SERVICE] {
+
+		if err = (&controllers.ServiceReconciler{
+			Client:                  mgr.GetClient(),
+			Scheme:                  mgr.GetScheme(),
+			Recorder:                mgr.GetEventRecorderFor(global.PACKAGE_NAME),
+			MaxConcurrentReconciles: *workers[CONTROLLER_SERVICE],
+			RequeueDelay:            *requeueDelays[CONTROLLER_SERVICE],
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "Unable to create service reconciler.", "controller", "Service")
+			os.Exit(1)
+		}
+
+	}
+
+	if enabledControllers[CONTROLLER_ISTIO_GATEWAY] {
+
+		if err = (&controllers.IstioGatewayReconciler{
+			Client:                  mgr.GetClient(),
+			Scheme:                  mgr.GetScheme(),
+			Recorder:                mgr.GetEventRecorderFor(global.PACKAGE_NAME),
+			MaxConcurrentReconciles: *workers[CONTROLLER_ISTIO_GATEWAY],
+			RequeueDelay:            *requeueDelays[CONTROLLER_ISTIO_GATEWAY],
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "Unable to create Istio gateway reconciler.", "controller", "IstioGateway")
+			os.Exit(1)
+		}
+
+	}
+
+	if enabledControllers[CONTROLLER_LISTENER] {
+
+		if err = (&controllers.ListenerReconciler{
+			Client:                  mgr.GetClient(),
+			Scheme:                  mgr.GetScheme(),
+			Recorder:                mgr.GetEventRecorderFor(global.PACKAGE_NAME),
+			MaxConcurrentReconciles: *workers[CONTROLLER_LISTENER],
+			RequeueDelay:            *requeueDelays[CONTROLLER_LISTENER],
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "Unable to create listener reconciler.", "controller", "Listener")
+			os.Exit(1)
+		}
+
+	}
+
+	if enabledControllers[CONTROLLER_ACM_SECRET_STATE] {
+
+		if err = (&controllers.ACMSecretStateReconciler{
+			Client:                  mgr.GetClient(),
+			Scheme:                  mgr.GetScheme(),
+			Recorder:                mgr.GetEventRecorderFor(global.PACKAGE_NAME),
+			MaxConcurrentReconciles: *workers[CONTROLLER_ACM_SECRET_STATE],
+			RequeueDelay:            *requeueDelays[CONTROLLER_ACM_SECRET_STATE],
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "Unable to create ACM secret state reconciler.", "controller", "ACMSecretState")
+			os.Exit(1)
+		}
+
+	}
+
+	if getBooleanEnv(ENABLE_ANNOTATION_WEBHOOK) {
+
+		// Serves on the manager's webhook port (9443). Serving certificates are expected in the default location (/tmp/k8s-webhook-server/serving-certs.)
+		mgr.GetWebhookServer().Register(webhooks.AnnotationValidatorPath, &webhook.Admission{Handler: &webhooks.AnnotationValidator{Compat: annotationCompat}})
+
+	}
+
+	if getBooleanEnv(ENABLE_INGRESS_DEFAULTING_WEBHOOK) {
+
+		parsedIngressSelector, err := labels.Parse(ingressDefaultingSelector)
+		if err != nil {
+			setupLog.Error(err, "Invalid Ingress defaulting selector configuration.")
+			os.Exit(1)
+		}
+		if ingressDefaultListenPorts != "" {
+			if err := webhooks.ValidateListenPorts(ingressDefaultListenPorts); err != nil {
+				setupLog.Error(err, "Invalid Ingress default listen ports configuration.")
+				os.Exit(1)
+			}
+		}
+		if ingressDefaultIPAddressType != "" {
+			if err := webhooks.ValidateIPAddressType(ingressDefaultIPAddressType); err != nil {
+				setupLog.Error(err, "Invalid Ingress default IP address type configuration.")
+				os.Exit(1)
+			}
+		}
+
+		mgr.GetWebhookServer().Register(webhooks.IngressDefaulterPath, &webhook.Admission{Handler: &webhooks.IngressDefaulter{Selector: parsedIngressSelector, ListenPorts: ingressDefaultListenPorts, IPAddressType: ingressDefaultIPAddressType, Compat: annotationCompat}})
+
+	}
+
+	// Summary of managed objects, served alongside metrics (e.g. 'curl localhost:8080/status?format=table'.)
+	if err := mgr.AddMetricsExtraHandler(controllers.StatusPath, &controllers.StatusHandler{Client: mgr.GetClient()}); err != nil {
+		setupLog.Error(err, "Unable to set up status endpoint.")
+		os.Exit(1)
+	}
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "Unable to set up health check.")
 		os.Exit(1)
@@ -125,6 +790,44 @@ func main() {
 		setupLog.Error(err, "Unable to set up ready check.")
 		os.Exit(1)
 	}
+	// The agent is not ready while its AWS credentials are unavailable (e.g. IRSA is misconfigured), but continues to run so that it recovers once they are.
+	if err := mgr.AddReadyzCheck("aws-credentials", controllers.AWSCredentialsReadyCheck); err != nil {
+		setupLog.Error(err, "Unable to set up AWS credentials ready check.")
+		os.Exit(1)
+	}
+
+	// AWS connectivity is checked periodically, by every replica (see AWSHealthChecker.)
+	awsHealthChecker := &controllers.AWSHealthChecker{Interval: awsHealthCheckInterval, FailureThreshold: awsHealthCheckFailureThreshold}
+	if err := mgr.Add(awsHealthChecker); err != nil {
+		setupLog.Error(err, "Unable to set up AWS health check.")
+		os.Exit(1)
+	}
+	if err := mgr.AddReadyzCheck("aws", awsHealthChecker.ReadyCheck); err != nil {
+		setupLog.Error(err, "Unable to set up AWS ready check.")
+		os.Exit(1)
+	}
+	if err := mgr.AddHealthzCheck("aws", awsHealthChecker.HealthCheck); err != nil {
+		setupLog.Error(err, "Unable to set up AWS health check.")
+		os.Exit(1)
+	}
+
+	// Version 1 annotations are migrated before controllers start (by every replica, since migration is idempotent), and then periodically by the leader to catch annotations re-applied from older manifests.
+	if annotationCompat {
+		annotationMigrator := &controllers.AnnotationMigrator{Client: mgr.GetClient(), Reader: mgr.GetAPIReader()}
+		migrationCtx, cancel := context.WithTimeout(ctrl.LoggerInto(context.Background(), setupLog), 5*time.Minute)
+		annotationMigrator.Migrate(migrationCtx)
+		cancel()
+		if err := mgr.Add(annotationMigrator); err != nil {
+			setupLog.Error(err, "Unable to set up annotation migration.")
+			os.Exit(1)
+		}
+	}
+
+	credentialsCtx, cancel := context.WithTimeout(ctrl.LoggerInto(context.Background(), setupLog), 30*time.Second)
+	if err := controllers.CheckAWSCredentials(credentialsCtx); err == nil {
+		setupLog.Info("AWS credentials are available.")
+	}
+	cancel()
 
 	setupLog.Info("Starting manager...")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
@@ -137,3 +840,316 @@ func getBooleanEnv(key string) bool {
 	result, _ := strconv.ParseBool(os.Getenv(key))
 	return result
 }
+
+// Returns the boolean value of the environment variable, or the default if it is unset or not a boolean.
+func getBooleanEnvOrDefault(key string, defaultValue bool) bool {
+	result, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return result
+}
+
+// Returns the names of all controllers that can be selected using the --controllers flag.
+func allControllers() []string {
+	return []string{
+		CONTROLLER_SECRET,
+		CONTROLLER_CERTIFICATE,
+		CONTROLLER_ACM_CERTIFICATE_SYNC,
+		CONTROLLER_INGRESS,
+		CONTROLLER_ACM_CERTIFICATE_REQUEST,
+		CONTROLLER_PRIVATE_CERTIFICATE,
+		CONTROLLER_ACM_CERTIFICATE_EXPORT,
+		CONTROLLER_GATEWAY,
+		CONTROLLER_SERVICE,
+		CONTROLLER_ISTIO_GATEWAY,
+		CONTROLLER_LISTENER,
+		CONTROLLER_ACM_SECRET_STATE,
+	}
+}
+
+// Returns the set of controllers to run: either those listed in controllerList or, if this is empty, those enabled by the ENABLE_* environment variables.
+func selectControllers(controllerList string) (map[string]bool, error) {
+
+	if strings.TrimSpace(controllerList) == "" {
+		return map[string]bool{
+			CONTROLLER_SECRET:                  getBooleanEnv(ENABLE_CERTIFICATE_SYNC),
+			CONTROLLER_CERTIFICATE:             getBooleanEnv(ENABLE_CERTIFICATE_SYNC),
+			CONTROLLER_ACM_CERTIFICATE_SYNC:    getBooleanEnv(ENABLE_CERTIFICATE_SYNC),
+			CONTROLLER_INGRESS:                 getBooleanEnv(ENABLE_INGRESS_DECORATION),
+			CONTROLLER_ACM_CERTIFICATE_REQUEST: getBooleanEnv(ENABLE_CERTIFICATE_REQUESTS),
+			CONTROLLER_PRIVATE_CERTIFICATE:     getBooleanEnv(ENABLE_PRIVATE_CA),
+			CONTROLLER_ACM_CERTIFICATE_EXPORT:  getBooleanEnv(ENABLE_CERTIFICATE_EXPORT),
+			CONTROLLER_GATEWAY:                 getBooleanEnv(ENABLE_GATEWAY_DECORATION),
+			CONTROLLER_SERVICE:                 getBooleanEnv(ENABLE_SERVICE_DECORATION),
+			CONTROLLER_ISTIO_GATEWAY:           getBooleanEnv(ENABLE_ISTIO_DECORATION),
+			CONTROLLER_LISTENER:                getBooleanEnv(ENABLE_LISTENER_ROTATION),
+			CONTROLLER_ACM_SECRET_STATE:        getBooleanEnv(ENABLE_SECRET_STATE),
+		}, nil
+	}
+
+	result := map[string]bool{}
+	for _, name := range strings.Split(controllerList, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, controller := range allControllers() {
+			known = known || controller == name
+		}
+		if !known {
+			return nil, fmt.Errorf("Unknown controller '%s'. Expected one of: %s.", name, strings.Join(allControllers(), ", "))
+		}
+		result[name] = true
+	}
+
+	return result, nil
+}
+
+// Returns the names of the selected controllers, in canonical order.
+func enabledControllerNames(enabledControllers map[string]bool) []string {
+	names := []string{}
+	for _, name := range allControllers() {
+		if enabledControllers[name] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Returns the non-empty elements of a comma-separated environment variable.
+func getListEnv(key string) []string {
+	result := []string{}
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+// Returns the name of the environment variable holding the default initial requeue delay for a controller (e.g. SECRET_REQUEUE_DELAY.)
+func requeueDelayEnv(controllerName string) string {
+	return strings.ToUpper(controllerName) + "_REQUEUE_DELAY"
+}
+
+// Returns the name of the environment variable holding the default worker count for a controller (e.g. SECRET_WORKERS.)
+func workersEnv(controllerName string) string {
+	return strings.ToUpper(controllerName) + "_WORKERS"
+}
+
+// Returns the name of the environment variable holding the log level for a controller (e.g. SECRET_LOG_LEVEL.)
+func logLevelEnv(controllerName string) string {
+	return strings.ToUpper(controllerName) + "_LOG_LEVEL"
+}
+
+// Parses a log level: 'debug', 'info', 'error', or an integer verbosity (as used with logr's V(), e.g. '2'.)
+func parseLogLevel(value string) (zapcore.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "debug":
+		return zapcore.DebugLevel, nil
+	case "info":
+		return zapcore.InfoLevel, nil
+	case "error":
+		return zapcore.ErrorLevel, nil
+	}
+	verbosity, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || verbosity < 0 {
+		return 0, fmt.Errorf("Log level '%s' must be one of 'debug', 'info' or 'error', or a non-negative integer.", value)
+	}
+	// Zap levels are the negation of logr verbosity.
+	return zapcore.Level(-verbosity), nil
+}
+
+// Applies the log level, format and sampling settings to the zap options. Development mode is retained, so that messages are only sampled if requested.
+func applyLogSettings(opts *zap.Options, logLevel string, logFormat string, logSampling bool) error {
+
+	switch strings.ToLower(strings.TrimSpace(logFormat)) {
+	case "", "console":
+	case "json":
+		zap.JSONEncoder()(opts)
+		zap.StacktraceLevel(zapcore.ErrorLevel)(opts)
+		if logLevel == "" {
+			logLevel = "info"
+		}
+	default:
+		return fmt.Errorf("Log format '%s' must be one of 'console' or 'json'.", logFormat)
+	}
+
+	if logLevel != "" {
+		level, err := parseLogLevel(logLevel)
+		if err != nil {
+			return err
+		}
+		zap.Level(level)(opts)
+	}
+
+	if logSampling {
+		zap.RawZapOpts(uberzap.WrapCore(func(core zapcore.Core) zapcore.Core {
+			return zapcore.NewSamplerWithOptions(core, time.Second, 100, 100)
+		}))(opts)
+	}
+
+	return nil
+}
+
+func getIntEnv(key string, defaultValue int) int {
+	result, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || result <= 0 {
+		return defaultValue
+	}
+	return result
+}
+
+// Returns a pointer to the duration, or nil if it is not set (so that the default applies.)
+func optionalDuration(duration time.Duration) *time.Duration {
+	if duration <= 0 {
+		return nil
+	}
+	return &duration
+}
+
+// Checks that the leader election timings (where set, otherwise the controller-runtime defaults) are consistent: the leader must give up leadership before its lease can be acquired by another candidate, and must be able to retry renewal before giving up.
+func validateLeaderElectionTimings(leaseDuration time.Duration, renewDeadline time.Duration, retryPeriod time.Duration) error {
+
+	if leaseDuration <= 0 {
+		leaseDuration = 15 * time.Second
+	}
+	if renewDeadline <= 0 {
+		renewDeadline = 10 * time.Second
+	}
+	if retryPeriod <= 0 {
+		retryPeriod = 2 * time.Second
+	}
+
+	if renewDeadline >= leaseDuration {
+		return fmt.Errorf("The leader election renew deadline (%s) must be less than the lease duration (%s).", renewDeadline, leaseDuration)
+	}
+	// Retries are jittered by up to 20% (see leaderelection.JitterFactor.)
+	if float64(renewDeadline) <= 1.2*float64(retryPeriod) {
+		return fmt.Errorf("The leader election renew deadline (%s) must be greater than 1.2 times the retry period (%s).", renewDeadline, retryPeriod)
+	}
+
+	return nil
+}
+
+func getDurationEnv(key string) (time.Duration, bool) {
+	result, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || result <= 0 {
+		return 0, false
+	}
+	return result, true
+}
+
+// Settings read from the agent's config file (see the --config flag.)
+type configFileSettings struct {
+	flags map[string]string
+	env   map[string]string
+}
+
+// Returns the path of the config file given by the --config flag (or the CONFIG_FILE environment variable), if any. The command line is scanned before flags are parsed, since the config file sets the environment variables which provide the defaults of flags.
+func configFilePath(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "config" {
+			continue
+		}
+		if hasValue {
+			return value
+		}
+		if i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return os.Getenv(CONFIG_FILE)
+}
+
+// Reads the config file at the path (if any.) Values may be strings, numbers, booleans or lists (which are joined with commas, e.g. for --controllers.)
+func loadConfigFile(path string) (configFileSettings, error) {
+
+	settings := configFileSettings{flags: map[string]string{}, env: map[string]string{}}
+	if path == "" {
+		return settings, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return settings, fmt.Errorf("Could not read config file '%s': %w", path, err)
+	}
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal(content, &values); err != nil {
+		return settings, fmt.Errorf("Could not parse config file '%s': %w", path, err)
+	}
+
+	for key, value := range values {
+		if key == "env" {
+			env, ok := value.(map[string]interface{})
+			if !ok {
+				return settings, fmt.Errorf("Invalid config file '%s': 'env' must map environment variable names to values.", path)
+			}
+			for name, envValue := range env {
+				if settings.env[name], err = formatConfigValue(envValue); err != nil {
+					return settings, fmt.Errorf("Invalid config file '%s': environment variable '%s' %s", path, name, err)
+				}
+			}
+			continue
+		}
+		if settings.flags[key], err = formatConfigValue(value); err != nil {
+			return settings, fmt.Errorf("Invalid config file '%s': flag '%s' %s", path, key, err)
+		}
+	}
+
+	return settings, nil
+}
+
+// Formats a value read from the config file as the string value of a flag or environment variable.
+func formatConfigValue(value interface{}) (string, error) {
+	switch typedValue := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return typedValue, nil
+	case bool:
+		return strconv.FormatBool(typedValue), nil
+	case float64:
+		return strconv.FormatFloat(typedValue, 'f', -1, 64), nil
+	case []interface{}:
+		items := []string{}
+		for _, item := range typedValue {
+			formattedItem, err := formatConfigValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, formattedItem)
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("must be a string, number, boolean or list.")
+}
+
+// Sets the flags given in the config file, unless they were given on the command line.
+func (s configFileSettings) applyFlags(flagSet *flag.FlagSet) error {
+
+	commandLineFlags := map[string]bool{}
+	flagSet.Visit(func(f *flag.Flag) {
+		commandLineFlags[f.Name] = true
+	})
+
+	for name, value := range s.flags {
+		if name == "config" || flagSet.Lookup(name) == nil {
+			return fmt.Errorf("Invalid config file: unknown flag '%s'.", name)
+		}
+		if commandLineFlags[name] {
+			continue
+		}
+		if err := flagSet.Set(name, value); err != nil {
+			return fmt.Errorf("Invalid config file: flag '%s': %w", name, err)
+		}
+	}
+
+	return nil
+}
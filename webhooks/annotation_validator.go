@@ -0,0 +1,382 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"Validitron/k8s-acm-certificate-agent/controllers"
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+const (
+	AnnotationValidatorPath = "/validate-agent-annotations"
+)
+
+var (
+	regionPattern       = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+	hostedZoneIDPattern = regexp.MustCompile(`^[A-Z0-9]{1,32}$`)
+	accountIDPattern    = regexp.MustCompile(`^[0-9]{12}$`)
+)
+
+// AnnotationValidator rejects objects whose acm-certificate-agent annotations are malformed or unknown.
+// Only object metadata is inspected, so the same validator can be registered for any resource type.
+type AnnotationValidator struct {
+	// If true, version 1 annotations are validated as their current equivalents (with a warning that they are deprecated.) Otherwise version 1 annotations are rejected when they are added or changed, but those carried unchanged by an update are admitted (with a warning that they are ignored), so that objects annotated by earlier versions of the agent can still be updated by other writers.
+	Compat bool
+}
+
+func (v *AnnotationValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+
+	if req.Object.Raw == nil {
+		return admission.Allowed("")
+	}
+
+	object := &metav1.PartialObjectMetadata{}
+	if err := json.Unmarshal(req.Object.Raw, object); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	warnings := []string{}
+	problems := []string{}
+	if v.Compat {
+		for _, key := range controllers.UpgradeAnnotations(object.Annotations) {
+			currentKey, _ := controllers.UpgradeAnnotationKey(key)
+			warnings = append(warnings, fmt.Sprintf("Annotation '%s' is deprecated: use '%s'.", key, currentKey))
+		}
+	} else {
+		previous := &metav1.PartialObjectMetadata{}
+		if req.OldObject.Raw != nil {
+			if err := json.Unmarshal(req.OldObject.Raw, previous); err != nil {
+				return admission.Errored(http.StatusBadRequest, err)
+			}
+		}
+		for key, value := range object.Annotations {
+			currentKey, ok := controllers.UpgradeAnnotationKey(key)
+			if !ok {
+				continue
+			}
+			if previousValue, exists := previous.Annotations[key]; exists && previousValue == value {
+				warnings = append(warnings, fmt.Sprintf("Annotation '%s' is ignored: use '%s'.", key, currentKey))
+			} else {
+				problems = append(problems, fmt.Sprintf("Annotation '%s' is no longer supported: use '%s'.", key, currentKey))
+			}
+		}
+	}
+
+	problems = append(problems, ValidateAnnotations(object.Annotations)...)
+	if len(problems) > 0 {
+		return admission.Denied(strings.Join(problems, " ")).WithWarnings(warnings...)
+	}
+
+	return admission.Allowed("").WithWarnings(warnings...)
+}
+
+// ValidateAnnotations returns a description of each problem found in the agent annotations (other than version 1 annotations, which are checked by AnnotationValidator.)
+func ValidateAnnotations(annotations map[string]string) []string {
+
+	problems := []string{}
+
+	for key, value := range annotations {
+		if !strings.HasPrefix(key, global.ANNOTATION_PREFIX+"/") {
+			continue
+		}
+
+		validator, ok := annotationValidators[key]
+		if !ok && strings.HasPrefix(key, global.AGENT_CERTIFICATE_ARN_ANNOTATION+".") {
+			region := strings.TrimPrefix(key, global.AGENT_CERTIFICATE_ARN_ANNOTATION+".")
+			validator, ok = regionalCertificateArnValidator(region), regionPattern.MatchString(region)
+		}
+		if !ok {
+			problems = append(problems, fmt.Sprintf("Annotation '%s' is not recognised.", key))
+			continue
+		}
+
+		if err := validator(value); err != nil {
+			problems = append(problems, fmt.Sprintf("Annotation '%s' is invalid: %s", key, err))
+		}
+	}
+
+	return problems
+}
+
+// Validation functions for each known agent annotation.
+var annotationValidators = map[string]func(string) error{
+	global.AGENT_ENABLED_ANNOTATION:                    validateBoolean,
+	global.AGENT_INHERITS_FROM_ANNOTATION:              validateAny,
+	global.AGENT_CERTIFICATE_ARN_ANNOTATION:            validateCertificateArn,
+	global.AGENT_CERTIFICATE_DOMAIN_NAMES_ANNOTATION:   validateAny,
+	global.AGENT_CERTIFICATE_SERIAL_NUMBER_ANNOTATION:  validateAny,
+	global.AGENT_CERTIFICATE_EXPIRY_DATE_ANNOTATION:    validateAny,
+	global.AGENT_REGIONS_ANNOTATION:                    validateRegions,
+	global.AGENT_ASSUME_ROLE_ARN_ANNOTATION:            validateRoleArn,
+	global.AGENT_DELETE_POLICY_ANNOTATION:              validateDeletePolicy,
+	global.AGENT_REQUEST_CERTIFICATE_ANNOTATION:        validateBoolean,
+	global.AGENT_HOSTED_ZONE_ID_ANNOTATION:             validateHostedZoneIDs,
+	global.AGENT_CERTIFICATE_SOURCE_ANNOTATION:         controllers.ValidateCertificateSource,
+	global.AGENT_SOURCE_CLUSTER_ANNOTATION:             validateAny,
+	global.AGENT_SYNC_STATUS_ANNOTATION:                validateAny,
+	global.AGENT_RETRY_COUNT_ANNOTATION:                validateAny,
+	global.AGENT_ACM_CERTIFICATES_ANNOTATION:           validateAny,
+	global.AGENT_PARSE_FAILURE_ANNOTATION:              validateAny,
+	global.AGENT_DATA_HASH_ANNOTATION:                  validateAny,
+	global.AGENT_CERTIFICATE_HASH_ANNOTATION:           validateAny,
+	global.AGENT_CONFIG_HASH_ANNOTATION:                validateAny,
+	global.AGENT_CERTIFICATE_SECRET_ANNOTATION:         validateBoolean,
+	global.AGENT_CERT_KEY_ANNOTATION:                   validateDataKey,
+	global.AGENT_KEY_KEY_ANNOTATION:                    validateDataKey,
+	global.AGENT_CHAIN_KEY_ANNOTATION:                  validateDataKey,
+	global.AGENT_PKCS12_KEY_ANNOTATION:                 validateDataKey,
+	global.AGENT_PKCS12_PASSWORD_KEY_ANNOTATION:        validateDataKey,
+	global.AGENT_KEY_PASSWORD_KEY_ANNOTATION:           validateDataKey,
+	global.AGENT_FETCH_CHAIN_ANNOTATION:                validateBoolean,
+	global.AGENT_CHECK_REVOCATION_ANNOTATION:           validateBoolean,
+	global.AGENT_SECRET_NAMESPACES_ANNOTATION:          validateNamespaces,
+	global.AGENT_SECRET_SELECTOR_ANNOTATION:            validateLabelSelector,
+	global.AGENT_CERTIFICATE_ARN_POLICY_ANNOTATION:     validateCertificateArnPolicy,
+	global.AGENT_MANAGED_CERTIFICATE_ARNS_ANNOTATION:   validateCertificateArns,
+	global.AGENT_HOST_CERTIFICATES_ANNOTATION:          validateAny,
+	global.AGENT_SSL_REDIRECT_ANNOTATION:               validateSSLRedirectPolicy,
+	global.AGENT_MANAGED_SSL_REDIRECT_ANNOTATION:       validateAny,
+	global.AGENT_CERTIFICATE_SELECTION_ANNOTATION:      validateCertificateSelection,
+	global.AGENT_REQUEST_QUOTA_INCREASE_ANNOTATION:     validateBoolean,
+	global.AGENT_USE_FOR_ANNOTATION:                    validateUseFor,
+	global.AGENT_CLOUDFRONT_CERTIFICATE_ARN_ANNOTATION: validateCertificateArn,
+	global.AGENT_LISTENER_ARNS_ANNOTATION:              validateListenerArns,
+	global.AGENT_LISTENER_CERTIFICATE_ANNOTATION:       validateListenerCertificate,
+	global.AGENT_LISTENER_CERTIFICATE_ARNS_ANNOTATION:  validateCertificateArns,
+	global.AGENT_TAGS_ANNOTATION:                       validateTags,
+	global.AGENT_ISSUER_ANNOTATION:                     validateIssuerName,
+	global.AGENT_CLUSTER_ISSUER_ANNOTATION:             validateIssuerName,
+	global.AGENT_NOTIFICATION_WEBHOOK_ANNOTATION:       controllers.ValidateNotificationWebhookURL,
+	global.AGENT_NOTIFICATION_TEMPLATE_ANNOTATION:      controllers.ValidateNotificationTemplate,
+	global.AGENT_MULTI_LEAF_ANNOTATION:                 validateBoolean,
+	global.AGENT_LEAF_CERTIFICATES_ANNOTATION:          validateAny,
+	global.AGENT_DOMAIN_MATCHING_ANNOTATION:            validateDomainMatching,
+	global.AGENT_DOMAIN_MAPPING_ANNOTATION:             validateConfigMapName,
+}
+
+func validateAny(value string) error {
+	return nil
+}
+
+func validateDataKey(value string) error {
+	if problems := validation.IsConfigMapKey(value); len(problems) > 0 {
+		return fmt.Errorf("'%s' is not a valid Secret data key (%s.)", value, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func validateBoolean(value string) error {
+	if _, err := strconv.ParseBool(value); err != nil {
+		return fmt.Errorf("'%s' is not a boolean value.", value)
+	}
+	return nil
+}
+
+func validateArn(value string, service string) error {
+	// Empty ARNs are permitted (the agent treats these as unset.)
+	if value == "" {
+		return nil
+	}
+	parsedArn, err := arn.Parse(value)
+	if err != nil {
+		return fmt.Errorf("'%s' is not a valid ARN.", value)
+	}
+	if parsedArn.Service != service {
+		return fmt.Errorf("'%s' is not an %s ARN.", value, strings.ToUpper(service))
+	}
+	return nil
+}
+
+func validateCertificateArn(value string) error {
+	if err := validateArn(value, "acm"); err != nil || value == "" {
+		return err
+	}
+	parsedArn, _ := arn.Parse(value)
+	if !strings.HasPrefix(parsedArn.Resource, "certificate/") || parsedArn.Region == "" || !accountIDPattern.MatchString(parsedArn.AccountID) {
+		return fmt.Errorf("'%s' is not an ACM certificate ARN.", value)
+	}
+	return nil
+}
+
+// Returns a validator for the ACM certificate ARN of the specified region, which must belong to that region.
+func regionalCertificateArnValidator(region string) func(string) error {
+	return func(value string) error {
+		if err := validateCertificateArn(value); err != nil || value == "" {
+			return err
+		}
+		if parsedArn, _ := arn.Parse(value); parsedArn.Region != region {
+			return fmt.Errorf("'%s' belongs to region '%s', not '%s'.", value, parsedArn.Region, region)
+		}
+		return nil
+	}
+}
+
+func validateCertificateArns(value string) error {
+	for _, certificateArn := range strings.Split(value, ",") {
+		if err := validateCertificateArn(strings.TrimSpace(certificateArn)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateRoleArn(value string) error {
+	return validateArn(value, "iam")
+}
+
+func validateRegions(value string) error {
+	for _, region := range strings.Split(value, ",") {
+		region = strings.TrimSpace(region)
+		if region != "" && !regionPattern.MatchString(region) {
+			return fmt.Errorf("'%s' is not a valid AWS region.", region)
+		}
+	}
+	return nil
+}
+
+func validateNamespaces(value string) error {
+	for _, namespace := range strings.Split(value, ",") {
+		namespace = strings.TrimSpace(namespace)
+		if namespace == "" {
+			continue
+		}
+		if problems := validation.IsDNS1123Label(namespace); len(problems) > 0 {
+			return fmt.Errorf("'%s' is not a valid namespace (%s.)", namespace, strings.Join(problems, "; "))
+		}
+	}
+	return nil
+}
+
+func validateLabelSelector(value string) error {
+	if _, err := labels.Parse(value); err != nil {
+		return fmt.Errorf("'%s' is not a valid label selector (%s.)", value, err)
+	}
+	return nil
+}
+
+func validateDeletePolicy(value string) error {
+	if !strings.EqualFold(value, global.DELETE_POLICY_DELETE) && !strings.EqualFold(value, global.DELETE_POLICY_RETAIN) {
+		return fmt.Errorf("'%s' must be one of '%s' or '%s'.", value, global.DELETE_POLICY_DELETE, global.DELETE_POLICY_RETAIN)
+	}
+	return nil
+}
+
+func validateSSLRedirectPolicy(value string) error {
+	if !strings.EqualFold(value, global.SSL_REDIRECT_POLICY_ANNOTATION) && !strings.EqualFold(value, global.SSL_REDIRECT_POLICY_ACTIONS) && !strings.EqualFold(value, global.SSL_REDIRECT_POLICY_NONE) {
+		return fmt.Errorf("'%s' must be one of '%s', '%s' or '%s'.", value, global.SSL_REDIRECT_POLICY_ANNOTATION, global.SSL_REDIRECT_POLICY_ACTIONS, global.SSL_REDIRECT_POLICY_NONE)
+	}
+	return nil
+}
+
+func validateCertificateArnPolicy(value string) error {
+	if !strings.EqualFold(value, global.CERTIFICATE_ARN_POLICY_MERGE) && !strings.EqualFold(value, global.CERTIFICATE_ARN_POLICY_REPLACE) {
+		return fmt.Errorf("'%s' must be one of '%s' or '%s'.", value, global.CERTIFICATE_ARN_POLICY_MERGE, global.CERTIFICATE_ARN_POLICY_REPLACE)
+	}
+	return nil
+}
+
+func validateCertificateSelection(value string) error {
+	if !strings.EqualFold(value, global.CERTIFICATE_SELECTION_LATEST_EXPIRY) && !strings.EqualFold(value, global.CERTIFICATE_SELECTION_MOST_SPECIFIC) {
+		return fmt.Errorf("'%s' must be one of '%s' or '%s'.", value, global.CERTIFICATE_SELECTION_LATEST_EXPIRY, global.CERTIFICATE_SELECTION_MOST_SPECIFIC)
+	}
+	return nil
+}
+
+func validateDomainMatching(value string) error {
+	for _, policy := range []string{global.DOMAIN_MATCHING_EXACT, global.DOMAIN_MATCHING_WILDCARD, global.DOMAIN_MATCHING_WILDCARD_ANY_DEPTH, global.DOMAIN_MATCHING_MAPPED} {
+		if strings.EqualFold(value, policy) {
+			return nil
+		}
+	}
+	return fmt.Errorf("'%s' must be one of '%s', '%s', '%s' or '%s'.", value, global.DOMAIN_MATCHING_EXACT, global.DOMAIN_MATCHING_WILDCARD, global.DOMAIN_MATCHING_WILDCARD_ANY_DEPTH, global.DOMAIN_MATCHING_MAPPED)
+}
+
+func validateConfigMapName(value string) error {
+	if problems := validation.IsDNS1123Subdomain(value); len(problems) > 0 {
+		return fmt.Errorf("'%s' is not a valid ConfigMap name (%s.)", value, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func validateListenerArns(value string) error {
+	for _, listenerArn := range strings.Split(value, ",") {
+		listenerArn = strings.TrimSpace(listenerArn)
+		if err := validateArn(listenerArn, "elasticloadbalancing"); err != nil {
+			return err
+		}
+		if parsedArn, _ := arn.Parse(listenerArn); listenerArn != "" && !strings.HasPrefix(parsedArn.Resource, "listener/") {
+			return fmt.Errorf("'%s' is not a load balancer listener ARN.", listenerArn)
+		}
+	}
+	return nil
+}
+
+func validateListenerCertificate(value string) error {
+	if !strings.EqualFold(value, global.LISTENER_CERTIFICATE_DEFAULT) && !strings.EqualFold(value, global.LISTENER_CERTIFICATE_ADDITIONAL) {
+		return fmt.Errorf("'%s' must be one of '%s' or '%s'.", value, global.LISTENER_CERTIFICATE_DEFAULT, global.LISTENER_CERTIFICATE_ADDITIONAL)
+	}
+	return nil
+}
+
+func validateUseFor(value string) error {
+	if !strings.EqualFold(value, global.USE_FOR_CLOUDFRONT) {
+		return fmt.Errorf("'%s' must be '%s'.", value, global.USE_FOR_CLOUDFRONT)
+	}
+	return nil
+}
+
+func validateTags(value string) error {
+	for _, tag := range strings.Split(value, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return fmt.Errorf("'%s' is not a valid tag: expected 'key=value'.", tag)
+		}
+		if len(strings.TrimSpace(parts[0])) > 128 {
+			return fmt.Errorf("Tag key '%s' exceeds 128 characters.", strings.TrimSpace(parts[0]))
+		}
+	}
+	return nil
+}
+
+func validateIssuerName(value string) error {
+	if problems := validation.IsDNS1123Subdomain(value); len(problems) > 0 {
+		return fmt.Errorf("'%s' is not a valid issuer name (%s.)", value, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func validateHostedZoneIDs(value string) error {
+	for _, hostedZoneID := range strings.Split(value, ",") {
+		hostedZoneID = strings.TrimPrefix(strings.TrimSpace(hostedZoneID), "/hostedzone/")
+		if !hostedZoneIDPattern.MatchString(hostedZoneID) {
+			return fmt.Errorf("'%s' is not a valid Route53 hosted zone ID.", hostedZoneID)
+		}
+	}
+	return nil
+}
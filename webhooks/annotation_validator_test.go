@@ -0,0 +1,176 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+// Every agent annotation declared in the global package has a validator, so that the webhook does not reject the agent's own annotations as unrecognised.
+func TestAnnotationValidatorsCoverAgentAnnotations(t *testing.T) {
+
+	file, err := parser.ParseFile(token.NewFileSet(), "../global/global.go", nil, 0)
+	if err != nil {
+		t.Fatalf("Could not parse global.go: %s", err)
+	}
+
+	found := 0
+	ast.Inspect(file, func(node ast.Node) bool {
+		spec, ok := node.(*ast.ValueSpec)
+		if !ok {
+			return true
+		}
+		for i, name := range spec.Names {
+			if !strings.HasPrefix(name.Name, "AGENT_") || !strings.HasSuffix(name.Name, "_ANNOTATION") {
+				continue
+			}
+			found++
+
+			// Annotation keys are declared as ANNOTATION_PREFIX + "/<name>".
+			expression, ok := spec.Values[i].(*ast.BinaryExpr)
+			if !ok {
+				t.Errorf("%s is not declared as ANNOTATION_PREFIX + \"/<name>\".", name.Name)
+				continue
+			}
+			prefix, ok := expression.X.(*ast.Ident)
+			suffix, isLiteral := expression.Y.(*ast.BasicLit)
+			if !ok || prefix.Name != "ANNOTATION_PREFIX" || !isLiteral {
+				t.Errorf("%s is not declared as ANNOTATION_PREFIX + \"/<name>\".", name.Name)
+				continue
+			}
+			value, err := strconv.Unquote(suffix.Value)
+			if err != nil {
+				t.Fatalf("Could not read %s: %s", name.Name, err)
+			}
+
+			if _, ok := annotationValidators[global.ANNOTATION_PREFIX+value]; !ok {
+				t.Errorf("%s ('%s') has no validator.", name.Name, global.ANNOTATION_PREFIX+value)
+			}
+		}
+		return false
+	})
+
+	if found == 0 {
+		t.Fatalf("Found no agent annotations in global.go.")
+	}
+}
+
+func TestValidateNotificationAnnotations(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		valid       bool
+	}{
+		{"README example", map[string]string{
+			global.AGENT_NOTIFICATION_WEBHOOK_ANNOTATION:  "https://hooks.slack.com/services/T000/B000/XXXX",
+			global.AGENT_NOTIFICATION_TEMPLATE_ANNOTATION: `{"summary": {{ .Title | json }}, "object": {{ printf "%s/%s" .Namespace .Name | json }}}`,
+		}, true},
+		{"HTTP webhook", map[string]string{global.AGENT_NOTIFICATION_WEBHOOK_ANNOTATION: "http://notifier.monitoring.svc/hook"}, true},
+		{"Empty webhook", map[string]string{global.AGENT_NOTIFICATION_WEBHOOK_ANNOTATION: ""}, true},
+		{"Relative webhook", map[string]string{global.AGENT_NOTIFICATION_WEBHOOK_ANNOTATION: "/hook"}, false},
+		{"Non-HTTP webhook", map[string]string{global.AGENT_NOTIFICATION_WEBHOOK_ANNOTATION: "ftp://example.test/hook"}, false},
+		{"Unparseable template", map[string]string{global.AGENT_NOTIFICATION_TEMPLATE_ANNOTATION: `{"text": {{ .Title }`}, false},
+		{"Unknown template function", map[string]string{global.AGENT_NOTIFICATION_TEMPLATE_ANNOTATION: `{"text": {{ .Title | yaml }}}`}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			problems := ValidateAnnotations(test.annotations)
+			if test.valid && len(problems) > 0 {
+				t.Errorf("Annotations were rejected: %s", strings.Join(problems, " "))
+			}
+			if !test.valid && len(problems) == 0 {
+				t.Errorf("Annotations were accepted.")
+			}
+		})
+	}
+}
+
+func TestAnnotationValidatorVersion1Annotations(t *testing.T) {
+
+	v1Regions := global.V1_ANNOTATION_PREFIX + strings.TrimPrefix(global.AGENT_REGIONS_ANNOTATION, global.ANNOTATION_PREFIX)
+	deprecated := fmt.Sprintf("Annotation '%s' is deprecated: use '%s'.", v1Regions, global.AGENT_REGIONS_ANNOTATION)
+	ignored := fmt.Sprintf("Annotation '%s' is ignored: use '%s'.", v1Regions, global.AGENT_REGIONS_ANNOTATION)
+
+	tests := []struct {
+		name     string
+		compat   bool
+		previous map[string]string
+		current  map[string]string
+		allowed  bool
+		warnings []string
+	}{
+		{"Current key", false, nil, map[string]string{global.AGENT_REGIONS_ANNOTATION: "us-east-1"}, true, nil},
+		{"Version 1 key on create", false, nil, map[string]string{v1Regions: "us-east-1"}, false, nil},
+		{"Version 1 key unchanged on update", false, map[string]string{v1Regions: "us-east-1"}, map[string]string{v1Regions: "us-east-1"}, true, []string{ignored}},
+		{"Version 1 key changed on update", false, map[string]string{v1Regions: "us-east-1"}, map[string]string{v1Regions: "eu-west-1"}, false, nil},
+		{"Version 1 key added on update", false, map[string]string{global.AGENT_REGIONS_ANNOTATION: "us-east-1"}, map[string]string{global.AGENT_REGIONS_ANNOTATION: "us-east-1", v1Regions: "us-east-1"}, false, nil},
+		{"Both keys with the same value", false, nil, map[string]string{v1Regions: "us-east-1", global.AGENT_REGIONS_ANNOTATION: "us-east-1"}, false, nil},
+		{"Both keys with different values", false, nil, map[string]string{v1Regions: "us-east-1", global.AGENT_REGIONS_ANNOTATION: "eu-west-1"}, false, nil},
+		{"Both keys unchanged on update", false, map[string]string{v1Regions: "us-east-1", global.AGENT_REGIONS_ANNOTATION: "eu-west-1"}, map[string]string{v1Regions: "us-east-1", global.AGENT_REGIONS_ANNOTATION: "eu-west-1"}, true, []string{ignored}},
+		{"Compat version 1 key", true, nil, map[string]string{v1Regions: "us-east-1"}, true, []string{deprecated}},
+		{"Compat invalid version 1 key", true, nil, map[string]string{v1Regions: "not a region"}, false, []string{deprecated}},
+		{"Compat both keys with the same value", true, nil, map[string]string{v1Regions: "us-east-1", global.AGENT_REGIONS_ANNOTATION: "us-east-1"}, true, []string{deprecated}},
+		// The current key takes precedence, so only its value is validated.
+		{"Compat both keys with invalid version 1 value", true, nil, map[string]string{v1Regions: "not a region", global.AGENT_REGIONS_ANNOTATION: "us-east-1"}, true, []string{deprecated}},
+		{"Compat both keys with invalid current value", true, nil, map[string]string{v1Regions: "us-east-1", global.AGENT_REGIONS_ANNOTATION: "not a region"}, false, []string{deprecated}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{Object: newTestRawObject(t, test.current)}}
+			if test.previous != nil {
+				req.Operation = admissionv1.Update
+				req.OldObject = newTestRawObject(t, test.previous)
+			} else {
+				req.Operation = admissionv1.Create
+			}
+
+			validator := &AnnotationValidator{Compat: test.compat}
+			resp := validator.Handle(context.Background(), req)
+
+			if resp.Allowed != test.allowed {
+				t.Errorf("Allowed is %t, expected %t (%v).", resp.Allowed, test.allowed, resp.Result)
+			}
+			if len(resp.Warnings) != len(test.warnings) || (len(test.warnings) > 0 && !reflect.DeepEqual(resp.Warnings, test.warnings)) {
+				t.Errorf("Warnings are %v, expected %v.", resp.Warnings, test.warnings)
+			}
+		})
+	}
+}
+
+// Returns the serialised form of a Secret carrying the annotations.
+func newTestRawObject(t *testing.T, annotations map[string]string) runtime.RawExtension {
+	raw, err := json.Marshal(&corev1.Secret{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "tls", Annotations: annotations},
+	})
+	if err != nil {
+		t.Fatalf("Could not encode Secret: %s", err)
+	}
+	return runtime.RawExtension{Raw: raw}
+}
@@ -0,0 +1,101 @@
+/*
+
+acm-certificate-agent
+Centre for Digital Transformation of Health
+Copyright Kit Huckvale 2022.
+
+*/
+
+//lint:file-ignore ST1005 Override golang logging/error formatting conventions (use Validitron standard which is 'Sentence case with punctuation.')
+
+package webhooks
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"Validitron/k8s-acm-certificate-agent/controllers"
+	"Validitron/k8s-acm-certificate-agent/global"
+)
+
+const (
+	IngressDefaulterPath = "/mutate-ingresses"
+)
+
+// IngressDefaulter enables the agent on Ingresses whose labels match Selector when they are created, by adding the 'enabled' annotation (and, if ListenPorts or IPAddressType are set, the ALB listen-ports and ip-address-type annotations), so that Ingresses created from application charts can be enrolled without modifying the charts.
+// Ingresses already carrying the 'enabled' annotation are not changed (so an Ingress can opt out by carrying 'enabled: false'), and nor are annotations already carried by the Ingress.
+type IngressDefaulter struct {
+	// Ingresses whose labels match the selector are enabled. A nil (or empty) selector matches every Ingress.
+	Selector labels.Selector
+
+	// Default value of the ALB listen-ports annotation (e.g. '[{"HTTPS":443}]'), or empty if the annotation is not added.
+	ListenPorts string
+
+	// Default value of the ALB ip-address-type annotation (e.g. 'dualstack', so that load balancers serve IPv6 clients), or empty if the annotation is not added.
+	IPAddressType string
+
+	// If true, Ingresses carrying the version 1 'enabled' annotation are also treated as already annotated (see --annotation-compat.)
+	Compat bool
+}
+
+func (d *IngressDefaulter) Handle(ctx context.Context, req admission.Request) admission.Response {
+
+	if req.Object.Raw == nil {
+		return admission.Allowed("")
+	}
+
+	// Unstructured, so that fields of the Ingress unknown to this version of the API are preserved in the patch.
+	ingress := &unstructured.Unstructured{}
+	if err := ingress.UnmarshalJSON(req.Object.Raw); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	if d.Selector != nil && !d.Selector.Empty() && !d.Selector.Matches(labels.Set(ingress.GetLabels())) {
+		return admission.Allowed("Ingress does not match selector.")
+	}
+
+	annotations := ingress.GetAnnotations()
+	if _, ok := annotations[global.AGENT_ENABLED_ANNOTATION]; ok {
+		return admission.Allowed("Ingress is already annotated.")
+	}
+	if _, ok := annotations[global.V1_ANNOTATION_PREFIX+"/enabled"]; ok && d.Compat {
+		return admission.Allowed("Ingress is already annotated.")
+	}
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[global.AGENT_ENABLED_ANNOTATION] = "true"
+	if _, ok := annotations[global.ALB_INGRESS_LISTEN_PORTS_ANNOTATION]; !ok && d.ListenPorts != "" {
+		annotations[global.ALB_INGRESS_LISTEN_PORTS_ANNOTATION] = d.ListenPorts
+	}
+	if _, ok := annotations[global.ALB_INGRESS_IP_ADDRESS_TYPE_ANNOTATION]; !ok && d.IPAddressType != "" {
+		annotations[global.ALB_INGRESS_IP_ADDRESS_TYPE_ANNOTATION] = d.IPAddressType
+	}
+	ingress.SetAnnotations(annotations)
+
+	mutated, err := ingress.MarshalJSON()
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, mutated)
+}
+
+// ValidateListenPorts returns an error if the value is not a valid ALB listen-ports annotation (a JSON list of maps from protocol to port, e.g. '[{"HTTP":80},{"HTTPS":443}]', see controllers.ParseListenPorts.)
+func ValidateListenPorts(value string) error {
+	_, err := controllers.ParseListenPorts(value)
+	return err
+}
+
+// ValidateIPAddressType returns an error if the value is not a valid ALB ip-address-type annotation.
+func ValidateIPAddressType(value string) error {
+	switch value {
+	case "ipv4", "dualstack", "dualstack-without-public-ipv4":
+		return nil
+	}
+	return fmt.Errorf("Unsupported IP address type '%s': must be 'ipv4', 'dualstack' or 'dualstack-without-public-ipv4'.", value)
+}